@@ -2,8 +2,11 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"strings"
@@ -19,6 +22,11 @@ const (
 var (
 	server               = flag.String("server", "127.0.0.1:4300", "Server host:port")
 	disableAutoReconnect = flag.Bool("no-auto", false, "Disable auto-reconnect to server")
+	useTLS               = flag.Bool("tls", false, "Connect with TLS")
+	caCertFile           = flag.String("cacert", "", "CA certificate file used to verify the server")
+	certFile             = flag.String("cert", "", "Client certificate file")
+	keyFile              = flag.String("key", "", "Client private key file")
+	insecure             = flag.Bool("insecure", false, "Do not verify the server certificate")
 )
 
 type Client struct {
@@ -50,8 +58,48 @@ func reconnect(server string, next int64) {
 	connect(server, next, false)
 }
 
+func tlsConfig(server string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: *insecure,
+	}
+	if *caCertFile != "" {
+		pem, err := ioutil.ReadFile(*caCertFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", *caCertFile)
+		}
+	}
+	if *certFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func dial(server string) (net.Conn, error) {
+	if !*useTLS {
+		return net.Dial("tcp4", server)
+	}
+	config, err := tlsConfig(server)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Dial("tcp4", server, config)
+}
+
 func connect(server string, next int64, firstConnection bool) {
-	conn, err := net.Dial("tcp4", server)
+	conn, err := dial(server)
 	if err != nil {
 		fmt.Println(err.Error())
 		if firstConnection {
@@ -0,0 +1,743 @@
+package core
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/glob"
+)
+
+const (
+	ACL_DEFAULT_USER = "default"
+	// default number of denied commands kept by ACL LOG
+	ACL_LOG_MAX_LEN = 128
+)
+
+var (
+	// aclNoAuthVerbs can be run by any client, authenticated or not
+	aclNoAuthVerbs = map[string]bool{
+		"auth": true,
+		"quit": true,
+	}
+	errNoAuth    = fmt.Errorf("NOAUTH Authentication required.")
+	errWrongPass = fmt.Errorf("WRONGPASS invalid username-password pair or user is disabled.")
+)
+
+// aclUser is a user of the ACL, its fields are protected by the lock of the
+// ACL.
+type aclUser struct {
+	name    string
+	enabled bool
+	nopass  bool
+	// SHA256 digests of the passwords
+	passwords map[string]bool
+	// allowed command names
+	commands map[string]bool
+	// commandRules are the command rules applied to the user, used to
+	// describe it
+	commandRules    []string
+	keyPatterns     []string
+	keyGlobs        []glob.Glob
+	channelPatterns []string
+	channelGlobs    []glob.Glob
+}
+
+type aclLogEntry struct {
+	count      int
+	reason     string
+	context    string
+	object     string
+	username   string
+	clientInfo string
+	created    time.Time
+	updated    time.Time
+}
+
+// ACL keeps the users allowed to run queries on a peer.
+type ACL struct {
+	mu        sync.RWMutex
+	users     map[string]*aclUser
+	log       []*aclLogEntry
+	logMaxLen int
+}
+
+func NewACL() *ACL {
+	a := &ACL{
+		users:     make(map[string]*aclUser),
+		logMaxLen: ACL_LOG_MAX_LEN,
+	}
+	a.users[ACL_DEFAULT_USER] = newDefaultUser()
+	return a
+}
+
+func newACLUser(name string) *aclUser {
+	return &aclUser{
+		name:      name,
+		passwords: make(map[string]bool),
+		commands:  make(map[string]bool),
+	}
+}
+
+// newDefaultUser returns the default user which can run every command
+// without password.
+func newDefaultUser() *aclUser {
+	u := newACLUser(ACL_DEFAULT_USER)
+	for _, rule := range []string{"on", "nopass", "~*", "&*", "+@all"} {
+		u.apply(rule)
+	}
+	return u
+}
+
+func aclPasswordHash(password string) string {
+	h := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(h[:])
+}
+
+func isPasswordHash(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *aclUser) clone() *aclUser {
+	c := *u
+	c.passwords = make(map[string]bool)
+	for h := range u.passwords {
+		c.passwords[h] = true
+	}
+	c.commands = make(map[string]bool)
+	for name, allowed := range u.commands {
+		c.commands[name] = allowed
+	}
+	c.commandRules = append([]string{}, u.commandRules...)
+	c.keyPatterns = append([]string{}, u.keyPatterns...)
+	c.keyGlobs = append([]glob.Glob{}, u.keyGlobs...)
+	c.channelPatterns = append([]string{}, u.channelPatterns...)
+	c.channelGlobs = append([]glob.Glob{}, u.channelGlobs...)
+	return &c
+}
+
+func (u *aclUser) setCommands(names []string, allowed bool) {
+	for _, name := range names {
+		u.commands[name] = allowed
+	}
+}
+
+// apply applies a rule of ACL SETUSER to the user.
+func (u *aclUser) apply(rule string) error {
+	switch lower := strings.ToLower(rule); {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass = true
+		u.passwords = make(map[string]bool)
+	case lower == "resetpass":
+		u.nopass = false
+		u.passwords = make(map[string]bool)
+	case strings.HasPrefix(rule, ">"):
+		u.nopass = false
+		u.passwords[aclPasswordHash(rule[1:])] = true
+	case strings.HasPrefix(rule, "<"):
+		h := aclPasswordHash(rule[1:])
+		if !u.passwords[h] {
+			return fmt.Errorf("no such password")
+		}
+		delete(u.passwords, h)
+	case strings.HasPrefix(rule, "#"):
+		if !isPasswordHash(rule[1:]) {
+			return fmt.Errorf("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		u.nopass = false
+		u.passwords[rule[1:]] = true
+	case strings.HasPrefix(rule, "!"):
+		if !u.passwords[rule[1:]] {
+			return fmt.Errorf("no such password")
+		}
+		delete(u.passwords, rule[1:])
+	case lower == "allkeys":
+		return u.apply("~*")
+	case lower == "resetkeys":
+		u.keyPatterns = nil
+		u.keyGlobs = nil
+	case strings.HasPrefix(rule, "~"):
+		g, err := glob.Compile(rule[1:])
+		if err != nil {
+			return fmt.Errorf("Syntax error")
+		}
+		u.keyPatterns = append(u.keyPatterns, rule[1:])
+		u.keyGlobs = append(u.keyGlobs, g)
+	case lower == "allchannels":
+		return u.apply("&*")
+	case lower == "resetchannels":
+		u.channelPatterns = nil
+		u.channelGlobs = nil
+	case strings.HasPrefix(rule, "&"):
+		g, err := glob.Compile(rule[1:])
+		if err != nil {
+			return fmt.Errorf("Syntax error")
+		}
+		u.channelPatterns = append(u.channelPatterns, rule[1:])
+		u.channelGlobs = append(u.channelGlobs, g)
+	case lower == "allcommands":
+		return u.apply("+@all")
+	case lower == "nocommands":
+		return u.apply("-@all")
+	case strings.HasPrefix(rule, "+@") || strings.HasPrefix(rule, "-@"):
+		category := lower[2:]
+		if category != "all" && !stringInSlice(category, commandCategories()) {
+			return fmt.Errorf("Unknown command category")
+		}
+		if category == "all" {
+			u.commands = make(map[string]bool)
+			u.commandRules = nil
+		}
+		u.setCommands(commandsInCategory(category), rule[0] == '+')
+		u.commandRules = append(u.commandRules, lower)
+	case strings.HasPrefix(rule, "+") || strings.HasPrefix(rule, "-"):
+		names := commandNames(lower[1:])
+		if len(names) == 0 {
+			return fmt.Errorf("Unknown command")
+		}
+		u.setCommands(names, rule[0] == '+')
+		u.commandRules = append(u.commandRules, lower)
+	case lower == "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "resetchannels", "off", "-@all"} {
+			u.apply(r)
+		}
+	default:
+		return fmt.Errorf("Syntax error")
+	}
+	return nil
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) flags() []string {
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+func (u *aclUser) passwordHashes() []string {
+	return sortedKeys(u.passwords)
+}
+
+func (u *aclUser) commandsString() string {
+	rules := u.commandRules
+	// users start without any command allowed
+	if len(rules) == 0 || (rules[0] != "+@all" && rules[0] != "-@all") {
+		rules = append([]string{"-@all"}, rules...)
+	}
+	return strings.Join(rules, " ")
+}
+
+func (u *aclUser) keysString() string {
+	var rules []string
+	for _, p := range u.keyPatterns {
+		rules = append(rules, "~"+p)
+	}
+	return strings.Join(rules, " ")
+}
+
+func (u *aclUser) channelsString() string {
+	if len(u.channelPatterns) == 0 {
+		return "resetchannels"
+	}
+	var rules []string
+	for _, p := range u.channelPatterns {
+		rules = append(rules, "&"+p)
+	}
+	return strings.Join(rules, " ")
+}
+
+// String describes the user with the rules of ACL SETUSER, it is the format
+// of the ACL file and of ACL LIST.
+func (u *aclUser) String() string {
+	rules := []string{"user", u.name}
+	rules = append(rules, u.flags()...)
+	for _, h := range u.passwordHashes() {
+		rules = append(rules, "#"+h)
+	}
+	if keys := u.keysString(); keys != "" {
+		rules = append(rules, keys)
+	}
+	rules = append(rules, u.channelsString(), u.commandsString())
+	return strings.Join(rules, " ")
+}
+
+func (u *aclUser) canRun(name string) bool {
+	return u.commands[name]
+}
+
+func (u *aclUser) canAccessKey(key string) bool {
+	for _, g := range u.keyGlobs {
+		if g.Match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) canAccessChannel(channel string, pattern bool) bool {
+	for i, g := range u.channelGlobs {
+		// subscription patterns have to be allowed as is
+		if pattern && u.channelPatterns[i] != "*" && u.channelPatterns[i] != channel {
+			continue
+		}
+		if g.Match(channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultUser returns the user new clients are authenticated as, or nil when
+// clients have to authenticate with AUTH.
+func (a *ACL) DefaultUser() *aclUser {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u := a.users[ACL_DEFAULT_USER]
+	if u == nil || !u.enabled || !u.nopass {
+		return nil
+	}
+	return u
+}
+
+func (a *ACL) Authenticate(username string, password string) (*aclUser, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u := a.users[username]
+	if u == nil || !u.enabled {
+		return nil, errWrongPass
+	}
+	if !u.nopass && !u.passwords[aclPasswordHash(password)] {
+		return nil, errWrongPass
+	}
+	return u, nil
+}
+
+// SetUser creates or updates a user. Rules are applied at once, nothing
+// changes if one of them is invalid.
+func (a *ACL) SetUser(name string, rules ...string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u := a.users[name]
+	var updated *aclUser
+	if u == nil {
+		updated = newACLUser(name)
+	} else {
+		updated = u.clone()
+	}
+	for _, rule := range rules {
+		if err := updated.apply(rule); err != nil {
+			return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': %s", rule, err)
+		}
+	}
+	if u == nil {
+		a.users[name] = updated
+		return nil
+	}
+	// authenticated clients keep a reference to the user
+	*u = *updated
+	return nil
+}
+
+func (a *ACL) GetUser(name string) *aclUser {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.users[name]
+}
+
+// DelUser removes a user and returns it, or nil when it does not exist.
+func (a *ACL) DelUser(name string) (*aclUser, error) {
+	if name == ACL_DEFAULT_USER {
+		return nil, fmt.Errorf("ERR The 'default' user cannot be removed")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u := a.users[name]
+	delete(a.users, name)
+	return u, nil
+}
+
+// Users returns the users sorted by name.
+func (a *ACL) Users() []*aclUser {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var users []*aclUser
+	for _, u := range a.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].name < users[j].name })
+	return users
+}
+
+// Describe returns the rules describing a user, ACL file format.
+func (a *ACL) Describe(u *aclUser) string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return u.String()
+}
+
+// Check returns the reason why the user cannot run a command and the object
+// denied: "command", "key" or "channel". The reason is empty when the user
+// is allowed.
+func (a *ACL) Check(u *aclUser, name string, spec *commandSpec, args []string) (string, string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if !u.canRun(name) {
+		return "command", name
+	}
+	if spec.keys != nil {
+		for _, key := range spec.keys(args) {
+			if !u.canAccessKey(key) {
+				return "key", key
+			}
+		}
+	}
+	if spec.channels != nil {
+		for _, channel := range spec.channels(args) {
+			if !u.canAccessChannel(channel, spec.patterns) {
+				return "channel", channel
+			}
+		}
+	}
+	return "", ""
+}
+
+// LogDenied records a denied command or authentication, identical entries
+// are grouped.
+func (a *ACL) LogDenied(reason string, context string, object string, username string, clientInfo string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for i, e := range a.log {
+		if e.reason == reason && e.context == context && e.object == object && e.username == username {
+			e.count++
+			e.updated = now
+			e.clientInfo = clientInfo
+			// newest entries first
+			copy(a.log[1:i+1], a.log[:i])
+			a.log[0] = e
+			return
+		}
+	}
+	a.log = append([]*aclLogEntry{{
+		count:      1,
+		reason:     reason,
+		context:    context,
+		object:     object,
+		username:   username,
+		clientInfo: clientInfo,
+		created:    now,
+		updated:    now,
+	}}, a.log...)
+	if len(a.log) > a.logMaxLen {
+		a.log = a.log[:a.logMaxLen]
+	}
+}
+
+// Log returns the count latest entries of the log as replies.
+func (a *ACL) Log(count int) []interface{} {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	entries := []interface{}{}
+	for i, e := range a.log {
+		if i >= count {
+			break
+		}
+		entries = append(entries, []interface{}{
+			"count", e.count,
+			"reason", e.reason,
+			"context", e.context,
+			"object", e.object,
+			"username", e.username,
+			"age-seconds", strconv.FormatFloat(time.Since(e.created).Seconds(), 'f', 3, 64),
+			"client-info", e.clientInfo,
+		})
+	}
+	return entries
+}
+
+func (a *ACL) ResetLog() {
+	a.mu.Lock()
+	a.log = nil
+	a.mu.Unlock()
+}
+
+func (a *ACL) LogMaxLen() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.logMaxLen
+}
+
+func (a *ACL) SetLogMaxLen(n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.logMaxLen = n
+	if len(a.log) > n {
+		a.log = a.log[:n]
+	}
+}
+
+// LoadFile replaces the users with the ones of an ACL file. Every line of
+// the file describes a user: "user <name> [rule ...]". The default user
+// keeps its default rules when the file does not describe it.
+func (a *ACL) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	loaded := NewACL()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		words := strings.Fields(scanner.Text())
+		if len(words) == 0 || strings.HasPrefix(words[0], "#") {
+			continue
+		}
+		if words[0] != "user" || len(words) < 2 {
+			return fmt.Errorf("%s:%d: line should start with user keyword", path, line)
+		}
+		rules := words[2:]
+		if words[1] == ACL_DEFAULT_USER {
+			// rules of the file replace the default ones
+			rules = append([]string{"reset"}, rules...)
+		}
+		if err := loaded.SetUser(words[1], rules...); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.users = loaded.users
+	a.mu.Unlock()
+	return nil
+}
+
+func (c *VQLClient) info() string {
+	var addr string
+	if c.conn != nil {
+		addr = c.conn.RemoteAddr().String()
+	}
+	return fmt.Sprintf("id=%d addr=%s name=%s", c.id, addr, c.name)
+}
+
+// checkACL verifies the client is authenticated and allowed to run the
+// query. Queries of peers are trusted.
+func (q *Query) checkACL() error {
+	if q.c == nil || q.FromPeer || q.forwarded || aclNoAuthVerbs[q.verb()] {
+		return nil
+	}
+	u := q.c.user
+	if u == nil {
+		return errNoAuth
+	}
+	args := q.args()
+	name, spec := lookupCommand(q.verb(), args)
+	if spec == nil {
+		// unknown commands are reported by Execute
+		return nil
+	}
+	reason, object := q.p.acl.Check(u, name, spec, args)
+	if reason == "" {
+		return nil
+	}
+	context := "toplevel"
+	if q.script != nil {
+		context = "lua"
+	}
+	q.p.acl.LogDenied(reason, context, object, u.name, q.c.info())
+	switch reason {
+	case "key":
+		return fmt.Errorf("NOPERM No permissions to access a key")
+	case "channel":
+		return fmt.Errorf("NOPERM No permissions to access a channel")
+	default:
+		return fmt.Errorf("NOPERM User %s has no permissions to run the '%s' command", u.name, name)
+	}
+}
+
+func (q *Query) auth(r *Response, args []string) error {
+	var username, password string
+	switch len(args) {
+	case 1:
+		username, password = ACL_DEFAULT_USER, args[0]
+		if q.p.acl.DefaultUser() != nil {
+			return fmt.Errorf("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		}
+	case 2:
+		username, password = args[0], args[1]
+	default:
+		return fmt.Errorf("wrong number of arguments for 'auth' command")
+	}
+	u, err := q.p.acl.Authenticate(username, password)
+	if err != nil {
+		q.p.acl.LogDenied("auth", "toplevel", "AUTH", username, q.c.info())
+		return err
+	}
+	q.c.user = u
+	r.OK()
+	return nil
+}
+
+func (q *Query) aclSetUser(r *Response, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("wrong number of arguments for 'acl setuser' command")
+	}
+	if err := q.p.acl.SetUser(args[1], args[2:]...); err != nil {
+		return err
+	}
+	r.OK()
+	return nil
+}
+
+func (q *Query) aclGetUser(r *Response, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for 'acl getuser' command")
+	}
+	u := q.p.acl.GetUser(args[1])
+	if u == nil {
+		r.Replies = [][]byte{formattedReply(nil)}
+		return nil
+	}
+	q.p.acl.mu.RLock()
+	reply := []interface{}{
+		"flags", stringsToReply(u.flags()),
+		"passwords", stringsToReply(u.passwordHashes()),
+		"commands", u.commandsString(),
+		"keys", u.keysString(),
+		"channels", u.channelsString(),
+	}
+	q.p.acl.mu.RUnlock()
+	r.Replies = [][]byte{formattedReply(reply)}
+	return nil
+}
+
+func stringsToReply(items []string) []interface{} {
+	reply := []interface{}{}
+	for _, item := range items {
+		reply = append(reply, item)
+	}
+	return reply
+}
+
+func (q *Query) aclDelUser(r *Response, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("wrong number of arguments for 'acl deluser' command")
+	}
+	var deleted int
+	for _, name := range args[1:] {
+		u, err := q.p.acl.DelUser(name)
+		if err != nil {
+			return err
+		}
+		if u == nil {
+			continue
+		}
+		deleted++
+		// clients authenticated as a removed user are disconnected
+		if q.p.vqlTCPServer != nil {
+			lock.Lock()
+			for c := range q.p.vqlTCPServer.clients {
+				if c.user == u && c.conn != nil {
+					c.conn.Close()
+				}
+			}
+			lock.Unlock()
+		}
+	}
+	r.PayloadString([]byte(strconv.Itoa(deleted)))
+	r.Type = typeInteger
+	return nil
+}
+
+func (q *Query) aclList(r *Response) error {
+	var lines []string
+	for _, u := range q.p.acl.Users() {
+		lines = append(lines, q.p.acl.Describe(u))
+	}
+	r.Replies = [][]byte{formattedReply(stringsToReply(lines))}
+	return nil
+}
+
+func (q *Query) aclUsers(r *Response) error {
+	var names []string
+	for _, u := range q.p.acl.Users() {
+		names = append(names, u.name)
+	}
+	r.Replies = [][]byte{formattedReply(stringsToReply(names))}
+	return nil
+}
+
+func (q *Query) aclCat(r *Response, args []string) error {
+	switch len(args) {
+	case 1:
+		r.Replies = [][]byte{formattedReply(stringsToReply(commandCategories()))}
+	case 2:
+		category := strings.ToLower(args[1])
+		if !stringInSlice(category, commandCategories()) {
+			return fmt.Errorf("ERR Unknown category '%s'", args[1])
+		}
+		r.Replies = [][]byte{formattedReply(stringsToReply(commandsInCategory(category)))}
+	default:
+		return fmt.Errorf("wrong number of arguments for 'acl cat' command")
+	}
+	return nil
+}
+
+func (q *Query) aclLog(r *Response, args []string) error {
+	count := 10
+	switch {
+	case len(args) == 1:
+	case len(args) == 2 && strings.ToLower(args[1]) == "reset":
+		q.p.acl.ResetLog()
+		r.OK()
+		return nil
+	case len(args) == 2:
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return fmt.Errorf("ERR value is out of range, must be positive")
+		}
+		count = n
+	default:
+		return fmt.Errorf("wrong number of arguments for 'acl log' command")
+	}
+	r.Replies = [][]byte{formattedReply(q.p.acl.Log(count))}
+	return nil
+}
+
+// LoadACLFile replaces the users of the peer with the ones of an ACL file.
+func (p *Peer) LoadACLFile(path string) error {
+	return p.acl.LoadFile(path)
+}
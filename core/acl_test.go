@@ -0,0 +1,148 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestACLUsers(t *testing.T) {
+	client := setup()
+	hash := aclPasswordHash("secret")
+	suites := []string{
+		"acl whoami", "$7\r\ndefault\r\n",
+		"acl users", "*1\r\n$7\r\ndefault\r\n",
+		"acl setuser alice", "+OK\r\n",
+		"acl getuser alice", "*10\r\n$5\r\nflags\r\n*1\r\n$3\r\noff\r\n$9\r\npasswords\r\n*0\r\n$8\r\ncommands\r\n$5\r\n-@all\r\n$4\r\nkeys\r\n$0\r\n\r\n$8\r\nchannels\r\n$13\r\nresetchannels\r\n",
+		"acl setuser alice on >secret ~app:* &news +@read +set -get", "+OK\r\n",
+		"acl list", string(formattedReply([]interface{}{"user alice on #" + hash + " ~app:* &news -@all +@read +set -get", "user default on nopass ~* &* +@all"})),
+		"acl setuser alice +foo", "ERR Error in ACL SETUSER modifier '+foo': Unknown command",
+		"acl setuser alice +@foo", "ERR Error in ACL SETUSER modifier '+@foo': Unknown command category",
+		"acl setuser alice #1234", "ERR Error in ACL SETUSER modifier '#1234': The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters",
+		"acl setuser alice <nopassword", "ERR Error in ACL SETUSER modifier '<nopassword': no such password",
+		"acl setuser alice off bar", "ERR Error in ACL SETUSER modifier 'bar': Syntax error",
+		"acl getuser alice", "*10\r\n$5\r\nflags\r\n*1\r\n$2\r\non\r\n$9\r\npasswords\r\n*1\r\n$64\r\n" + hash + "\r\n$8\r\ncommands\r\n$22\r\n-@all +@read +set -get\r\n$4\r\nkeys\r\n$6\r\n~app:*\r\n$8\r\nchannels\r\n$5\r\n&news\r\n",
+		"acl getuser bob", "$-1\r\n",
+		"acl cat", "*12\r\n$5\r\nadmin\r\n$10\r\nconnection\r\n$9\r\ndangerous\r\n$4\r\nfast\r\n$8\r\nkeyspace\r\n$6\r\npubsub\r\n$4\r\nread\r\n$9\r\nscripting\r\n$3\r\nset\r\n$4\r\nslow\r\n$6\r\nstring\r\n$5\r\nwrite\r\n",
+		"acl cat string", "*4\r\n$4\r\ndecr\r\n$3\r\nget\r\n$4\r\nincr\r\n$3\r\nset\r\n",
+		"acl cat foo", "ERR Unknown category 'foo'",
+		"acl deluser default", "ERR The 'default' user cannot be removed",
+		"acl deluser alice bob", ":1\r\n",
+		"acl users", "*1\r\n$7\r\ndefault\r\n",
+	}
+	for i := 0; i < len(suites); i += 2 {
+		expected := suites[i+1]
+		if output := <-executeAsync(client, suites[i]); expected != output {
+			t.Errorf("%s: want %q, got %q", suites[i], expected, output)
+		}
+	}
+
+	// queries without client, like the ones of the peers, have no user
+	q, err := client.ParseRawQuery([]byte("acl whoami"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.c = nil
+	if _, err := q.Execute(); err != errNoAuth {
+		t.Errorf("want %+v, got %+v", errNoAuth, err)
+	}
+}
+
+func TestACLPermissions(t *testing.T) {
+	client := setup()
+	<-executeAsync(client, "acl setuser alice on >secret ~app:* &news +@read +set +publish +eval +acl|whoami -keys")
+	conn, reader := pipeVQLConn(client.vqlTCPServer)
+	defer conn.Close()
+
+	suites := []string{
+		"auth alice nope\r\n", "-WRONGPASS invalid username-password pair or user is disabled.\r\n",
+		"auth alice secret\r\n", "+OK\r\n",
+		"acl whoami\r\n", "$5\r\nalice\r\n",
+		"set app:1 foo\r\n", "+OK\r\n",
+		"get app:1\r\n", "$3\r\nfoo\r\n",
+		"set other foo\r\n", "-NOPERM No permissions to access a key\r\n",
+		"keys *\r\n", "-NOPERM User alice has no permissions to run the 'keys' command\r\n",
+		"flushdb\r\n", "-NOPERM User alice has no permissions to run the 'flushdb' command\r\n",
+		"config get *\r\n", "-NOPERM User alice has no permissions to run the 'config|get' command\r\n",
+		"publish news hello\r\n", ":0\r\n",
+		"publish sport hello\r\n", "-NOPERM No permissions to access a channel\r\n",
+		vqlCommand("eval", "return redis.call('get', KEYS[1])", "1", "app:1"), "$3\r\nfoo\r\n",
+		vqlCommand("eval", "return redis.call('get', 'other')", "0"), "-ERR Error running script: user_script:1: NOPERM No permissions to access a key\r\n",
+	}
+	for i := 0; i < len(suites); i += 2 {
+		conn.Write([]byte(suites[i]))
+		expectReply(t, conn, reader, suites[i+1])
+	}
+
+	output := <-executeAsync(client, "acl log 2")
+	for _, expected := range []string{"reason\r\n$3\r\nkey\r\n$7\r\ncontext\r\n$3\r\nlua\r\n$6\r\nobject\r\n$5\r\nother\r\n$8\r\nusername\r\n$5\r\nalice\r\n", "reason\r\n$7\r\nchannel\r\n"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("want %q in ACL log, got %q", expected, output)
+		}
+	}
+	if !strings.HasPrefix(output, "*2\r\n") {
+		t.Errorf("want 2 entries, got %q", output)
+	}
+	if output := <-executeAsync(client, "acl log reset"); output != "+OK\r\n" {
+		t.Errorf("want %q, got %q", "+OK\r\n", output)
+	}
+	if output := <-executeAsync(client, "acl log"); output != "*0\r\n" {
+		t.Errorf("want %q, got %q", "*0\r\n", output)
+	}
+
+	// removed users are disconnected
+	<-executeAsync(client, "acl deluser alice")
+	conn.Write([]byte("get app:1\r\n"))
+	if _, err := reader.ReadByte(); err == nil {
+		t.Errorf("want connection closed")
+	}
+}
+
+func TestACLAuthRequired(t *testing.T) {
+	client := setup()
+	if output := <-executeAsync(client, "auth secret"); !strings.HasPrefix(output, "ERR AUTH <password> called without any password configured") {
+		t.Errorf("want AUTH error, got %q", output)
+	}
+	<-executeAsync(client, "acl setuser default resetpass >secret")
+	conn, reader := pipeVQLConn(client.vqlTCPServer)
+	defer conn.Close()
+
+	suites := []string{
+		"get foo\r\n", "-NOAUTH Authentication required.\r\n",
+		"auth wrong\r\n", "-WRONGPASS invalid username-password pair or user is disabled.\r\n",
+		"auth secret\r\n", "+OK\r\n",
+		"get foo\r\n", "$-1\r\n",
+	}
+	for i := 0; i < len(suites); i += 2 {
+		conn.Write([]byte(suites[i]))
+		expectReply(t, conn, reader, suites[i+1])
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	client := setup()
+	f, err := ioutil.TempFile("", "velocidb-acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# users\nuser default on >secret ~* &* +@all\n\nuser reader on nopass ~* +@read\n")
+	f.Close()
+	if err := client.vqlTCPServer.Peer.LoadACLFile(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	expected := string(formattedReply([]interface{}{
+		"user default on #" + aclPasswordHash("secret") + " ~* &* +@all",
+		"user reader on nopass ~* resetchannels -@all +@read",
+	}))
+	if output := <-executeAsync(client, "acl list"); expected != output {
+		t.Errorf("want %q, got %q", expected, output)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("user reader on +nope\n"), 0644)
+	expected = f.Name() + ":1: ERR Error in ACL SETUSER modifier '+nope': Unknown command"
+	if err := client.vqlTCPServer.Peer.LoadACLFile(f.Name()); err == nil || err.Error() != expected {
+		t.Errorf("want %q, got %v", expected, err)
+	}
+}
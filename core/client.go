@@ -1,11 +1,29 @@
 package core
 
 import (
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Messages pushed to a client, like published messages, are queued and
+// written by a goroutine of the client, so that the publisher never waits
+// for the subscribers. A message pushed while PUSH_QUEUE_SIZE messages are
+// waiting is dropped, a client which does not read a message within
+// PUSH_TIMEOUT is disconnected.
+const (
+	// seconds a subscriber has to read a pushed message before being
+	// disconnected
+	PUSH_TIMEOUT    = 5
+	PUSH_QUEUE_SIZE = 1024
 )
 
 var (
 	endByte = []byte("\r\n")
+
+	errPushQueueFull = fmt.Errorf("push queue full")
 )
 
 type VQLClient struct {
@@ -13,17 +31,96 @@ type VQLClient struct {
 	name         string
 	conn         net.Conn
 	vqlTCPServer *VQLTCPServer
+	// user the client is authenticated as, nil until it authenticates
+	user *aclUser
+	// writeLock serializes replies and pushed pub/sub messages
+	writeLock sync.Mutex
+	// consistency is the level set with CLIENT CONSISTENCY, 0 when the
+	// levels of the keys apply
+	consistency int
+	// asking is set by ASKING for the next query
+	asking bool
+	// readonly is set by READONLY: the writes of the client are rejected by
+	// replicas instead of being forwarded to their primary
+	readonly bool
+	// pushes queues the pushed messages, written by a goroutine started
+	// with the first one and stopped once closed is closed
+	pushes     chan []byte
+	pushWriter sync.Once
+	closed     chan struct{}
+	closeOnce  sync.Once
 }
 
 func NewVQLClient(id int64, name string, conn net.Conn, v *VQLTCPServer) *VQLClient {
-	return &VQLClient{
+	c := &VQLClient{
 		id:           id,
 		name:         name,
 		vqlTCPServer: v,
 		conn:         conn,
+		pushes:       make(chan []byte, PUSH_QUEUE_SIZE),
+		closed:       make(chan struct{}),
+	}
+	if v != nil {
+		c.user = v.Peer.acl.DefaultUser()
 	}
+	return c
 }
 
 func (c *VQLClient) ParseRawQuery(input []byte) (*Query, error) {
 	return c.vqlTCPServer.Peer.ParseRawQuery(c, input)
 }
+
+func (c *VQLClient) Write(data []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.conn.Write(data)
+}
+
+// Push queues a message the client did not ask for, like a published
+// message, without waiting for the client to read it. The message is dropped
+// when the queue of the client is full.
+func (c *VQLClient) Push(data []byte) error {
+	c.pushWriter.Do(func() {
+		go c.writePushes()
+	})
+	select {
+	case c.pushes <- data:
+		return nil
+	default:
+		if c.vqlTCPServer != nil {
+			atomic.AddInt64(&c.vqlTCPServer.Peer.Stats.PushDropped, 1)
+		}
+		return errPushQueueFull
+	}
+}
+
+// writePushes writes the queued messages until the client is closed. Clients
+// too slow to read them are disconnected.
+func (c *VQLClient) writePushes() {
+	for {
+		select {
+		case data := <-c.pushes:
+			c.writeLock.Lock()
+			c.conn.SetWriteDeadline(time.Now().Add(PUSH_TIMEOUT * time.Second))
+			_, err := c.conn.Write(data)
+			c.conn.SetWriteDeadline(time.Time{})
+			c.writeLock.Unlock()
+			if err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Close disconnects the client and stops writing its pushed messages.
+func (c *VQLClient) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
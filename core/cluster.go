@@ -0,0 +1,489 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// With sharding, the keyspace is split in hash slots like Redis Cluster
+// does: the slot of a key is the CRC16 of the key, or of its hash tag, modulo
+// CLUSTER_SLOTS. Each slot is stored by replication-factor peers chosen by
+// rendezvous hashing among the members of the cluster, so that a membership
+// change only moves the slots of the peers joining or leaving. The first
+// owner of a slot is its primary. Queries on keys of a slot the peer does
+// not own are redirected to the primary with a MOVED error, or forwarded to
+// it.
+const (
+	CLUSTER_SLOTS = 16384
+	// default number of peers storing each slot
+	CLUSTER_REPLICATION_FACTOR = 2
+
+	clusterRoutingRedirect = "redirect"
+	clusterRoutingForward  = "forward"
+)
+
+type Cluster struct {
+	p *Peer
+	// mu guards the settings and the owners table
+	mu                sync.Mutex
+	replicationFactor int
+	routing           string
+	// owners holds the owners of every slot, computed for the members
+	// identified by signature
+	signature string
+	owners    [][]string
+	// migrating holds the slots the peer moves to their owners, importing
+	// the slots the peer imports by source peer ID
+	migrating  map[int]string
+	importing  map[int]string
+	migrations []*slotMigration
+	batchSize  int
+}
+
+// EnableSharding partitions the keyspace among the members of the cluster.
+// It has to be called before Run.
+func (p *Peer) EnableSharding(replicationFactor int) {
+	if replicationFactor < 1 {
+		replicationFactor = CLUSTER_REPLICATION_FACTOR
+	}
+	p.cluster = &Cluster{
+		p:                 p,
+		replicationFactor: replicationFactor,
+		routing:           clusterRoutingRedirect,
+		migrating:         make(map[int]string),
+		importing:         make(map[int]string),
+		batchSize:         MIGRATION_BATCH_SIZE,
+	}
+}
+
+func (c *Cluster) ReplicationFactor() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.replicationFactor
+}
+
+func (c *Cluster) SetReplicationFactor(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.replicationFactor = n
+	// the owners are computed again
+	c.signature = ""
+}
+
+func (c *Cluster) Routing() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.routing
+}
+
+func (c *Cluster) SetRouting(routing string) error {
+	if routing != clusterRoutingRedirect && routing != clusterRoutingForward {
+		return fmt.Errorf("argument must be '%s' or '%s'", clusterRoutingRedirect, clusterRoutingForward)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routing = routing
+	return nil
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum used by Redis Cluster.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// keySlot returns the slot of a key. When the key contains a non empty hash
+// tag between braces, only the tag is hashed so that related keys share a
+// slot.
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16([]byte(key)) % CLUSTER_SLOTS)
+}
+
+// slotScore is the rendezvous hashing score of a member for a slot.
+func slotScore(id string, slot int) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(slot))
+	h.Write(b)
+	// FNV barely mixes the last bytes into the high bits, the splitmix64
+	// finalizer spreads them
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// members returns the IDs of the members storing data: the peer unless it
+// is leaving and the members not declared dead, sorted.
+func (c *Cluster) members() []string {
+	ids := []string{}
+	if !c.p.Leaving() {
+		ids = append(ids, c.p.ID)
+	}
+	for _, m := range c.p.gossip.Members() {
+		if m.State != memberDead {
+			ids = append(ids, m.ID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// table returns the owners of every slot, computed again when the members
+// change.
+func (c *Cluster) table() [][]string {
+	members := c.members()
+	signature := strings.Join(members, ",")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if signature == c.signature {
+		return c.owners
+	}
+	c.signature = signature
+	c.owners = rendezvousOwners(members, c.replicationFactor)
+	return c.owners
+}
+
+// rendezvousOwners returns the n members with the highest score for every
+// slot.
+func rendezvousOwners(members []string, n int) [][]string {
+	if n > len(members) {
+		n = len(members)
+	}
+	owners := make([][]string, CLUSTER_SLOTS)
+	scores := make([]uint64, len(members))
+	for slot := range owners {
+		sorted := append([]string{}, members...)
+		for i, id := range sorted {
+			scores[i] = slotScore(id, slot)
+		}
+		sort.Sort(byScore{ids: sorted, scores: scores})
+		owners[slot] = sorted[:n]
+	}
+	return owners
+}
+
+type byScore struct {
+	ids    []string
+	scores []uint64
+}
+
+func (s byScore) Len() int { return len(s.ids) }
+func (s byScore) Less(i, j int) bool {
+	if s.scores[i] != s.scores[j] {
+		return s.scores[i] > s.scores[j]
+	}
+	return s.ids[i] < s.ids[j]
+}
+func (s byScore) Swap(i, j int) {
+	s.ids[i], s.ids[j] = s.ids[j], s.ids[i]
+	s.scores[i], s.scores[j] = s.scores[j], s.scores[i]
+}
+
+// slotOwners returns the owners of a slot, its primary first.
+func (c *Cluster) slotOwners(slot int) []string {
+	return c.table()[slot]
+}
+
+// link returns the open link with a member.
+func (c *Cluster) link(id string) *Peer {
+	for _, l := range c.p.Mesh.List() {
+		if l.Ready() && l.remoteID() == id {
+			return l
+		}
+	}
+	return nil
+}
+
+// vqlAddr returns the address of the VQL server of a member.
+func (c *Cluster) vqlAddr(id string) string {
+	if id == c.p.ID {
+		if c.p.vqlTCPServer == nil {
+			return ""
+		}
+		return c.p.vqlTCPServer.connString()
+	}
+	for _, l := range c.p.Mesh.List() {
+		if l.remoteID() == id {
+			if addr := l.remoteVQLAddr(); addr != "" {
+				return addr
+			}
+		}
+	}
+	return ""
+}
+
+// querySlot returns the slot of the keys of a query. ok is false when the
+// query has no key.
+func (q *Query) querySlot() (slot int, ok bool, err error) {
+	args := q.args()
+	_, spec := lookupCommand(q.verb(), args)
+	if spec == nil || spec.keys == nil {
+		return 0, false, nil
+	}
+	for i, key := range spec.keys(args) {
+		s := keySlot(key)
+		if i > 0 && s != slot {
+			return 0, false, fmt.Errorf("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+		slot, ok = s, true
+	}
+	return slot, ok, nil
+}
+
+// queryOwners returns the members storing the keys of a query, nil when the
+// query has no key.
+func (c *Cluster) queryOwners(q *Query) []string {
+	slot, ok, err := q.querySlot()
+	if err != nil || !ok {
+		return nil
+	}
+	return c.slotOwners(slot)
+}
+
+// route redirects or forwards the queries on keys the peer does not store.
+// routed is false when the query is executed locally.
+func (q *Query) route() (r *Response, err error, routed bool) {
+	c := q.p.cluster
+	// ASKING only applies to the next query of the client
+	if q.c != nil && q.verb() != "asking" {
+		q.asking = q.asking || q.c.asking
+		q.c.asking = false
+	}
+	slot, ok, err := q.querySlot()
+	if err != nil {
+		return nil, err, true
+	}
+	if !ok {
+		return nil, nil, false
+	}
+	owners := c.slotOwners(slot)
+	if stringInSlice(q.p.ID, owners) {
+		// the keys of an importing slot may still be stored by the source
+		if source := c.slotState(slot, c.importing); source != "" && !q.asking && !q.keysExist() {
+			return q.redirect("ASK", slot, source)
+		}
+		return nil, nil, false
+	}
+	if c.slotState(slot, c.migrating) != "" {
+		if q.keysExist() {
+			return nil, nil, false
+		}
+		return q.redirect("ASK", slot, owners...)
+	}
+	return q.redirect("MOVED", slot, owners...)
+}
+
+// redirect answers a MOVED or ASK redirection to the first of the members,
+// or forwards the query to the first member linked with the peer.
+func (q *Query) redirect(redirection string, slot int, ids ...string) (*Response, error, bool) {
+	c := q.p.cluster
+	// forwarded queries are not forwarded again, in case peers do not agree
+	// on the owners yet
+	if c.Routing() == clusterRoutingForward && !q.forwarded {
+		for _, id := range ids {
+			if link := c.link(id); link != nil {
+				r, err := q.forward(link, redirection == "ASK")
+				return r, err, true
+			}
+		}
+	}
+	// the last member leaving the cluster owns no slot
+	addr := ""
+	if len(ids) > 0 {
+		addr = c.vqlAddr(ids[0])
+	}
+	if addr == "" {
+		return nil, fmt.Errorf("CLUSTERDOWN Hash slot %d not served", slot), true
+	}
+	return nil, fmt.Errorf("%s %d %s", redirection, slot, addr), true
+}
+
+// forward executes a query on another peer on behalf of the client.
+func (q *Query) forward(link *Peer, asking bool) (*Response, error) {
+	rq := NewSimpleQuery(string(formattedArray(q.parsed)))
+	rq.forwarded = true
+	rq.asking = asking
+	resp, err := q.p.RemoteExecute(link, rq)
+	if err != nil {
+		return nil, fmt.Errorf("TRYAGAIN %s", err)
+	}
+	if resp.isError() {
+		return nil, fmt.Errorf("%s", resp.Payload[0])
+	}
+	r := NewResponse(q)
+	r.Replies = [][]byte{resp.FormattedPayload()}
+	return r, nil
+}
+
+// slotRange is a range of contiguous slots with the same owners.
+type slotRange struct {
+	start, end int
+	owners     []string
+}
+
+func (c *Cluster) slotRanges() (ranges []slotRange) {
+	for slot, owners := range c.table() {
+		last := len(ranges) - 1
+		if last >= 0 && strings.Join(ranges[last].owners, ",") == strings.Join(owners, ",") {
+			ranges[last].end = slot
+			continue
+		}
+		ranges = append(ranges, slotRange{start: slot, end: slot, owners: owners})
+	}
+	return ranges
+}
+
+func (c *Cluster) nodeEndpoint(id string) (string, int) {
+	host, port, err := net.SplitHostPort(c.vqlAddr(id))
+	if err != nil {
+		return "", 0
+	}
+	n, _ := strconv.Atoi(port)
+	return host, n
+}
+
+func (c *Cluster) clusterSlots() []interface{} {
+	slots := []interface{}{}
+	for _, r := range c.slotRanges() {
+		item := []interface{}{r.start, r.end}
+		for _, id := range r.owners {
+			host, port := c.nodeEndpoint(id)
+			item = append(item, []interface{}{host, port, id})
+		}
+		slots = append(slots, item)
+	}
+	return slots
+}
+
+// clusterShards groups the slot ranges by owners.
+func (c *Cluster) clusterShards() []interface{} {
+	index := make(map[string]int)
+	shards := [][]interface{}{}
+	owners := [][]string{}
+	for _, r := range c.slotRanges() {
+		key := strings.Join(r.owners, ",")
+		i, ok := index[key]
+		if !ok {
+			i = len(shards)
+			index[key] = i
+			shards = append(shards, []interface{}{})
+			owners = append(owners, r.owners)
+		}
+		shards[i] = append(shards[i], r.start, r.end)
+	}
+	reply := []interface{}{}
+	for i, slots := range shards {
+		nodes := []interface{}{}
+		for j, id := range owners[i] {
+			host, port := c.nodeEndpoint(id)
+			role := "replica"
+			if j == 0 {
+				role = "master"
+			}
+			nodes = append(nodes, []interface{}{"id", id, "endpoint", host, "port", port, "role", role, "health", "online"})
+		}
+		reply = append(reply, []interface{}{"slots", slots, "nodes", nodes})
+	}
+	return reply
+}
+
+func (q *Query) clusterCommand(r *Response, args []string) error {
+	sub := strings.ToLower(args[0])
+	if sub == "keyslot" {
+		if len(args) != 2 {
+			return fmt.Errorf("wrong number of arguments for 'cluster keyslot' command")
+		}
+		r.PayloadString([]byte(strconv.Itoa(keySlot(args[1]))))
+		r.Type = typeInteger
+		return nil
+	}
+	c := q.p.cluster
+	if c == nil {
+		return fmt.Errorf("ERR This instance has cluster support disabled")
+	}
+	switch sub {
+	case "countkeysinslot":
+		if len(args) != 2 {
+			return fmt.Errorf("wrong number of arguments for 'cluster countkeysinslot' command")
+		}
+		slot, err := strconv.Atoi(args[1])
+		if err != nil || slot < 0 || slot >= CLUSTER_SLOTS {
+			return fmt.Errorf("ERR Invalid slot")
+		}
+		count := 0
+		for _, key := range q.p.storage.Keys("*") {
+			if keySlot(key) == slot {
+				count++
+			}
+		}
+		r.PayloadString([]byte(strconv.Itoa(count)))
+		r.Type = typeInteger
+	case "rebalance":
+		if err := c.Rebalance(); err != nil {
+			return err
+		}
+		// a rebalance started by a client rebalances every peer
+		if !q.FromPeer {
+			for _, link := range c.p.replicas() {
+				if link.Ready() {
+					go c.p.RemoteExecute(link, NewSimpleQuery(string(formattedArray([][]byte{[]byte("cluster"), []byte("rebalance")}))))
+				}
+			}
+		}
+		r.OK()
+	case "slots":
+		r.Replies = [][]byte{formattedReply(c.clusterSlots())}
+	case "shards":
+		r.Replies = [][]byte{formattedReply(c.clusterShards())}
+	default:
+		return fmt.Errorf("ERR unknown command 'cluster %s'", args[0])
+	}
+	return nil
+}
+
+func infoCluster(p *Peer) (info []string) {
+	info = append(info, "# Cluster")
+	if p.cluster == nil {
+		info = append(info, "cluster_enabled:0")
+		return info
+	}
+	owned := 0
+	for _, owners := range p.cluster.table() {
+		if stringInSlice(p.ID, owners) {
+			owned++
+		}
+	}
+	info = append(info, "cluster_enabled:1")
+	info = append(info, fmt.Sprintf("cluster_size:%d", len(p.cluster.members())))
+	info = append(info, fmt.Sprintf("cluster_replication_factor:%d", p.cluster.ReplicationFactor()))
+	info = append(info, fmt.Sprintf("cluster_routing:%s", p.cluster.Routing()))
+	info = append(info, fmt.Sprintf("cluster_slots_owned:%d", owned))
+	info = append(info, infoMigrations(p.cluster)...)
+	return info
+}
@@ -0,0 +1,191 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeySlot(t *testing.T) {
+	if output := crc16([]byte("123456789")); output != 0x31c3 {
+		t.Errorf("want %+v, got %+v", 0x31c3, output)
+	}
+	suites := []struct {
+		input    string
+		expected int
+	}{
+		{"foo", 12182},
+		{"somekey", 11058},
+		{"{user1000}.following", keySlot("user1000")},
+		{"{user1000}.followers", keySlot("user1000")},
+		{"foo{}{bar}", keySlot("foo{}{bar}")},
+		{"foo{{bar}}", keySlot("{bar")},
+	}
+	for _, s := range suites {
+		if output := keySlot(s.input); s.expected != output {
+			t.Errorf("%s: want %+v, got %+v", s.input, s.expected, output)
+		}
+	}
+	if keySlot("foo{}{bar}") == keySlot("bar") {
+		t.Errorf("want an empty hash tag to be ignored")
+	}
+}
+
+func TestRendezvousOwners(t *testing.T) {
+	members := []string{"a", "b", "c"}
+	owners := rendezvousOwners(members, 2)
+	owned := make(map[string]int)
+	for slot, o := range owners {
+		if len(o) != 2 || o[0] == o[1] {
+			t.Fatalf("slot %d: want 2 distinct owners, got %+v", slot, o)
+		}
+		for _, id := range o {
+			owned[id]++
+		}
+	}
+	// each member stores about 2/3 of the slots
+	for _, id := range members {
+		if owned[id] < CLUSTER_SLOTS*6/10 || owned[id] > CLUSTER_SLOTS*73/100 {
+			t.Errorf("%s: unbalanced, owns %d slots", id, owned[id])
+		}
+	}
+
+	// the slots of the remaining members do not move when a member leaves
+	after := rendezvousOwners([]string{"a", "b"}, 2)
+	for slot, o := range owners {
+		for _, id := range o {
+			if id != "c" && !stringInSlice(id, after[slot]) {
+				t.Fatalf("slot %d: %s lost the slot", slot, id)
+			}
+		}
+	}
+
+	if output := rendezvousOwners([]string{"a"}, 2)[0]; len(output) != 1 {
+		t.Errorf("want %+v, got %+v", []string{"a"}, output)
+	}
+}
+
+func setupCluster(replicationFactor int) *VQLClient {
+	peer, err := NewPeer("127.0.0.1", 0)
+	if err != nil {
+		panic(err)
+	}
+	peer.gossip.probeInterval = 100 * time.Millisecond
+	peer.gossip.probeTimeout = 50 * time.Millisecond
+	peer.gossip.suspicionTimeout = 500 * time.Millisecond
+	peer.gossip.syncInterval = 300 * time.Millisecond
+	peer.EnableSharding(replicationFactor)
+	go peer.Run()
+	vqlTCPServer, err := NewVQLTCPServer(peer, "127.0.0.1", 0)
+	if err != nil {
+		panic(err)
+	}
+	go vqlTCPServer.Run()
+	for i := 0; i < 50 && (peer.tcpServer == nil || peer.tcpServer.Port() == 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return NewVQLClient(1, "test-client", nil, vqlTCPServer)
+}
+
+func TestClusterCommand(t *testing.T) {
+	client := setup()
+	suites := []struct {
+		input    string
+		expected string
+	}{
+		{"cluster keyslot foo", ":12182\r\n"},
+		{"cluster keyslot", "wrong number of arguments for 'cluster keyslot' command"},
+		{"cluster slots", "ERR This instance has cluster support disabled"},
+		{"info cluster", "$30\r\n# Cluster\r\ncluster_enabled:0\r\n\r\n"},
+	}
+	for _, s := range suites {
+		if output := <-executeAsync(client, s.input); s.expected != output {
+			t.Errorf("%s: want %q, got %q", s.input, s.expected, output)
+		}
+	}
+
+	client = setupCluster(2)
+	id := client.vqlTCPServer.Peer.ID
+	addr := client.vqlTCPServer.connString()
+	host, port := addr[:strings.LastIndex(addr, ":")], addr[strings.LastIndex(addr, ":")+1:]
+	suites = []struct {
+		input    string
+		expected string
+	}{
+		{"set foo bar", "+OK\r\n"},
+		{"del foo bar", "CROSSSLOT Keys in request don't hash to the same slot"},
+		{"cluster slots", fmt.Sprintf("*1\r\n*3\r\n:0\r\n:16383\r\n*3\r\n$%d\r\n%s\r\n:%s\r\n$%d\r\n%s\r\n", len(host), host, port, len(id), id)},
+		{"cluster foo", "ERR unknown command 'cluster foo'"},
+		{"config get cluster-routing", "*2\r\n$15\r\ncluster-routing\r\n$8\r\nredirect\r\n"},
+		{"config set cluster-routing proxy", "ERR Invalid argument 'proxy' for CONFIG SET 'cluster-routing' - argument must be 'redirect' or 'forward'"},
+	}
+	for _, s := range suites {
+		if output := <-executeAsync(client, s.input); s.expected != output {
+			t.Errorf("%s: want %q, got %q", s.input, s.expected, output)
+		}
+	}
+	if output := <-executeAsync(client, "cluster shards"); !strings.Contains(output, "$6\r\nmaster\r\n") {
+		t.Errorf("want a master node, got %q", output)
+	}
+}
+
+func TestClusterRouting(t *testing.T) {
+	clients := []*VQLClient{setupCluster(1), setupCluster(1), setupCluster(1)}
+	peers := []*Peer{}
+	for _, c := range clients {
+		peers = append(peers, c.vqlTCPServer.Peer)
+	}
+	for _, c := range clients[1:] {
+		<-executeAsync(c, fmt.Sprintf("peer connect %s", peers[0].connString()))
+	}
+	for i, c := range clients {
+		for j, p := range peers {
+			if i != j {
+				waitMemberState(c, p.ID, memberAlive)
+			}
+		}
+	}
+
+	// find a key owned by the last peer only
+	var key string
+	var owner []string
+	for i := 0; ; i++ {
+		key = fmt.Sprintf("key%d", i)
+		owner = peers[0].cluster.slotOwners(keySlot(key))
+		if owner[0] == peers[2].ID {
+			break
+		}
+	}
+	for i := 0; i < 100 && len(peers[0].cluster.vqlAddr(peers[2].ID)) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	expected := fmt.Sprintf("MOVED %d %s", keySlot(key), clients[2].vqlTCPServer.connString())
+	if output := <-executeAsync(clients[0], fmt.Sprintf("set %s v", key)); expected != output {
+		t.Errorf("want %q, got %q", expected, output)
+	}
+
+	// forwarded queries are executed by the owner of the key
+	<-executeAsync(clients[0], "config set cluster-routing forward")
+	if output := <-executeAsync(clients[0], fmt.Sprintf("set %s v", key)); output != "+OK\r\n" {
+		t.Errorf("want %q, got %q", "+OK\r\n", output)
+	}
+	if output := string(peers[2].storage.Get(key)); output != "v" {
+		t.Errorf("want %+v, got %+v", "v", output)
+	}
+	expected = "$1\r\nv\r\n"
+	for i, c := range clients {
+		<-executeAsync(c, "config set cluster-routing forward")
+		if output := <-executeAsync(c, fmt.Sprintf("get %s", key)); expected != output {
+			t.Errorf("peer %d: want %q, got %q", i, expected, output)
+		}
+	}
+	// the keys are not replicated to the peers which do not own them
+	time.Sleep(100 * time.Millisecond)
+	for _, p := range peers[:2] {
+		if output := p.storage.Get(key); output != nil {
+			t.Errorf("want %+v, got %+v", nil, output)
+		}
+	}
+}
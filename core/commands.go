@@ -0,0 +1,225 @@
+package core
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// commandSpec describes a VQL command: the categories it belongs to and
+// where its keys and pub/sub channels are among its arguments.
+type commandSpec struct {
+	categories []string
+	// keys returns the keys among the arguments of the command
+	keys func(args []string) []string
+	// channels returns the pub/sub channels among the arguments of the
+	// command
+	channels func(args []string) []string
+	// patterns is set when the channels are subscription patterns
+	patterns bool
+}
+
+var (
+	// commandSpecs is indexed by command name, subcommands are named
+	// "<command>|<subcommand>" like "config|get".
+	commandSpecs = map[string]*commandSpec{
+		"auth":                    {categories: []string{"fast", "connection"}},
+		"ping":                    {categories: []string{"fast", "connection"}},
+		"select":                  {categories: []string{"fast", "connection"}},
+		"quit":                    {categories: []string{"fast", "connection"}},
+		"help":                    {categories: []string{"fast", "connection"}},
+		"client|setname":          {categories: []string{"slow", "connection"}},
+		"client|getname":          {categories: []string{"slow", "connection"}},
+		"client|list":             {categories: []string{"admin", "slow", "dangerous", "connection"}},
+		"client|kill":             {categories: []string{"admin", "slow", "dangerous", "connection"}},
+		"client|consistency":      {categories: []string{"slow", "connection"}},
+		"info":                    {categories: []string{"slow", "dangerous"}},
+		"time":                    {categories: []string{"fast"}},
+		"get":                     {categories: []string{"read", "string", "fast"}, keys: firstKey},
+		"set":                     {categories: []string{"write", "string", "slow"}, keys: firstKey},
+		"incr":                    {categories: []string{"write", "string", "fast"}, keys: firstKey},
+		"decr":                    {categories: []string{"write", "string", "fast"}, keys: firstKey},
+		"del":                     {categories: []string{"keyspace", "write", "slow"}, keys: allKeys},
+		"type":                    {categories: []string{"keyspace", "read", "fast"}, keys: firstKey},
+		"ttl":                     {categories: []string{"keyspace", "read", "fast"}, keys: firstKey},
+		"pttl":                    {categories: []string{"keyspace", "read", "fast"}, keys: firstKey},
+		"expire":                  {categories: []string{"keyspace", "write", "fast"}, keys: firstKey},
+		"pexpire":                 {categories: []string{"keyspace", "write", "fast"}, keys: firstKey},
+		"expireat":                {categories: []string{"keyspace", "write", "fast"}, keys: firstKey},
+		"pexpireat":               {categories: []string{"keyspace", "write", "fast"}, keys: firstKey},
+		"persist":                 {categories: []string{"keyspace", "write", "fast"}, keys: firstKey},
+		"keys":                    {categories: []string{"keyspace", "read", "slow", "dangerous"}},
+		"scan":                    {categories: []string{"keyspace", "read", "slow"}},
+		"flushdb":                 {categories: []string{"keyspace", "write", "slow", "dangerous"}},
+		"subscribe":               {categories: []string{"pubsub", "slow"}, channels: allChannels},
+		"psubscribe":              {categories: []string{"pubsub", "slow"}, channels: allChannels, patterns: true},
+		"unsubscribe":             {categories: []string{"pubsub", "slow"}},
+		"punsubscribe":            {categories: []string{"pubsub", "slow"}},
+		"publish":                 {categories: []string{"pubsub", "fast"}, channels: firstChannel},
+		"pubsub|channels":         {categories: []string{"pubsub", "slow"}},
+		"pubsub|numsub":           {categories: []string{"pubsub", "slow"}},
+		"pubsub|numpat":           {categories: []string{"pubsub", "slow"}},
+		"eval":                    {categories: []string{"slow", "scripting"}, keys: scriptKeys},
+		"evalsha":                 {categories: []string{"slow", "scripting"}, keys: scriptKeys},
+		"fcall":                   {categories: []string{"slow", "scripting"}, keys: scriptKeys},
+		"script|load":             {categories: []string{"slow", "scripting"}},
+		"script|exists":           {categories: []string{"slow", "scripting"}},
+		"script|flush":            {categories: []string{"slow", "scripting"}},
+		"script|kill":             {categories: []string{"slow", "scripting"}},
+		"function|load":           {categories: []string{"write", "slow", "scripting"}},
+		"function|delete":         {categories: []string{"write", "slow", "scripting"}},
+		"function|flush":          {categories: []string{"write", "slow", "scripting"}},
+		"function|list":           {categories: []string{"slow", "scripting"}},
+		"function|kill":           {categories: []string{"slow", "scripting"}},
+		"config|get":              {categories: []string{"admin", "slow", "dangerous"}},
+		"config|set":              {categories: []string{"admin", "slow", "dangerous"}},
+		"peer|id":                 {categories: []string{"admin", "slow"}},
+		"peer|get":                {categories: []string{"admin", "slow"}},
+		"peer|read":               {categories: []string{"admin", "slow"}},
+		"peer|list":               {categories: []string{"admin", "slow"}},
+		"peer|connect":            {categories: []string{"admin", "slow", "dangerous"}},
+		"peer|remove":             {categories: []string{"admin", "slow", "dangerous"}},
+		"asking":                  {categories: []string{"fast"}},
+		"cluster|countkeysinslot": {categories: []string{"slow"}},
+		"cluster|rebalance":       {categories: []string{"admin", "slow", "dangerous"}},
+		"cluster|keyslot":         {categories: []string{"slow"}},
+		"cluster|slots":           {categories: []string{"slow"}},
+		"cluster|shards":          {categories: []string{"slow"}},
+		"peer|restore":            {categories: []string{"admin", "write", "slow"}},
+		"peer|importing":          {categories: []string{"admin", "slow"}},
+		"peer|stable":             {categories: []string{"admin", "slow"}},
+		"peer|merkle":             {categories: []string{"admin", "slow"}},
+		"peer|range":              {categories: []string{"admin", "slow"}},
+		"peer|repair":             {categories: []string{"admin", "slow", "dangerous"}},
+		"peer|role":               {categories: []string{"admin", "slow"}},
+		"peer|vote":               {categories: []string{"admin", "slow"}},
+		"peer|promoted":           {categories: []string{"admin", "slow", "dangerous"}},
+		"peer|leave":              {categories: []string{"admin", "slow", "dangerous"}},
+		"replicaof":               {categories: []string{"admin", "slow", "dangerous"}},
+		"role":                    {categories: []string{"admin", "fast", "dangerous"}},
+		"readonly":                {categories: []string{"fast", "connection"}},
+		"readwrite":               {categories: []string{"fast", "connection"}},
+		"consistency|set":         {categories: []string{"admin", "slow", "dangerous"}},
+		"consistency|del":         {categories: []string{"admin", "slow", "dangerous"}},
+		"consistency|get":         {categories: []string{"slow"}},
+		"consistency|list":        {categories: []string{"slow"}},
+		"crdt|set":                {categories: []string{"admin", "slow", "dangerous"}},
+		"crdt|del":                {categories: []string{"admin", "slow", "dangerous"}},
+		"crdt|get":                {categories: []string{"slow"}},
+		"crdt|list":               {categories: []string{"slow"}},
+		"crdt|merge":              {categories: []string{"admin", "write", "slow"}, keys: crdtKey},
+		"sadd":                    {categories: []string{"write", "set", "fast"}, keys: firstKey},
+		"srem":                    {categories: []string{"write", "set", "fast"}, keys: firstKey},
+		"smembers":                {categories: []string{"read", "set", "slow"}, keys: firstKey},
+		"sismember":               {categories: []string{"read", "set", "fast"}, keys: firstKey},
+		"scard":                   {categories: []string{"read", "set", "fast"}, keys: firstKey},
+		"acl|setuser":             {categories: []string{"admin", "slow", "dangerous"}},
+		"acl|getuser":             {categories: []string{"admin", "slow", "dangerous"}},
+		"acl|deluser":             {categories: []string{"admin", "slow", "dangerous"}},
+		"acl|list":                {categories: []string{"admin", "slow", "dangerous"}},
+		"acl|users":               {categories: []string{"admin", "slow", "dangerous"}},
+		"acl|log":                 {categories: []string{"admin", "slow", "dangerous"}},
+		"acl|whoami":              {categories: []string{"slow"}},
+		"acl|cat":                 {categories: []string{"slow"}},
+	}
+)
+
+func firstKey(args []string) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	return args[:1]
+}
+
+func allKeys(args []string) []string {
+	return args
+}
+
+// scriptKeys returns the keys of EVAL, EVALSHA and FCALL which are preceded
+// by their count.
+func scriptKeys(args []string) []string {
+	if len(args) < 2 {
+		return nil
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 0 || n > len(args)-2 {
+		return nil
+	}
+	return args[2 : 2+n]
+}
+
+// crdtKey returns the key of CRDT MERGE, following the subcommand.
+func crdtKey(args []string) []string {
+	if len(args) < 2 {
+		return nil
+	}
+	return args[1:2]
+}
+
+func firstChannel(args []string) []string {
+	return firstKey(args)
+}
+
+func allChannels(args []string) []string {
+	return args
+}
+
+// lookupCommand returns the name and the spec of a command, or nil when the
+// command is unknown.
+func lookupCommand(verb string, args []string) (string, *commandSpec) {
+	if len(args) > 0 {
+		name := verb + "|" + strings.ToLower(args[0])
+		if spec := commandSpecs[name]; spec != nil {
+			return name, spec
+		}
+	}
+	return verb, commandSpecs[verb]
+}
+
+func (s *commandSpec) hasCategory(category string) bool {
+	for _, c := range s.categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// commandCategories returns the sorted categories of all the commands.
+func commandCategories() []string {
+	seen := make(map[string]bool)
+	for _, spec := range commandSpecs {
+		for _, c := range spec.categories {
+			seen[c] = true
+		}
+	}
+	return sortedKeys(seen)
+}
+
+// commandsInCategory returns the sorted names of the commands of category.
+func commandsInCategory(category string) []string {
+	var names []string
+	for name, spec := range commandSpecs {
+		if category == "all" || spec.hasCategory(category) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// commandNames returns the names of the commands matching name, a command
+// like "config" matches all its subcommands.
+func commandNames(name string) []string {
+	if commandSpecs[name] != nil {
+		return []string{name}
+	}
+	var names []string
+	for n := range commandSpecs {
+		if strings.HasPrefix(n, name+"|") {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,213 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/glob"
+)
+
+// configParameter is a runtime parameter of a peer available through
+// CONFIG GET and CONFIG SET.
+type configParameter struct {
+	get func(p *Peer) string
+	set func(p *Peer, value string) error
+}
+
+var (
+	configParameters = map[string]*configParameter{
+		"notify-keyspace-events": {
+			get: func(p *Peer) string {
+				return keyspaceEventsString(p.keyspaceEvents())
+			},
+			set: func(p *Peer, value string) error {
+				flags, err := parseKeyspaceEvents(value)
+				if err != nil {
+					return err
+				}
+				p.setKeyspaceEvents(flags)
+				return nil
+			},
+		},
+		"acllog-max-len": {
+			get: func(p *Peer) string {
+				return strconv.Itoa(p.acl.LogMaxLen())
+			},
+			set: func(p *Peer, value string) error {
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					return fmt.Errorf("argument must be a positive number")
+				}
+				p.acl.SetLogMaxLen(n)
+				return nil
+			},
+		},
+		"cluster-replication-factor": {
+			get: func(p *Peer) string {
+				if p.cluster == nil {
+					return "0"
+				}
+				return strconv.Itoa(p.cluster.ReplicationFactor())
+			},
+			set: func(p *Peer, value string) error {
+				if p.cluster == nil {
+					return fmt.Errorf("sharding is disabled")
+				}
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 {
+					return fmt.Errorf("argument must be a positive number")
+				}
+				p.cluster.SetReplicationFactor(n)
+				return nil
+			},
+		},
+		"cluster-routing": {
+			get: func(p *Peer) string {
+				if p.cluster == nil {
+					return ""
+				}
+				return p.cluster.Routing()
+			},
+			set: func(p *Peer, value string) error {
+				if p.cluster == nil {
+					return fmt.Errorf("sharding is disabled")
+				}
+				return p.cluster.SetRouting(strings.ToLower(value))
+			},
+		},
+		"anti-entropy-interval": {
+			get: func(p *Peer) string {
+				return strconv.FormatInt(atomic.LoadInt64(&p.repairInterval), 10)
+			},
+			set: func(p *Peer, value string) error {
+				seconds, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || seconds < 0 {
+					return fmt.Errorf("argument must be a positive number of seconds or 0")
+				}
+				atomic.StoreInt64(&p.repairInterval, seconds)
+				return nil
+			},
+		},
+		"hint-ttl": {
+			get: func(p *Peer) string {
+				return strconv.FormatInt(atomic.LoadInt64(&p.hints.ttl), 10)
+			},
+			set: func(p *Peer, value string) error {
+				seconds, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || seconds < 0 {
+					return fmt.Errorf("argument must be a positive number of seconds or 0")
+				}
+				atomic.StoreInt64(&p.hints.ttl, seconds)
+				return nil
+			},
+		},
+		"hints-per-peer": {
+			get: func(p *Peer) string {
+				return strconv.FormatInt(atomic.LoadInt64(&p.hints.max), 10)
+			},
+			set: func(p *Peer, value string) error {
+				max, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || max <= 0 {
+					return fmt.Errorf("argument must be a positive number of hints")
+				}
+				atomic.StoreInt64(&p.hints.max, max)
+				return nil
+			},
+		},
+		"replica-writes": {
+			get: func(p *Peer) string {
+				return p.role.Writes()
+			},
+			set: func(p *Peer, value string) error {
+				return p.role.SetWrites(strings.ToLower(value))
+			},
+		},
+		"failover-timeout": {
+			get: func(p *Peer) string {
+				return strconv.FormatInt(atomic.LoadInt64(&p.role.timeout), 10)
+			},
+			set: func(p *Peer, value string) error {
+				ms, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || ms < 0 {
+					return fmt.Errorf("argument must be a positive number of milliseconds or 0")
+				}
+				atomic.StoreInt64(&p.role.timeout, ms)
+				return nil
+			},
+		},
+		"lua-time-limit": {
+			get: func(p *Peer) string {
+				return strconv.FormatInt(int64(p.scripts.TimeLimit()/time.Millisecond), 10)
+			},
+			set: func(p *Peer, value string) error {
+				ms, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || ms <= 0 {
+					return fmt.Errorf("argument must be a positive number of milliseconds")
+				}
+				p.scripts.SetTimeLimit(ms)
+				return nil
+			},
+		},
+		"lua-hard-time-limit": {
+			get: func(p *Peer) string {
+				return strconv.FormatInt(int64(p.scripts.HardTimeLimit()/time.Millisecond), 10)
+			},
+			set: func(p *Peer, value string) error {
+				ms, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || ms <= 0 {
+					return fmt.Errorf("argument must be a positive number of milliseconds")
+				}
+				p.scripts.SetHardTimeLimit(ms)
+				return nil
+			},
+		},
+	}
+)
+
+func (q *Query) configGet(r *Response, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("wrong number of arguments for 'config get' command")
+	}
+	var names []string
+	for name := range configParameters {
+		for _, pattern := range args[1:] {
+			g, err := glob.Compile(strings.ToLower(pattern))
+			if err != nil {
+				return err
+			}
+			if g.Match(name) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	r.Payload = [][]byte{}
+	for _, name := range names {
+		r.Payload = append(r.Payload, []byte(name), []byte(configParameters[name].get(q.p)))
+	}
+	r.Type = typeArray
+	return nil
+}
+
+func (q *Query) configSet(r *Response, args []string) error {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return fmt.Errorf("wrong number of arguments for 'config set' command")
+	}
+	for i := 1; i < len(args); i += 2 {
+		if configParameters[strings.ToLower(args[i])] == nil {
+			return fmt.Errorf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i])
+		}
+	}
+	for i := 1; i < len(args); i += 2 {
+		if err := configParameters[strings.ToLower(args[i])].set(q.p, args[i+1]); err != nil {
+			return fmt.Errorf("ERR Invalid argument '%s' for CONFIG SET '%s' - %s", args[i+1], args[i], err)
+		}
+	}
+	r.OK()
+	return nil
+}
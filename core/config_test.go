@@ -0,0 +1,26 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestConfig(t *testing.T) {
+	client := setup()
+	suites := []string{
+		"config get notify*", "*2\r\n$22\r\nnotify-keyspace-events\r\n$0\r\n\r\n",
+		"config get foo", "*0\r\n",
+		"config set notify-keyspace-events Ex", "+OK\r\n",
+		"config get notify-keyspace-events", "*2\r\n$22\r\nnotify-keyspace-events\r\n$2\r\nxE\r\n",
+		"config set notify-keyspace-events KEA", "+OK\r\n",
+		"CONFIG GET NOTIFY-KEYSPACE-EVENTS", "*2\r\n$22\r\nnotify-keyspace-events\r\n$3\r\nAKE\r\n",
+		"config set notify-keyspace-events Q", "ERR Invalid argument 'Q' for CONFIG SET 'notify-keyspace-events' - invalid event class 'Q'",
+		"config set foo bar", "ERR Unknown option or number of arguments for CONFIG SET - 'foo'",
+		"config set notify-keyspace-events", "wrong number of arguments for 'config set' command",
+	}
+	for i := 0; i < len(suites); i += 2 {
+		expected := suites[i+1]
+		if output := <-executeAsync(client, suites[i]); expected != output {
+			t.Errorf("%s: want %q, got %q", suites[i], expected, output)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bjorand/velocidb/raft"
+	storagePkg "github.com/bjorand/velocidb/storage"
+)
+
+// In consistent mode, writes are not replicated with PublishVQL: they are
+// proposed to the Raft log and executed by every peer once committed, in the
+// log order. Reads are served by the leader once it confirmed it still leads
+// a majority of the members and applied every write committed before the
+// read (read index): followers forward them to the leader. Raft messages are
+// carried in C frames between peers announcing the raft capability.
+const (
+	RAFT_TICK_INTERVAL = 100 // milliseconds
+	// milliseconds between two checks of a read waiting for its index
+	RAFT_READ_CHECK_INTERVAL = 5
+	// ticks between two reconciliations of the raft members with the mesh
+	RAFT_RECONCILE_TICKS = 10
+	// messages waiting to be sent, the next ones are dropped
+	RAFT_SEND_QUEUE_SIZE = 1024
+)
+
+var (
+	// consensusVerbs are the commands proposed to the log besides the ones
+	// in the write category: scripts may write and have to be loaded by
+	// every peer. Every peer runs the scripts of the log, they get the same
+	// random numbers and cannot call the commands answering differently on
+	// every peer, so that they write the same values
+	consensusVerbs = map[string]bool{
+		"eval":         true,
+		"evalsha":      true,
+		"fcall":        true,
+		"script|load":  true,
+		"script|flush": true,
+	}
+)
+
+type Consensus struct {
+	p    *Peer
+	node *raft.Node
+	// client executes the committed queries
+	client *VQLClient
+	mu     sync.Mutex
+	// waiting holds the queries proposed by this peer waiting for their
+	// reply, by query ID
+	waiting      map[string]chan []byte
+	sendQueue    chan raft.Message
+	tickInterval time.Duration
+}
+
+// consensusFSM applies the committed queries to the peer.
+type consensusFSM struct {
+	c *Consensus
+}
+
+type consensusTransport struct {
+	c *Consensus
+}
+
+// EnableConsensus runs the peer in consistent mode. The peer bootstrapping
+// the cluster is its first member, the others are added by the leader once
+// they are connected to it. It has to be called before Run.
+func (p *Peer) EnableConsensus(bootstrap bool) {
+	c := &Consensus{
+		p:            p,
+		client:       NewVQLClient(-1, fmt.Sprintf("raft-%s", p.ID), nil, p.vqlTCPServer),
+		waiting:      make(map[string]chan []byte),
+		sendQueue:    make(chan raft.Message, RAFT_SEND_QUEUE_SIZE),
+		tickInterval: RAFT_TICK_INTERVAL * time.Millisecond,
+	}
+	config := raft.Config{
+		ID:   p.ID,
+		Seed: time.Now().UnixNano(),
+	}
+	if bootstrap {
+		config.Members = []string{p.ID}
+	}
+	c.node = raft.NewNode(config, &consensusFSM{c: c}, &consensusTransport{c: c})
+	p.consensus = c
+}
+
+func (t *consensusTransport) Send(msg raft.Message) {
+	select {
+	case t.c.sendQueue <- msg:
+	default:
+	}
+}
+
+// link returns the open link with a peer supporting raft.
+func (c *Consensus) link(id string) *Peer {
+	for _, l := range c.p.Mesh.List() {
+		if l.Ready() && l.remoteID() == id && hasCapability(l.remoteCapabilities(), "raft") {
+			return l
+		}
+	}
+	return nil
+}
+
+func (c *Consensus) sender() {
+	for msg := range c.sendQueue {
+		link := c.link(msg.To)
+		if link == nil {
+			continue
+		}
+		conn, _ := link.session()
+		if conn == nil {
+			continue
+		}
+		data, err := raft.EncodeMessage(msg)
+		if err != nil {
+			fmt.Printf("[raft] Unable to encode message: %s\n", err)
+			continue
+		}
+		writeFrame(conn, frameRaft, data)
+	}
+}
+
+func (c *Consensus) handle(payload []byte) {
+	msg, err := raft.DecodeMessage(payload)
+	if err != nil {
+		fmt.Printf("[raft] Invalid message: %s\n", err)
+		return
+	}
+	c.node.Step(msg)
+}
+
+func (c *Consensus) run() {
+	go c.sender()
+	ticker := time.NewTicker(c.tickInterval)
+	defer ticker.Stop()
+	for i := 1; ; i++ {
+		<-ticker.C
+		c.node.Tick()
+		if i%RAFT_RECONCILE_TICKS == 0 {
+			c.reconcile()
+		}
+	}
+}
+
+// reconcile makes the members of the raft cluster follow the mesh: the
+// leader adds the linked peers supporting raft and removes the members
+// gossip declared dead, one at a time.
+func (c *Consensus) reconcile() {
+	status := c.node.Status()
+	if status.State != raft.Leader {
+		return
+	}
+	members := make(map[string]bool)
+	for _, id := range status.Members {
+		members[id] = true
+	}
+	for _, m := range c.p.gossip.Members() {
+		if m.State == memberDead && members[m.ID] {
+			c.node.RemoveMember(m.ID)
+			return
+		}
+	}
+	for _, l := range c.p.Mesh.List() {
+		id := l.remoteID()
+		if l.Ready() && !members[id] && hasCapability(l.remoteCapabilities(), "raft") {
+			c.node.AddMember(id)
+			return
+		}
+	}
+}
+
+// propose proposes a query to the log and waits for the reply of its
+// execution.
+func (c *Consensus) propose(q *Query) (*Response, error) {
+	reply := make(chan []byte, 1)
+	c.mu.Lock()
+	c.waiting[q.id] = reply
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.waiting, q.id)
+		c.mu.Unlock()
+	}()
+	if err := c.node.Propose(formattedArray([][]byte{[]byte(q.id), formattedArray(q.parsed)})); err != nil {
+		return nil, fmt.Errorf("CLUSTERDOWN %s", err)
+	}
+	select {
+	case data := <-reply:
+		if len(data) > 0 && data[0] == '-' {
+			return nil, fmt.Errorf("%s", strings.TrimSuffix(string(data[1:]), "\r\n"))
+		}
+		r := NewResponse(q)
+		r.Replies = [][]byte{data}
+		return r, nil
+	case <-time.After(QUERY_TIMEOUT * time.Second):
+		return nil, fmt.Errorf("TRYAGAIN the write was not committed in time")
+	}
+}
+
+func (f *consensusFSM) Apply(entry raft.Entry) {
+	c := f.c
+	v, _, err := decodeReply(entry.Data)
+	items, ok := v.([]interface{})
+	if err != nil || !ok || len(items) != 2 {
+		fmt.Printf("[raft] Invalid log entry %d\n", entry.Index)
+		return
+	}
+	id, _ := items[0].([]byte)
+	raw, _ := items[1].([]byte)
+	q, err := c.p.ParseRawQuery(c.client, raw)
+	if err != nil {
+		fmt.Printf("[raft] Invalid log entry %d: %s\n", entry.Index, err)
+		return
+	}
+	q.FromPeer = true
+	var data []byte
+	r, err := q.Execute()
+	switch {
+	case err != nil:
+		data = formattedReply(errorReply(err.Error()))
+	case r == nil:
+		data = formattedReply(nil)
+	default:
+		data = r.FormattedPayload()
+	}
+	c.mu.Lock()
+	reply := c.waiting[string(id)]
+	c.mu.Unlock()
+	if reply != nil {
+		select {
+		case reply <- data:
+		default:
+		}
+	}
+}
+
+// consensusSnapshot is the state the log compacted in a snapshot leads to:
+// the keyspace, the scripts loaded with SCRIPT LOAD or EVAL and the function
+// libraries.
+type consensusSnapshot struct {
+	Items     []storagePkg.Item
+	Scripts   []string
+	Libraries []string
+}
+
+func (f *consensusFSM) Snapshot() ([]byte, error) {
+	snapshot := consensusSnapshot{Items: f.c.p.storage.Dump()}
+	snapshot.Scripts, snapshot.Libraries = f.c.p.scripts.dump()
+	return json.Marshal(snapshot)
+}
+
+func (f *consensusFSM) Restore(data []byte) error {
+	var snapshot consensusSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	if err := f.c.p.scripts.restore(snapshot.Scripts, snapshot.Libraries); err != nil {
+		return err
+	}
+	f.c.p.storage.Load(snapshot.Items)
+	return nil
+}
+
+// consensusRead serves a read in consistent mode. The leader waits until
+// it confirmed its leadership and applied the writes committed before the
+// read, then lets Execute serve it; followers forward it to the leader.
+func (q *Query) consensusRead() (r *Response, err error, handled bool) {
+	name, spec := lookupCommand(q.verb(), q.args())
+	if spec == nil || !spec.hasCategory("read") || consensusVerbs[name] {
+		return nil, nil, false
+	}
+	c := q.p.consensus
+	read, err := c.node.ReadIndex()
+	switch err {
+	case nil:
+	case raft.ErrNotLeader:
+		leader := c.node.Status().Leader
+		if q.forwarded || leader == "" {
+			// the leader changed since the read was forwarded
+			return nil, fmt.Errorf("CLUSTERDOWN %s", raft.ErrNoLeader), true
+		}
+		link := c.link(leader)
+		if link == nil {
+			return nil, fmt.Errorf("TRYAGAIN Leader %s is not linked", leader), true
+		}
+		r, err = q.forward(link, false)
+		return r, err, true
+	default:
+		return nil, fmt.Errorf("TRYAGAIN %s", err), true
+	}
+	deadline := time.Now().Add(QUERY_TIMEOUT * time.Second)
+	for {
+		confirmed, err := c.node.ReadConfirmed(read)
+		if err != nil {
+			return nil, fmt.Errorf("TRYAGAIN %s", err), true
+		}
+		if confirmed {
+			return nil, nil, false
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("TRYAGAIN the read was not confirmed in time"), true
+		}
+		time.Sleep(RAFT_READ_CHECK_INTERVAL * time.Millisecond)
+	}
+}
+
+// consensusRequired reports whether the query has to be ordered by the log.
+func (q *Query) consensusRequired() bool {
+	name, spec := lookupCommand(q.verb(), q.args())
+	if spec == nil {
+		return false
+	}
+	return spec.hasCategory("write") || consensusVerbs[name]
+}
+
+func infoRaft(p *Peer) (info []string) {
+	info = append(info, "# Raft")
+	if p.consensus == nil {
+		info = append(info, "raft_enabled:0")
+		return info
+	}
+	status := p.consensus.node.Status()
+	info = append(info, "raft_enabled:1")
+	info = append(info, fmt.Sprintf("raft_state:%s", status.State))
+	info = append(info, fmt.Sprintf("raft_term:%d", status.Term))
+	info = append(info, fmt.Sprintf("raft_leader:%s", status.Leader))
+	info = append(info, fmt.Sprintf("raft_commit_index:%d", status.CommitIndex))
+	info = append(info, fmt.Sprintf("raft_applied_index:%d", status.AppliedIndex))
+	info = append(info, fmt.Sprintf("raft_snapshot_index:%d", status.SnapshotIndex))
+	info = append(info, fmt.Sprintf("raft_members:%s", strings.Join(status.Members, ",")))
+	return info
+}
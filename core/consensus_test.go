@@ -0,0 +1,163 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupConsensus(bootstrap bool) *VQLClient {
+	peer, err := NewPeer("127.0.0.1", 0)
+	if err != nil {
+		panic(err)
+	}
+	peer.gossip.probeInterval = 100 * time.Millisecond
+	peer.gossip.probeTimeout = 50 * time.Millisecond
+	peer.EnableConsensus(bootstrap)
+	peer.consensus.tickInterval = 20 * time.Millisecond
+	go peer.Run()
+	vqlTCPServer, err := NewVQLTCPServer(peer, "127.0.0.1", 0)
+	if err != nil {
+		panic(err)
+	}
+	go vqlTCPServer.Run()
+	for i := 0; i < 50 && (peer.tcpServer == nil || peer.tcpServer.Port() == 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return NewVQLClient(1, "test-client", nil, vqlTCPServer)
+}
+
+// waitInfoRaft waits until the INFO RAFT output of client contains every
+// string.
+func waitInfoRaft(client *VQLClient, s ...string) string {
+	var output string
+	for i := 0; i < 200; i++ {
+		output = <-executeAsync(client, "info raft")
+		found := 0
+		for _, e := range s {
+			if strings.Contains(output, e) {
+				found++
+			}
+		}
+		if found == len(s) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return output
+}
+
+func TestConsensus(t *testing.T) {
+	clients := []*VQLClient{setupConsensus(true), setupConsensus(false), setupConsensus(false)}
+	peers := []*Peer{}
+	for _, c := range clients {
+		peers = append(peers, c.vqlTCPServer.Peer)
+	}
+	for _, c := range clients[1:] {
+		<-executeAsync(c, fmt.Sprintf("peer connect %s", peers[0].connString()))
+	}
+
+	// the leader adds the connected peers to the cluster
+	output := waitInfoRaft(clients[0], "raft_state:leader")
+	if !strings.Contains(output, "raft_state:leader") {
+		t.Fatalf("want leader, got %q", output)
+	}
+	leader := fmt.Sprintf("raft_leader:%s\r\n", peers[0].ID)
+	for _, c := range clients {
+		output = waitInfoRaft(c, leader, peers[1].ID, peers[2].ID)
+		for _, p := range peers {
+			if !strings.Contains(output, leader) || !strings.Contains(strings.Split(output, "raft_members:")[1], p.ID) {
+				t.Fatalf("want member %s and leader %s, got %q", p.ID, peers[0].ID, output)
+			}
+		}
+	}
+
+	// writes of every peer are applied by all of them in the log order
+	for i := 0; i < 3; i++ {
+		for j, c := range clients {
+			expected := fmt.Sprintf(":%d\r\n", i*len(clients)+j+1)
+			if output := <-executeAsync(c, "incr counter"); expected != output {
+				t.Errorf("want %q, got %q", expected, output)
+			}
+		}
+	}
+	// errors of the committed queries are returned to the client
+	expected := "ERR unknown command 'incr'"
+	if output := <-executeAsync(clients[2], "incr"); expected != output {
+		t.Errorf("want %q, got %q", expected, output)
+	}
+	expected = "$1\r\n9\r\n"
+	for i, c := range clients {
+		for j := 0; j < 50; j++ {
+			if output = <-executeAsync(c, "get counter"); expected == output {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if expected != output {
+			t.Errorf("peer %d: want %q, got %q", i, expected, output)
+		}
+	}
+
+	// reads are served by the leader, the follower storage is not read
+	peers[2].storage.Set("counter", []byte("stale"))
+	expected = "$1\r\n9\r\n"
+	if output := <-executeAsync(clients[2], "get counter"); expected != output {
+		t.Errorf("want %q, got %q", expected, output)
+	}
+
+	// scripts write the same values on every peer
+	if output := <-executeAsync(clients[1], vqlCommand("eval", "return redis.call('set', 'random', math.random(1000000))", "0")); output != "+OK\r\n" {
+		t.Errorf("want %q, got %q", "+OK\r\n", output)
+	}
+	expected = string(peers[0].storage.Get("random"))
+	for i, p := range peers {
+		for j := 0; j < 50 && p.storage.Get("random") == nil; j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if output := string(p.storage.Get("random")); expected == "" || expected != output {
+			t.Errorf("peer %d: want %q, got %q", i, expected, output)
+		}
+	}
+	expected = errScriptNondeterministic.Error()
+	if output := <-executeAsync(clients[1], vqlCommand("eval", "return redis.call('time')", "0")); !strings.Contains(output, expected) {
+		t.Errorf("want %q in %q", expected, output)
+	}
+
+	// without consensus
+	client := setup()
+	expected = "# Raft\r\nraft_enabled:0\r\n"
+	if output := <-executeAsync(client, "info raft"); !strings.Contains(output, expected) {
+		t.Errorf("want %q, got %q", expected, output)
+	}
+}
+
+func TestConsensusSnapshot(t *testing.T) {
+	client1, client2 := setupConsensus(true), setupConsensus(false)
+	waitInfoRaft(client1, "raft_state:leader")
+	<-executeAsync(client1, "set foo bar")
+	sha := <-executeAsync(client1, vqlCommand("script", "load", "return 1"))
+	lib := "#!lua name=mylib\nredis.register_function('myget', function(keys) return redis.call('get', keys[1]) end)"
+	<-executeAsync(client1, vqlCommand("function", "load", lib))
+
+	// the snapshot holds the keyspace, the scripts and the libraries
+	data, err := (&consensusFSM{c: client1.vqlTCPServer.Peer.consensus}).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scripts := client2.vqlTCPServer.Peer.scripts
+	scripts.Load([]byte("return 2"))
+	if err := (&consensusFSM{c: client2.vqlTCPServer.Peer.consensus}).Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	if !scripts.Exists(strings.Split(sha, "\r\n")[1]) || scripts.Exists(scriptSHA1([]byte("return 2"))) {
+		t.Errorf("want the scripts of the snapshot, got %+v", scripts.sources)
+	}
+	if scripts.library("myget") == nil {
+		t.Errorf("want the libraries of the snapshot, got %+v", scripts.Libraries(""))
+	}
+	if output := string(client2.vqlTCPServer.Peer.storage.Get("foo")); output != "bar" {
+		t.Errorf("want %q, got %q", "bar", output)
+	}
+}
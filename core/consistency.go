@@ -0,0 +1,436 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	storagePkg "github.com/bjorand/velocidb/storage"
+)
+
+// The consistency level of a query is the number of peers which have to
+// acknowledge a write before it is answered, or answer a read before the
+// latest value they hold is returned. Peers are the local peer and the
+// peers of the mesh, whether they are connected or not: ONE is the local
+// peer only, QUORUM a majority of them and ALL every one of them. Writes are
+// ordered by their version, the latest write wins.
+const (
+	CONSISTENCY_ONE = 1 + iota
+	CONSISTENCY_QUORUM
+	CONSISTENCY_ALL
+)
+
+var (
+	CONSISTENCY_LEVEL_TEXT = map[int]string{
+		CONSISTENCY_ONE:    "ONE",
+		CONSISTENCY_QUORUM: "QUORUM",
+		CONSISTENCY_ALL:    "ALL",
+	}
+)
+
+func parseConsistencyLevel(s string) (int, error) {
+	for level, text := range CONSISTENCY_LEVEL_TEXT {
+		if strings.EqualFold(s, text) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("ERR invalid consistency level '%s', expected ONE, QUORUM or ALL", s)
+}
+
+// requiredAcks returns the number of peers out of n answering a query of
+// the consistency level.
+func requiredAcks(level int, n int) int {
+	switch level {
+	case CONSISTENCY_QUORUM:
+		return n/2 + 1
+	case CONSISTENCY_ALL:
+		return n
+	}
+	return 1
+}
+
+// prefixPolicies is a table of the settings of the keys by key prefix, like
+// their consistency level. text holds the names of the settings.
+type prefixPolicies struct {
+	mu       sync.RWMutex
+	prefixes map[string]int
+	text     map[int]string
+}
+
+func newPrefixPolicies(text map[int]string) *prefixPolicies {
+	return &prefixPolicies{prefixes: make(map[string]int), text: text}
+}
+
+func (c *prefixPolicies) Set(prefix string, level int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prefixes[prefix] = level
+}
+
+func (c *prefixPolicies) Del(prefix string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.prefixes[prefix]
+	delete(c.prefixes, prefix)
+	return ok
+}
+
+// Lookup returns the setting of the longest prefix of key, 0 when no prefix
+// matches.
+func (c *prefixPolicies) Lookup(key string) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	level, longest := 0, -1
+	for prefix, l := range c.prefixes {
+		if strings.HasPrefix(key, prefix) && len(prefix) > longest {
+			level, longest = l, len(prefix)
+		}
+	}
+	return level
+}
+
+// List returns the policies sorted by prefix.
+func (c *prefixPolicies) List() (policies []string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for prefix, level := range c.prefixes {
+		policies = append(policies, fmt.Sprintf("%s %s", prefix, c.text[level]))
+	}
+	sort.Strings(policies)
+	return policies
+}
+
+// consistencyLevel returns the level of a query: the level of the client
+// when it set one, else the strongest level of the keys of the query.
+func (q *Query) consistencyLevel() int {
+	if q.c != nil && q.c.consistency != 0 {
+		return q.c.consistency
+	}
+	level := CONSISTENCY_ONE
+	args := q.args()
+	_, spec := lookupCommand(q.verb(), args)
+	if spec == nil || spec.keys == nil {
+		return level
+	}
+	for _, key := range spec.keys(args) {
+		if l := q.p.consistency.Lookup(key); l > level {
+			level = l
+		}
+	}
+	return level
+}
+
+func (q *Query) isWrite() bool {
+	_, spec := lookupCommand(q.verb(), q.args())
+	return spec != nil && spec.hasCategory("write")
+}
+
+// writeVersion returns the version of the keys written by the query. Local
+// writes are versioned with the hybrid logical clock of the peer, after the
+// current version of the key, so that they win over the writes of peers
+// with a clock ahead.
+func (q *Query) writeVersion(key string) storagePkg.Version {
+	if !q.version.IsZero() {
+		q.p.clock.Observe(q.version.Timestamp)
+	}
+	if q.version.IsZero() {
+		ts := q.p.clock.Now()
+		if _, current, ok := q.p.storage.GetVersion(key); ok && current.Timestamp >= ts {
+			ts = current.Timestamp + 1
+		}
+		q.version = storagePkg.Version{Timestamp: ts, Peer: q.p.ID}
+	}
+	return q.version
+}
+
+// replicas returns one link per remote peer of the mesh.
+func (p *Peer) replicas() (replicas []*Peer) {
+	seen := make(map[string]int)
+	for _, remotePeer := range p.Mesh.List() {
+		id := remotePeer.remoteID()
+		if id == "" {
+			replicas = append(replicas, remotePeer)
+			continue
+		}
+		i, ok := seen[id]
+		switch {
+		case !ok:
+			seen[id] = len(replicas)
+			replicas = append(replicas, remotePeer)
+		case !replicas[i].Ready() && remotePeer.Ready():
+			replicas[i] = remotePeer
+		}
+	}
+	return replicas
+}
+
+// replicas returns the links with the peers storing the keys of the query:
+// with sharding, the other owners of their slot.
+func (q *Query) replicas() []*Peer {
+	replicas := q.p.replicas()
+	if q.p.cluster == nil {
+		return replicas
+	}
+	owners := q.p.cluster.queryOwners(q)
+	if owners == nil {
+		return replicas
+	}
+	filtered := []*Peer{}
+	for _, remotePeer := range replicas {
+		if stringInSlice(remotePeer.remoteID(), owners) {
+			filtered = append(filtered, remotePeer)
+		}
+	}
+	return filtered
+}
+
+// executeConsistent executes a write then replicates it like the other
+// writes, with an offset in the backlog and hints for the unreachable
+// peers, and waits until enough peers acknowledged it. The write is not
+// rolled back when too few peers acknowledged it.
+func (q *Query) executeConsistent(level int) (*Response, error) {
+	q.coordinated = true
+	r, err := q.Execute()
+	if err != nil || !q.written {
+		return r, err
+	}
+	required := requiredAcks(level, len(q.replicas())+1) - 1
+	acks, sent := q.p.publish(q, true)
+	acked := make(map[string]bool)
+	for i := 0; i < sent && len(acked) < required; i++ {
+		if id := <-acks; id != "" {
+			acked[id] = true
+		}
+	}
+	if len(acked) < required {
+		return nil, fmt.Errorf("NOREPLICAS Not enough peers acknowledged the write: %d of %d", len(acked)+1, required+1)
+	}
+	return r, nil
+}
+
+// replicaRead is the item of a key read from a peer, link is nil for the
+// local peer.
+type replicaRead struct {
+	link  *Peer
+	item  storagePkg.Item
+	found bool
+	ok    bool
+}
+
+// readConsistent reads a key from enough peers and returns the latest
+// value. The peers holding an older value are repaired in the background
+// once every peer answered.
+func (q *Query) readConsistent(level int) (*Response, error) {
+	q.coordinated = true
+	args := q.args()
+	if len(args) != 1 {
+		return q.Execute()
+	}
+	key := args[0]
+	item, found := q.p.storage.DumpKey(key)
+	reads := []replicaRead{{item: item, found: found, ok: true}}
+	replicas := q.replicas()
+	required := requiredAcks(level, len(replicas)+1) - 1
+	answers := make(chan replicaRead, len(replicas))
+	for _, remotePeer := range replicas {
+		go func(remotePeer *Peer) {
+			answers <- q.p.remoteRead(remotePeer, key)
+		}(remotePeer)
+	}
+	got, waiting := 0, len(replicas)
+	for ; waiting > 0 && got < required; waiting-- {
+		read := <-answers
+		reads = append(reads, read)
+		if read.ok {
+			got++
+		}
+	}
+	go q.p.readRepair(append([]replicaRead{}, reads...), answers, waiting)
+	if got < required {
+		return nil, fmt.Errorf("NOREPLICAS Not enough peers answered the read: %d of %d", got+1, required+1)
+	}
+	r := NewResponse(q)
+	r.Type = typeBulkString
+	latest, found := latestRead(reads)
+	if !found {
+		r.PayloadString(nil)
+		return r, nil
+	}
+	if latest.Type == "" {
+		r.PayloadString(latest.Value)
+		return r, nil
+	}
+	c, err := storagePkg.DecodeCRDT(latest.Type, latest.Value)
+	if err != nil {
+		return nil, err
+	}
+	if c.Value() == nil {
+		return nil, storagePkg.ErrWrongType
+	}
+	r.PayloadString(c.Value())
+	return r, nil
+}
+
+// latestRead returns the latest item of the reads: the item with the
+// latest version, or the merge of the CRDTs read.
+func latestRead(reads []replicaRead) (latest storagePkg.Item, found bool) {
+	for _, read := range reads {
+		switch {
+		case !read.ok || !read.found:
+		case !found:
+			latest, found = read.item, true
+		case latest.Type != "" && read.item.Type == latest.Type:
+			c, err := storagePkg.DecodeCRDT(latest.Type, latest.Value)
+			if err != nil {
+				continue
+			}
+			o, err := storagePkg.DecodeCRDT(read.item.Type, read.item.Value)
+			if err != nil {
+				continue
+			}
+			c.Merge(o)
+			latest.Value = c.Encode()
+		case read.item.Version.Newer(latest.Version):
+			latest = read.item
+		}
+	}
+	return latest, found
+}
+
+// readRepair waits for the reads still expected, then restores the latest
+// item of the key read on the peers which answered an older one. Keys
+// written without a version are not repaired, neither are the keys missing
+// from the latest reads: a deletion can't be told from a missed write.
+func (p *Peer) readRepair(reads []replicaRead, answers chan replicaRead, waiting int) {
+	for ; waiting > 0; waiting-- {
+		reads = append(reads, <-answers)
+	}
+	latest, found := latestRead(reads)
+	if !found || (latest.Type == "" && latest.Version.IsZero()) {
+		return
+	}
+	for _, read := range reads {
+		switch {
+		case !read.ok:
+			continue
+		case !read.found:
+		case sameItem(read.item, latest):
+			continue
+		case latest.Type == "" && !latest.Version.Newer(read.item.Version):
+			continue
+		}
+		if read.link == nil {
+			p.storage.Restore(latest)
+		} else {
+			parsed := append([][]byte{[]byte("peer"), []byte("restore")}, encodeStorageItem(latest)...)
+			resp, err := p.RemoteExecute(read.link, NewSimpleQuery(string(formattedArray(parsed))))
+			if err != nil || resp.isError() {
+				continue
+			}
+		}
+		atomic.AddInt64(&p.Stats.ReadRepairs, 1)
+	}
+}
+
+// remoteRead reads the item of a key from a remote peer.
+func (p *Peer) remoteRead(remotePeer *Peer, key string) replicaRead {
+	if !remotePeer.Ready() {
+		return replicaRead{link: remotePeer}
+	}
+	resp, err := p.RemoteExecute(remotePeer, NewSimpleQuery(string(formattedArray([][]byte{[]byte("peer"), []byte("read"), []byte(key)}))))
+	if err != nil || resp.Type == typeError {
+		return replicaRead{link: remotePeer}
+	}
+	if resp.Type != typeArray || len(resp.Payload) != STORAGE_ITEM_FIELDS {
+		return replicaRead{link: remotePeer, ok: true}
+	}
+	fields := []string{}
+	for _, field := range resp.Payload {
+		fields = append(fields, string(field))
+	}
+	item, err := decodeStorageItem(fields)
+	if err != nil {
+		return replicaRead{link: remotePeer}
+	}
+	return replicaRead{link: remotePeer, item: item, found: true, ok: true}
+}
+
+// peerRead answers PEER READ with the item of a key: its value, version,
+// expiration time and CRDT type.
+func (q *Query) peerRead(r *Response, key string) {
+	item, ok := q.p.storage.DumpKey(key)
+	if !ok {
+		r.Type = typeBulkString
+		r.PayloadString(nil)
+		return
+	}
+	r.Type = typeArray
+	r.Payload = encodeStorageItem(item)
+}
+
+func (q *Query) consistencyCommand(r *Response, args []string) error {
+	switch strings.ToLower(args[0]) {
+	case "set":
+		if len(args) != 3 {
+			return fmt.Errorf("wrong number of arguments for 'consistency set' command")
+		}
+		level, err := parseConsistencyLevel(args[2])
+		if err != nil {
+			return err
+		}
+		q.p.consistency.Set(args[1], level)
+		r.OK()
+	case "del":
+		if len(args) != 2 {
+			return fmt.Errorf("wrong number of arguments for 'consistency del' command")
+		}
+		r.PayloadString([]byte(boolToInteger(q.p.consistency.Del(args[1]))))
+		r.Type = typeInteger
+	case "get":
+		if len(args) != 2 {
+			return fmt.Errorf("wrong number of arguments for 'consistency get' command")
+		}
+		level := q.p.consistency.Lookup(args[1])
+		if level == 0 {
+			level = CONSISTENCY_ONE
+		}
+		r.PayloadString([]byte(CONSISTENCY_LEVEL_TEXT[level]))
+	case "list":
+		r.Type = typeArray
+		r.Payload = [][]byte{}
+		for _, policy := range q.p.consistency.List() {
+			r.Payload = append(r.Payload, []byte(policy))
+		}
+	default:
+		return fmt.Errorf("ERR unknown command 'consistency %s'", args[0])
+	}
+	return nil
+}
+
+func (q *Query) clientConsistency(r *Response, args []string) error {
+	switch len(args) {
+	case 1:
+		if q.c.consistency == 0 {
+			r.PayloadString([]byte("DEFAULT"))
+			return nil
+		}
+		r.PayloadString([]byte(CONSISTENCY_LEVEL_TEXT[q.c.consistency]))
+	case 2:
+		if strings.EqualFold(args[1], "default") {
+			q.c.consistency = 0
+			r.OK()
+			return nil
+		}
+		level, err := parseConsistencyLevel(args[1])
+		if err != nil {
+			return err
+		}
+		q.c.consistency = level
+		r.OK()
+	default:
+		return fmt.Errorf("wrong number of arguments for 'client consistency' command")
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	storagePkg "github.com/bjorand/velocidb/storage"
+)
+
+func TestConsistencyPolicies(t *testing.T) {
+	suites := []struct {
+		level, n int
+		expected int
+	}{
+		{CONSISTENCY_ONE, 3, 1},
+		{CONSISTENCY_QUORUM, 3, 2},
+		{CONSISTENCY_QUORUM, 4, 3},
+		{CONSISTENCY_ALL, 3, 3},
+	}
+	for _, s := range suites {
+		if output := requiredAcks(s.level, s.n); s.expected != output {
+			t.Errorf("%s of %d: want %+v, got %+v", CONSISTENCY_LEVEL_TEXT[s.level], s.n, s.expected, output)
+		}
+	}
+
+	client := setup()
+	for _, input := range []string{
+		"consistency set user: QUORUM",
+		"consistency set user:admin: all",
+	} {
+		if output := <-executeAsync(client, input); output != "+OK\r\n" {
+			t.Errorf("want %q, got %q", "+OK\r\n", output)
+		}
+	}
+	suites2 := []struct {
+		input    string
+		expected string
+	}{
+		{"consistency get user:1", "+QUORUM\r\n"},
+		{"consistency get user:admin:1", "+ALL\r\n"},
+		{"consistency get session:1", "+ONE\r\n"},
+		{"consistency list", "*2\r\n$12\r\nuser: QUORUM\r\n$15\r\nuser:admin: ALL\r\n"},
+		{"consistency set user: TWO", "ERR invalid consistency level 'TWO', expected ONE, QUORUM or ALL"},
+		{"consistency del user:admin:", ":1\r\n"},
+		{"consistency del user:admin:", ":0\r\n"},
+		{"client consistency", "+DEFAULT\r\n"},
+		{"client consistency all", "+OK\r\n"},
+		{"client consistency", "+ALL\r\n"},
+		{"client consistency default", "+OK\r\n"},
+	}
+	for _, s := range suites2 {
+		if output := <-executeAsync(client, s.input); s.expected != output {
+			t.Errorf("%s: want %q, got %q", s.input, s.expected, output)
+		}
+	}
+
+	// the client level wins over the level of the keys
+	q, _ := client.ParseRawQuery([]byte("set user:1 x"))
+	if output := q.consistencyLevel(); output != CONSISTENCY_QUORUM {
+		t.Errorf("want %+v, got %+v", CONSISTENCY_QUORUM, output)
+	}
+	client.consistency = CONSISTENCY_ONE
+	if output := q.consistencyLevel(); output != CONSISTENCY_ONE {
+		t.Errorf("want %+v, got %+v", CONSISTENCY_ONE, output)
+	}
+}
+
+func TestConsistencyLevels(t *testing.T) {
+	clients := []*VQLClient{setupGossip(), setupGossip(), setupGossip()}
+	peers := []*Peer{}
+	for _, c := range clients {
+		peers = append(peers, c.vqlTCPServer.Peer)
+	}
+	for _, c := range clients[1:] {
+		<-executeAsync(c, fmt.Sprintf("peer connect %s", peers[0].connString()))
+	}
+	for i, c := range clients {
+		for j, p := range peers {
+			if i != j {
+				waitMemberState(c, p.ID, memberAlive)
+			}
+		}
+	}
+
+	// a write acknowledged by ALL peers is readable on every peer right
+	// away
+	<-executeAsync(clients[0], "client consistency all")
+	expected := "+OK\r\n"
+	if output := <-executeAsync(clients[0], "set foo bar"); expected != output {
+		t.Fatalf("want %q, got %q", expected, output)
+	}
+	expected = "$3\r\nbar\r\n"
+	for i, c := range clients {
+		if output := <-executeAsync(c, "get foo"); expected != output {
+			t.Errorf("peer %d: want %q, got %q", i, expected, output)
+		}
+	}
+	// and replicated like the other writes, from the backlog
+	if output := peers[0].backlog.Offset(); output != 1 {
+		t.Errorf("want %+v, got %+v", 1, output)
+	}
+
+	// replicated writes older than the current one are ignored
+	version := storagePkg.Version{Timestamp: time.Now().Add(time.Hour).UnixNano(), Peer: peers[2].ID}
+	peers[2].storage.SetVersion("foo", []byte("latest"), version)
+	<-executeAsync(clients[1], "client consistency quorum")
+	<-executeAsync(clients[1], "set foo stale")
+	if output := string(peers[2].storage.Get("foo")); output != "latest" {
+		t.Errorf("want %+v, got %+v", "latest", output)
+	}
+	// reads from ALL peers return the latest write and repair the peers
+	// which answered an older one
+	expected = "$6\r\nlatest\r\n"
+	if output := <-executeAsync(clients[0], "get foo"); expected != output {
+		t.Errorf("want %q, got %q", expected, output)
+	}
+	for i := 0; i < 100 && string(peers[0].storage.Get("foo"))+string(peers[1].storage.Get("foo")) != "latestlatest"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i, p := range peers {
+		if _, output, _ := p.storage.GetVersion("foo"); output != version {
+			t.Errorf("peer %d: want %+v, got %+v", i, version, output)
+		}
+	}
+	expected = "read_repairs:2"
+	if output := <-executeAsync(clients[0], "info replication"); !strings.Contains(output, expected) {
+		t.Errorf("want %q in %q", expected, output)
+	}
+
+	// a peer which can't be reached fails writes and reads of level ALL,
+	// not of level QUORUM
+	<-executeAsync(clients[0], "peer connect 127.0.0.1:1")
+	for i := 0; i < 50 && len(peers[0].replicas()) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	expected = "NOREPLICAS Not enough peers acknowledged the write: 3 of 4"
+	if output := <-executeAsync(clients[0], "set bar 1"); expected != output {
+		t.Errorf("want %q, got %q", expected, output)
+	}
+	expected = "NOREPLICAS Not enough peers answered the read: 3 of 4"
+	if output := <-executeAsync(clients[0], "get bar"); expected != output {
+		t.Errorf("want %q, got %q", expected, output)
+	}
+	<-executeAsync(clients[0], "client consistency quorum")
+	if output := <-executeAsync(clients[0], "set bar 2"); !strings.HasPrefix(output, "+OK") {
+		t.Errorf("want %q, got %q", "+OK\r\n", output)
+	}
+}
+
+func TestLatestRead(t *testing.T) {
+	older, newer := storagePkg.Version{Timestamp: 1, Peer: "a"}, storagePkg.Version{Timestamp: 2, Peer: "b"}
+	counter := func(peer string, by int64) storagePkg.Item {
+		c := storagePkg.NewPNCounter()
+		c.Add(peer, by)
+		return storagePkg.Item{Key: "k", Type: storagePkg.CRDT_COUNTER, Value: c.Encode()}
+	}
+	suites := []struct {
+		reads    []replicaRead
+		expected string
+	}{
+		{[]replicaRead{{ok: true}, {}}, "false"},
+		{[]replicaRead{
+			{item: storagePkg.Item{Key: "k", Value: []byte("old"), Version: older}, found: true, ok: true},
+			{item: storagePkg.Item{Key: "k", Value: []byte("new"), Version: newer}, found: true, ok: true},
+			{item: storagePkg.Item{Key: "k", Value: []byte("failed"), Version: newer}, found: true},
+		}, "new true"},
+		{[]replicaRead{
+			{item: counter("a", 1), found: true, ok: true},
+			{ok: true},
+			{item: counter("b", 2), found: true, ok: true},
+		}, "3 true"},
+	}
+	for _, s := range suites {
+		latest, found := latestRead(s.reads)
+		output := fmt.Sprint(found)
+		if found {
+			value := latest.Value
+			if latest.Type != "" {
+				c, _ := storagePkg.DecodeCRDT(latest.Type, latest.Value)
+				value = c.Value()
+			}
+			output = fmt.Sprintf("%s %v", value, found)
+		}
+		if output != s.expected {
+			t.Errorf("want %q, got %q", s.expected, output)
+		}
+	}
+}
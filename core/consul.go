@@ -0,0 +1,205 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bjorand/velocidb/utils"
+)
+
+// ConsulDiscovery discovers the peers registered in the Consul catalog with
+// the HTTP API of the local Consul agent. The peer registers itself as an
+// instance of the service with a TCP health check on its peer port, and
+// lists the instances passing their checks with blocking queries: Peers
+// returns once the instances change or after CONSUL_WAIT seconds.
+const (
+	CONSUL_HTTP_ADDR = "127.0.0.1:8500"
+	CONSUL_SERVICE   = "velocidb"
+	// seconds a blocking query waits for a change
+	CONSUL_WAIT = 30
+	// seconds a request waits for an answer, on top of CONSUL_WAIT for the
+	// blocking queries
+	CONSUL_REQUEST_TIMEOUT = 10
+	// health check of the peer
+	CONSUL_CHECK_INTERVAL   = "10s"
+	CONSUL_DEREGISTER_AFTER = "1m"
+)
+
+type ConsulDiscovery struct {
+	// Addr is the address of the Consul agent, Token its ACL token
+	Addr    string
+	Service string
+	Token   string
+	// Wait is how long a blocking query waits for a change
+	Wait   time.Duration
+	client *http.Client
+	mu     sync.Mutex
+	id     string
+	index  uint64
+}
+
+type consulCheck struct {
+	TCP                            string `json:"TCP"`
+	Interval                       string `json:"Interval"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+}
+
+type consulService struct {
+	ID      string       `json:"ID"`
+	Name    string       `json:"Name,omitempty"`
+	Address string       `json:"Address"`
+	Port    int64        `json:"Port"`
+	Check   *consulCheck `json:"Check,omitempty"`
+}
+
+// consulServiceEntry is an instance of a service listed by the health
+// endpoint.
+type consulServiceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service consulService `json:"Service"`
+}
+
+// NewConsulDiscovery returns the discovery of the instances of service
+// registered in the Consul agent at addr.
+func NewConsulDiscovery(addr string, service string, token string) *ConsulDiscovery {
+	if addr == "" {
+		addr = CONSUL_HTTP_ADDR
+	}
+	if service == "" {
+		service = CONSUL_SERVICE
+	}
+	return &ConsulDiscovery{
+		Addr:    addr,
+		Service: service,
+		Token:   token,
+		Wait:    CONSUL_WAIT * time.Second,
+		client:  &http.Client{},
+	}
+}
+
+func (c *ConsulDiscovery) Name() string {
+	return "consul"
+}
+
+func (c *ConsulDiscovery) request(method string, path string, query url.Values, body interface{}, timeout time.Duration) (*http.Response, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	u := url.URL{Scheme: "http", Host: c.Addr, Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	client := *c.client
+	client.Timeout = timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("consul %s %s: %s", method, path, resp.Status)
+	}
+	return resp, nil
+}
+
+// Register registers the peer as an instance of the service, checked by
+// Consul with a TCP connection to its peer port. A peer listening on every
+// interface is registered with the address of the Consul node.
+func (c *ConsulDiscovery) Register(p *Peer) error {
+	host, port, err := utils.SplitHostPort(p.connString())
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = ""
+	}
+	c.mu.Lock()
+	c.id = "velocidb-" + p.ID
+	c.mu.Unlock()
+	service := consulService{
+		ID:      "velocidb-" + p.ID,
+		Name:    c.Service,
+		Address: host,
+		Port:    port,
+		Check: &consulCheck{
+			TCP:                            p.connString(),
+			Interval:                       CONSUL_CHECK_INTERVAL,
+			DeregisterCriticalServiceAfter: CONSUL_DEREGISTER_AFTER,
+		},
+	}
+	resp, err := c.request(http.MethodPut, "/v1/agent/service/register", nil, service, CONSUL_REQUEST_TIMEOUT*time.Second)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *ConsulDiscovery) Deregister(p *Peer) error {
+	resp, err := c.request(http.MethodPut, "/v1/agent/service/deregister/velocidb-"+p.ID, nil, nil, CONSUL_REQUEST_TIMEOUT*time.Second)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Peers returns the addresses of the other instances of the service passing
+// their health checks, once they changed since the last call.
+func (c *ConsulDiscovery) Peers() ([]string, error) {
+	c.mu.Lock()
+	index, id := c.index, c.id
+	c.mu.Unlock()
+	query := url.Values{}
+	query.Set("passing", "true")
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(c.Wait/time.Second)))
+	}
+	resp, err := c.request(http.MethodGet, "/v1/health/service/"+c.Service, query, nil, c.Wait+CONSUL_REQUEST_TIMEOUT*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	entries := []consulServiceEntry{}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+	// the index is reset when it goes backwards
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if next < index {
+		next = 0
+	}
+	c.mu.Lock()
+	c.index = next
+	c.mu.Unlock()
+	addrs := []string{}
+	for _, entry := range entries {
+		if entry.Service.ID == id {
+			continue
+		}
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		addrs = append(addrs, net.JoinHostPort(host, strconv.FormatInt(entry.Service.Port, 10)))
+	}
+	return addrs, nil
+}
@@ -0,0 +1,157 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul is an in-process stand-in for the HTTP API of a Consul agent:
+// it registers services and answers the health endpoint with the instances
+// passing their checks, blocking the queries until the index changes.
+type fakeConsul struct {
+	mu       sync.Mutex
+	index    uint64
+	changed  chan struct{}
+	services map[string]consulService
+	critical map[string]bool
+	tokens   []string
+}
+
+func newFakeConsul() (*fakeConsul, *httptest.Server) {
+	f := &fakeConsul{
+		index:    1,
+		changed:  make(chan struct{}),
+		services: make(map[string]consulService),
+		critical: make(map[string]bool),
+	}
+	return f, httptest.NewServer(f)
+}
+
+// update changes the catalog and wakes the blocking queries up.
+func (f *fakeConsul) update(change func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	change()
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) register(s consulService) {
+	f.update(func() { f.services[s.ID] = s })
+}
+
+func (f *fakeConsul) setCritical(id string, critical bool) {
+	f.update(func() { f.critical[id] = critical })
+}
+
+func (f *fakeConsul) registered(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.services[id]
+	return ok
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.tokens = append(f.tokens, r.Header.Get("X-Consul-Token"))
+	f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/agent/service/register":
+		s := consulService{}
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil || s.Check == nil {
+			http.Error(w, "invalid service", http.StatusBadRequest)
+			return
+		}
+		f.register(s)
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+		f.update(func() { delete(f.services, id) })
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/health/service/"):
+		name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+		index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+		wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+		f.mu.Lock()
+		if index >= f.index {
+			changed := f.changed
+			f.mu.Unlock()
+			select {
+			case <-changed:
+			case <-time.After(wait):
+			}
+			f.mu.Lock()
+		}
+		entries := []consulServiceEntry{}
+		for id, s := range f.services {
+			if s.Name == name && !f.critical[id] {
+				entry := consulServiceEntry{Service: s}
+				entry.Node.Address = "127.0.0.1"
+				entries = append(entries, entry)
+			}
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(entries)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestConsulDiscovery(t *testing.T) {
+	f, server := newFakeConsul()
+	defer server.Close()
+	client1, client2 := setupGossip(), setupGossip()
+	p1, p2 := client1.vqlTCPServer.Peer, client2.vqlTCPServer.Peer
+
+	d := NewConsulDiscovery(server.Listener.Addr().String(), "", "secret")
+	d.Wait = time.Second
+	if err := p1.StartDiscovery(d); err != nil {
+		t.Fatal(err)
+	}
+	if !f.registered("velocidb-" + p1.ID) {
+		t.Fatalf("want %s registered", p1.ID)
+	}
+	// the peer links with the instances which appear
+	f.register(consulService{ID: "velocidb-" + p2.ID, Name: CONSUL_SERVICE, Port: p2.tcpServer.Port(), Check: &consulCheck{}})
+	var link *Peer
+	for i := 0; i < 100 && (link == nil || !link.Ready()); i++ {
+		time.Sleep(20 * time.Millisecond)
+		link = p1.Mesh.GetPeerByKey(p2.connString())
+	}
+	if link == nil || !link.Ready() {
+		t.Fatalf("want a link with %s", p2.connString())
+	}
+	output := <-executeAsync(client1, "info peer")
+	for _, e := range []string{"discovery:consul", "discovery_status:ok", "discovered_links:1"} {
+		if !strings.Contains(output, e) {
+			t.Errorf("want %q in %q", e, output)
+		}
+	}
+
+	// and removes the links with the instances failing their checks
+	f.setCritical("velocidb-"+p2.ID, true)
+	for i := 0; i < 100 && !link.Removed(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !link.Removed() {
+		t.Errorf("want the link with %s removed", p2.connString())
+	}
+
+	if err := p1.StopDiscovery(); err != nil {
+		t.Fatal(err)
+	}
+	if f.registered("velocidb-" + p1.ID) {
+		t.Errorf("want %s deregistered", p1.ID)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if output := f.tokens[0]; output != "secret" {
+		t.Errorf("want %+v, got %+v", "secret", output)
+	}
+}
@@ -0,0 +1,191 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	storagePkg "github.com/bjorand/velocidb/storage"
+)
+
+// Strings are last-write-wins registers: their writes are versioned by the
+// hybrid logical clock of the peers, the latest one wins. The keys matching
+// a COUNTER prefix hold PN-counters updated with INCR and DECR, and the set
+// commands write OR-sets, CRDTs which converge whatever the order the
+// writes are received in. The writes of a CRDT are replicated as the delta
+// of its state, merged on the other peers:
+//
+//	CRDT MERGE <key> <type> <state>
+//
+// Full syncs and migrations merge the CRDTs too, so that peers which wrote
+// during a network split converge once linked again.
+const (
+	CRDT_MODE_REGISTER = 1 + iota
+	CRDT_MODE_COUNTER
+)
+
+var (
+	CRDT_MODE_TEXT = map[int]string{
+		CRDT_MODE_REGISTER: "REGISTER",
+		CRDT_MODE_COUNTER:  "COUNTER",
+	}
+)
+
+func parseCRDTMode(s string) (int, error) {
+	for mode, text := range CRDT_MODE_TEXT {
+		if strings.EqualFold(s, text) {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("ERR invalid CRDT mode '%s', expected REGISTER or COUNTER", s)
+}
+
+// isCounter reports whether INCR and DECR update the PN-counter of a key: it
+// holds one already or matches a COUNTER prefix.
+func (q *Query) isCounter(key string) bool {
+	return q.p.storage.Type(key) == storagePkg.CRDT_COUNTER || q.p.crdtModes.Lookup(key) == CRDT_MODE_COUNTER
+}
+
+// counterAdd adds by to the PN-counter of a key, counted for the peer which
+// received the write.
+func (q *Query) counterAdd(key string, by int64) ([]byte, error) {
+	v, delta, err := q.p.storage.CounterAdd(key, q.writeVersion(key).Peer, by)
+	if err != nil {
+		return nil, err
+	}
+	q.replicateDelta(key, delta)
+	return v, nil
+}
+
+// replicateDelta replaces the query with the CRDT MERGE of the delta of a
+// key, written to the WAL and replicated instead of the query.
+func (q *Query) replicateDelta(key string, delta storagePkg.CRDT) {
+	q.parsed = [][]byte{[]byte("crdt"), []byte("merge"), []byte(key), []byte(delta.Type()), delta.Encode()}
+	q.raw = formattedArray(q.parsed)
+}
+
+// crdtMerge answers CRDT MERGE.
+func (q *Query) crdtMerge(r *Response, args []string) error {
+	if len(args) != 4 {
+		return fmt.Errorf("wrong number of arguments for 'crdt merge' command")
+	}
+	c, err := storagePkg.DecodeCRDT(args[2], []byte(args[3]))
+	if err != nil {
+		return err
+	}
+	if err := q.p.storage.MergeCRDT(args[1], c); err != nil {
+		return err
+	}
+	q.p.notifyKeyspaceEvent(notifyGeneric, "merge", args[1])
+	q.WalWrite()
+	r.OK()
+	return nil
+}
+
+func (q *Query) crdtCommand(r *Response, args []string) error {
+	switch strings.ToLower(args[0]) {
+	case "set":
+		if len(args) != 3 {
+			return fmt.Errorf("wrong number of arguments for 'crdt set' command")
+		}
+		mode, err := parseCRDTMode(args[2])
+		if err != nil {
+			return err
+		}
+		q.p.crdtModes.Set(args[1], mode)
+		r.OK()
+	case "del":
+		if len(args) != 2 {
+			return fmt.Errorf("wrong number of arguments for 'crdt del' command")
+		}
+		r.PayloadString([]byte(boolToInteger(q.p.crdtModes.Del(args[1]))))
+		r.Type = typeInteger
+	case "get":
+		if len(args) != 2 {
+			return fmt.Errorf("wrong number of arguments for 'crdt get' command")
+		}
+		mode := q.p.crdtModes.Lookup(args[1])
+		if mode == 0 {
+			mode = CRDT_MODE_REGISTER
+		}
+		r.PayloadString([]byte(CRDT_MODE_TEXT[mode]))
+	case "list":
+		r.Type = typeArray
+		r.Payload = [][]byte{}
+		for _, policy := range q.p.crdtModes.List() {
+			r.Payload = append(r.Payload, []byte(policy))
+		}
+	case "merge":
+		return q.crdtMerge(r, args)
+	default:
+		return fmt.Errorf("ERR unknown command 'crdt %s'", args[0])
+	}
+	return nil
+}
+
+// setAdd answers SADD.
+func (q *Query) setAdd(r *Response, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("wrong number of arguments for 'sadd' command")
+	}
+	// the tag of the members is the version of the write, unique to it
+	added, delta, err := q.p.storage.SetAdd(args[0], q.writeVersion(args[0]).String(), args[1:]...)
+	if err != nil {
+		return err
+	}
+	q.replicateDelta(args[0], delta)
+	q.p.notifyKeyspaceEvent(notifySet, "sadd", args[0])
+	q.WalWrite()
+	r.PayloadString([]byte(strconv.Itoa(added)))
+	r.Type = typeInteger
+	return nil
+}
+
+// setRemove answers SREM.
+func (q *Query) setRemove(r *Response, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("wrong number of arguments for 'srem' command")
+	}
+	removed, delta, err := q.p.storage.SetRemove(args[0], args[1:]...)
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		q.replicateDelta(args[0], delta)
+		q.p.notifyKeyspaceEvent(notifySet, "srem", args[0])
+		q.WalWrite()
+	}
+	r.PayloadString([]byte(strconv.Itoa(removed)))
+	r.Type = typeInteger
+	return nil
+}
+
+// setRead answers SMEMBERS, SISMEMBER and SCARD.
+func (q *Query) setRead(r *Response, verb string, args []string) error {
+	expected := 1
+	if verb == "sismember" {
+		expected = 2
+	}
+	if len(args) != expected {
+		return fmt.Errorf("wrong number of arguments for '%s' command", verb)
+	}
+	members, err := q.p.storage.SetMembers(args[0])
+	if err != nil {
+		return err
+	}
+	switch verb {
+	case "smembers":
+		r.Type = typeArray
+		r.Payload = [][]byte{}
+		for _, member := range members {
+			r.Payload = append(r.Payload, []byte(member))
+		}
+	case "sismember":
+		r.PayloadString([]byte(boolToInteger(stringInSlice(args[1], members))))
+		r.Type = typeInteger
+	case "scard":
+		r.PayloadString([]byte(strconv.Itoa(len(members))))
+		r.Type = typeInteger
+	}
+	return nil
+}
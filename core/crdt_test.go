@@ -0,0 +1,113 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	storagePkg "github.com/bjorand/velocidb/storage"
+)
+
+func TestCRDTCommand(t *testing.T) {
+	client := setup()
+	suites := []struct {
+		input    string
+		expected string
+	}{
+		{"crdt get hits:1", "+REGISTER\r\n"},
+		{"crdt set hits: counter", "+OK\r\n"},
+		{"crdt set hits:raw register", "+OK\r\n"},
+		{"crdt set x gset", "ERR invalid CRDT mode 'gset', expected REGISTER or COUNTER"},
+		{"crdt get hits:1", "+COUNTER\r\n"},
+		{"crdt get hits:raw:1", "+REGISTER\r\n"},
+		{"crdt list", "*2\r\n$13\r\nhits: COUNTER\r\n$17\r\nhits:raw REGISTER\r\n"},
+		{"set hits:1 10", "+OK\r\n"},
+		{"incr hits:1", ":11\r\n"},
+		{"decr hits:1", ":10\r\n"},
+		{"type hits:1", "+string\r\n"},
+		{"sadd tags a b a", ":2\r\n"},
+		{"sadd tags c", ":1\r\n"},
+		{"srem tags b d", ":1\r\n"},
+		{"smembers tags", "*2\r\n$1\r\na\r\n$1\r\nc\r\n"},
+		{"sismember tags a", ":1\r\n"},
+		{"sismember tags b", ":0\r\n"},
+		{"scard tags", ":2\r\n"},
+		{"scard missing", ":0\r\n"},
+		{"type tags", "+set\r\n"},
+		{"type missing", "+none\r\n"},
+		{"get tags", storagePkg.ErrWrongType.Error()},
+		{"incr tags", storagePkg.ErrWrongType.Error()},
+		{"sadd hits:1 a", storagePkg.ErrWrongType.Error()},
+		{"crdt del hits:", ":1\r\n"},
+		{"crdt del hits:", ":0\r\n"},
+	}
+	for _, s := range suites {
+		if output := <-executeAsync(client, s.input); output != s.expected {
+			t.Errorf("%s: want %q, got %q", s.input, s.expected, output)
+		}
+	}
+	// hits:1 is still a counter
+	if output := <-executeAsync(client, "incr hits:1"); output != ":11\r\n" {
+		t.Errorf("want %q, got %q", ":11\r\n", output)
+	}
+}
+
+func TestCRDTReplicatedDelta(t *testing.T) {
+	client := setup()
+	<-executeAsync(client, "crdt set c counter")
+	q, _ := client.ParseRawQuery([]byte("incr c"))
+	if _, err := q.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	// the delta is replicated instead of the query, and merged once
+	expected := "crdt merge c counter"
+	if output := string(bytes.Join(q.parsed[:4], []byte(" "))); output != expected {
+		t.Fatalf("want %q, got %q", expected, output)
+	}
+	o := setup()
+	for i := 0; i < 2; i++ {
+		rq, err := o.ParseRawQuery(q.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rq.FromPeer = true
+		if _, err := rq.Execute(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if output := <-executeAsync(o, "get c"); output != "$1\r\n1\r\n" {
+		t.Errorf("want %q, got %q", "$1\r\n1\r\n", output)
+	}
+}
+
+func TestCRDTMergeOnReconnect(t *testing.T) {
+	clients := []*VQLClient{setupGossip(), setupGossip()}
+	// the peers write while they are not linked
+	for i, client := range clients {
+		<-executeAsync(client, "crdt set hits counter")
+		for j := 0; j <= i; j++ {
+			<-executeAsync(client, "incr hits")
+		}
+		<-executeAsync(client, "sadd tags common")
+		<-executeAsync(client, "sadd tags only"+string(rune('a'+i)))
+	}
+	<-executeAsync(clients[0], "srem tags common")
+
+	<-executeAsync(clients[1], "peer connect "+clients[0].vqlTCPServer.Peer.connString())
+	// the addition of common by the second peer was concurrent with its
+	// removal by the first one
+	expected := "$1\r\n3\r\n*3\r\n$6\r\ncommon\r\n$5\r\nonlya\r\n$5\r\nonlyb\r\n"
+	for _, client := range clients {
+		var output string
+		for i := 0; i < 100; i++ {
+			output = <-executeAsync(client, "get hits") + <-executeAsync(client, "smembers tags")
+			if output == expected {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if output != expected {
+			t.Errorf("want %q, got %q", expected, output)
+		}
+	}
+}
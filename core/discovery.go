@@ -0,0 +1,200 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bjorand/velocidb/utils"
+)
+
+// A peer started with a discovery service registers itself in it and links
+// with the peers it lists: it connects to the peers which appear and
+// removes the links it made with the peers which disappear. Discovery
+// implementations may block in Peers until the list changes, the peer
+// waits DISCOVERY_INTERVAL between two calls and DISCOVERY_RETRY_INTERVAL
+// after an error.
+const (
+	// milliseconds
+	DISCOVERY_INTERVAL       = 1000
+	DISCOVERY_RETRY_INTERVAL = 5000
+)
+
+// Discovery finds the peers of the cluster.
+type Discovery interface {
+	// Name names the discovery service in INFO
+	Name() string
+	// Register announces the peer to the discovery service
+	Register(p *Peer) error
+	// Deregister removes the peer from the discovery service
+	Deregister(p *Peer) error
+	// Peers returns the addresses of the other peers, host:port
+	Peers() ([]string, error)
+}
+
+// discoveryLoop links the peer with the peers of a discovery service until
+// it is stopped.
+type discoveryLoop struct {
+	d        Discovery
+	stop     chan struct{}
+	interval time.Duration
+	retry    time.Duration
+	mu       sync.Mutex
+	// links are the links made with the discovered peers by address
+	links map[string]*Peer
+	err   error
+}
+
+func newDiscoveryLoop(d Discovery) *discoveryLoop {
+	return &discoveryLoop{
+		d:        d,
+		stop:     make(chan struct{}),
+		interval: DISCOVERY_INTERVAL * time.Millisecond,
+		retry:    DISCOVERY_RETRY_INTERVAL * time.Millisecond,
+		links:    make(map[string]*Peer),
+	}
+}
+
+// StartDiscovery registers the peer in a discovery service and links it
+// with the peers it finds.
+func (p *Peer) StartDiscovery(d Discovery) error {
+	return p.startDiscovery(newDiscoveryLoop(d))
+}
+
+func (p *Peer) startDiscovery(l *discoveryLoop) error {
+	if err := l.d.Register(p); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.discovery = l
+	p.mu.Unlock()
+	go p.discover(l)
+	return nil
+}
+
+// StopDiscovery stops linking with the discovered peers and deregisters the
+// peer. The links already made are kept.
+func (p *Peer) StopDiscovery() error {
+	p.mu.Lock()
+	l := p.discovery
+	p.discovery = nil
+	p.mu.Unlock()
+	if l == nil {
+		return nil
+	}
+	close(l.stop)
+	return l.d.Deregister(p)
+}
+
+func (p *Peer) discover(l *discoveryLoop) {
+	for {
+		addrs, err := l.d.Peers()
+		delay := l.interval
+		l.mu.Lock()
+		l.err = err
+		l.mu.Unlock()
+		if err != nil {
+			fmt.Printf("[discovery %s] Unable to list peers: %s\n", l.d.Name(), err)
+			delay = l.retry
+		}
+		select {
+		case <-l.stop:
+			return
+		default:
+		}
+		if err == nil {
+			p.linkDiscovered(l, addrs)
+		}
+		select {
+		case <-l.stop:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// linkDiscovered connects to the discovered peers the peer is not linked
+// with, again when the link made with them was removed, and removes the
+// links made with the peers which are not listed anymore.
+func (p *Peer) linkDiscovered(l *discoveryLoop, addrs []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	listed := make(map[string]bool)
+	for _, addr := range addrs {
+		listed[addr] = true
+		if link := l.links[addr]; link != nil && link.Removed() {
+			// the link was removed since, with PEER REMOVE or by gossip
+			delete(l.links, addr)
+		}
+		if p.isSelf(addr) || l.links[addr] != nil || p.Mesh.GetPeerByKey(addr) != nil {
+			continue
+		}
+		link, err := p.ConnectToPeerAddr(addr)
+		if err != nil {
+			fmt.Printf("[discovery %s] Invalid peer address %s: %s\n", l.d.Name(), addr, err)
+			continue
+		}
+		l.links[addr] = link
+	}
+	for addr, link := range l.links {
+		if !listed[addr] {
+			p.RemovePeer(link)
+			delete(l.links, addr)
+		}
+	}
+}
+
+// isSelf reports whether addr is the address of the peer: its listen
+// address, or an address of its host on its port when it listens on every
+// interface.
+func (p *Peer) isSelf(addr string) bool {
+	if addr == p.connString() {
+		return true
+	}
+	host, port, err := utils.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	listen, listenPort, err := utils.SplitHostPort(p.connString())
+	if err != nil || port != listenPort {
+		return false
+	}
+	if ip := net.ParseIP(listen); ip == nil || !ip.IsUnspecified() {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func infoDiscovery(p *Peer) []string {
+	p.mu.RLock()
+	l := p.discovery
+	p.mu.RUnlock()
+	if l == nil {
+		return []string{"discovery:none"}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	status := "ok"
+	if l.err != nil {
+		status = l.err.Error()
+	}
+	return []string{
+		fmt.Sprintf("discovery:%s", l.d.Name()),
+		fmt.Sprintf("discovery_status:%s", status),
+		fmt.Sprintf("discovered_links:%d", len(l.links)),
+	}
+}
@@ -0,0 +1,98 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DNSDiscovery discovers the peers published in DNS, like the pods of a
+// Kubernetes headless service. Without port, the name is looked up as SRV
+// records, each giving the port of a peer and a target whose addresses are
+// looked up; with a port, the name is looked up as A/AAAA records, one
+// address per peer. Peers do not register: the records are managed by the
+// DNS server.
+const (
+	// seconds a lookup waits for the DNS server
+	DNS_LOOKUP_TIMEOUT = 5
+)
+
+type DNSDiscovery struct {
+	Host string
+	Port int64
+	// Resolver looks the records up, net.DefaultResolver by default
+	Resolver *net.Resolver
+}
+
+// NewDNSDiscovery returns the discovery of the peers published as the SRV
+// records of host, or as its addresses when port is not 0.
+func NewDNSDiscovery(host string, port int64) *DNSDiscovery {
+	return &DNSDiscovery{
+		Host:     host,
+		Port:     port,
+		Resolver: net.DefaultResolver,
+	}
+}
+
+func (d *DNSDiscovery) Name() string {
+	if d.Port == 0 {
+		return "dns-srv"
+	}
+	return "dns"
+}
+
+func (d *DNSDiscovery) Register(p *Peer) error {
+	return nil
+}
+
+func (d *DNSDiscovery) Deregister(p *Peer) error {
+	return nil
+}
+
+// Peers returns the addresses of the peers published in DNS, sorted. The
+// SRV targets which cannot be looked up are skipped, unless none can.
+func (d *DNSDiscovery) Peers() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DNS_LOOKUP_TIMEOUT*time.Second)
+	defer cancel()
+	if d.Port != 0 {
+		ips, err := d.Resolver.LookupHost(ctx, d.Host)
+		if err != nil {
+			return nil, err
+		}
+		addrs := joinHostsPort(ips, d.Port)
+		sort.Strings(addrs)
+		return addrs, nil
+	}
+	_, records, err := d.Resolver.LookupSRV(ctx, "", "", d.Host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []string{}
+	var lookupErr error
+	for _, srv := range records {
+		ips, err := d.Resolver.LookupHost(ctx, srv.Target)
+		if err != nil {
+			// the other targets are still linked with
+			lookupErr = fmt.Errorf("SRV target %s: %s", srv.Target, err)
+			fmt.Printf("[discovery %s] Unable to look up %s\n", d.Name(), lookupErr)
+			continue
+		}
+		addrs = append(addrs, joinHostsPort(ips, int64(srv.Port))...)
+	}
+	if len(addrs) == 0 && lookupErr != nil {
+		// the links are kept while no target can be looked up
+		return nil, lookupErr
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+func joinHostsPort(hosts []string, port int64) (addrs []string) {
+	for _, host := range hosts {
+		addrs = append(addrs, net.JoinHostPort(host, strconv.FormatInt(port, 10)))
+	}
+	return addrs
+}
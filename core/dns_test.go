@@ -0,0 +1,200 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	dnsTypeA   = 1
+	dnsTypeSRV = 33
+)
+
+// dnsStub is a local DNS server answering the A and SRV records it holds,
+// and no record for the other questions.
+type dnsStub struct {
+	mu   sync.Mutex
+	conn net.PacketConn
+	a    map[string]net.IP
+	srv  map[string][]net.SRV
+}
+
+func newDNSStub() *dnsStub {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s := &dnsStub{conn: conn, a: make(map[string]net.IP), srv: make(map[string][]net.SRV)}
+	go s.serve()
+	return s
+}
+
+// resolver returns a resolver sending its queries to the stub.
+func (s *dnsStub) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return net.Dial("udp4", s.conn.LocalAddr().String())
+		},
+	}
+}
+
+func (s *dnsStub) setSRV(name string, records []net.SRV) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.srv[name] = records
+}
+
+func dnsName(name string) (data []byte) {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		data = append(data, byte(len(label)))
+		data = append(data, label...)
+	}
+	return append(data, 0)
+}
+
+func (s *dnsStub) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if reply := s.answer(buf[:n]); reply != nil {
+			s.conn.WriteTo(reply, addr)
+		}
+	}
+}
+
+func (s *dnsStub) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	labels := []string{}
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		end := i + 1 + int(query[i])
+		if end > len(query) {
+			return nil
+		}
+		labels = append(labels, strings.ToLower(string(query[i+1:end])))
+		i = end
+	}
+	if i+5 > len(query) {
+		return nil
+	}
+	name := strings.Join(labels, ".") + "."
+	qtype := binary.BigEndian.Uint16(query[i+1:])
+	question := query[12 : i+5]
+
+	s.mu.Lock()
+	rdatas := [][]byte{}
+	switch qtype {
+	case dnsTypeA:
+		if ip := s.a[name]; ip != nil {
+			rdatas = append(rdatas, ip.To4())
+		}
+	case dnsTypeSRV:
+		for _, srv := range s.srv[name] {
+			rdata := make([]byte, 6)
+			binary.BigEndian.PutUint16(rdata[0:], srv.Priority)
+			binary.BigEndian.PutUint16(rdata[2:], srv.Weight)
+			binary.BigEndian.PutUint16(rdata[4:], srv.Port)
+			rdatas = append(rdatas, append(rdata, dnsName(srv.Target)...))
+		}
+	}
+	s.mu.Unlock()
+
+	reply := make([]byte, 12)
+	copy(reply, query[:2])
+	binary.BigEndian.PutUint16(reply[2:], 0x8180)
+	binary.BigEndian.PutUint16(reply[4:], 1)
+	binary.BigEndian.PutUint16(reply[6:], uint16(len(rdatas)))
+	reply = append(reply, question...)
+	for _, rdata := range rdatas {
+		rr := make([]byte, 12)
+		// the name points to the question
+		binary.BigEndian.PutUint16(rr[0:], 0xc00c)
+		binary.BigEndian.PutUint16(rr[2:], qtype)
+		binary.BigEndian.PutUint16(rr[4:], 1)
+		binary.BigEndian.PutUint32(rr[6:], 60)
+		binary.BigEndian.PutUint16(rr[10:], uint16(len(rdata)))
+		reply = append(append(reply, rr...), rdata...)
+	}
+	return reply
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	stub := newDNSStub()
+	defer stub.conn.Close()
+	client1, client2 := setupGossip(), setupGossip()
+	p1, p2 := client1.vqlTCPServer.Peer, client2.vqlTCPServer.Peer
+	stub.a["velocidb.test."] = net.IPv4(127, 0, 0, 1)
+	stub.a["peer1.velocidb.test."] = net.IPv4(127, 0, 0, 1)
+	stub.a["peer2.velocidb.test."] = net.IPv4(127, 0, 0, 1)
+	stub.setSRV("_peer._tcp.velocidb.test.", []net.SRV{
+		{Target: "peer1.velocidb.test.", Port: uint16(p1.tcpServer.Port())},
+		{Target: "peer2.velocidb.test.", Port: uint16(p2.tcpServer.Port())},
+	})
+
+	d := NewDNSDiscovery("velocidb.test.", 7000)
+	d.Resolver = stub.resolver()
+	addrs, err := d.Peers()
+	if output := fmt.Sprint(addrs, err); output != "[127.0.0.1:7000] <nil>" {
+		t.Errorf("want %+v, got %+v", "[127.0.0.1:7000] <nil>", output)
+	}
+
+	// the SRV targets which cannot be looked up are skipped
+	d = NewDNSDiscovery("_peer._tcp.velocidb.test.", 0)
+	d.Resolver = stub.resolver()
+	stub.setSRV("_peer._tcp.velocidb.test.", []net.SRV{
+		{Target: "peer1.velocidb.test.", Port: uint16(p1.tcpServer.Port())},
+		{Target: "peer3.velocidb.test.", Port: 7000},
+	})
+	addrs, err = d.Peers()
+	expected := fmt.Sprintf("[%s] <nil>", p1.connString())
+	if output := fmt.Sprint(addrs, err); output != expected {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+	stub.setSRV("_peer._tcp.velocidb.test.", []net.SRV{{Target: "peer3.velocidb.test.", Port: 7000}})
+	if _, err := d.Peers(); err == nil {
+		t.Errorf("want an error when no target can be looked up")
+	}
+
+	// the peer links with the targets of the SRV records but itself
+	stub.setSRV("_peer._tcp.velocidb.test.", []net.SRV{
+		{Target: "peer1.velocidb.test.", Port: uint16(p1.tcpServer.Port())},
+		{Target: "peer2.velocidb.test.", Port: uint16(p2.tcpServer.Port())},
+	})
+	if err := p1.StartDiscovery(d); err != nil {
+		t.Fatal(err)
+	}
+	defer p1.StopDiscovery()
+	var link *Peer
+	for i := 0; i < 100 && (link == nil || !link.Ready()); i++ {
+		time.Sleep(20 * time.Millisecond)
+		link = p1.Mesh.GetPeerByKey(p2.connString())
+	}
+	if link == nil || !link.Ready() {
+		t.Fatalf("want a link with %s", p2.connString())
+	}
+	expected = "discovery:dns-srv\r\ndiscovery_status:ok\r\ndiscovered_links:1"
+	if output := <-executeAsync(client1, "info peer"); !strings.Contains(output, expected) {
+		t.Errorf("want %q in %q", expected, output)
+	}
+
+	// and removes the link once its record is removed
+	stub.setSRV("_peer._tcp.velocidb.test.", []net.SRV{{Target: "peer1.velocidb.test.", Port: uint16(p1.tcpServer.Port())}})
+	for i := 0; i < 150 && !link.Removed(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !link.Removed() {
+		t.Errorf("want the link with %s removed", p2.connString())
+	}
+}
@@ -0,0 +1,343 @@
+package core
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A replica which has no link ready with its primary for FAILOVER_TIMEOUT
+// milliseconds starts an election, after a random delay so that replicas do
+// not all start one at once. It asks the other peers of the mesh for their
+// vote in a new epoch with PEER VOTE, and is promoted once a majority of the
+// peers, itself included and the failed primary excluded, voted for it. A
+// peer votes once per epoch, for a replica of a primary it has no link ready
+// with either and which received at least the writes it received from that
+// primary. The promoted replica announces the epoch with PEER PROMOTED to
+// every peer, and every peer announces the last promotion it knows to the
+// peers it links with later: the replicas of the failed primary replicate
+// it, the failed primary and the peers promoted in an older epoch become its
+// replicas. Failover events are published on FAILOVER_CHANNEL.
+//
+// The epoch fences the failed primary. Writes are replicated with the epoch
+// of the peer which received them from their client, and the sync requests
+// carry the epoch of the requesting peer: a peer rejects the writes of an
+// older epoch, and does not serve the syncs requested from a newer one. A
+// primary which has no link ready with a majority of its replicas may have
+// been replaced meanwhile, it refuses the writes of its clients with
+// NOREPLICAS until it links with them again. A primary knows its replicas
+// without asking the peers: the peers announce the ID of their primary in
+// their HELLO, and with a ROLE sync message when it changes.
+//
+//	PEER VOTE <epoch> <primary-addr> <primary-id> <offset>
+//	PEER PROMOTED <epoch> <addr> <failed-primary-addr>
+//	ROLE [<primary-id>]                 announces the primary of the peer
+const (
+	// milliseconds without link with the primary before an election, 0
+	// disables failover
+	FAILOVER_TIMEOUT = 5000
+	// milliseconds between two checks of the link with the primary
+	FAILOVER_CHECK_INTERVAL = 100
+	FAILOVER_CHANNEL        = "__failover__"
+)
+
+// notifyFailover publishes a failover event to the local subscribers of
+// FAILOVER_CHANNEL.
+func (p *Peer) notifyFailover(event string, args ...string) {
+	p.pubsub.Publish(FAILOVER_CHANNEL, []byte(strings.Join(append([]string{event}, args...), " ")))
+}
+
+// electionDelay returns how long a replica waits before an election: the
+// failover timeout and a random jitter of up to half of it.
+func electionDelay(timeout int64) time.Duration {
+	return time.Duration(timeout+rand.Int63n(timeout/2+1)) * time.Millisecond
+}
+
+func (p *Peer) failoverCycle() {
+	ticker := time.NewTicker(FAILOVER_CHECK_INTERVAL * time.Millisecond)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		p.checkPrimary(now)
+		p.announceRole()
+		p.checkReplicas()
+	}
+}
+
+// checkPrimary starts an election when the link with the primary of the
+// peer is down since the election delay.
+func (p *Peer) checkPrimary(now time.Time) {
+	primary := p.role.Primary()
+	timeout := atomic.LoadInt64(&p.role.timeout)
+	if primary == "" || timeout == 0 || p.Leaving() {
+		return
+	}
+	link := p.primaryLink()
+	p.role.mu.Lock()
+	if link != nil && link.Ready() {
+		p.role.primaryID = link.remoteID()
+		p.role.electAt = time.Time{}
+		p.role.mu.Unlock()
+		return
+	}
+	if p.role.electAt.IsZero() {
+		p.role.electAt = now.Add(electionDelay(timeout))
+	}
+	due := !now.Before(p.role.electAt)
+	p.role.mu.Unlock()
+	if !due {
+		return
+	}
+	if !p.elect(primary) {
+		p.role.mu.Lock()
+		if p.role.primary == primary {
+			p.role.electAt = time.Now().Add(electionDelay(timeout))
+		}
+		p.role.mu.Unlock()
+	}
+}
+
+// checkReplicas refreshes the replicas of a primary from the roles the
+// peers announced, and fences it while it has no link ready with a majority
+// of them. A replica is forgotten once it announces it replicates another
+// peer, or that it left the cluster.
+func (p *Peer) checkReplicas() {
+	if p.role.Primary() != "" || atomic.LoadInt64(&p.role.timeout) == 0 {
+		p.role.mu.Lock()
+		p.role.replicaIDs, p.role.fenced = nil, false
+		p.role.mu.Unlock()
+		return
+	}
+	// the role of the peers linked is known, the last one announced is
+	// kept for the others
+	ready := make(map[string]bool)
+	for _, link := range p.Mesh.List() {
+		if link.Ready() {
+			ready[link.remoteID()] = link.remotePrimaryID() == p.ID
+		}
+	}
+	p.role.mu.Lock()
+	defer p.role.mu.Unlock()
+	if p.role.replicaIDs == nil {
+		p.role.replicaIDs = make(map[string]bool)
+	}
+	for id, replica := range ready {
+		if replica {
+			p.role.replicaIDs[id] = true
+		} else {
+			delete(p.role.replicaIDs, id)
+		}
+	}
+	linked := 0
+	for id := range p.role.replicaIDs {
+		switch {
+		case p.gossip.hasLeft(id):
+			delete(p.role.replicaIDs, id)
+		case ready[id]:
+			linked++
+		}
+	}
+	fenced := len(p.role.replicaIDs) > 0 && linked*2 <= len(p.role.replicaIDs)
+	if fenced != p.role.fenced {
+		if fenced {
+			fmt.Printf("[peer] Fenced: %d replicas of %d linked\n", linked, len(p.role.replicaIDs))
+		} else {
+			fmt.Println("[peer] Not fenced anymore")
+		}
+	}
+	p.role.fenced = fenced
+}
+
+// elect asks the peers of the mesh for their vote to replace primary, and
+// promotes the peer when a majority voted for it.
+func (p *Peer) elect(primary string) bool {
+	p.role.mu.Lock()
+	epoch := p.role.epoch + 1
+	if p.role.lastVote >= epoch {
+		epoch = p.role.lastVote + 1
+	}
+	p.role.lastVote = epoch
+	primaryID := p.role.primaryID
+	p.role.mu.Unlock()
+	offset := p.replOffset(primaryID)
+	p.notifyFailover("try-failover", strconv.FormatInt(epoch, 10), primary)
+
+	voters := []*Peer{}
+	for _, link := range p.replicas() {
+		if link.Key() == primary || (primaryID != "" && link.remoteID() == primaryID) {
+			continue
+		}
+		voters = append(voters, link)
+	}
+	quorum := (len(voters)+1)/2 + 1
+	query := formattedArray([][]byte{
+		[]byte("peer"), []byte("vote"),
+		[]byte(strconv.FormatInt(epoch, 10)),
+		[]byte(primary),
+		[]byte(primaryID),
+		[]byte(strconv.FormatInt(offset, 10)),
+	})
+	granted := make(chan bool, len(voters))
+	for _, link := range voters {
+		go func(link *Peer) {
+			if !link.Ready() {
+				granted <- false
+				return
+			}
+			resp, err := p.RemoteExecute(link, NewSimpleQuery(string(query)))
+			granted <- err == nil && resp.Type == typeInteger && len(resp.Payload) == 1 && string(resp.Payload[0]) == "1"
+		}(link)
+	}
+	votes := 1
+	for range voters {
+		if <-granted {
+			votes++
+		}
+	}
+	if votes < quorum {
+		fmt.Printf("[peer %s] Failover of epoch %d failed: %d votes of %d\n", primary, epoch, votes, quorum)
+		return false
+	}
+	return p.promote(epoch, primary)
+}
+
+// promote turns the peer into the primary replacing the failed primary and
+// announces it to the peers of the mesh.
+func (p *Peer) promote(epoch int64, primary string) bool {
+	p.role.mu.Lock()
+	// the peer may have replicated another primary meanwhile
+	if p.role.primary != primary || p.role.epoch >= epoch {
+		p.role.mu.Unlock()
+		return false
+	}
+	p.role.primary = ""
+	p.role.epoch = epoch
+	p.role.failedPrimary = primary
+	p.role.promoted, p.role.replaced = p.connString(), primary
+	p.role.electAt = time.Time{}
+	p.role.mu.Unlock()
+	atomic.AddInt64(&p.Stats.Failovers, 1)
+	fmt.Printf("[peer %s] Promoted to primary in epoch %d\n", primary, epoch)
+	p.notifyFailover("switch-master", primary, p.connString(), strconv.FormatInt(epoch, 10))
+	for _, link := range p.replicas() {
+		if link.Ready() {
+			go p.announcePromotion(link)
+		}
+	}
+	return true
+}
+
+// announcePromotion sends PEER PROMOTED to the remote peer of a link with
+// the last promotion the peer knows.
+func (p *Peer) announcePromotion(link *Peer) {
+	p.role.mu.RLock()
+	epoch, promoted, failed := p.role.epoch, p.role.promoted, p.role.replaced
+	p.role.mu.RUnlock()
+	if promoted == "" {
+		return
+	}
+	query := formattedArray([][]byte{
+		[]byte("peer"), []byte("promoted"),
+		[]byte(strconv.FormatInt(epoch, 10)),
+		[]byte(promoted),
+		[]byte(failed),
+	})
+	if _, err := p.RemoteExecute(link, NewSimpleQuery(string(query))); err != nil {
+		fmt.Printf("[peer %s] Unable to announce promotion: %s\n", link.connString(), err)
+	}
+}
+
+// peerVote answers PEER VOTE with 1 when the peer votes for the replica
+// asking it, else 0.
+func (q *Query) peerVote(r *Response, args []string) error {
+	if len(args) != 5 {
+		return fmt.Errorf(Help("peer"))
+	}
+	epoch, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid epoch %s", args[1])
+	}
+	offset, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid offset %s", args[4])
+	}
+	p := q.p
+	primary, primaryID := args[2], args[3]
+	// the peer does not vote against a primary it is linked with
+	down := p.connString() != primary
+	for _, link := range p.Mesh.List() {
+		if (link.Key() == primary || (primaryID != "" && link.remoteID() == primaryID)) && link.Ready() {
+			down = false
+		}
+	}
+	var received int64
+	if p.role.Primary() == primary {
+		received = p.replOffset(primaryID)
+	}
+	p.role.mu.Lock()
+	granted := down && offset >= received && epoch > p.role.epoch && epoch > p.role.lastVote
+	if granted {
+		p.role.lastVote = epoch
+	}
+	p.role.mu.Unlock()
+	r.Type = typeInteger
+	if granted {
+		r.PayloadString([]byte("1"))
+	} else {
+		r.PayloadString([]byte("0"))
+	}
+	return nil
+}
+
+// peerPromoted handles PEER PROMOTED: the peer replicates the promoted
+// replica when it replicated the failed primary, was the failed primary or
+// was promoted in an older epoch.
+func (q *Query) peerPromoted(r *Response, args []string) error {
+	if len(args) != 4 {
+		return fmt.Errorf(Help("peer"))
+	}
+	epoch, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid epoch %s", args[1])
+	}
+	p := q.p
+	addr, failed := args[2], args[3]
+	self := p.connString()
+	p.role.mu.Lock()
+	if epoch <= p.role.epoch {
+		p.role.mu.Unlock()
+		r.OK()
+		return nil
+	}
+	p.role.epoch = epoch
+	p.role.promoted, p.role.replaced = addr, failed
+	primary := p.role.primary
+	follow := addr != self && (primary == failed ||
+		(primary == "" && (self == failed || p.role.failedPrimary == failed)))
+	p.role.mu.Unlock()
+	p.notifyFailover("switch-master", failed, addr, strconv.FormatInt(epoch, 10))
+	if follow {
+		go func() {
+			if err := p.ReplicaOf(addr); err != nil {
+				fmt.Printf("[peer %s] Unable to replicate promoted primary: %s\n", addr, err)
+			}
+		}()
+	}
+	r.OK()
+	return nil
+}
+
+func infoFailover(p *Peer) []string {
+	p.role.mu.RLock()
+	defer p.role.mu.RUnlock()
+	return []string{
+		fmt.Sprintf("failover_timeout:%d", atomic.LoadInt64(&p.role.timeout)),
+		fmt.Sprintf("failover_epoch:%d", p.role.epoch),
+		fmt.Sprintf("failovers:%d", atomic.LoadInt64(&p.Stats.Failovers)),
+		fmt.Sprintf("failover_replicas:%d", len(p.role.replicaIDs)),
+		fmt.Sprintf("failover_fenced:%s", boolToInteger(p.role.fenced)),
+		fmt.Sprintf("failover_stale_writes:%d", atomic.LoadInt64(&p.Stats.StaleWrites)),
+	}
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPeerVote(t *testing.T) {
+	client := setupGossip()
+	p := client.vqlTCPServer.Peer
+	suites := []struct {
+		input    string
+		expected string
+	}{
+		{"peer vote 1 127.0.0.1:1 b 0", ":1\r\n"},
+		// one vote per epoch
+		{"peer vote 1 127.0.0.1:1 b 0", ":0\r\n"},
+		{"peer vote 2 127.0.0.1:1 b 0", ":1\r\n"},
+		// the peer is the primary
+		{"peer vote 3 " + p.connString() + " a 0", ":0\r\n"},
+		{"peer vote 3 127.0.0.1:1 b x", "Invalid offset x"},
+	}
+	for _, s := range suites {
+		if output := <-executeAsync(client, s.input); output != s.expected {
+			t.Errorf("%s: want %q, got %q", s.input, s.expected, output)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	client1, client2 := setupGossip(), setupGossip()
+	p1, p2 := client1.vqlTCPServer.Peer, client2.vqlTCPServer.Peer
+	conn, reader := pipeVQLConn(client2.vqlTCPServer)
+	defer conn.Close()
+	conn.Write([]byte("subscribe " + FAILOVER_CHANNEL + "\r\n"))
+	expectReply(t, conn, reader, string(formattedReply([]interface{}{"subscribe", FAILOVER_CHANNEL, 1})))
+
+	<-executeAsync(client2, "config set failover-timeout 200")
+	<-executeAsync(client2, "replicaof "+strings.Replace(p1.connString(), ":", " ", 1))
+	expected := "master_link_status:up"
+	if output := waitInfoReplication(client2, expected); !strings.Contains(output, expected) {
+		t.Fatalf("want %q in %q", expected, output)
+	}
+	<-executeAsync(client1, "set a 1")
+	for i := 0; i < 100 && p2.storage.Get("a") == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	expected = "failover_replicas:1"
+	if output := waitInfoReplication(client1, expected); !strings.Contains(output, expected) {
+		t.Fatalf("want %q in %q", expected, output)
+	}
+	for _, p := range []*Peer{p1, p2} {
+		p.gossip.mu.Lock()
+		p.gossip.deaf = true
+		p.gossip.mu.Unlock()
+	}
+
+	// the primary fails, the replica is promoted
+	for _, link := range p2.Mesh.List() {
+		p2.RemovePeer(link)
+	}
+	for _, link := range p1.Mesh.List() {
+		p1.RemovePeer(link)
+	}
+	for _, message := range []string{
+		fmt.Sprintf("try-failover 1 %s", p1.connString()),
+		fmt.Sprintf("switch-master %s %s 1", p1.connString(), p2.connString()),
+	} {
+		expectReply(t, conn, reader, string(formattedReply([]interface{}{"message", FAILOVER_CHANNEL, message})))
+	}
+	// the failed primary lost its replica and refuses the writes
+	expected = "failover_fenced:1"
+	if output := waitInfoReplication(client1, expected); !strings.Contains(output, expected) {
+		t.Fatalf("want %q in %q", expected, output)
+	}
+	if output := <-executeAsync(client1, "set c 0"); output != errNoReplicas.Error() {
+		t.Errorf("want %q, got %q", errNoReplicas.Error(), output)
+	}
+	if output := <-executeAsync(client2, "set b 2"); output != "+OK\r\n" {
+		t.Errorf("want %q, got %q", "+OK\r\n", output)
+	}
+	output := <-executeAsync(client2, "info replication")
+	for _, e := range []string{"role:master", "failover_epoch:1", "failovers:1"} {
+		if !strings.Contains(output, e) {
+			t.Errorf("want %q in %q", e, output)
+		}
+	}
+
+	// the failed primary becomes a replica of the promoted one once linked
+	if _, err := p1.ConnectToPeerAddr(p2.connString()); err != nil {
+		t.Fatal(err)
+	}
+	expected = fmt.Sprintf("master_port:%d", p2.tcpServer.Port())
+	if output := waitInfoReplication(client1, expected, "failover_epoch:1"); !strings.Contains(output, expected) {
+		t.Fatalf("want %q in %q", expected, output)
+	}
+	if output := <-executeAsync(client1, "set c 3"); output != errReadOnly.Error() {
+		t.Errorf("want %q, got %q", errReadOnly.Error(), output)
+	}
+	for i := 0; i < 100 && p1.storage.Get("b") == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if output := string(p1.storage.Get("b")); output != "2" {
+		t.Errorf("want %+v, got %+v", "2", output)
+	}
+}
+
+func TestEpochFencing(t *testing.T) {
+	client1, client2 := setupGossip(), setupGossip()
+	p1, p2 := client1.vqlTCPServer.Peer, client2.vqlTCPServer.Peer
+	link, err := p2.ConnectToPeerAddr(p1.connString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output := waitPeerStatus(link, PEER_STATUS_CONNECTED); output != PEER_STATUS_CONNECTED {
+		t.Fatalf("want %+v, got %+v", PEER_STATUS_CONNECTED, output)
+	}
+	// p2 learned a failover p1 missed
+	p2.role.mu.Lock()
+	p2.role.epoch = 1
+	p2.role.mu.Unlock()
+
+	// the writes of the older epoch are rejected, not those of the newer one
+	<-executeAsync(client1, "set a 1")
+	<-executeAsync(client2, "set b 2")
+	for i := 0; i < 100 && p1.storage.Get("b") == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if output := string(p1.storage.Get("b")); output != "2" {
+		t.Errorf("want %+v, got %+v", "2", output)
+	}
+	expected := "failover_stale_writes:1"
+	if output := waitInfoReplication(client2, expected); !strings.Contains(output, expected) {
+		t.Errorf("want %q in %q", expected, output)
+	}
+	if p2.storage.Get("a") != nil {
+		t.Errorf("want the write of epoch 0 rejected")
+	}
+
+	// p1 does not serve the sync requested from the newer epoch
+	if err := p2.requestSync(link, [][]byte{[]byte("FULLSYNC")}); err != nil {
+		t.Fatal(err)
+	}
+	state := SYNC_STATE_REQUESTED
+	for i := 0; i < 100 && state == SYNC_STATE_REQUESTED; i++ {
+		time.Sleep(10 * time.Millisecond)
+		state, _ = link.fullSync.status()
+	}
+	if state != SYNC_STATE_FAILED {
+		t.Errorf("want %+v, got %+v", SYNC_STATE_TEXT[SYNC_STATE_FAILED], SYNC_STATE_TEXT[state])
+	}
+}
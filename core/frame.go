@@ -0,0 +1,355 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	cryptoRand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Peers exchange frames: a header made of the protocol magic, the protocol
+// version, the frame type and the payload length (big endian), followed by
+// the payload.
+//
+//	+-------+---------+------+----------------+---------+
+//	| "VD"  | version | type | length: uint32 | payload |
+//	+-------+---------+------+----------------+---------+
+const (
+	PEER_PROTOCOL_VERSION  = 1
+	PEER_FRAME_HEADER_SIZE = 8
+	PEER_FRAME_MAX_SIZE    = 64 << 20
+	// seconds a peer has to complete the HELLO handshake
+	HELLO_TIMEOUT = 5
+
+	frameHello    byte = 'H'
+	frameQuery    byte = 'Q'
+	frameResponse byte = 'R'
+	// frameError carries the reason a peer closes the connection
+	frameError byte = 'E'
+	// frameGossip carries the membership protocol messages
+	frameGossip byte = 'G'
+	// frameRaft carries the consensus messages
+	frameRaft byte = 'C'
+	// frameSync carries the full sync of the keyspace
+	frameSync byte = 'S'
+	// frameAuth carries the proof of the shared secret of the peer which
+	// dialed
+	frameAuth byte = 'A'
+)
+
+var (
+	PEER_PROTOCOL_MAGIC = []byte("VD")
+	// PEER_CAPABILITIES are the features announced in the HELLO handshake
+	PEER_CAPABILITIES = []string{"pubsub", "scripting", "gossip", "sync"}
+
+	errPeerProtocol     = fmt.Errorf("incompatible peer protocol")
+	errPeerAuthRequired = fmt.Errorf("peer authentication required")
+	errPeerAuthFailed   = fmt.Errorf("peer authentication failed")
+)
+
+type frame struct {
+	version byte
+	kind    byte
+	payload []byte
+}
+
+func encodeFrame(kind byte, payload []byte) []byte {
+	data := make([]byte, PEER_FRAME_HEADER_SIZE, PEER_FRAME_HEADER_SIZE+len(payload))
+	copy(data, PEER_PROTOCOL_MAGIC)
+	data[2] = PEER_PROTOCOL_VERSION
+	data[3] = kind
+	binary.BigEndian.PutUint32(data[4:], uint32(len(payload)))
+	return append(data, payload...)
+}
+
+// writeFrame writes a frame with a single write so that frames written
+// concurrently on a connection are not interleaved.
+func writeFrame(w io.Writer, kind byte, payload []byte) error {
+	_, err := w.Write(encodeFrame(kind, payload))
+	return err
+}
+
+// readFrame reads the next frame. Data which does not start with the
+// protocol magic or a frame of another protocol version are reported as
+// errPeerProtocol.
+func readFrame(r io.Reader) (*frame, error) {
+	header := make([]byte, PEER_FRAME_HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:2], PEER_PROTOCOL_MAGIC) {
+		return nil, errPeerProtocol
+	}
+	f := &frame{
+		version: header[2],
+		kind:    header[3],
+	}
+	size := binary.BigEndian.Uint32(header[4:])
+	if size > PEER_FRAME_MAX_SIZE {
+		return nil, fmt.Errorf("peer frame of %d bytes exceeds the maximum size", size)
+	}
+	f.payload = make([]byte, size)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	if f.version != PEER_PROTOCOL_VERSION {
+		return f, fmt.Errorf("%s: version %d, expected %d", errPeerProtocol, f.version, PEER_PROTOCOL_VERSION)
+	}
+	return f, nil
+}
+
+// peerHello is exchanged by peers when they connect: the peer which dialed
+// sends its HELLO first, the other peer answers with its own.
+type peerHello struct {
+	ID string
+	// Addr is the address the peer listens to
+	Addr         string
+	Version      int
+	Capabilities []string
+	// VQLAddr is the address of the VQL server of the peer, if any
+	VQLAddr string
+	// Tags label the peer, like its region
+	Tags []string
+	// Primary is the ID of the primary the peer replicates, if any
+	Primary string
+	// Nonce is the challenge the other side answers to prove it knows the
+	// shared secret, Auth the answer of the peer which accepted the
+	// connection to the nonce of the peer which dialed
+	Nonce string
+	Auth  string
+}
+
+func (p *Peer) hello() *peerHello {
+	capabilities := PEER_CAPABILITIES
+	if p.consensus != nil {
+		capabilities = append(append([]string{}, capabilities...), "raft")
+	}
+	h := &peerHello{
+		ID:           p.ID,
+		Addr:         p.connString(),
+		Version:      PEER_PROTOCOL_VERSION,
+		Capabilities: capabilities,
+	}
+	if p.vqlTCPServer != nil {
+		h.VQLAddr = p.vqlTCPServer.connString()
+	}
+	p.mu.RLock()
+	h.Tags = p.Tags
+	p.mu.RUnlock()
+	h.Primary = p.role.PrimaryID()
+	return h
+}
+
+func (h *peerHello) encode() []byte {
+	fields := [][]byte{
+		[]byte("id"), []byte(h.ID),
+		[]byte("addr"), []byte(h.Addr),
+		[]byte("version"), []byte(strconv.Itoa(h.Version)),
+		[]byte("capabilities"), []byte(strings.Join(h.Capabilities, ",")),
+	}
+	if h.VQLAddr != "" {
+		fields = append(fields, []byte("vql_addr"), []byte(h.VQLAddr))
+	}
+	if len(h.Tags) > 0 {
+		fields = append(fields, []byte("tags"), []byte(strings.Join(h.Tags, ",")))
+	}
+	if h.Primary != "" {
+		fields = append(fields, []byte("primary"), []byte(h.Primary))
+	}
+	if h.Nonce != "" {
+		fields = append(fields, []byte("nonce"), []byte(h.Nonce))
+	}
+	if h.Auth != "" {
+		fields = append(fields, []byte("auth"), []byte(h.Auth))
+	}
+	return formattedArray(fields)
+}
+
+// decodePeerHello decodes a HELLO payload, unknown fields are ignored so
+// that new fields can be added.
+func decodePeerHello(payload []byte) (*peerHello, error) {
+	v, _, err := decodeReply(payload)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := v.([]interface{})
+	if !ok || len(items)%2 != 0 {
+		return nil, fmt.Errorf("invalid HELLO")
+	}
+	h := &peerHello{}
+	for i := 0; i < len(items); i += 2 {
+		name, _ := items[i].([]byte)
+		value, _ := items[i+1].([]byte)
+		switch string(name) {
+		case "id":
+			h.ID = string(value)
+		case "addr":
+			h.Addr = string(value)
+		case "version":
+			h.Version, err = strconv.Atoi(string(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid HELLO version %q", value)
+			}
+		case "capabilities":
+			if len(value) > 0 {
+				h.Capabilities = strings.Split(string(value), ",")
+			}
+		case "vql_addr":
+			h.VQLAddr = string(value)
+		case "tags":
+			if len(value) > 0 {
+				h.Tags = strings.Split(string(value), ",")
+			}
+		case "primary":
+			h.Primary = string(value)
+		case "nonce":
+			h.Nonce = string(value)
+		case "auth":
+			h.Auth = string(value)
+		}
+	}
+	if h.ID == "" {
+		return nil, fmt.Errorf("HELLO without peer ID")
+	}
+	if h.Version != PEER_PROTOCOL_VERSION {
+		return nil, fmt.Errorf("%s: version %d, expected %d", errPeerProtocol, h.Version, PEER_PROTOCOL_VERSION)
+	}
+	return h, nil
+}
+
+// listenAddr returns the address other peers can dial to reach the peer
+// which sent the HELLO. An unspecified listen host like 0.0.0.0 is replaced
+// by the host the connection comes from.
+func (h *peerHello) listenAddr(remote net.Addr) (string, error) {
+	return reachableAddr(h.Addr, remote)
+}
+
+// vqlListenAddr returns the address clients can dial to reach the VQL
+// server of the peer which sent the HELLO, empty when it has none.
+func (h *peerHello) vqlListenAddr(remote net.Addr) string {
+	if h.VQLAddr == "" {
+		return ""
+	}
+	addr, err := reachableAddr(h.VQLAddr, remote)
+	if err != nil {
+		return ""
+	}
+	return addr
+}
+
+func reachableAddr(addr string, remote net.Addr) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host, _, err = net.SplitHostPort(remote.String())
+		if err != nil {
+			return "", err
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// readHello reads the HELLO of the other side of a new connection.
+func (p *Peer) readHello(conn net.Conn) (*peerHello, error) {
+	f, err := readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	switch f.kind {
+	case frameHello:
+	case frameError:
+		return nil, fmt.Errorf("peer refused the connection: %s", f.payload)
+	default:
+		return nil, fmt.Errorf("expected HELLO, got frame type %q", f.kind)
+	}
+	h, err := decodePeerHello(f.payload)
+	if err != nil {
+		return nil, err
+	}
+	if h.ID == p.ID {
+		return nil, fmt.Errorf("connection to self")
+	}
+	return h, nil
+}
+
+func hasCapability(capabilities []string, capability string) bool {
+	return stringInSlice(capability, capabilities)
+}
+
+// Peers sharing a secret prove it to each other in the HELLO handshake,
+// without sending it: each side sends a random nonce and answers with the
+// HMAC-SHA256 keyed by the secret of its role in the handshake, of both
+// nonces and of both IDs. The peer which accepted the connection answers in
+// its HELLO, the peer which dialed in an AUTH frame once it checked the
+// answer. As the answers differ by role and bind both sides, an answer
+// obtained from a peer in another handshake is refused.
+const (
+	proofDialer    = "dialer"
+	proofResponder = "responder"
+)
+
+func (p *Peer) newNonce() string {
+	if p.secret == nil {
+		return ""
+	}
+	nonce := make([]byte, 16)
+	if _, err := cryptoRand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(nonce)
+}
+
+// secretProof returns the answer of a side of the handshake between the
+// peer dialerID which sent dialerNonce and the peer responderID which sent
+// responderNonce.
+func (p *Peer) secretProof(role string, dialerNonce string, responderNonce string, dialerID string, responderID string) string {
+	mac := hmac.New(sha256.New, p.secret)
+	for _, field := range []string{role, dialerNonce, responderNonce, dialerID, responderID} {
+		mac.Write([]byte(field))
+		mac.Write([]byte{0})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// proveSecret checks the answer of the peer which accepted the connection
+// and sends the answer of the peer, nonce is the nonce of its HELLO.
+func (p *Peer) proveSecret(conn net.Conn, nonce string, hello *peerHello) error {
+	if p.secret == nil {
+		return nil
+	}
+	if hello.Auth == "" || hello.Nonce == "" {
+		return errPeerAuthRequired
+	}
+	if !hmac.Equal([]byte(hello.Auth), []byte(p.secretProof(proofResponder, nonce, hello.Nonce, p.ID, hello.ID))) {
+		return errPeerAuthFailed
+	}
+	return writeFrame(conn, frameAuth, []byte(p.secretProof(proofDialer, nonce, hello.Nonce, p.ID, hello.ID)))
+}
+
+// checkSecretProof reads the answer of the peer which dialed, nonce is the
+// nonce of the HELLO of the peer.
+func (p *Peer) checkSecretProof(conn net.Conn, nonce string, hello *peerHello) error {
+	if p.secret == nil {
+		return nil
+	}
+	f, err := readFrame(conn)
+	if err != nil {
+		return err
+	}
+	if f.kind != frameAuth {
+		return fmt.Errorf("expected AUTH, got frame type %q", f.kind)
+	}
+	if !hmac.Equal(f.payload, []byte(p.secretProof(proofDialer, hello.Nonce, nonce, hello.ID, p.ID))) {
+		return errPeerAuthFailed
+	}
+	return nil
+}
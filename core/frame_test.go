@@ -0,0 +1,128 @@
+package core
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrames(t *testing.T) {
+	var buf bytes.Buffer
+	writeFrame(&buf, frameQuery, []byte("foo"))
+	writeFrame(&buf, frameResponse, []byte{})
+	expected := "VD\x01Q\x00\x00\x00\x03fooVD\x01R\x00\x00\x00\x00"
+	if output := buf.String(); expected != output {
+		t.Errorf("want %q, got %q", expected, output)
+	}
+
+	suites := []struct {
+		kind    byte
+		payload string
+	}{
+		{frameQuery, "foo"},
+		{frameResponse, ""},
+	}
+	for _, s := range suites {
+		f, err := readFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.kind != s.kind || string(f.payload) != s.payload {
+			t.Errorf("want %q %q, got %q %q", s.kind, s.payload, f.kind, f.payload)
+		}
+	}
+
+	if _, err := readFrame(strings.NewReader("0\r\n*1\r\n$4\r\nping\r\n")); err != errPeerProtocol {
+		t.Errorf("want %+v, got %+v", errPeerProtocol, err)
+	}
+	if _, err := readFrame(strings.NewReader("VD\x02Q\x00\x00\x00\x00")); err == nil || !strings.HasPrefix(err.Error(), errPeerProtocol.Error()) {
+		t.Errorf("want version mismatch, got %+v", err)
+	}
+	if _, err := readFrame(strings.NewReader("VD\x01Q\xff\xff\xff\xff")); err == nil {
+		t.Errorf("want error for an oversized frame")
+	}
+}
+
+func TestPeerHello(t *testing.T) {
+	hello := &peerHello{
+		ID:           "peer-1",
+		Addr:         "0.0.0.0:4300",
+		Version:      PEER_PROTOCOL_VERSION,
+		Capabilities: []string{"pubsub", "scripting"},
+		VQLAddr:      "0.0.0.0:4301",
+		Tags:         []string{"region=eu", "zone=eu-1"},
+		Primary:      "peer-0",
+	}
+	decoded, err := decodePeerHello(hello.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ID != hello.ID || decoded.Primary != hello.Primary || decoded.Addr != hello.Addr || decoded.VQLAddr != hello.VQLAddr || decoded.Version != hello.Version || strings.Join(decoded.Capabilities, ",") != "pubsub,scripting" || strings.Join(decoded.Tags, ",") != "region=eu,zone=eu-1" {
+		t.Errorf("want %+v, got %+v", hello, decoded)
+	}
+
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 51234}
+	suites := []string{
+		"0.0.0.0:4300", "10.0.0.2:4300",
+		":4300", "10.0.0.2:4300",
+		"192.168.1.5:4300", "192.168.1.5:4300",
+	}
+	for i := 0; i < len(suites); i += 2 {
+		h := &peerHello{Addr: suites[i]}
+		output, err := h.listenAddr(remote)
+		if err != nil || suites[i+1] != output {
+			t.Errorf("%s: want %q, got %q %v", suites[i], suites[i+1], output, err)
+		}
+	}
+	if output := hello.vqlListenAddr(remote); output != "10.0.0.2:4301" {
+		t.Errorf("want %q, got %q", "10.0.0.2:4301", output)
+	}
+
+	hello.Version = PEER_PROTOCOL_VERSION + 1
+	if _, err := decodePeerHello(hello.encode()); err == nil {
+		t.Errorf("want error for another protocol version")
+	}
+	hello.Version = PEER_PROTOCOL_VERSION
+	hello.ID = ""
+	if _, err := decodePeerHello(hello.encode()); err == nil {
+		t.Errorf("want error for a HELLO without peer ID")
+	}
+}
+
+func TestPeerHandshake(t *testing.T) {
+	client := setup()
+	peer := client.vqlTCPServer.Peer
+	for i := 0; i < 50 && (peer.tcpServer == nil || peer.tcpServer.Port() == 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// peers of the previous protocol are refused
+	conn, err := net.Dial("tcp4", peer.connString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("0\r\n*1\r\n$4\r\nping\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	f, err := readFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.kind != frameError {
+		t.Errorf("want %q, got %q", frameError, f.kind)
+	}
+
+	// connection to self
+	self, err := net.Dial("tcp4", peer.connString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer self.Close()
+	writeFrame(self, frameHello, peer.hello().encode())
+	self.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := peer.readHello(self); err == nil {
+		t.Errorf("want error for a connection to self")
+	}
+}
@@ -0,0 +1,613 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Cluster membership is maintained with a SWIM-style gossip protocol over
+// the peer links. Every protocol period a peer probes one member with a PING.
+// Without ACK in time, it asks other members to probe it (PING-REQ). A member
+// nobody could reach is suspected, then declared dead if it does not refute
+// the suspicion in time by announcing a higher incarnation number. Membership
+// changes are piggybacked on the probes. Peers exchange their whole member
+// list when they connect, so that a peer joining through a single seed learns
+// the whole cluster, and periodically with a random member to repair the
+// states missed.
+const (
+	GOSSIP_PROBE_INTERVAL  = 1000 // milliseconds
+	GOSSIP_PROBE_TIMEOUT   = 500  // milliseconds
+	GOSSIP_INDIRECT_PROBES = 3
+	// milliseconds a suspected member has to refute the suspicion
+	GOSSIP_SUSPICION_TIMEOUT = 5000
+	// milliseconds dead members are kept in the member list
+	GOSSIP_DEAD_RETENTION = 60000
+	// updates are piggybacked GOSSIP_RETRANSMIT_MULT * log10(members) times
+	GOSSIP_RETRANSMIT_MULT = 4
+	// maximum number of updates piggybacked on a message
+	GOSSIP_MAX_UPDATES = 16
+	// milliseconds between two member list exchanges with a random member
+	GOSSIP_SYNC_INTERVAL = 30000
+
+	memberAlive   = 0
+	memberSuspect = 1
+	memberDead    = 2
+
+	gossipPing    = "ping"
+	gossipAck     = "ack"
+	gossipPingReq = "ping-req"
+	gossipSync    = "sync"
+)
+
+var (
+	MEMBER_STATE_TEXT = map[int]string{
+		memberAlive:   "alive",
+		memberSuspect: "suspect",
+		memberDead:    "dead",
+	}
+)
+
+type member struct {
+	ID          string
+	Addr        string
+	State       int
+	Incarnation uint64
+	// since is when the member entered its current state
+	since time.Time
+	// left is set when the member announced its own death: it left the
+	// cluster rather than failed
+	left bool
+}
+
+type gossipUpdate struct {
+	m         member
+	transmits int
+}
+
+type gossipMessage struct {
+	kind    string
+	seq     uint64
+	target  string
+	updates []member
+}
+
+type Gossip struct {
+	p       *Peer
+	mu      sync.Mutex
+	self    *member
+	members map[string]*member
+	updates []*gossipUpdate
+	seq     uint64
+	acks    map[uint64]chan struct{}
+	// probeOrder is the shuffled list of members probed in turn
+	probeOrder []string
+	// dialing holds the links opened to members learned by gossip
+	dialing map[string]*Peer
+	// deaf drops every gossip message, to simulate a failed peer in tests
+	deaf bool
+
+	probeInterval    time.Duration
+	probeTimeout     time.Duration
+	suspicionTimeout time.Duration
+	deadRetention    time.Duration
+	syncInterval     time.Duration
+}
+
+func NewGossip(p *Peer) *Gossip {
+	return &Gossip{
+		p:                p,
+		self:             &member{ID: p.ID, State: memberAlive, since: time.Now()},
+		members:          make(map[string]*member),
+		acks:             make(map[uint64]chan struct{}),
+		dialing:          make(map[string]*Peer),
+		probeInterval:    GOSSIP_PROBE_INTERVAL * time.Millisecond,
+		probeTimeout:     GOSSIP_PROBE_TIMEOUT * time.Millisecond,
+		suspicionTimeout: GOSSIP_SUSPICION_TIMEOUT * time.Millisecond,
+		deadRetention:    GOSSIP_DEAD_RETENTION * time.Millisecond,
+		syncInterval:     GOSSIP_SYNC_INTERVAL * time.Millisecond,
+	}
+}
+
+func (m *member) encode() []interface{} {
+	return []interface{}{m.ID, m.Addr, MEMBER_STATE_TEXT[m.State], strconv.FormatUint(m.Incarnation, 10)}
+}
+
+func (msg *gossipMessage) encode() []byte {
+	updates := []interface{}{}
+	for i := range msg.updates {
+		updates = append(updates, msg.updates[i].encode())
+	}
+	return formattedReply([]interface{}{msg.kind, strconv.FormatUint(msg.seq, 10), msg.target, updates})
+}
+
+func decodeGossipMessage(payload []byte) (*gossipMessage, error) {
+	v, _, err := decodeReply(payload)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := v.([]interface{})
+	if !ok || len(items) != 4 {
+		return nil, fmt.Errorf("invalid gossip message")
+	}
+	kind, _ := items[0].([]byte)
+	seq, _ := items[1].([]byte)
+	target, _ := items[2].([]byte)
+	updates, _ := items[3].([]interface{})
+	msg := &gossipMessage{
+		kind:   string(kind),
+		target: string(target),
+	}
+	if msg.seq, err = strconv.ParseUint(string(seq), 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid gossip sequence number %q", seq)
+	}
+	for _, u := range updates {
+		fields, _ := u.([]interface{})
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid gossip update")
+		}
+		id, _ := fields[0].([]byte)
+		addr, _ := fields[1].([]byte)
+		state, _ := fields[2].([]byte)
+		incarnation, _ := fields[3].([]byte)
+		m := member{ID: string(id), Addr: string(addr), State: -1}
+		for s, text := range MEMBER_STATE_TEXT {
+			if text == string(state) {
+				m.State = s
+			}
+		}
+		if m.ID == "" || m.State < 0 {
+			return nil, fmt.Errorf("invalid gossip update")
+		}
+		if m.Incarnation, err = strconv.ParseUint(string(incarnation), 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid gossip incarnation %q", incarnation)
+		}
+		msg.updates = append(msg.updates, m)
+	}
+	return msg, nil
+}
+
+// Members returns the other members of the cluster sorted by ID.
+func (g *Gossip) Members() []member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	members := []member{}
+	for _, m := range g.members {
+		members = append(members, *m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+	return members
+}
+
+// peerList returns the PEER LIST entries: the members of the cluster with
+// the details of the link with them, then the links with peers which are not
+// members yet.
+func (p *Peer) peerList() (peers []string) {
+	links := p.Mesh.List()
+	linked := make(map[*Peer]bool)
+	for _, m := range p.gossip.Members() {
+		link := "connection=" + PEER_STATUS_TEXT[PEER_STATUS_NO_CONNECTION]
+		for _, l := range links {
+			if !linked[l] && l.remoteID() == m.ID {
+				linked[l] = true
+				link = l.describe()
+				break
+			}
+		}
+		peers = append(peers, fmt.Sprintf("id=%s addr=%s state=%s incarnation=%d %s", m.ID, m.Addr, MEMBER_STATE_TEXT[m.State], m.Incarnation, link))
+	}
+	for _, l := range links {
+		if !linked[l] {
+			peers = append(peers, fmt.Sprintf("id=%s addr=%s state=unknown incarnation=0 %s", l.remoteID(), l.Key(), l.describe()))
+		}
+	}
+	return peers
+}
+
+func (g *Gossip) selfMember() member {
+	self := *g.self
+	self.Addr = g.p.connString()
+	return self
+}
+
+// link returns the open link with a member supporting gossip.
+func (g *Gossip) link(id string) *Peer {
+	for _, l := range g.p.Mesh.List() {
+		if l.Ready() && l.remoteID() == id && hasCapability(l.remoteCapabilities(), "gossip") {
+			return l
+		}
+	}
+	return nil
+}
+
+// otherLinks returns up to count random links, except the one with the
+// member excluded.
+func (g *Gossip) otherLinks(excluded string, count int) (links []*Peer) {
+	for _, l := range g.p.Mesh.List() {
+		if l.Ready() && l.remoteID() != excluded && hasCapability(l.remoteCapabilities(), "gossip") {
+			links = append(links, l)
+		}
+	}
+	rand.Shuffle(len(links), func(i, j int) {
+		links[i], links[j] = links[j], links[i]
+	})
+	if len(links) > count {
+		links = links[:count]
+	}
+	return links
+}
+
+func (g *Gossip) retransmitLimit() int {
+	return GOSSIP_RETRANSMIT_MULT * int(math.Ceil(math.Log10(float64(len(g.members)+2))))
+}
+
+// queue schedules the dissemination of a member state, replacing the pending
+// update of the same member.
+func (g *Gossip) queue(m member) {
+	for i, u := range g.updates {
+		if u.m.ID == m.ID {
+			g.updates = append(g.updates[:i], g.updates[i+1:]...)
+			break
+		}
+	}
+	g.updates = append(g.updates, &gossipUpdate{m: m})
+}
+
+// piggyback returns the updates to send with the next message, the least
+// transmitted first.
+func (g *Gossip) piggyback() (updates []member) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	sort.SliceStable(g.updates, func(i, j int) bool {
+		return g.updates[i].transmits < g.updates[j].transmits
+	})
+	limit := g.retransmitLimit()
+	kept := g.updates[:0]
+	for _, u := range g.updates {
+		if len(updates) < GOSSIP_MAX_UPDATES {
+			updates = append(updates, u.m)
+			u.transmits++
+		}
+		if u.transmits < limit {
+			kept = append(kept, u)
+		}
+	}
+	g.updates = kept
+	return updates
+}
+
+func (g *Gossip) send(link *Peer, msg *gossipMessage) error {
+	conn, _ := link.session()
+	if conn == nil {
+		return fmt.Errorf("no connection to peer %s", link.connString())
+	}
+	if msg.updates == nil {
+		msg.updates = g.piggyback()
+	}
+	return writeFrame(conn, frameGossip, msg.encode())
+}
+
+// sync sends the whole member list to a peer which just connected.
+func (g *Gossip) sync(link *Peer) {
+	g.mu.Lock()
+	updates := []member{g.selfMember()}
+	for _, m := range g.members {
+		updates = append(updates, *m)
+	}
+	g.mu.Unlock()
+	if err := g.send(link, &gossipMessage{kind: gossipSync, updates: updates}); err != nil {
+		fmt.Printf("[gossip] Unable to sync with peer %s: %s\n", link.connString(), err)
+	}
+}
+
+// leave declares the peer dead to every member it is linked with.
+func (g *Gossip) leave() {
+	g.mu.Lock()
+	g.self.State = memberDead
+	g.self.Incarnation++
+	g.self.since = time.Now()
+	updates := []member{g.selfMember()}
+	g.mu.Unlock()
+	for _, link := range g.otherLinks("", len(g.p.Mesh.List())) {
+		if err := g.send(link, &gossipMessage{kind: gossipSync, updates: updates}); err != nil {
+			fmt.Printf("[gossip] Unable to announce leave to peer %s: %s\n", link.connString(), err)
+		}
+	}
+}
+
+func (g *Gossip) nextSeq() (uint64, chan struct{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.seq++
+	ack := make(chan struct{}, 1)
+	g.acks[g.seq] = ack
+	return g.seq, ack
+}
+
+func (g *Gossip) forgetSeq(seq uint64) {
+	g.mu.Lock()
+	delete(g.acks, seq)
+	g.mu.Unlock()
+}
+
+// handle processes a gossip message received from a link.
+func (g *Gossip) handle(link *Peer, payload []byte) {
+	g.mu.Lock()
+	deaf := g.deaf
+	g.mu.Unlock()
+	if deaf {
+		return
+	}
+	msg, err := decodeGossipMessage(payload)
+	if err != nil {
+		fmt.Printf("[gossip] Invalid message from peer %s: %s\n", link.connString(), err)
+		return
+	}
+	for _, u := range msg.updates {
+		g.merge(u, link)
+	}
+	switch msg.kind {
+	case gossipPing:
+		g.send(link, &gossipMessage{kind: gossipAck, seq: msg.seq})
+	case gossipAck:
+		g.mu.Lock()
+		ack := g.acks[msg.seq]
+		g.mu.Unlock()
+		if ack != nil {
+			select {
+			case ack <- struct{}{}:
+			default:
+			}
+		}
+	case gossipPingReq:
+		go func() {
+			if g.probeDirect(msg.target) {
+				g.send(link, &gossipMessage{kind: gossipAck, seq: msg.seq})
+			}
+		}()
+	}
+}
+
+// hasLeft reports whether a member announced it left the cluster.
+func (g *Gossip) hasLeft(id string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m := g.members[id]
+	return m != nil && m.left
+}
+
+// isDead reports whether a member is declared dead.
+func (g *Gossip) isDead(id string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m := g.members[id]
+	return m != nil && m.State == memberDead
+}
+
+// merge applies a member state received from a link. A state is accepted
+// when it is more recent than the known one: a higher incarnation, or at the
+// same incarnation a suspicion of an alive member or the death of a member.
+func (g *Gossip) merge(u member, from *Peer) {
+	g.mu.Lock()
+	if u.ID == g.self.ID {
+		// refute suspicions about ourself, unless we left
+		if g.self.State == memberAlive && u.State != memberAlive && u.Incarnation >= g.self.Incarnation {
+			g.self.Incarnation = u.Incarnation + 1
+			g.queue(g.selfMember())
+		}
+		g.mu.Unlock()
+		return
+	}
+	if from != nil && u.ID == from.remoteID() {
+		// the address a member announces for itself may be unspecified
+		u.Addr = from.Key()
+	}
+	left := u.State == memberDead && from != nil && u.ID == from.remoteID()
+	m := g.members[u.ID]
+	if m != nil && left {
+		m.left = true
+	}
+	if m == nil {
+		if u.State == memberDead {
+			g.mu.Unlock()
+			return
+		}
+		m = &u
+		m.since = time.Now()
+		g.members[u.ID] = m
+		fmt.Printf("[gossip] Member %s %s at %s\n", m.ID, MEMBER_STATE_TEXT[m.State], m.Addr)
+	} else {
+		switch u.State {
+		case memberAlive:
+			if u.Incarnation <= m.Incarnation {
+				g.mu.Unlock()
+				return
+			}
+		case memberSuspect:
+			if u.Incarnation < m.Incarnation || u.Incarnation == m.Incarnation && m.State != memberAlive {
+				g.mu.Unlock()
+				return
+			}
+		case memberDead:
+			if u.Incarnation < m.Incarnation || m.State == memberDead {
+				g.mu.Unlock()
+				return
+			}
+		}
+		if m.State != u.State {
+			fmt.Printf("[gossip] Member %s %s\n", m.ID, MEMBER_STATE_TEXT[u.State])
+			m.since = time.Now()
+		}
+		m.State = u.State
+		m.Incarnation = u.Incarnation
+		m.left = m.left && u.State == memberDead
+		if u.Addr != "" {
+			m.Addr = u.Addr
+		}
+	}
+	g.queue(*m)
+	dial := g.shouldDial(m)
+	g.mu.Unlock()
+	if dial {
+		g.dial(m.ID, m.Addr)
+	}
+}
+
+// shouldDial reports whether to open a link with a member learned by
+// gossip. Only the peer with the lowest ID dials so that two members do not
+// open two links with each other.
+func (g *Gossip) shouldDial(m *member) bool {
+	if m.State != memberAlive || g.self.State != memberAlive || g.self.ID > m.ID || g.dialing[m.ID] != nil {
+		return false
+	}
+	for _, l := range g.p.Mesh.List() {
+		if l.remoteID() == m.ID || l.Key() == m.Addr {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *Gossip) dial(id string, addr string) {
+	link, err := g.p.ConnectToPeerAddr(addr)
+	if err != nil {
+		fmt.Printf("[gossip] Unable to connect to member %s at %s: %s\n", id, addr, err)
+		return
+	}
+	g.mu.Lock()
+	g.dialing[id] = link
+	g.mu.Unlock()
+}
+
+// probeDirect pings a member over its link and waits for the ACK.
+func (g *Gossip) probeDirect(id string) bool {
+	link := g.link(id)
+	if link == nil {
+		return false
+	}
+	seq, ack := g.nextSeq()
+	defer g.forgetSeq(seq)
+	if err := g.send(link, &gossipMessage{kind: gossipPing, seq: seq, target: id}); err != nil {
+		return false
+	}
+	select {
+	case <-ack:
+		return true
+	case <-time.After(g.probeTimeout):
+		return false
+	}
+}
+
+// probe checks a member is alive, directly then through other members, and
+// suspects it when nobody could reach it.
+func (g *Gossip) probe(id string) {
+	if g.probeDirect(id) {
+		return
+	}
+	seq, ack := g.nextSeq()
+	defer g.forgetSeq(seq)
+	for _, link := range g.otherLinks(id, GOSSIP_INDIRECT_PROBES) {
+		g.send(link, &gossipMessage{kind: gossipPingReq, seq: seq, target: id})
+	}
+	select {
+	case <-ack:
+		return
+	case <-time.After(g.probeInterval - g.probeTimeout):
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m := g.members[id]
+	if m == nil || m.State != memberAlive {
+		return
+	}
+	fmt.Printf("[gossip] Member %s suspect\n", id)
+	m.State = memberSuspect
+	m.since = time.Now()
+	g.queue(*m)
+}
+
+// nextTarget returns the next member to probe. Members are probed in a
+// random order, each once per round.
+func (g *Gossip) nextTarget() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for len(g.probeOrder) > 0 {
+		id := g.probeOrder[0]
+		g.probeOrder = g.probeOrder[1:]
+		if m := g.members[id]; m != nil && m.State != memberDead {
+			return id
+		}
+	}
+	for id, m := range g.members {
+		if m.State != memberDead {
+			g.probeOrder = append(g.probeOrder, id)
+		}
+	}
+	rand.Shuffle(len(g.probeOrder), func(i, j int) {
+		g.probeOrder[i], g.probeOrder[j] = g.probeOrder[j], g.probeOrder[i]
+	})
+	if len(g.probeOrder) == 0 {
+		return ""
+	}
+	id := g.probeOrder[0]
+	g.probeOrder = g.probeOrder[1:]
+	return id
+}
+
+// reap declares dead the members suspected for too long and forgets the
+// members dead for too long, closing the links gossip opened with them.
+func (g *Gossip) reap() {
+	var removed []*Peer
+	g.mu.Lock()
+	now := time.Now()
+	for id, m := range g.members {
+		switch {
+		case m.State == memberSuspect && now.Sub(m.since) > g.suspicionTimeout:
+			fmt.Printf("[gossip] Member %s dead\n", id)
+			m.State = memberDead
+			m.since = now
+			g.queue(*m)
+		case m.State == memberDead && now.Sub(m.since) > g.deadRetention:
+			delete(g.members, id)
+			if link := g.dialing[id]; link != nil {
+				removed = append(removed, link)
+				delete(g.dialing, id)
+			}
+		}
+	}
+	g.mu.Unlock()
+	for _, link := range removed {
+		g.p.RemovePeer(link)
+	}
+}
+
+func (g *Gossip) run() {
+	ticker := time.NewTicker(g.probeInterval)
+	defer ticker.Stop()
+	lastSync := time.Now()
+	for range ticker.C {
+		g.mu.Lock()
+		deaf := g.deaf
+		left := g.self.State == memberDead
+		g.mu.Unlock()
+		if deaf || left {
+			continue
+		}
+		g.reap()
+		if time.Since(lastSync) > g.syncInterval {
+			lastSync = time.Now()
+			for _, link := range g.otherLinks("", 1) {
+				go g.sync(link)
+			}
+		}
+		if id := g.nextTarget(); id != "" {
+			g.probe(id)
+		}
+	}
+}
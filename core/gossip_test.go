@@ -0,0 +1,191 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGossipMessage(t *testing.T) {
+	msg := &gossipMessage{
+		kind:   gossipPingReq,
+		seq:    42,
+		target: "b",
+		updates: []member{
+			{ID: "a", Addr: "10.0.0.1:4300", State: memberAlive, Incarnation: 1},
+			{ID: "b", Addr: "10.0.0.2:4300", State: memberSuspect, Incarnation: 3},
+		},
+	}
+	decoded, err := decodeGossipMessage(msg.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("%+v", msg)
+	if output := fmt.Sprintf("%+v", decoded); expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+
+	for _, payload := range []string{
+		"*1\r\n$4\r\nping\r\n",
+		string(formattedReply([]interface{}{"ping", "x", "", []interface{}{}})),
+		string(formattedReply([]interface{}{"ping", "1", "", []interface{}{[]interface{}{"a", "", "gone", "0"}}})),
+	} {
+		if _, err := decodeGossipMessage([]byte(payload)); err == nil {
+			t.Errorf("want error for %q", payload)
+		}
+	}
+}
+
+func TestGossipMerge(t *testing.T) {
+	p, err := NewPeer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// members with a lower ID are not dialed
+	p.ID = "z"
+	p.gossip = NewGossip(p)
+	g := p.gossip
+
+	suites := []struct {
+		update   member
+		expected string
+	}{
+		{member{ID: "a", Addr: "10.0.0.1:4300", State: memberAlive}, "alive 0"},
+		{member{ID: "a", State: memberSuspect}, "suspect 0"},
+		{member{ID: "a", State: memberAlive}, "suspect 0"},
+		{member{ID: "a", State: memberAlive, Incarnation: 1}, "alive 1"},
+		{member{ID: "a", State: memberSuspect}, "alive 1"},
+		{member{ID: "a", State: memberDead, Incarnation: 1}, "dead 1"},
+		{member{ID: "a", State: memberSuspect, Incarnation: 1}, "dead 1"},
+		{member{ID: "a", State: memberAlive, Incarnation: 2}, "alive 2"},
+	}
+	for i, s := range suites {
+		g.merge(s.update, nil)
+		m := g.Members()[0]
+		if output := fmt.Sprintf("%s %d", MEMBER_STATE_TEXT[m.State], m.Incarnation); s.expected != output {
+			t.Errorf("%d: want %+v, got %+v", i, s.expected, output)
+		}
+	}
+	if output := g.Members()[0].Addr; output != "10.0.0.1:4300" {
+		t.Errorf("want %+v, got %+v", "10.0.0.1:4300", output)
+	}
+
+	// unknown dead members are ignored
+	g.merge(member{ID: "b", State: memberDead}, nil)
+	if output := len(g.Members()); output != 1 {
+		t.Errorf("want %+v, got %+v", 1, output)
+	}
+
+	// suspicions about ourself are refuted with a higher incarnation
+	g.merge(member{ID: "z", State: memberSuspect, Incarnation: 4}, nil)
+	expected := "alive 5"
+	var output string
+	for _, u := range g.piggyback() {
+		if u.ID == "z" {
+			output = fmt.Sprintf("%s %d", MEMBER_STATE_TEXT[u.State], u.Incarnation)
+		}
+	}
+	if expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+}
+
+func setupGossip() *VQLClient {
+	peer, err := NewPeer("127.0.0.1", 0)
+	if err != nil {
+		panic(err)
+	}
+	peer.gossip.probeInterval = 100 * time.Millisecond
+	peer.gossip.probeTimeout = 50 * time.Millisecond
+	peer.gossip.suspicionTimeout = 500 * time.Millisecond
+	peer.gossip.syncInterval = 300 * time.Millisecond
+	go peer.Run()
+	vqlTCPServer, err := NewVQLTCPServer(peer, "127.0.0.1", 0)
+	if err != nil {
+		panic(err)
+	}
+	go vqlTCPServer.Run()
+	for i := 0; i < 50 && (peer.tcpServer == nil || peer.tcpServer.Port() == 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return NewVQLClient(1, "test-client", nil, vqlTCPServer)
+}
+
+// waitMemberState waits until the peer of client sees the member in state.
+func waitMemberState(client *VQLClient, id string, state int) string {
+	var output string
+	for i := 0; i < 100; i++ {
+		output = <-executeAsync(client, "peer list")
+		for _, line := range strings.Split(output, "\r\n") {
+			if strings.Contains(line, "id="+id+" ") && strings.Contains(line, "state="+MEMBER_STATE_TEXT[state]+" ") {
+				return line
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return output
+}
+
+func TestGossipCluster(t *testing.T) {
+	seed := setupGossip()
+	clients := []*VQLClient{seed, setupGossip(), setupGossip()}
+	peers := []*Peer{}
+	for _, c := range clients {
+		peers = append(peers, c.vqlTCPServer.Peer)
+	}
+	// b and c only know the seed
+	for _, c := range clients[1:] {
+		<-executeAsync(c, fmt.Sprintf("peer connect %s", peers[0].connString()))
+	}
+
+	// every peer learns the whole cluster and links with every member
+	for i, c := range clients {
+		for j, p := range peers {
+			if i == j {
+				continue
+			}
+			line := waitMemberState(c, p.ID, memberAlive)
+			if !strings.Contains(line, "connection=Connected") {
+				t.Fatalf("peer %d: want member %d alive and connected, got %q", i, j, line)
+			}
+		}
+	}
+
+	// b and c replicate over the link gossip opened
+	<-executeAsync(clients[1], "set foo bar")
+	expected := "$3\r\nbar\r\n"
+	var output string
+	for i := 0; i < 50; i++ {
+		if output = <-executeAsync(clients[2], "get foo"); output == expected {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if expected != output {
+		t.Errorf("want %q, got %q", expected, output)
+	}
+
+	// a peer which stops answering is suspected then declared dead
+	failed := peers[2].gossip
+	failed.mu.Lock()
+	failed.deaf = true
+	failed.mu.Unlock()
+	for _, c := range clients[:2] {
+		line := waitMemberState(c, peers[2].ID, memberDead)
+		if !strings.Contains(line, "state=dead") {
+			t.Fatalf("want member dead, got %q", line)
+		}
+	}
+
+	// once it answers again, it refutes its death with a higher incarnation
+	failed.mu.Lock()
+	failed.deaf = false
+	failed.mu.Unlock()
+	for _, c := range clients[:2] {
+		line := waitMemberState(c, peers[2].ID, memberAlive)
+		if !strings.Contains(line, "state=alive") || strings.Contains(line, "incarnation=0 ") {
+			t.Fatalf("want member alive with a higher incarnation, got %q", line)
+		}
+	}
+}
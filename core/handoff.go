@@ -0,0 +1,527 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PublishVQL skips the peers which are not linked. While the link with a
+// peer it was linked with is down, a peer keeps the writes for it as hints,
+// appended to a file of its hints directory. When the peer links again and
+// requests the writes following its offset with PSYNC, the writes missing
+// from the backlog are sent from the hints instead of a full sync, as long
+// as no hint was dropped since that offset. The hints older than HINT_TTL
+// expire, the oldest hints are dropped beyond HINTS_MAX_PER_PEER. The hints
+// of a peer are discarded once it is synced. The hints files left in the
+// hints directory by a previous run are reloaded at startup: their offsets
+// belong to the backlog of that run, so they are replayed to their peer as
+// soon as it links again, before it syncs. A peer leaving the cluster hands
+// the hints it still keeps off to a live peer with PEER HINT, which keeps
+// them like reloaded hints.
+//
+//	PEER HINT <peer-id> <frame> [<frame> ...]  keeps writes for a peer
+const (
+	// seconds a hint is kept, 0 disables hinted handoff
+	HINT_TTL           = 3 * 3600
+	HINTS_MAX_PER_PEER = 100000
+	// bytes of dropped hints kept in a hints file before it is compacted
+	HINTS_COMPACT_SIZE = 1 << 20
+)
+
+// hint is a write kept for a peer, the Q frame of the write is stored in the
+// hints file of the peer at pos. The offset of the hints reloaded from a
+// previous run is 0.
+type hint struct {
+	offset   int64
+	expireAt time.Time
+	pos      int64
+	size     int64
+}
+
+// hintQueue holds the hints of a peer, oldest first.
+type hintQueue struct {
+	f     *os.File
+	hints []hint
+	// end is the size of the hints file
+	end int64
+}
+
+// hintedHandoff holds the hints of the peers which cannot be reached.
+type hintedHandoff struct {
+	mu     sync.Mutex
+	dir    string
+	queues map[string]*hintQueue
+	stats  *Stats
+	// ttl and max are read and written atomically
+	ttl int64
+	max int64
+}
+
+func newHintedHandoff(dir string, stats *Stats) *hintedHandoff {
+	return &hintedHandoff{
+		dir:    dir,
+		queues: make(map[string]*hintQueue),
+		stats:  stats,
+		ttl:    HINT_TTL,
+		max:    HINTS_MAX_PER_PEER,
+	}
+}
+
+// load reloads the hints files of the hints directory.
+func (h *hintedHandoff) load() error {
+	files, err := filepath.Glob(filepath.Join(h.dir, "*.hints"))
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	expireAt := time.Now().Add(time.Duration(atomic.LoadInt64(&h.ttl)) * time.Second)
+	for _, name := range files {
+		id := strings.TrimSuffix(filepath.Base(name), ".hints")
+		if _, err := uuid.Parse(id); err != nil {
+			continue
+		}
+		f, err := os.OpenFile(name, os.O_RDWR, 0600)
+		if err != nil {
+			return err
+		}
+		queue := &hintQueue{f: f}
+		r := bufio.NewReader(f)
+		for {
+			frame, err := readFrame(r)
+			if err != nil {
+				// a frame cut short by a crash ends the queue
+				break
+			}
+			size := int64(PEER_FRAME_HEADER_SIZE + len(frame.payload))
+			queue.hints = append(queue.hints, hint{expireAt: expireAt, pos: queue.end, size: size})
+			queue.end += size
+		}
+		if err := f.Truncate(queue.end); err != nil {
+			f.Close()
+			return err
+		}
+		if len(queue.hints) == 0 {
+			f.Close()
+			os.Remove(name)
+			continue
+		}
+		h.queues[id] = queue
+		atomic.AddInt64(&h.stats.HintsQueued, int64(len(queue.hints)))
+	}
+	return nil
+}
+
+func (h *hintedHandoff) enabled() bool {
+	return atomic.LoadInt64(&h.ttl) > 0
+}
+
+// add appends the hint of a write to the queue of a peer.
+func (h *hintedHandoff) add(id string, q *Query) error {
+	ttl := atomic.LoadInt64(&h.ttl)
+	if ttl == 0 {
+		return nil
+	}
+	// the ID names the hints file
+	if _, err := uuid.Parse(id); err != nil {
+		return fmt.Errorf("invalid peer ID %q", id)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	queue := h.queues[id]
+	if queue == nil {
+		f, err := os.OpenFile(filepath.Join(h.dir, fmt.Sprintf("%s.hints", id)), os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		// the writes are appended to the hints of a previous run
+		queue = &hintQueue{f: f, end: info.Size()}
+		h.queues[id] = queue
+	}
+	data := q.PeerQueryEncode()
+	if _, err := queue.f.WriteAt(data, queue.end); err != nil {
+		return err
+	}
+	queue.hints = append(queue.hints, hint{
+		offset:   q.offset,
+		expireAt: time.Now().Add(time.Duration(ttl) * time.Second),
+		pos:      queue.end,
+		size:     int64(len(data)),
+	})
+	queue.end += int64(len(data))
+	atomic.AddInt64(&h.stats.HintsQueued, 1)
+	if over := len(queue.hints) - int(atomic.LoadInt64(&h.max)); over > 0 {
+		queue.hints = queue.hints[over:]
+		atomic.AddInt64(&h.stats.HintsDropped, int64(over))
+		atomic.AddInt64(&h.stats.HintsQueued, -int64(over))
+	}
+	return h.compact(queue)
+}
+
+// compact rewrites the hints file of a queue without the dropped hints once
+// they take more than HINTS_COMPACT_SIZE bytes.
+func (h *hintedHandoff) compact(queue *hintQueue) error {
+	if len(queue.hints) == 0 || queue.hints[0].pos <= HINTS_COMPACT_SIZE {
+		return nil
+	}
+	first := queue.hints[0].pos
+	data := make([]byte, queue.end-first)
+	if _, err := queue.f.ReadAt(data, first); err != nil {
+		return err
+	}
+	if err := queue.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := queue.f.WriteAt(data, 0); err != nil {
+		return err
+	}
+	for i := range queue.hints {
+		queue.hints[i].pos -= first
+	}
+	queue.end -= first
+	return nil
+}
+
+// expire drops the hints expired at now.
+func (h *hintedHandoff) expire(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, queue := range h.queues {
+		expired := 0
+		for expired < len(queue.hints) && !now.Before(queue.hints[expired].expireAt) {
+			expired++
+		}
+		if expired == 0 {
+			continue
+		}
+		queue.hints = queue.hints[expired:]
+		atomic.AddInt64(&h.stats.HintsExpired, int64(expired))
+		atomic.AddInt64(&h.stats.HintsQueued, -int64(expired))
+		if len(queue.hints) == 0 {
+			h.remove(id)
+			continue
+		}
+		h.compact(queue)
+	}
+}
+
+// take returns the Q frames of the hints of a peer following offset and
+// removes the queue of the peer. ok is false, and the queue is kept, when
+// some of the writes following offset were not hinted or were dropped, or
+// when reloaded hints were not replayed yet.
+func (h *hintedHandoff) take(id string, offset int64) (frames [][]byte, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	queue := h.queues[id]
+	if queue == nil || len(queue.hints) == 0 || queue.hints[0].offset == 0 || queue.hints[0].offset > offset+1 {
+		return nil, false
+	}
+	for _, hint := range queue.hints {
+		// the hints handed off by a leaving peer have no offset
+		if hint.offset != 0 && hint.offset <= offset {
+			continue
+		}
+		data := make([]byte, hint.size)
+		if _, err := queue.f.ReadAt(data, hint.pos); err != nil {
+			return nil, false
+		}
+		frames = append(frames, data)
+	}
+	h.remove(id)
+	return frames, true
+}
+
+// takeReloaded returns the Q frames of the hints of a peer reloaded from a
+// previous run and removes them from its queue.
+func (h *hintedHandoff) takeReloaded(id string) (frames [][]byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	queue := h.queues[id]
+	if queue == nil {
+		return nil
+	}
+	reloaded := 0
+	for reloaded < len(queue.hints) && queue.hints[reloaded].offset == 0 {
+		hint := queue.hints[reloaded]
+		data := make([]byte, hint.size)
+		if _, err := queue.f.ReadAt(data, hint.pos); err != nil {
+			break
+		}
+		frames = append(frames, data)
+		reloaded++
+	}
+	if reloaded == 0 {
+		return nil
+	}
+	queue.hints = queue.hints[reloaded:]
+	atomic.AddInt64(&h.stats.HintsQueued, -int64(reloaded))
+	if len(queue.hints) == 0 {
+		h.remove(id)
+	} else {
+		h.compact(queue)
+	}
+	return frames
+}
+
+// ids returns the IDs of the peers with hints.
+func (h *hintedHandoff) ids() (ids []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id := range h.queues {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// frames returns the Q frames of the hints of a peer.
+func (h *hintedHandoff) frames(id string) (frames [][]byte, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	queue := h.queues[id]
+	if queue == nil {
+		return nil, nil
+	}
+	for _, hint := range queue.hints {
+		data := make([]byte, hint.size)
+		if _, err := queue.f.ReadAt(data, hint.pos); err != nil {
+			return nil, err
+		}
+		frames = append(frames, data)
+	}
+	return frames, nil
+}
+
+// drop removes the hints of a peer.
+func (h *hintedHandoff) drop(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(id)
+}
+
+// empty reports whether no hint is kept.
+func (h *hintedHandoff) empty() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.queues) == 0
+}
+
+// dropAll removes the hints of every peer.
+func (h *hintedHandoff) dropAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id := range h.queues {
+		h.remove(id)
+	}
+}
+
+func (h *hintedHandoff) remove(id string) {
+	queue := h.queues[id]
+	if queue == nil {
+		return
+	}
+	atomic.AddInt64(&h.stats.HintsQueued, -int64(len(queue.hints)))
+	queue.f.Close()
+	os.Remove(queue.f.Name())
+	delete(h.queues, id)
+}
+
+// hintUnreachable keeps a write as hints for the peers the peer was linked
+// with which have no link ready: the links reconnecting and the members of
+// the cluster. With sharding, only the owners of the keys of the write are
+// hinted.
+func (p *Peer) hintUnreachable(query *Query, owners []string) {
+	if !p.hints.enabled() {
+		return
+	}
+	ready := make(map[string]bool)
+	down := make(map[string]bool)
+	for _, link := range p.Mesh.List() {
+		id := link.remoteID()
+		switch {
+		case id == "":
+		case link.Ready():
+			ready[id] = true
+		case !link.Removed():
+			down[id] = true
+		}
+	}
+	for _, m := range p.gossip.Members() {
+		down[m.ID] = true
+	}
+	for id := range down {
+		if ready[id] || stringInSlice(id, query.reached) || (owners != nil && !stringInSlice(id, owners)) {
+			continue
+		}
+		p.syncMu.Lock()
+		_, linked := p.replOffsets[id]
+		p.syncMu.Unlock()
+		if !linked {
+			continue
+		}
+		if err := p.hints.add(id, query); err != nil {
+			fmt.Printf("[peer %s] Unable to hint write: %s\n", id, err)
+		}
+	}
+}
+
+// hintedWrites returns the writes hinted for a peer following offset, false
+// when some of them are missing.
+func (p *Peer) hintedWrites(id string, offset int64) ([]*Query, bool) {
+	frames, ok := p.hints.take(id, offset)
+	if !ok {
+		return nil, false
+	}
+	queries, ok := p.hintFrames(frames)
+	if !ok {
+		return nil, false
+	}
+	atomic.AddInt64(&p.Stats.HintsReplayed, int64(len(queries)))
+	return queries, true
+}
+
+func (p *Peer) hintFrames(frames [][]byte) ([]*Query, bool) {
+	queries := []*Query{}
+	for _, data := range frames {
+		f, err := readFrame(bytes.NewReader(data))
+		if err != nil {
+			return nil, false
+		}
+		q, err := p.ParsePeerQuery(nil, f.payload)
+		if err != nil {
+			return nil, false
+		}
+		queries = append(queries, q)
+	}
+	return queries, true
+}
+
+// reloadedHints returns the writes hinted for a peer by a previous run.
+// Their offsets belong to the backlog of that run and are not sent.
+func (p *Peer) reloadedHints(id string) []*Query {
+	queries, ok := p.hintFrames(p.hints.takeReloaded(id))
+	if !ok {
+		fmt.Printf("[peer %s] Unable to read the reloaded hints\n", id)
+		return nil
+	}
+	for _, q := range queries {
+		q.offset = 0
+	}
+	return queries
+}
+
+// replayHints sends the writes reloaded from the hints of a previous run to
+// a peer which linked again.
+func (p *Peer) replayHints(link *Peer, queries []*Query, done chan struct{}) {
+	for _, q := range queries {
+		// writes are sent after the snapshot of a full sync
+		if !link.fullSync.hold(q) {
+			select {
+			case link.broadcastVQLQuery <- q:
+			case <-done:
+				return
+			}
+		}
+		atomic.AddInt64(&p.Stats.HintsReplayed, 1)
+	}
+}
+
+// handOffHints sends the hints kept for every peer to a live peer, which
+// keeps them until their peer links with it. It returns the number of hints
+// which could not be handed off.
+func (p *Peer) handOffHints() (left int) {
+	for _, id := range p.hints.ids() {
+		frames, err := p.hints.frames(id)
+		if err != nil {
+			fmt.Printf("[peer %s] Unable to read the hints: %s\n", id, err)
+			continue
+		}
+		handedOff := false
+		for _, link := range p.replicas() {
+			if !link.Ready() || link.remoteID() == id {
+				continue
+			}
+			if err := p.sendHints(link, id, frames); err != nil {
+				fmt.Printf("[peer %s] Unable to hand the hints off: %s\n", link.connString(), err)
+				continue
+			}
+			handedOff = true
+			break
+		}
+		if !handedOff {
+			left += len(frames)
+			continue
+		}
+		p.hints.drop(id)
+	}
+	return left
+}
+
+// sendHints sends the hints of a peer to the remote peer of a link with
+// PEER HINT, in batches.
+func (p *Peer) sendHints(link *Peer, id string, frames [][]byte) error {
+	for i := 0; i < len(frames); i += MIGRATION_BATCH_SIZE {
+		end := i + MIGRATION_BATCH_SIZE
+		if end > len(frames) {
+			end = len(frames)
+		}
+		parsed := append([][]byte{[]byte("peer"), []byte("hint"), []byte(id)}, frames[i:end]...)
+		resp, err := p.RemoteExecute(link, NewSimpleQuery(string(formattedArray(parsed))))
+		if err != nil {
+			return err
+		}
+		if resp.isError() {
+			return fmt.Errorf("%s", resp.Payload[0])
+		}
+	}
+	return nil
+}
+
+// peerHint answers PEER HINT: the writes handed off by a leaving peer are
+// kept for their peer like the hints reloaded from a previous run.
+func (q *Query) peerHint(r *Response, args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf(Help("peer"))
+	}
+	frames := [][]byte{}
+	for _, arg := range args[2:] {
+		frames = append(frames, []byte(arg))
+	}
+	queries, ok := q.p.hintFrames(frames)
+	if !ok {
+		return fmt.Errorf("ERR invalid hint")
+	}
+	for _, hinted := range queries {
+		hinted.offset = 0
+		if err := q.p.hints.add(args[1], hinted); err != nil {
+			return err
+		}
+	}
+	r.OK()
+	return nil
+}
+
+func infoHints(p *Peer) []string {
+	return []string{
+		fmt.Sprintf("hint_ttl:%d", atomic.LoadInt64(&p.hints.ttl)),
+		fmt.Sprintf("hints_queued:%d", atomic.LoadInt64(&p.Stats.HintsQueued)),
+		fmt.Sprintf("hints_replayed:%d", atomic.LoadInt64(&p.Stats.HintsReplayed)),
+		fmt.Sprintf("hints_expired:%d", atomic.LoadInt64(&p.Stats.HintsExpired)),
+		fmt.Sprintf("hints_dropped:%d", atomic.LoadInt64(&p.Stats.HintsDropped)),
+	}
+}
@@ -0,0 +1,177 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestHintQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "hints-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := &Stats{}
+	h := newHintedHandoff(dir, stats)
+	h.max = 2
+	peerB, peerC := uuid.New().String(), uuid.New().String()
+	for i := 1; i <= 3; i++ {
+		q := NewSimpleQuery(fmt.Sprintf("set k %d", i))
+		q.offset = int64(i)
+		if err := h.add(peerB, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if output := fmt.Sprint(stats.HintsQueued, stats.HintsDropped); output != "2 1" {
+		t.Errorf("want %+v, got %+v", "2 1", output)
+	}
+	// the hint following offset 0 was dropped
+	if _, ok := h.take(peerB, 0); ok {
+		t.Errorf("want %+v, got %+v", false, ok)
+	}
+	frames, ok := h.take(peerB, 2)
+	if !ok || len(frames) != 1 || !strings.Contains(string(frames[0]), "set k 3") {
+		t.Errorf("want the hint at offset 3, got %q %+v", frames, ok)
+	}
+	if _, ok := h.take(peerB, 2); ok || stats.HintsQueued != 0 {
+		t.Errorf("want the hints taken, got %+v %+v", ok, stats.HintsQueued)
+	}
+
+	h.add(peerC, NewSimpleQuery("set k 4"))
+	h.expire(time.Now())
+	if stats.HintsQueued != 1 {
+		t.Errorf("want %+v, got %+v", 1, stats.HintsQueued)
+	}
+	h.expire(time.Now().Add(HINT_TTL * time.Second))
+	if output := fmt.Sprint(stats.HintsQueued, stats.HintsExpired); output != "0 1" {
+		t.Errorf("want %+v, got %+v", "0 1", output)
+	}
+}
+
+func TestHintReload(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "hints-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHintedHandoff(dir, &Stats{})
+	id := uuid.New().String()
+	for i := 1; i <= 2; i++ {
+		q := NewSimpleQuery(fmt.Sprintf("set k %d", i))
+		q.offset = int64(i)
+		if err := h.add(id, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.add("../b", NewSimpleQuery("set k 3")); err == nil {
+		t.Errorf("want the invalid peer ID rejected")
+	}
+
+	// a restarted peer reloads the hints
+	stats := &Stats{}
+	h = newHintedHandoff(dir, stats)
+	if err := h.load(); err != nil {
+		t.Fatal(err)
+	}
+	if stats.HintsQueued != 2 {
+		t.Errorf("want %+v, got %+v", 2, stats.HintsQueued)
+	}
+	// their offsets belong to the previous run
+	if _, ok := h.take(id, 0); ok {
+		t.Errorf("want %+v, got %+v", false, ok)
+	}
+	q := NewSimpleQuery("set k 3")
+	q.offset = 1
+	h.add(id, q)
+	frames := h.takeReloaded(id)
+	if len(frames) != 2 || !strings.Contains(string(frames[1]), "set k 2") {
+		t.Errorf("want the reloaded hints, got %q", frames)
+	}
+	frames, ok := h.take(id, 0)
+	if !ok || len(frames) != 1 || !strings.Contains(string(frames[0]), "set k 3") {
+		t.Errorf("want the hint at offset 1, got %q %+v", frames, ok)
+	}
+
+	// a peer keeps its temporary directory unless the hints directory is
+	// usable
+	p, err := NewPeer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	temp, file := p.hints.dir, filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetHintsDir(filepath.Join(file, "hints")); err == nil || p.hints.dir != temp {
+		t.Errorf("want an error and %s, got %+v and %s", temp, err, p.hints.dir)
+	}
+	if err := p.SetHintsDir(dir); err != nil || p.hints.dir != dir {
+		t.Errorf("want %s, got %+v and %s", dir, err, p.hints.dir)
+	}
+}
+
+func TestHintedHandoff(t *testing.T) {
+	client1, client2 := setupGossip(), setupGossip()
+	p1, p2 := client1.vqlTCPServer.Peer, client2.vqlTCPServer.Peer
+	// the backlog of p1 only holds the last write
+	p1.backlog = newReplicationBacklog(1)
+	link, err := p2.ConnectToPeerAddr(p1.connString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output := waitPeerStatus(link, PEER_STATUS_CONNECTED); output != PEER_STATUS_CONNECTED {
+		t.Fatalf("want %+v, got %+v", PEER_STATUS_CONNECTED, output)
+	}
+	<-executeAsync(client1, "set a 1")
+	expected := "offset=1,"
+	if output := waitInfoReplication(client2, expected); !strings.Contains(output, expected) {
+		t.Fatalf("want %q in %q", expected, output)
+	}
+	if output := waitMemberState(client1, p2.ID, memberAlive); !strings.Contains(output, "state=alive") {
+		t.Fatalf("want %s alive in %q", p2.ID, output)
+	}
+	for _, p := range []*Peer{p1, p2} {
+		p.gossip.mu.Lock()
+		p.gossip.deaf = true
+		p.gossip.mu.Unlock()
+	}
+
+	// writes made while p2 is not linked are hinted
+	p2.RemovePeer(link)
+	for i := 0; i < 100 && p1.Mesh.Len() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	<-executeAsync(client1, "set b 2")
+	<-executeAsync(client1, "incr c")
+	expected = "hints_queued:2"
+	if output := <-executeAsync(client1, "info replication"); !strings.Contains(output, expected) {
+		t.Fatalf("want %q in %q", expected, output)
+	}
+
+	// the writes missing from the backlog are sent from the hints
+	if _, err := p2.ConnectToPeerAddr(p1.connString()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && p2.storage.Get("c") == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if output := string(p2.storage.Get("b")) + string(p2.storage.Get("c")); output != "21" {
+		t.Errorf("want %+v, got %+v", "21", output)
+	}
+	output := waitInfoReplication(client2, "partial_syncs_received:1")
+	for _, e := range []string{"partial_syncs_received:1", "full_syncs_received:1", "offset=3,"} {
+		if !strings.Contains(output, e) {
+			t.Errorf("want %q in %q", e, output)
+		}
+	}
+	output = <-executeAsync(client1, "info replication")
+	for _, e := range []string{"hints_queued:0", "hints_replayed:2", "hints_expired:0", "partial_syncs_served:1"} {
+		if !strings.Contains(output, e) {
+			t.Errorf("want %q in %q", e, output)
+		}
+	}
+}
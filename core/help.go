@@ -5,7 +5,39 @@ func Help(topic string) string {
 	help["peer"] = `
 peer connect <host>:<port>
 peer list
+peer read <key>
+peer restore <key> <version> <expire-at-ms> <type> <value> [<key> ...]
+peer importing <start-slot> <end-slot> <source-id>
+peer stable <start-slot> <end-slot>
+peer merkle <peer-id> <node> [<node> ...]
+peer range <peer-id> <leaf> [<leaf> ...]
+peer repair <id>
+peer hint <peer-id> <frame> [<frame> ...]
+peer role
+peer vote <epoch> <primary-addr> <primary-id> <offset>
+peer promoted <epoch> <addr> <failed-primary-addr>
 peer remove <id>
+peer leave
+  `
+	help["consistency"] = `
+consistency set <prefix> ONE|QUORUM|ALL
+consistency del <prefix>
+consistency get <key>
+consistency list
+  `
+	help["crdt"] = `
+crdt set <prefix> REGISTER|COUNTER
+crdt del <prefix>
+crdt get <key>
+crdt list
+crdt merge <key> <type> <state>
+  `
+	help["cluster"] = `
+cluster countkeysinslot <slot>
+cluster keyslot <key>
+cluster rebalance
+cluster slots
+cluster shards
   `
 	if topic != "" && help[topic] != "" {
 		return help[topic]
@@ -0,0 +1,147 @@
+package core
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// A peer leaves the cluster with PEER LEAVE, or when the process receives
+// SIGTERM. It declares itself dead to the members it is linked with, so
+// that they stop routing to it and the raft leader removes it, without
+// waiting for the failure detector. It stops accepting VQL clients, waits
+// up to DRAIN_TIMEOUT for the queries in progress, and closes the client
+// connections. It then hands its data off: with sharding, it moves the
+// keys it stores to the owners computed without it; otherwise it waits
+// until the linked peers acknowledged the writes it replicated to them. It
+// waits up to HANDOFF_TIMEOUT for the handoff. The hints it kept for the
+// unreachable peers are kept until then, for the peers which link again
+// meanwhile and take them, unless gossip declares all of them dead. The
+// hints left are handed off to a live peer, which keeps them for their
+// peer. It finally closes its links, flushes its WAL and is left.
+const (
+	// seconds waited for the queries in progress
+	DRAIN_TIMEOUT = 30
+	// seconds waited for the handoff of the data
+	HANDOFF_TIMEOUT = 60
+	// milliseconds between two checks of the handoff
+	HANDOFF_CHECK_INTERVAL = 100
+)
+
+var (
+	errLeaving = fmt.Errorf("TRYAGAIN Peer is leaving the cluster")
+)
+
+// Leaving reports whether the peer started to leave the cluster.
+func (p *Peer) Leaving() bool {
+	return atomic.LoadInt32(&p.leaving) == 1
+}
+
+// Left returns a channel closed once the peer left the cluster.
+func (p *Peer) Left() <-chan struct{} {
+	return p.left
+}
+
+// Leave leaves the cluster and returns once the peer left. It may be called
+// more than once.
+func (p *Peer) Leave() {
+	p.leaveOnce.Do(func() {
+		atomic.StoreInt32(&p.leaving, 1)
+		fmt.Println("[peer] Leaving the cluster")
+		p.gossip.leave()
+		if p.vqlTCPServer != nil {
+			p.vqlTCPServer.Drain(DRAIN_TIMEOUT * time.Second)
+		}
+		p.handOff(time.Now().Add(HANDOFF_TIMEOUT * time.Second))
+		if err := p.StopDiscovery(); err != nil {
+			fmt.Printf("[peer] Unable to deregister: %s\n", err)
+		}
+		if p.tcpServer != nil {
+			p.tcpServer.Close()
+		}
+		for _, link := range p.Mesh.List() {
+			p.RemovePeer(link)
+		}
+		p.Shutdown()
+		close(p.left)
+	})
+	<-p.left
+}
+
+// handOff hands the data of the peer off to the remaining peers, until
+// deadline.
+func (p *Peer) handOff(deadline time.Time) {
+	if p.cluster != nil {
+		for {
+			err := p.cluster.Rebalance()
+			if err != errRebalanceInProgress {
+				if err != nil {
+					fmt.Printf("[peer] Unable to move the keys: %s\n", err)
+				}
+				break
+			}
+			if !waitUntil(deadline, p.cluster.migrationsDone) {
+				break
+			}
+		}
+		if !waitUntil(deadline, p.cluster.migrationsDone) {
+			fmt.Println("[peer] Leaving before the keys are moved")
+		}
+	}
+	if !waitUntil(deadline, p.replicated) {
+		fmt.Println("[peer] Leaving before the writes are acknowledged")
+	}
+	// the dead peers do not take their hints
+	taken := func() bool {
+		for _, id := range p.hints.ids() {
+			if !p.gossip.isDead(id) {
+				return false
+			}
+		}
+		return true
+	}
+	waitUntil(deadline, taken)
+	if left := p.handOffHints(); left > 0 {
+		fmt.Printf("[peer] Leaving before the hints are taken, dropping %d hints\n", left)
+	}
+	p.hints.dropAll()
+}
+
+// migrationsDone reports whether the migrations of the last rebalance
+// ended.
+func (c *Cluster) migrationsDone() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range c.migrations {
+		if m.state == MIGRATION_PENDING || m.state == MIGRATION_RUNNING {
+			return false
+		}
+	}
+	return true
+}
+
+// replicated reports whether the peers linked with the peer acknowledged
+// every write replicated to them.
+func (p *Peer) replicated() bool {
+	for _, link := range p.Mesh.List() {
+		if !link.Ready() {
+			continue
+		}
+		if len(link.broadcastVQLQuery) > 0 || atomic.LoadInt64(&link.replAcked) < atomic.LoadInt64(&link.replSent) {
+			return false
+		}
+	}
+	return true
+}
+
+// waitUntil waits until done returns true, false when deadline passed
+// before.
+func waitUntil(deadline time.Time, done func() bool) bool {
+	for !done() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(HANDOFF_CHECK_INTERVAL * time.Millisecond)
+	}
+	return true
+}
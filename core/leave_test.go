@@ -0,0 +1,127 @@
+package core
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestPeerLeave(t *testing.T) {
+	client1, client2 := setupGossip(), setupGossip()
+	p1 := client1.vqlTCPServer.Peer
+	<-executeAsync(client2, "peer connect "+p1.connString())
+	if line := waitMemberState(client2, p1.ID, memberAlive); !strings.Contains(line, "connection=Connected") {
+		t.Fatalf("want member alive and connected, got %q", line)
+	}
+	conn, reader := pipeVQLConn(client1.vqlTCPServer)
+	conn.Write([]byte("set foo bar\r\n"))
+	expectReply(t, conn, reader, "+OK\r\n")
+
+	if output := <-executeAsync(client1, "peer leave"); output != "+OK\r\n" {
+		t.Fatalf("want %q, got %q", "+OK\r\n", output)
+	}
+	select {
+	case <-p1.Left():
+	case <-time.After(20 * time.Second):
+		t.Fatal("want the peer to leave")
+	}
+
+	// the remaining peer sees it dead and stores its writes
+	if line := waitMemberState(client2, p1.ID, memberDead); !strings.Contains(line, "state=dead") {
+		t.Errorf("want member dead, got %q", line)
+	}
+	if output := <-executeAsync(client2, "get foo"); output != "$3\r\nbar\r\n" {
+		t.Errorf("want %q, got %q", "$3\r\nbar\r\n", output)
+	}
+
+	// it does not listen anymore and closed the connections of the clients
+	for _, addr := range []string{p1.connString(), client1.vqlTCPServer.connString()} {
+		if c, err := net.DialTimeout("tcp4", addr, time.Second); err == nil {
+			c.Close()
+			t.Errorf("want connection to %s refused", addr)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := reader.ReadByte(); err == nil {
+		t.Errorf("want the client connection closed")
+	}
+	conn, reader = pipeVQLConn(client1.vqlTCPServer)
+	conn.Write([]byte("get foo\r\n"))
+	expectReply(t, conn, reader, "-TRYAGAIN Peer is leaving the cluster\r\n")
+	conn.Close()
+
+	// and flushed its WAL
+	select {
+	case <-p1.walWriter.WaitTerminate:
+	case <-time.After(time.Second):
+		t.Errorf("want the WAL closed")
+	}
+	expected := "leaving:1"
+	if output := <-executeAsync(client1, "info peer"); !strings.Contains(output, expected) {
+		t.Errorf("want %q in %q", expected, output)
+	}
+	// leaving again returns at once
+	p1.Leave()
+	if output := <-executeAsync(client2, "info peer"); !strings.Contains(output, "leaving:0") {
+		t.Errorf("want %q in %q", "leaving:0", output)
+	}
+}
+
+func TestHandOffHints(t *testing.T) {
+	client := setupGossip()
+	p := client.vqlTCPServer.Peer
+	id := uuid.New().String()
+
+	// the hints are kept until the deadline
+	if err := p.hints.add(id, NewSimpleQuery("set a 1")); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	p.handOff(start.Add(300 * time.Millisecond))
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || !p.hints.empty() {
+		t.Errorf("want the hints kept until the deadline, got %+v %+v", elapsed, p.hints.empty())
+	}
+
+	// or until their peer took them
+	p.hints.add(id, NewSimpleQuery("set a 2"))
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		p.hints.drop(id)
+	}()
+	start = time.Now()
+	p.handOff(start.Add(10 * time.Second))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("want the handoff done once the hints are taken, got %+v", elapsed)
+	}
+
+	// or not waited for when gossip declares their peer dead
+	p.gossip.mu.Lock()
+	p.gossip.members[id] = &member{ID: id, State: memberDead}
+	p.gossip.mu.Unlock()
+	p.hints.add(id, NewSimpleQuery("set a 3"))
+	start = time.Now()
+	p.handOff(start.Add(10 * time.Second))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("want the handoff done at once for a dead peer, got %+v", elapsed)
+	}
+
+	// the hints left are handed off to a live peer
+	other := setupGossip()
+	<-executeAsync(other, "peer connect "+p.connString())
+	if line := waitMemberState(other, p.ID, memberAlive); !strings.Contains(line, "connection=Connected") {
+		t.Fatalf("want member alive and connected, got %q", line)
+	}
+	p.hints.add(id, NewSimpleQuery("set a 4"))
+	p.hints.add(id, NewSimpleQuery("set a 5"))
+	p.handOff(time.Now())
+	if !p.hints.empty() {
+		t.Errorf("want the hints handed off")
+	}
+	frames := other.vqlTCPServer.Peer.hints.takeReloaded(id)
+	if len(frames) != 2 || !strings.Contains(string(frames[1]), "set a 5") {
+		t.Errorf("want the hints kept by the live peer, got %q", frames)
+	}
+}
@@ -1,33 +1,48 @@
 package core
 
+import "sync"
+
 type Mesh struct {
-	Peers      map[*Peer]bool
-	register   chan *Peer
-	deregister chan *Peer
+	mu    sync.RWMutex
+	Peers map[*Peer]bool
 }
 
 func newMesh() *Mesh {
 	return &Mesh{
-		Peers:      make(map[*Peer]bool),
-		register:   make(chan *Peer),
-		deregister: make(chan *Peer),
+		Peers: make(map[*Peer]bool),
 	}
 }
 
-func (m *Mesh) registrator() {
-	for {
-		select {
-		case p := <-m.register:
-			m.Peers[p] = true
-			// go p.getRemoteID(remotePeer)
-		case p := <-m.deregister:
-			delete(m.Peers, p)
-		}
+func (m *Mesh) Register(p *Peer) {
+	m.mu.Lock()
+	m.Peers[p] = true
+	m.mu.Unlock()
+}
+
+func (m *Mesh) Deregister(p *Peer) {
+	m.mu.Lock()
+	delete(m.Peers, p)
+	m.mu.Unlock()
+}
+
+// List returns the registered peers.
+func (m *Mesh) List() (peers []*Peer) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for p := range m.Peers {
+		peers = append(peers, p)
 	}
+	return peers
+}
+
+func (m *Mesh) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.Peers)
 }
 
 func (m *Mesh) GetPeerByKey(key string) *Peer {
-	for p := range m.Peers {
+	for _, p := range m.List() {
 		if p.Key() == key {
 			return p
 		}
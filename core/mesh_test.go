@@ -6,7 +6,6 @@ import (
 
 func TestMesh(t *testing.T) {
 	m := newMesh()
-	go m.registrator()
 	p1, err := NewPeer("127.0.0.1", 0)
 	if err != nil {
 		t.Error(err)
@@ -15,12 +14,21 @@ func TestMesh(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	m.register <- p1
-	m.register <- p2
-	output := len(m.Peers)
+	m.Register(p1)
+	m.Register(p2)
+	output := m.Len()
 	expected := 2
 	if expected != output {
 		t.Errorf("want %+v, got %+v", expected, output)
 	}
 
+	m.Deregister(p1)
+	if p := m.GetPeerByKey(p2.Key()); p != p2 {
+		t.Errorf("want %+v, got %+v", p2, p)
+	}
+	output = m.Len()
+	expected = 1
+	if expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
 }
@@ -0,0 +1,373 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	storagePkg "github.com/bjorand/velocidb/storage"
+)
+
+// A rebalance moves the keys a peer stores to the owners of their slot once
+// the members of the cluster changed. The slots are migrated by ranges of
+// contiguous slots with the same owners, MIGRATION_BATCH_SIZE keys at a
+// time, with their version and expiration time: the owners keep the latest
+// version of a key. When the peer does not own the slots anymore, the keys
+// are removed once copied and the slots are migrating: the peer keeps
+// serving the keys it still stores and answers ASK for the others. The
+// owners are told the slots are importing from the peer, they answer ASK
+// for the keys they do not store yet unless the client sent ASKING.
+const (
+	MIGRATION_BATCH_SIZE = 100
+)
+
+const (
+	MIGRATION_PENDING = iota
+	MIGRATION_RUNNING
+	MIGRATION_DONE
+	MIGRATION_FAILED
+)
+
+var (
+	MIGRATION_STATE_TEXT = map[int]string{
+		MIGRATION_PENDING: "pending",
+		MIGRATION_RUNNING: "running",
+		MIGRATION_DONE:    "done",
+		MIGRATION_FAILED:  "failed",
+	}
+	errRebalanceInProgress = fmt.Errorf("ERR Rebalance already in progress")
+)
+
+// slotMigration is the migration of a range of slots to their owners.
+type slotMigration struct {
+	start, end int
+	targets    []string
+	// move is set when the peer does not own the slots anymore
+	move bool
+	// slots holds the slots of the range with keys, and their keys
+	slots []int
+	keys  map[int][]string
+	// progress, guarded by the mutex of the cluster
+	state     int
+	slotsDone int
+	keysMoved int
+	err       error
+}
+
+// planRebalance returns the migrations of the keys the peer stores to the
+// owners of their slot.
+func (c *Cluster) planRebalance() (migrations []*slotMigration) {
+	keys := make(map[int][]string)
+	for _, key := range c.p.storage.Keys("*") {
+		slot := keySlot(key)
+		keys[slot] = append(keys[slot], key)
+	}
+	slots := []int{}
+	for slot := range keys {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+	var last *slotMigration
+	for _, slot := range slots {
+		owners := c.slotOwners(slot)
+		targets := []string{}
+		for _, id := range owners {
+			if id != c.p.ID {
+				targets = append(targets, id)
+			}
+		}
+		if len(targets) == 0 {
+			continue
+		}
+		move := !stringInSlice(c.p.ID, owners)
+		if last == nil || last.move != move || strings.Join(last.targets, ",") != strings.Join(targets, ",") {
+			last = &slotMigration{start: slot, targets: targets, move: move, keys: make(map[int][]string)}
+			migrations = append(migrations, last)
+		}
+		sort.Strings(keys[slot])
+		last.end = slot
+		last.slots = append(last.slots, slot)
+		last.keys[slot] = keys[slot]
+	}
+	return migrations
+}
+
+// Rebalance starts the migration of the keys the peer stores to the owners
+// of their slot.
+func (c *Cluster) Rebalance() error {
+	c.mu.Lock()
+	for _, m := range c.migrations {
+		if m.state == MIGRATION_PENDING || m.state == MIGRATION_RUNNING {
+			c.mu.Unlock()
+			return errRebalanceInProgress
+		}
+	}
+	c.mu.Unlock()
+	migrations := c.planRebalance()
+	c.mu.Lock()
+	c.migrations = migrations
+	c.mu.Unlock()
+	go func() {
+		for _, m := range migrations {
+			c.migrate(m)
+		}
+	}()
+	return nil
+}
+
+func (c *Cluster) setMigrationState(m *slotMigration, state int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m.state = state
+	m.err = err
+}
+
+func (c *Cluster) migrate(m *slotMigration) {
+	c.setMigrationState(m, MIGRATION_RUNNING, nil)
+	links := []*Peer{}
+	for _, id := range m.targets {
+		link := c.link(id)
+		if link == nil {
+			c.setMigrationState(m, MIGRATION_FAILED, fmt.Errorf("no link with peer %s", id))
+			return
+		}
+		links = append(links, link)
+	}
+	if m.move {
+		c.setSlotsState(m.slots, c.migrating, "migrating")
+		defer c.setSlotsState(m.slots, c.migrating, "")
+	}
+	if err := c.notifyTargets(links, "importing", m); err != nil {
+		c.setMigrationState(m, MIGRATION_FAILED, err)
+		return
+	}
+	for _, slot := range m.slots {
+		keys := m.keys[slot]
+		for i := 0; i < len(keys); i += c.batchSize {
+			end := i + c.batchSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+			moved, err := c.migrateBatch(links, keys[i:end], m.move)
+			if err != nil {
+				c.notifyTargets(links, "stable", m)
+				c.setMigrationState(m, MIGRATION_FAILED, err)
+				return
+			}
+			c.mu.Lock()
+			m.keysMoved += moved
+			c.mu.Unlock()
+		}
+		c.mu.Lock()
+		m.slotsDone++
+		c.mu.Unlock()
+	}
+	if err := c.notifyTargets(links, "stable", m); err != nil {
+		c.setMigrationState(m, MIGRATION_FAILED, err)
+		return
+	}
+	c.setMigrationState(m, MIGRATION_DONE, nil)
+}
+
+// migrateBatch copies keys to the targets, and removes them when they are
+// moved.
+func (c *Cluster) migrateBatch(links []*Peer, keys []string, move bool) (int, error) {
+	items := []storagePkg.Item{}
+	for _, key := range keys {
+		if item, ok := c.p.storage.DumpKey(key); ok {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 {
+		return 0, nil
+	}
+	parsed := [][]byte{[]byte("peer"), []byte("restore")}
+	for _, item := range items {
+		parsed = append(parsed, encodeStorageItem(item)...)
+	}
+	for _, link := range links {
+		resp, err := c.p.RemoteExecute(link, NewSimpleQuery(string(formattedArray(parsed))))
+		if err != nil {
+			return 0, err
+		}
+		if resp.isError() {
+			return 0, fmt.Errorf("%s", resp.Payload[0])
+		}
+	}
+	if move {
+		// writes of the keys during the batch were replicated to the
+		// owners
+		for _, item := range items {
+			c.p.storage.Del(item.Key)
+		}
+	}
+	return len(items), nil
+}
+
+// notifyTargets sends PEER IMPORTING or PEER STABLE for the slots of the
+// migration to the targets.
+func (c *Cluster) notifyTargets(links []*Peer, state string, m *slotMigration) error {
+	parsed := [][]byte{[]byte("peer"), []byte(state), []byte(strconv.Itoa(m.start)), []byte(strconv.Itoa(m.end))}
+	if state == "importing" {
+		parsed = append(parsed, []byte(c.p.ID))
+	}
+	for _, link := range links {
+		resp, err := c.p.RemoteExecute(link, NewSimpleQuery(string(formattedArray(parsed))))
+		if err != nil {
+			return err
+		}
+		if resp.isError() {
+			return fmt.Errorf("%s", resp.Payload[0])
+		}
+	}
+	return nil
+}
+
+// STORAGE_ITEM_FIELDS is the number of fields of an encoded item, the
+// tombstones of the deleted keys are encoded with the STORAGE_TOMBSTONE type.
+const (
+	STORAGE_ITEM_FIELDS = 5
+	STORAGE_TOMBSTONE   = "tombstone"
+)
+
+// encodeStorageItem returns the key, version, expiration time in
+// milliseconds since the epoch, CRDT type and value of an item.
+func encodeStorageItem(item storagePkg.Item) [][]byte {
+	if item.Deleted {
+		return [][]byte{[]byte(item.Key), []byte(item.Version.String()), []byte{}, []byte(STORAGE_TOMBSTONE), []byte{}}
+	}
+	var version, expireAt string
+	if !item.Version.IsZero() {
+		version = item.Version.String()
+	}
+	if !item.ExpireAt.IsZero() {
+		expireAt = strconv.FormatInt(item.ExpireAt.UnixNano()/int64(time.Millisecond), 10)
+	}
+	return [][]byte{[]byte(item.Key), []byte(version), []byte(expireAt), []byte(item.Type), item.Value}
+}
+
+func decodeStorageItem(fields []string) (item storagePkg.Item, err error) {
+	item.Key = fields[0]
+	if fields[1] != "" {
+		if item.Version, err = storagePkg.ParseVersion(fields[1]); err != nil {
+			return item, err
+		}
+	}
+	if fields[2] != "" {
+		ms, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return item, fmt.Errorf("invalid expiration time %q", fields[2])
+		}
+		item.ExpireAt = time.Unix(0, ms*int64(time.Millisecond))
+	}
+	if fields[3] == STORAGE_TOMBSTONE {
+		item.Deleted = true
+		return item, nil
+	}
+	item.Type = fields[3]
+	item.Value = []byte(fields[4])
+	return item, nil
+}
+
+// peerRestore answers PEER RESTORE, sent with the keys of a migration.
+func (q *Query) peerRestore(r *Response, args []string) error {
+	fields := args[1:]
+	if len(fields) == 0 || len(fields)%STORAGE_ITEM_FIELDS != 0 {
+		return fmt.Errorf(Help("peer"))
+	}
+	restored := 0
+	for i := 0; i < len(fields); i += STORAGE_ITEM_FIELDS {
+		item, err := decodeStorageItem(fields[i : i+STORAGE_ITEM_FIELDS])
+		if err != nil {
+			return err
+		}
+		if q.p.storage.Restore(item) {
+			restored++
+		}
+	}
+	r.PayloadString([]byte(strconv.Itoa(restored)))
+	r.Type = typeInteger
+	return nil
+}
+
+// peerSlots answers PEER IMPORTING <start> <end> <source> and PEER STABLE
+// <start> <end>.
+func (q *Query) peerSlots(r *Response, args []string) error {
+	c := q.p.cluster
+	if c == nil {
+		return fmt.Errorf("ERR This instance has cluster support disabled")
+	}
+	importing := strings.ToLower(args[0]) == "importing"
+	if importing && len(args) != 4 || !importing && len(args) != 3 {
+		return fmt.Errorf(Help("peer"))
+	}
+	start, err := strconv.Atoi(args[1])
+	if err != nil || start < 0 || start >= CLUSTER_SLOTS {
+		return fmt.Errorf("ERR Invalid slot '%s'", args[1])
+	}
+	end, err := strconv.Atoi(args[2])
+	if err != nil || end < start || end >= CLUSTER_SLOTS {
+		return fmt.Errorf("ERR Invalid slot '%s'", args[2])
+	}
+	slots := []int{}
+	for slot := start; slot <= end; slot++ {
+		slots = append(slots, slot)
+	}
+	source := ""
+	if importing {
+		source = args[3]
+	}
+	c.setSlotsState(slots, c.importing, source)
+	r.OK()
+	return nil
+}
+
+// setSlotsState sets the state of slots in a table of slots, or removes
+// them when the state is empty.
+func (c *Cluster) setSlotsState(slots []int, table map[int]string, state string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, slot := range slots {
+		if state == "" {
+			delete(table, slot)
+			continue
+		}
+		table[slot] = state
+	}
+}
+
+func (c *Cluster) slotState(slot int, table map[int]string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return table[slot]
+}
+
+// keysExist reports whether the peer stores every key of the query.
+func (q *Query) keysExist() bool {
+	args := q.args()
+	_, spec := lookupCommand(q.verb(), args)
+	for _, key := range spec.keys(args) {
+		if !q.p.storage.Exists(key) {
+			return false
+		}
+	}
+	return true
+}
+
+func infoMigrations(c *Cluster) (info []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info = append(info, fmt.Sprintf("cluster_migrating_slots:%d", len(c.migrating)))
+	info = append(info, fmt.Sprintf("cluster_importing_slots:%d", len(c.importing)))
+	for i, m := range c.migrations {
+		migration := fmt.Sprintf("migration%d:slots=%d-%d,targets=%s,move=%s,state=%s,slots_done=%d/%d,keys_moved=%d",
+			i, m.start, m.end, strings.Join(m.targets, "|"), boolToInteger(m.move), MIGRATION_STATE_TEXT[m.state], m.slotsDone, len(m.slots), m.keysMoved)
+		if m.err != nil {
+			migration += fmt.Sprintf(",error=%s", m.err)
+		}
+		info = append(info, migration)
+	}
+	return info
+}
@@ -0,0 +1,170 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	storagePkg "github.com/bjorand/velocidb/storage"
+)
+
+func TestStorageItem(t *testing.T) {
+	items := []storagePkg.Item{
+		{Key: "k", Value: []byte("v")},
+		{Key: "k", Value: []byte(""), Version: storagePkg.Version{Timestamp: 42, Peer: "a"}, ExpireAt: time.Unix(1700000000, 123000000)},
+		{Key: "k", Value: []byte(`{"p":{"a":2},"n":{}}`), Type: storagePkg.CRDT_COUNTER},
+	}
+	for _, item := range items {
+		fields := []string{}
+		for _, field := range encodeStorageItem(item) {
+			fields = append(fields, string(field))
+		}
+		output, err := decodeStorageItem(fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output.Key != item.Key || string(output.Value) != string(item.Value) || output.Type != item.Type || output.Version != item.Version || !output.ExpireAt.Equal(item.ExpireAt) {
+			t.Errorf("want %+v, got %+v", item, output)
+		}
+	}
+	if _, err := decodeStorageItem([]string{"k", "", "x", "", "v"}); err == nil {
+		t.Errorf("want error for an invalid expiration time")
+	}
+}
+
+// setupClusterPair returns two peers sharding the keyspace without
+// replication, the first one storing keys before the second one joins.
+func setupClusterPair(t *testing.T, keys int) ([]*VQLClient, []*Peer) {
+	clients := []*VQLClient{setupCluster(1), setupCluster(1)}
+	peers := []*Peer{clients[0].vqlTCPServer.Peer, clients[1].vqlTCPServer.Peer}
+	for i := 0; i < keys; i++ {
+		if output := <-executeAsync(clients[0], fmt.Sprintf("set key%d v%d", i, i)); output != "+OK\r\n" {
+			t.Fatalf("want %q, got %q", "+OK\r\n", output)
+		}
+	}
+	<-executeAsync(clients[1], fmt.Sprintf("peer connect %s", peers[0].connString()))
+	waitMemberState(clients[0], peers[1].ID, memberAlive)
+	waitMemberState(clients[1], peers[0].ID, memberAlive)
+	for i := 0; i < 100 && (peers[0].cluster.vqlAddr(peers[1].ID) == "" || peers[1].cluster.vqlAddr(peers[0].ID) == ""); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return clients, peers
+}
+
+func TestClusterRebalance(t *testing.T) {
+	clients, peers := setupClusterPair(t, 50)
+
+	moved := []string{}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if peers[0].cluster.slotOwners(keySlot(key))[0] == peers[1].ID {
+			moved = append(moved, key)
+		}
+	}
+	if len(moved) == 0 {
+		t.Fatalf("want keys owned by the new peer")
+	}
+	// keys are not moved until the rebalance
+	expected := fmt.Sprintf("MOVED %d %s", keySlot(moved[0]), clients[1].vqlTCPServer.connString())
+	if output := <-executeAsync(clients[0], "get "+moved[0]); expected != output {
+		t.Errorf("want %q, got %q", expected, output)
+	}
+
+	peers[0].cluster.batchSize = 3
+	if output := <-executeAsync(clients[0], "cluster rebalance"); output != "+OK\r\n" {
+		t.Fatalf("want %q, got %q", "+OK\r\n", output)
+	}
+	var info string
+	for i := 0; i < 200; i++ {
+		info = <-executeAsync(clients[0], "info cluster")
+		if !strings.Contains(info, "state=running") && !strings.Contains(info, "state=pending") {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !strings.Contains(info, "state=done") || strings.Contains(info, "state=failed") || !strings.Contains(info, "cluster_migrating_slots:0") {
+		t.Errorf("want finished migrations, got %q", info)
+	}
+	keysMoved := 0
+	for _, line := range strings.Split(info, "\r\n") {
+		var n int
+		if i := strings.Index(line, "keys_moved="); i >= 0 {
+			fmt.Sscanf(line[i:], "keys_moved=%d", &n)
+			keysMoved += n
+		}
+	}
+	if keysMoved != len(moved) {
+		t.Errorf("want %+v, got %+v", len(moved), keysMoved)
+	}
+
+	if output := len(peers[1].storage.Keys("*")); output != len(moved) {
+		t.Errorf("want %+v, got %+v", len(moved), output)
+	}
+	if output := len(peers[0].storage.Keys("*")); output != 50-len(moved) {
+		t.Errorf("want %+v, got %+v", 50-len(moved), output)
+	}
+	expected = fmt.Sprintf("$%d\r\nv%s\r\n", len(moved[0])-2, strings.TrimPrefix(moved[0], "key"))
+	if output := <-executeAsync(clients[1], "get "+moved[0]); expected != output {
+		t.Errorf("want %q, got %q", expected, output)
+	}
+	expected = ":1\r\n"
+	if output := <-executeAsync(clients[1], fmt.Sprintf("cluster countkeysinslot %d", keySlot(moved[0]))); expected != output {
+		t.Errorf("want %q, got %q", expected, output)
+	}
+}
+
+func TestClusterAsk(t *testing.T) {
+	clients, peers := setupClusterPair(t, 0)
+	var key string
+	for i := 0; ; i++ {
+		key = fmt.Sprintf("key%d", i)
+		if peers[0].cluster.slotOwners(keySlot(key))[0] == peers[1].ID {
+			break
+		}
+	}
+	slot := keySlot(key)
+
+	// the source serves the keys it still stores
+	source := peers[0].cluster
+	source.setSlotsState([]int{slot}, source.migrating, "migrating")
+	peers[0].storage.Set(key, []byte("v"))
+	if output := <-executeAsync(clients[0], "get "+key); output != "$1\r\nv\r\n" {
+		t.Errorf("want %q, got %q", "$1\r\nv\r\n", output)
+	}
+	peers[0].storage.Del(key)
+	expected := fmt.Sprintf("ASK %d %s", slot, clients[1].vqlTCPServer.connString())
+	if output := <-executeAsync(clients[0], "get "+key); expected != output {
+		t.Errorf("want %q, got %q", expected, output)
+	}
+
+	// the target redirects to the source unless the client sent ASKING
+	target := peers[1].cluster
+	target.setSlotsState([]int{slot}, target.importing, peers[0].ID)
+	expected = fmt.Sprintf("ASK %d %s", slot, clients[0].vqlTCPServer.connString())
+	suites := []struct {
+		input    string
+		expected string
+	}{
+		{"get " + key, expected},
+		{"asking", "+OK\r\n"},
+		{"set " + key + " w", "+OK\r\n"},
+		{"get " + key, "$1\r\nw\r\n"},
+		{"del " + key, ":1\r\n"},
+		{"get " + key, expected},
+	}
+	for _, s := range suites {
+		if output := <-executeAsync(clients[1], s.input); s.expected != output {
+			t.Errorf("%s: want %q, got %q", s.input, s.expected, output)
+		}
+	}
+
+	// forwarded queries follow the ASK redirection
+	<-executeAsync(clients[0], "config set cluster-routing forward")
+	if output := <-executeAsync(clients[0], "set "+key+" x"); output != "+OK\r\n" {
+		t.Errorf("want %q, got %q", "+OK\r\n", output)
+	}
+	if output := string(peers[1].storage.Get(key)); output != "x" {
+		t.Errorf("want %+v, got %+v", "x", output)
+	}
+}
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Keyspace notification classes selected with notify-keyspace-events, they
+// use the same letters as Redis.
+const (
+	notifyKeyspace = 1 << iota // K
+	notifyKeyevent             // E
+	notifyGeneric              // g
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZset                 // z
+	notifyExpired              // x
+	notifyEvicted              // e
+	notifyStream               // t
+	notifyKeyMiss              // m
+	notifyNew                  // n
+
+	// A is an alias for every class but key misses and new keys
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZset | notifyExpired | notifyEvicted | notifyStream
+)
+
+var (
+	notifyFlags = []struct {
+		flag  byte
+		class int64
+	}{
+		{'g', notifyGeneric},
+		{'$', notifyString},
+		{'l', notifyList},
+		{'s', notifySet},
+		{'h', notifyHash},
+		{'z', notifyZset},
+		{'x', notifyExpired},
+		{'e', notifyEvicted},
+		{'t', notifyStream},
+		{'m', notifyKeyMiss},
+		{'n', notifyNew},
+		{'K', notifyKeyspace},
+		{'E', notifyKeyevent},
+	}
+)
+
+func parseKeyspaceEvents(value string) (int64, error) {
+	var flags int64
+	for i := 0; i < len(value); i++ {
+		if value[i] == 'A' {
+			flags |= notifyAll
+			continue
+		}
+		found := false
+		for _, f := range notifyFlags {
+			if f.flag == value[i] {
+				flags |= f.class
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid event class '%c'", value[i])
+		}
+	}
+	return flags, nil
+}
+
+func keyspaceEventsString(flags int64) string {
+	var s strings.Builder
+	if flags&notifyAll == notifyAll {
+		s.WriteByte('A')
+	}
+	for _, f := range notifyFlags {
+		if f.class&notifyAll != 0 && flags&notifyAll == notifyAll {
+			continue
+		}
+		if flags&f.class != 0 {
+			s.WriteByte(f.flag)
+		}
+	}
+	return s.String()
+}
+
+func (p *Peer) keyspaceEvents() int64 {
+	return atomic.LoadInt64(&p.notifyKeyspaceEvents)
+}
+
+func (p *Peer) setKeyspaceEvents(flags int64) {
+	atomic.StoreInt64(&p.notifyKeyspaceEvents, flags)
+}
+
+// notifyKeyspaceEvent publishes an event about key to the local subscribers
+// of __keyspace@0__:<key> and __keyevent@0__:<event>. Notifications are not
+// forwarded to the mesh since every peer applies replicated writes and
+// notifies its own subscribers. Events are queued for the subscribers, the
+// write does not wait for them to be read.
+func (p *Peer) notifyKeyspaceEvent(class int64, event string, key string) {
+	flags := p.keyspaceEvents()
+	if flags&class == 0 {
+		return
+	}
+	if flags&notifyKeyspace != 0 {
+		p.pubsub.Publish(fmt.Sprintf("__keyspace@0__:%s", key), []byte(event))
+	}
+	if flags&notifyKeyevent != 0 {
+		p.pubsub.Publish(fmt.Sprintf("__keyevent@0__:%s", event), []byte(key))
+	}
+}
+
+// expireCycle regularly removes the expired keys nobody accessed.
+func (p *Peer) expireCycle() {
+	ticker := time.NewTicker(EXPIRE_CYCLE_INTERVAL * time.Millisecond)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		p.storage.DeleteExpired(now)
+		p.hints.expire(now)
+	}
+}
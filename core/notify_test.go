@@ -0,0 +1,212 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyspaceEventsFlags(t *testing.T) {
+	testCases := map[string]string{
+		"":           "",
+		"KEA":        "AKE",
+		"Kg$":        "g$K",
+		"Ex":         "xE",
+		"AKEmn":      "AmnKE",
+		"g$lshzxetE": "AE",
+	}
+	for input, expected := range testCases {
+		flags, err := parseKeyspaceEvents(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output := keyspaceEventsString(flags)
+		if expected != output {
+			t.Errorf("%s: want %+v, got %+v", input, expected, output)
+		}
+	}
+	_, err := parseKeyspaceEvents("KE?")
+	if err == nil {
+		t.Error("want an error here")
+	}
+}
+
+func keyspaceEventReplies(event string, key string) string {
+	return fmt.Sprintf("%s%s",
+		formattedReply([]interface{}{"pmessage", "__key*__:*", "__keyspace@0__:" + key, event}),
+		formattedReply([]interface{}{"pmessage", "__key*__:*", "__keyevent@0__:" + event, key}),
+	)
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	client := setup()
+	conn, reader := pipeVQLConn(client.vqlTCPServer)
+	defer conn.Close()
+	conn.Write([]byte("psubscribe __key*__:*\r\n"))
+	expectReply(t, conn, reader, "*3\r\n$10\r\npsubscribe\r\n$10\r\n__key*__:*\r\n:1\r\n")
+
+	// notifications are disabled by default
+	<-executeAsync(client, "set foo bar")
+	<-executeAsync(client, "config set notify-keyspace-events KEA")
+
+	suites := []struct {
+		input   string
+		replies string
+	}{
+		{"set foo bar", keyspaceEventReplies("set", "foo")},
+		{"del foo", keyspaceEventReplies("del", "foo")},
+		{"incr n", keyspaceEventReplies("incrby", "n")},
+		{"decr n", keyspaceEventReplies("decrby", "n")},
+		{"expire n 100", keyspaceEventReplies("expire", "n")},
+		{"persist n", keyspaceEventReplies("persist", "n")},
+		{"set k v px 50", keyspaceEventReplies("set", "k") + keyspaceEventReplies("expire", "k")},
+		{"flushdb", keyspaceEventReplies("del", "n")},
+	}
+	for _, suite := range suites {
+		done := executeAsync(client, suite.input)
+		expectReply(t, conn, reader, suite.replies)
+		<-done
+		if suite.input == "set k v px 50" {
+			// removed by the expire cycle
+			expectReply(t, conn, reader, keyspaceEventReplies("expired", "k"))
+		}
+	}
+
+	<-executeAsync(client, "config set notify-keyspace-events Kx")
+	<-executeAsync(client, "set k v")
+	done := executeAsync(client, "pexpire k 10")
+	expectReply(t, conn, reader, string(formattedReply([]interface{}{"pmessage", "__key*__:*", "__keyspace@0__:k", "expired"})))
+	<-done
+
+	// writes are answered before the subscribers read their notifications
+	<-executeAsync(client, "config set notify-keyspace-events KEA")
+	expected := "+OK\r\n"
+	select {
+	case output := <-executeAsync(client, "set foo bar"):
+		if expected != output {
+			t.Errorf("want %q, got %q", expected, output)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("want the write answered without waiting for the subscriber")
+	}
+	expectReply(t, conn, reader, keyspaceEventReplies("set", "foo"))
+}
+
+func TestExpire(t *testing.T) {
+	client := setup()
+	suites := []string{
+		"ttl foo", ":-2\r\n",
+		"expire foo 10", ":0\r\n",
+		"set foo bar", "+OK\r\n",
+		"ttl foo", ":-1\r\n",
+		"expire foo 10", ":1\r\n",
+		"ttl foo", ":10\r\n",
+		"pexpire foo 20000", ":1\r\n",
+		"ttl foo", ":20\r\n",
+		"persist foo", ":1\r\n",
+		"persist foo", ":0\r\n",
+		"set foo bar ex 30", "+OK\r\n",
+		"ttl foo", ":30\r\n",
+		"set foo bar", "+OK\r\n",
+		"pttl foo", ":-1\r\n",
+		"set foo bar ex", "syntax error",
+		"set foo bar ex 0", "invalid expire time in 'set' command",
+		"set foo bar nx", "syntax error",
+		"expire foo -1", ":1\r\n",
+		"get foo", "$-1\r\n",
+	}
+	for i := 0; i < len(suites); i += 2 {
+		expected := suites[i+1]
+		if output := <-executeAsync(client, suites[i]); expected != output {
+			t.Errorf("%s: want %q, got %q", suites[i], expected, output)
+		}
+	}
+}
+
+func TestExpireAbsolute(t *testing.T) {
+	client := setup()
+	suites := []struct {
+		input string
+		verb  string
+		ttl   time.Duration
+	}{
+		{"set foo bar ex 10", "set", 10 * time.Second},
+		{"set foo bar px 20000", "set", 20 * time.Second},
+		{"expire foo 30", "pexpireat", 30 * time.Second},
+		{"pexpire foo 40000", "pexpireat", 40 * time.Second},
+	}
+	for _, suite := range suites {
+		q, err := client.ParseRawQuery([]byte(suite.input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := q.Execute(); err != nil {
+			t.Fatal(err)
+		}
+		// the query written and replicated holds the time the key expires
+		args := q.args()
+		if q.verb() != suite.verb || strings.ToLower(args[len(args)-2]) == "ex" || strings.ToLower(args[len(args)-2]) == "px" {
+			t.Errorf("%s: want an absolute expiration time, got %q", suite.input, q.raw)
+		}
+		at, err := strconv.ParseInt(args[len(args)-1], 10, 64)
+		if err != nil {
+			t.Fatalf("%s: %+v", suite.input, err)
+		}
+		expected := time.Now().Add(suite.ttl)
+		if d := time.Until(time.Unix(0, at*int64(time.Millisecond))) - suite.ttl; d > time.Second || d < -time.Second {
+			t.Errorf("%s: want %+v, got %+v", suite.input, expected, time.Unix(0, at*int64(time.Millisecond)))
+		}
+		if output := <-executeAsync(client, "ttl foo"); output != fmt.Sprintf(":%d\r\n", suite.ttl/time.Second) {
+			t.Errorf("%s: want %q, got %q", suite.input, fmt.Sprintf(":%d\r\n", suite.ttl/time.Second), output)
+		}
+	}
+
+	// a replayed write expires the key at the same time
+	at := strconv.FormatInt(time.Now().Add(time.Minute).UnixNano()/int64(time.Millisecond), 10)
+	for _, input := range []string{"pexpireat foo " + at, "set foo bar pxat " + at} {
+		if output := <-executeAsync(client, input); output != ":1\r\n" && output != "+OK\r\n" {
+			t.Fatalf("%s: got %q", input, output)
+		}
+		if output := <-executeAsync(client, "ttl foo"); output != ":60\r\n" {
+			t.Errorf("%s: want %q, got %q", input, ":60\r\n", output)
+		}
+	}
+	suites2 := []string{
+		"expireat foo 1", ":1\r\n",
+		"get foo", "$-1\r\n",
+		"expireat foo 1", ":0\r\n",
+		"set foo bar exat", "syntax error",
+		"set foo bar pxat 0", "invalid expire time in 'set' command",
+		"set foo bar ex 10 pxat 10", "syntax error",
+	}
+	for i := 0; i < len(suites2); i += 2 {
+		expected := suites2[i+1]
+		if output := <-executeAsync(client, suites2[i]); expected != output {
+			t.Errorf("%s: want %q, got %q", suites2[i], expected, output)
+		}
+	}
+}
+
+func TestDecrDuplicate(t *testing.T) {
+	client := setup()
+	<-executeAsync(client, "decr n")
+	q, err := client.ParseRawQuery([]byte("decr n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the write was already applied with a full sync
+	q.FromPeer = true
+	_, q.version, _ = client.vqlTCPServer.Peer.storage.GetVersion("n")
+	r, err := q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output := string(r.FormattedPayload()); output != ":-1\r\n" {
+		t.Errorf("want %q, got %q", ":-1\r\n", output)
+	}
+	if q.written {
+		t.Errorf("want the duplicate not written to the WAL")
+	}
+}
@@ -2,11 +2,18 @@ package core
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	tcp "github.com/bjorand/velocidb/tcp"
@@ -20,20 +27,26 @@ import (
 
 const (
 	// config
-	TCP_WORKERS_PER_PEER = 4
-	QUERY_TIMEOUT        = 3
+	TCP_WORKERS_PER_PEER  = 4
+	QUERY_TIMEOUT         = 3
+	EXPIRE_CYCLE_INTERVAL = 100 // milliseconds
+
+	// milliseconds before redialing a peer, doubled after each failed attempt
+	// up to PEER_RECONNECT_MAX_DELAY
+	PEER_RECONNECT_MIN_DELAY = 100
+	PEER_RECONNECT_MAX_DELAY = 30000
 
 	PEER_STATUS_NO_CONNECTION = 0
 	PEER_STATUS_CONNECTED     = 1
+	PEER_STATUS_RECONNECTING  = 2
 )
 
 var (
 	PEER_STATUS_TEXT = map[int]string{
 		PEER_STATUS_NO_CONNECTION: "No connection",
 		PEER_STATUS_CONNECTED:     "Connected",
+		PEER_STATUS_RECONNECTING:  "Reconnecting",
 	}
-	PEER_QUERY_TYPE    = []byte("0")
-	PEER_RESPONSE_TYPE = []byte("1")
 )
 
 type Stats struct {
@@ -41,20 +54,62 @@ type Stats struct {
 	BytesOut                     int64
 	connectionReadFailureCounter int64
 	connectionLastError          error
+	Reconnects                   int64
+	FullSyncsServed              int64
+	FullSyncsReceived            int64
+	PartialSyncsServed           int64
+	PartialSyncsReceived         int64
+	RelayedWrites                int64
+	DuplicateWrites              int64
+	Repairs                      int64
+	RepairedKeys                 int64
+	ReadRepairs                  int64
+	Failovers                    int64
+	StaleWrites                  int64
+	// PubSubDropped is the number of messages not sent to a peer
+	PubSubDropped int64
+	// PushDropped is the number of messages not sent to a client too slow
+	// to read them
+	PushDropped int64
+	// HintsQueued is the number of hints kept
+	HintsQueued   int64
+	HintsReplayed int64
+	HintsExpired  int64
+	HintsDropped  int64
 }
 
 type Peer struct {
-	ID                  string
-	Tags                []string
-	RemoteConn          net.Conn
-	Protocol            string
-	Height              int64
-	ListenPort          int64
-	ListenAddr          string
-	Stats               *Stats
-	RemoveSignal        bool
-	Name                string
-	Mesh                *Mesh
+	ID         string
+	Tags       []string
+	RemoteConn net.Conn
+	Protocol   string
+	Height     int64
+	ListenPort int64
+	ListenAddr string
+	Stats      *Stats
+	Name       string
+	Mesh       *Mesh
+	// ProtocolVersion and Capabilities are announced by the remote peer in
+	// its HELLO
+	ProtocolVersion int
+	Capabilities    []string
+	// VQLAddr is the address of the VQL server of the remote peer
+	VQLAddr string
+	// PrimaryID is the ID of the primary the remote peer replicates,
+	// announced in its HELLO and with ROLE
+	PrimaryID string
+	// mu guards the connection state of a remote peer: RemoteConn, done,
+	// reconnecting, the fields announced in its HELLO, Stats.Reconnects and
+	// Stats.connectionLastError
+	mu sync.RWMutex
+	// done is closed when the connection with the remote peer ends, a new
+	// channel is made for each connection
+	done chan struct{}
+	// reconnecting is set while the link to a peer we dialed is down
+	reconnecting bool
+	// removed is closed by RemovePeer to stop redialing the peer
+	removed             chan struct{}
+	removeOnce          sync.Once
 	gotRawQueryFromPeer chan []byte
 	// queryResponseSendQueue chan []byte
 	queryResponseReceived chan []byte
@@ -62,11 +117,67 @@ type Peer struct {
 	broadcastVQLQuery     chan *Query
 	queryWaiting          map[string]chan *Response
 	storage               *storagePkg.MemoryStorage
-	walWriter             *storagePkg.WalFileWriter
-	tcpServer             *tcp.TCPServer
-	vqlTCPServer          *VQLTCPServer
-	updateTrigger         chan bool
-	l                     *logger.Logger
+	pubsub                *PubSub
+	notifyKeyspaceEvents  int64
+	scripts               *ScriptEngine
+	acl                   *ACL
+	gossip                *Gossip
+	// consensus orders the writes in consistent mode
+	consensus *Consensus
+	// cluster partitions the keyspace when sharding is enabled
+	cluster *Cluster
+	// fullSync is the state of the full syncs of a link
+	fullSync *fullSync
+	// replAcked is the offset of the writes the remote peer of a link
+	// acknowledged, replSent the offset of the last write sent to it
+	replAcked int64
+	replSent  int64
+	// backlog holds the last writes replicated by the peer
+	backlog *replicationBacklog
+	// syncMu guards syncRequested and replOffsets, the offsets received
+	// from the peers the peer was linked with
+	syncMu        sync.Mutex
+	syncRequested bool
+	replOffsets   map[string]int64
+	// dedup holds the writes received from every origin peer, originSeq
+	// is the sequence number of the last write received from a client
+	dedup     *dedupWindow
+	originSeq int64
+	// discovery links the peer with the peers of a discovery service
+	discovery *discoveryLoop
+	// role is the replication role of the peer, primary or replica
+	role *replicaRole
+	// leaving is set once the peer started to leave the cluster, left is
+	// closed once it left
+	leaving   int32
+	leaveOnce sync.Once
+	left      chan struct{}
+	// repairMu serializes the repairs, run every repairInterval seconds
+	repairMu       sync.Mutex
+	repairInterval int64
+	// repairSessions holds the trees of the repairs other peers run with
+	// the peer
+	repairSessionsMu sync.Mutex
+	repairSessions   map[string]*repairSession
+	// hints holds the writes for the peers which cannot be reached
+	hints *hintedHandoff
+	// consistency holds the consistency levels of the keys
+	consistency *prefixPolicies
+	// crdtModes holds the CRDT modes of the keys
+	crdtModes *prefixPolicies
+	// clock versions the writes
+	clock *storagePkg.Clock
+	// execLock is held exclusively by running scripts
+	execLock  sync.RWMutex
+	walWriter *storagePkg.WalFileWriter
+	tcpServer *tcp.TCPServer
+	// tls secures the links with the other peers when set
+	tls *tcp.TLS
+	// secret shared by the peers of the cluster, proven in the HELLO
+	// handshake when set
+	secret       []byte
+	vqlTCPServer *VQLTCPServer
+	l            *logger.Logger
 }
 
 func (p *Peer) ParseRawQuery(c *VQLClient, data []byte) (*Query, error) {
@@ -128,19 +239,43 @@ func NewPeer(listenAddr string, port int64) (*Peer, error) {
 	if err != nil {
 		return nil, err
 	}
+	hintsDir, err := ioutil.TempDir("/tmp", fmt.Sprintf("hints-%s", id))
+	if err != nil {
+		return nil, err
+	}
 	peerID := id.String()
-	return &Peer{
+	stats := &Stats{}
+	p := &Peer{
 		ID:                peerID,
 		ListenAddr:        listenAddr,
 		ListenPort:        port,
-		Stats:             &Stats{},
+		Stats:             stats,
 		Mesh:              newMesh(),
 		broadcastVQLQuery: make(chan *Query, 1024),
 		queryWaiting:      make(map[string]chan *Response),
 		storage:           storagePkg.NewMemoryStorage(),
+		pubsub:            NewPubSub(),
+		scripts:           NewScriptEngine(),
+		acl:               NewACL(),
+		consistency:       newPrefixPolicies(CONSISTENCY_LEVEL_TEXT),
+		crdtModes:         newPrefixPolicies(CRDT_MODE_TEXT),
+		clock:             &storagePkg.Clock{},
+		backlog:           newReplicationBacklog(REPLICATION_BACKLOG_SIZE),
+		replOffsets:       make(map[string]int64),
+		dedup:             newDedupWindow(RELAY_DEDUP_WINDOW),
+		repairInterval:    ANTI_ENTROPY_INTERVAL,
+		repairSessions:    make(map[string]*repairSession),
+		hints:             newHintedHandoff(hintsDir, stats),
+		role:              newReplicaRole(),
+		left:              make(chan struct{}),
 		walWriter:         storagePkg.NewWalFileWriter(walDir),
 		l:                 logger.NewLogger(logger.Fields{"peer": peerID, "self": true}),
-	}, nil
+	}
+	p.gossip = NewGossip(p)
+	p.storage.OnExpire(func(key string) {
+		p.notifyKeyspaceEvent(notifyExpired, "expired", key)
+	})
+	return p, nil
 }
 
 func NewRemotePeer(listenAddr string, port int64) (*Peer, error) {
@@ -154,13 +289,14 @@ func NewRemotePeer(listenAddr string, port int64) (*Peer, error) {
 		queryWaiting:          make(map[string]chan *Response),
 		responseQueueToSend:   make(chan *Response, 1024),
 		queryResponseReceived: make(chan []byte, 1024),
-		updateTrigger:         make(chan bool, 1024),
+		removed:               make(chan struct{}),
+		fullSync:              newFullSync(),
 	}, nil
 }
 
 func (p *Peer) connString() string {
 	if p.tcpServer != nil {
-		return fmt.Sprintf("%s:%d", p.tcpServer.Host, p.tcpServer.Port)
+		return fmt.Sprintf("%s:%d", p.tcpServer.Host, p.tcpServer.Port())
 	}
 	return fmt.Sprintf("%s:%d", p.ListenAddr, p.ListenPort)
 
@@ -181,12 +317,111 @@ func (p *Peer) Info() (info map[string]interface{}) {
 }
 
 func (p *Peer) ConnectionStatus() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	if p.RemoteConn != nil {
 		return PEER_STATUS_CONNECTED
 	}
+	if p.reconnecting {
+		return PEER_STATUS_RECONNECTING
+	}
 	return PEER_STATUS_NO_CONNECTION
 }
 
+// LastError returns the reason the last connection attempt or connection
+// with the peer failed.
+func (p *Peer) LastError() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.Stats.connectionLastError == nil {
+		return ""
+	}
+	return p.Stats.connectionLastError.Error()
+}
+
+// describe returns the PEER LIST details of the link with a remote peer.
+func (p *Peer) describe() string {
+	status := p.ConnectionStatus()
+	lastError := p.LastError()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return fmt.Sprintf("connection=%s bytes_in=%d protocol=%d capabilities=%s tags=%s reconnects=%d last_error=%q",
+		PEER_STATUS_TEXT[status],
+		atomic.LoadInt64(&p.Stats.BytesIn),
+		p.ProtocolVersion,
+		strings.Join(p.Capabilities, ","),
+		strings.Join(p.Tags, ","),
+		p.Stats.Reconnects,
+		lastError,
+	)
+}
+
+// remoteID returns the ID the remote peer announced in its HELLO.
+func (p *Peer) remoteID() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.ID
+}
+
+func (p *Peer) remoteCapabilities() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Capabilities
+}
+
+func (p *Peer) remotePrimaryID() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.PrimaryID
+}
+
+func (p *Peer) setRemotePrimaryID(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.PrimaryID = id
+}
+
+func (p *Peer) remoteVQLAddr() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.VQLAddr
+}
+
+// session returns the connection with the remote peer and the channel closed
+// when it ends.
+func (p *Peer) session() (net.Conn, chan struct{}) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.RemoteConn, p.done
+}
+
+// startSession records the connection with the remote peer once the HELLO
+// handshake is done.
+func (p *Peer) startSession(conn net.Conn, hello *peerHello) chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ID = hello.ID
+	p.ProtocolVersion = hello.Version
+	p.Capabilities = hello.Capabilities
+	p.Tags = hello.Tags
+	p.VQLAddr = hello.vqlListenAddr(conn.RemoteAddr())
+	p.PrimaryID = hello.Primary
+	p.RemoteConn = conn
+	p.done = make(chan struct{})
+	p.reconnecting = false
+	p.Stats.connectionLastError = nil
+	return p.done
+}
+
+func (p *Peer) endSession(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.RemoteConn = nil
+	if err != nil {
+		p.Stats.connectionLastError = err
+	}
+}
+
 func (p *Peer) ConnectToPeerAddr(peerConnString string) (*Peer, error) {
 	peerAddr, peerPort, err := utils.SplitHostPort(peerConnString)
 	if err != nil {
@@ -204,103 +439,182 @@ func (p *Peer) Key() string {
 	return p.connString()
 }
 
+// Removed reports whether the peer was removed with RemovePeer.
+func (p *Peer) Removed() bool {
+	select {
+	case <-p.removed:
+		return true
+	default:
+		return false
+	}
+}
+
 func (p *Peer) RemovePeer(dead *Peer) {
-	dead.RemoveSignal = true
-	if dead.RemoteConn != nil {
-		dead.RemoteConn.Close()
+	if dead.removed != nil {
+		dead.removeOnce.Do(func() {
+			close(dead.removed)
+		})
+	}
+	if conn, _ := dead.session(); conn != nil {
+		conn.Close()
+	}
+}
+
+// reconnectDelay returns how long to wait before the given reconnection
+// attempt: an exponential backoff capped to PEER_RECONNECT_MAX_DELAY, with a
+// random jitter so that peers which lost the same peer do not redial it all
+// at once.
+func reconnectDelay(attempt int) time.Duration {
+	delay := time.Duration(PEER_RECONNECT_MAX_DELAY) * time.Millisecond
+	if attempt < 16 {
+		if d := time.Duration(PEER_RECONNECT_MIN_DELAY<<uint(attempt)) * time.Millisecond; d < delay {
+			delay = d
+		}
 	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
 }
 
+// connectToPeer supervises the link with a peer we dialed: the peer stays in
+// the mesh and is redialed whenever the connection fails or drops, until it
+// is removed with RemovePeer.
 func (p *Peer) connectToPeer(newPeer *Peer) {
-	defer func() {
-		p.Mesh.deregister <- newPeer
-	}()
-	p.Mesh.register <- newPeer
-	fmt.Printf("[mesh] register peer %s\n", newPeer.ID)
-	// initialPause := 0
-	// maxPause := 60
-	// pause := initialPause
-	// for {
-	// 	if newPeer.RemoveSignal {
-	// 		break
-	// 	}
-	// 	p.connectToPeer(remotePeer)
-	// }
+	p.Mesh.Register(newPeer)
+	defer p.Mesh.Deregister(newPeer)
+	fmt.Printf("[mesh] register peer %s\n", newPeer.connString())
+
+	for attempt := 0; ; attempt++ {
+		connected, err := p.dialPeer(newPeer)
+		if newPeer.Removed() {
+			fmt.Printf("[peer %s] Peer removed\n", newPeer.connString())
+			return
+		}
+		if connected {
+			attempt = 0
+		}
+		newPeer.mu.Lock()
+		newPeer.reconnecting = true
+		if err != nil {
+			newPeer.Stats.connectionLastError = err
+		}
+		newPeer.mu.Unlock()
+		delay := reconnectDelay(attempt)
+		fmt.Printf("[peer %s] %s, reconnecting in %s\n", newPeer.connString(), err, delay)
+		select {
+		case <-newPeer.removed:
+			fmt.Printf("[peer %s] Peer removed\n", newPeer.connString())
+			return
+		case <-time.After(delay):
+		}
+		newPeer.mu.Lock()
+		newPeer.Stats.Reconnects++
+		newPeer.mu.Unlock()
+	}
+}
 
+// dialPeer connects to a peer and serves the connection until it ends. It
+// reports whether the HELLO handshake succeeded and why the connection failed
+// or ended.
+func (p *Peer) dialPeer(newPeer *Peer) (bool, error) {
 	fmt.Printf("[peer] Connecting to peer %s\n", newPeer.connString())
-	newPeer.RemoteConn = nil
-	// time.Sleep(time.Duration(pause) * time.Second)
-	conn, err := net.Dial("tcp4", newPeer.connString())
+	var conn net.Conn
+	var err error
+	if p.tls != nil {
+		conn, err = tls.Dial("tcp4", newPeer.connString(), p.tls.ClientConfig())
+	} else {
+		conn, err = net.Dial("tcp4", newPeer.connString())
+	}
 	if err != nil {
-		fmt.Printf("[peer %s] %s\n", newPeer.connString(), err)
-		// if pause < maxPause {
-		// 	pause += 2
-		// }
-		return
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(HELLO_TIMEOUT * time.Second))
+	h := p.hello()
+	h.Nonce = p.newNonce()
+	if err := writeFrame(conn, frameHello, h.encode()); err != nil {
+		return false, fmt.Errorf("unable to send HELLO: %s", err)
 	}
-	newPeer.RemoteConn = conn
-	fmt.Printf("[peer %s] Connected\n", newPeer.connString())
-	// pause = initialPause
+	hello, err := p.readHello(conn)
+	if err == nil {
+		err = p.proveSecret(conn, h.Nonce, hello)
+	}
+	if err != nil {
+		return false, fmt.Errorf("handshake failed: %s", err)
+	}
+	conn.SetDeadline(time.Time{})
+	fmt.Printf("[peer %s] Connected to peer %s\n", newPeer.connString(), hello.ID)
+
+	return true, p.serveRemotePeer(newPeer, conn, hello)
+}
 
+// serveRemotePeer exchanges queries and responses with a remote peer once
+// the HELLO handshake is done, until the connection ends. It returns why the
+// connection ended.
+func (p *Peer) serveRemotePeer(remotePeer *Peer, conn net.Conn, hello *peerHello) error {
 	c := NewVQLClient(-1, fmt.Sprintf("peer-%s", p.ID), conn, p.vqlTCPServer)
+	done := remotePeer.startSession(conn, hello)
+	var err error
+	defer func() {
+		remotePeer.endSession(err)
+		close(done)
+		f := remotePeer.fullSync
+		f.mu.Lock()
+		if f.state == SYNC_STATE_REQUESTED || f.state == SYNC_STATE_RECEIVING {
+			f.state = SYNC_STATE_FAILED
+		}
+		f.mu.Unlock()
+	}()
 
 	for i := 0; i < TCP_WORKERS_PER_PEER; i++ {
-		go p.ResponseReader(i, newPeer, c)
-		go p.ResponseWriter(newPeer, c)
-		go p.QueryReader(newPeer, c)
-		go p.QueryWriter(newPeer, c)
+		go p.ResponseReader(i, remotePeer, done)
+		go p.ResponseWriter(remotePeer, conn, done)
+		go p.QueryReader(remotePeer, c, done)
+		go p.QueryWriter(remotePeer, conn, done)
 	}
-	go p.Updater(newPeer)
-
-	defer func() {
-		defer conn.Close()
-		close(newPeer.queryResponseReceived)
-		close(newPeer.responseQueueToSend)
-		close(newPeer.broadcastVQLQuery)
-		close(newPeer.gotRawQueryFromPeer)
-		close(newPeer.updateTrigger)
-	}()
+	if hasCapability(hello.Capabilities, "gossip") {
+		go p.gossip.sync(remotePeer)
+	}
+	if hasCapability(hello.Capabilities, "sync") {
+		if request := p.syncRequest(hello.ID); request != nil {
+			p.requestSync(remotePeer, request)
+		}
+		go p.acknowledge(remotePeer, done)
+	}
+	if queries := p.reloadedHints(hello.ID); len(queries) > 0 {
+		go p.replayHints(remotePeer, queries, done)
+	}
+	go p.announcePromotion(remotePeer)
 
 	for {
-		if newPeer.RemoveSignal {
-			break
+		if remotePeer.Removed() {
+			return nil
 		}
-		// fmt.Fprintf(conn, text+"\n")
-		reply := make([]byte, 1024)
-		n, err := conn.Read(reply)
-		newPeer.Stats.BytesIn += int64(n)
+		var f *frame
+		f, err = readFrame(conn)
 		if err != nil {
-			fmt.Printf("[peer %s] Read from peer failed: %s\n", newPeer.connString(), err.Error())
-			conn.Close()
+			fmt.Printf("[peer %s] Read from peer failed: %s\n", remotePeer.connString(), err)
 			p.Stats.connectionReadFailureCounter++
-			// pause = initialPause
-			break
+			return err
 		}
-		switch {
-		case bytes.HasPrefix(reply[:n], PEER_QUERY_TYPE):
-			select {
-			case newPeer.gotRawQueryFromPeer <- reply[:n]:
-			default:
+		atomic.AddInt64(&remotePeer.Stats.BytesIn, int64(PEER_FRAME_HEADER_SIZE+len(f.payload)))
+		switch f.kind {
+		case frameQuery:
+			remotePeer.gotRawQueryFromPeer <- f.payload
+		case frameResponse:
+			remotePeer.queryResponseReceived <- f.payload
+		case frameGossip:
+			p.gossip.handle(remotePeer, f.payload)
+		case frameRaft:
+			if p.consensus != nil {
+				p.consensus.handle(f.payload)
 			}
-
-		case bytes.HasPrefix(reply[:n], PEER_RESPONSE_TYPE):
-			select {
-			case newPeer.queryResponseReceived <- reply[:n]:
-			default:
-			}
-
+		case frameSync:
+			p.handleSync(remotePeer, f.payload)
+		case frameError:
+			fmt.Printf("[peer %s] Peer error: %s\n", remotePeer.connString(), f.payload)
+		default:
+			fmt.Printf("[peer %s] Unknown frame type %q\n", remotePeer.connString(), f.kind)
 		}
-		// // fmt.Printf("[peer %s] %s\n", newPeer.connString(), reply[:n])
-		// resp, err := p.ParsePeerResponse(newPeer, reply[:n])
-		// if err != nil {
-		// 	fmt.Println(err)
-		// 	continue
-		// }
-		// if resp.DisconnectSignal {
-		// 	break
-		// }
 	}
-	// }
 }
 
 type PeerResponse struct {
@@ -314,6 +628,8 @@ func infoPeer(p *Peer) (info []string) {
 	info = append(info, fmt.Sprintf("id:%s", p.ID))
 	info = append(info, fmt.Sprintf("listen_addr:%s", p.ListenAddr))
 	info = append(info, fmt.Sprintf("listen_port:%d", p.ListenPort))
+	info = append(info, fmt.Sprintf("leaving:%s", boolToInteger(p.Leaving())))
+	info = append(info, infoDiscovery(p)...)
 	return info
 }
 
@@ -326,10 +642,6 @@ func (r *PeerRequest) Execute() error {
 }
 
 func (p *Peer) ParsePeerResponse(c *VQLClient, input []byte) (*Response, error) {
-	if !bytes.HasPrefix(input, PEER_RESPONSE_TYPE) {
-		return nil, fmt.Errorf("invalid byte response")
-	}
-	input = bytes.TrimLeft(input, string(append(PEER_RESPONSE_TYPE, controlByte...)))
 	var q *Query
 	var err error
 	q, err = p.ParseRawQuery(c, input)
@@ -347,19 +659,15 @@ func (p *Peer) ParsePeerResponse(c *VQLClient, input []byte) (*Response, error)
 	if rid == "" {
 		return nil, fmt.Errorf("no response id found")
 	}
-	q = &Query{}
-	q.id = rid
-	r := NewResponse(q)
-	r.Payload = make([][]byte, 1)
-	// r.Payload[0] = q.parsed[1]
+	r, err := parseReply(q.parsed[1])
+	if err != nil {
+		return nil, err
+	}
+	r.q = &Query{id: rid}
 	return r, nil
 
 }
 func (p *Peer) ParsePeerQuery(c *VQLClient, input []byte) (*Query, error) {
-	if !bytes.HasPrefix(input, PEER_QUERY_TYPE) {
-		return nil, fmt.Errorf("invalid byte query")
-	}
-	input = bytes.TrimLeft(input, string(append(PEER_QUERY_TYPE, controlByte...)))
 	var q *Query
 	var err error
 	q, err = p.ParseRawQuery(c, input)
@@ -378,36 +686,83 @@ func (p *Peer) ParsePeerQuery(c *VQLClient, input []byte) (*Query, error) {
 		return nil, fmt.Errorf("no query id found")
 	}
 
+	var version storagePkg.Version
+	var forwarded, asking bool
+	var offset, seq, epoch int64
+	var origin string
+	var reached []string
+	for _, field := range q.parsed[2:] {
+		switch {
+		case bytes.HasPrefix(field, []byte("version=")):
+			version, err = storagePkg.ParseVersion(string(field[8:]))
+			if err != nil {
+				return nil, err
+			}
+		case bytes.Equal(field, []byte("forwarded=1")):
+			forwarded = true
+		case bytes.Equal(field, []byte("asking=1")):
+			asking = true
+		case bytes.HasPrefix(field, []byte("offset=")):
+			offset, err = strconv.ParseInt(string(field[7:]), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+		case bytes.HasPrefix(field, []byte("origin=")):
+			origin, seq, err = parseOrigin(string(field[7:]))
+			if err != nil {
+				return nil, err
+			}
+		case bytes.HasPrefix(field, []byte("reached=")):
+			reached = strings.Split(string(field[8:]), ",")
+		case bytes.HasPrefix(field, []byte("epoch=")):
+			epoch, err = strconv.ParseInt(string(field[6:]), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
 	q, err = p.ParseRawQuery(c, q.parsed[1])
 	if err != nil {
 		return nil, err
 	}
 	q.id = qid
+	q.version = version
+	q.forwarded = forwarded
+	q.asking = asking
+	q.offset = offset
+	q.origin, q.seq, q.reached = origin, seq, reached
+	q.epoch = epoch
 	return q, nil
 }
 
 func (p *Peer) RemoteExecute(remotePeer *Peer, q *Query) (*Response, error) {
+	waiting := make(chan *Response, 1)
 	lock.Lock()
-	remotePeer.queryWaiting[q.id] = make(chan *Response)
+	remotePeer.queryWaiting[q.id] = waiting
 	lock.Unlock()
-	defer delete(remotePeer.queryWaiting, q.id)
+	defer func() {
+		lock.Lock()
+		delete(remotePeer.queryWaiting, q.id)
+		lock.Unlock()
+	}()
 
+	_, done := remotePeer.session()
 	select {
 	case remotePeer.broadcastVQLQuery <- q:
 	default:
 	}
-	fmt.Println("waiting query", q.id)
 	select {
-	case resp := <-remotePeer.queryWaiting[q.id]:
-		fmt.Println("got response", resp.q.id)
+	case resp := <-waiting:
 		return resp, nil
+	case <-done:
+		return nil, fmt.Errorf("connection to peer %s closed waiting response for query %s", remotePeer.connString(), q.id)
 	case <-time.After(QUERY_TIMEOUT * time.Second):
 		return nil, fmt.Errorf("timeout waiting response for query %s", q.id)
 	}
 
 }
 
-func (p *Peer) ResponseReader(id int, remotePeer *Peer, c *VQLClient) {
+func (p *Peer) ResponseReader(id int, remotePeer *Peer, done chan struct{}) {
 	l := p.l.NewLogger(logger.Fields{"resp_reader": id, "remote_peer": remotePeer.connString()})
 	l.Debug(nil, "Starting response reader")
 	defer func() {
@@ -415,35 +770,34 @@ func (p *Peer) ResponseReader(id int, remotePeer *Peer, c *VQLClient) {
 	}()
 	for {
 		select {
-		case data, more := <-remotePeer.queryResponseReceived:
-			if !more {
-				return
-			}
+		case <-done:
+			return
+		case data := <-remotePeer.queryResponseReceived:
 			r, err := p.ParsePeerResponse(nil, data)
 			if err != nil {
 				fmt.Println("Unable to read peer response", string(data))
 				continue
 			}
-			fmt.Println("Received response for query", r.q.id)
+			lock.Lock()
+			waiting := remotePeer.queryWaiting[r.q.id]
+			lock.Unlock()
+			if waiting == nil {
+				continue
+			}
 			select {
-			case remotePeer.queryWaiting[r.q.id] <- r:
+			case waiting <- r:
 			default:
 			}
 		}
 	}
 }
 
-func (p *Peer) QueryReader(remotePeer *Peer, c *VQLClient) {
-	fmt.Println("Starting query reader for peer", remotePeer.ID)
-	defer func() {
-		fmt.Println("Exited query reader for peer", remotePeer.ID)
-	}()
+func (p *Peer) QueryReader(remotePeer *Peer, c *VQLClient, done chan struct{}) {
 	for {
 		select {
-		case d, more := <-remotePeer.gotRawQueryFromPeer:
-			if !more {
-				return
-			}
+		case <-done:
+			return
+		case d := <-remotePeer.gotRawQueryFromPeer:
 			query, err := p.ParsePeerQuery(c, d)
 			if err != nil {
 				fmt.Println("query parse error", err)
@@ -453,74 +807,86 @@ func (p *Peer) QueryReader(remotePeer *Peer, c *VQLClient) {
 				}
 				continue
 			}
-			query.FromPeer = true
-			fmt.Println("Query from peer:", query.words())
+			query.FromPeer = !query.forwarded
+			if epoch := p.role.Epoch(); query.FromPeer && query.origin != "" && query.isWrite() && query.epoch < epoch {
+				// the write was received by a primary replaced since
+				atomic.AddInt64(&p.Stats.StaleWrites, 1)
+				if query.offset > 0 {
+					p.receivedOffset(remotePeer.remoteID(), query.offset)
+				}
+				select {
+				case remotePeer.responseQueueToSend <- NewPeerResponseError(query, fmt.Errorf("STALEEPOCH Write of failover epoch %d, the peer is in epoch %d", query.epoch, epoch)):
+				default:
+				}
+				continue
+			}
+			if query.origin != "" && (query.origin == p.ID || !p.dedup.add(query.origin, query.seq)) {
+				// the write was already received from another peer, or
+				// comes back to its origin
+				atomic.AddInt64(&p.Stats.DuplicateWrites, 1)
+				if query.offset > 0 {
+					p.receivedOffset(remotePeer.remoteID(), query.offset)
+				}
+				// acknowledged, for the peers waiting for it
+				r := NewResponse(query)
+				r.OK()
+				select {
+				case remotePeer.responseQueueToSend <- r:
+				default:
+				}
+				continue
+			}
 			resp, err := query.Execute()
-			fmt.Println("query executed", query.id)
+			if query.offset > 0 {
+				p.receivedOffset(remotePeer.remoteID(), query.offset)
+			}
+			if query.origin != "" {
+				p.relay(query)
+			}
 			if err != nil {
-				fmt.Println("query execution error", err)
 				select {
 				case remotePeer.responseQueueToSend <- NewPeerResponseError(query, err):
 				default:
 				}
 				continue
 			}
-			fmt.Println("queuing response for query", query.id)
 			select {
 			case remotePeer.responseQueueToSend <- resp:
 			default:
 			}
-
-			fmt.Println("response queued for query", query.id)
 		}
 	}
 }
 
-func (p *Peer) QueryWriter(remotePeer *Peer, c *VQLClient) {
-	fmt.Println("Starting query writer for peer", remotePeer.ID)
-	defer func() {
-		fmt.Println("Exited query writer for peer", remotePeer.ID)
-	}()
+func (p *Peer) QueryWriter(remotePeer *Peer, conn net.Conn, done chan struct{}) {
 	for {
 		select {
-		case q, more := <-remotePeer.broadcastVQLQuery:
-			if !more {
-				return
-			}
+		case <-done:
+			return
+		case q := <-remotePeer.broadcastVQLQuery:
 			data := q.PeerQueryEncode()
-			_, err := remotePeer.RemoteConn.Write(data)
+			_, err := conn.Write(data)
 			if err != nil {
 				fmt.Println(err)
 				return
 			}
-			// select {
-			// case resp := <-remotePeer.queryWaiting[q.id]:
-			// 	fmt.Println("got response", resp.q.id)
-			// case <-time.After(QUERY_TIMEOUT * time.Second):
-			// 	fmt.Println("timeout waiting response for query", q.id)
-			// }
+			remotePeer.sentOffset(q.offset)
 		}
 	}
 }
 
-func (p *Peer) ResponseWriter(remotePeer *Peer, c *VQLClient) {
-	fmt.Println("Starting response writer for peer", remotePeer.ID)
-	defer func() {
-		fmt.Println("Exited response writer for peer", remotePeer.ID)
-	}()
+func (p *Peer) ResponseWriter(remotePeer *Peer, conn net.Conn, done chan struct{}) {
 	for {
 		select {
-		case r, more := <-remotePeer.responseQueueToSend:
-			if !more {
-				return
-			}
+		case <-done:
+			return
+		case r := <-remotePeer.responseQueueToSend:
 			data := r.PeerResponseEncode()
-			_, err := remotePeer.RemoteConn.Write(data)
+			_, err := conn.Write(data)
 			if err != nil {
 				fmt.Println(err)
 				return
 			}
-			fmt.Println("response sent", r.q.id)
 		}
 	}
 }
@@ -530,21 +896,25 @@ func (p *Peer) Run() {
 	if err != nil {
 		panic(err)
 	}
-	go p.Mesh.registrator()
 	go p.walWriter.Run()
+	go p.expireCycle()
+	go p.gossip.run()
+	go p.antiEntropy()
+	go p.failoverCycle()
+	if p.consensus != nil {
+		go p.consensus.run()
+	}
 	defer func() {
 		p.walWriter.Close()
 
 	}()
+	if p.tls != nil {
+		s.TLSConfig = p.tls.ServerConfig(true)
+	}
 	p.tcpServer = s
 	s.Run("peer", p.HandlePeerRequest)
 }
 
-func (q *Query) waitResponse() (*Response, error) {
-
-	return nil, fmt.Errorf("Timeout waiting response for query %s", q.raw)
-}
-
 // func (p *Peer) getRemoteID() string {
 // 	for {
 // 		q := &Query{
@@ -564,8 +934,38 @@ func (q *Query) waitResponse() (*Response, error) {
 
 func (p *Peer) HandlePeerRequest(s *tcp.TCPServer, conn net.Conn) {
 	fmt.Printf("[peer] Serving %s\n", conn.RemoteAddr().String())
-	c := NewVQLClient(-1, fmt.Sprintf("peer-%s", p.ID), conn, p.vqlTCPServer)
-	remotePeerAddr, remotePeerPort, err := utils.SplitHostPort(conn.RemoteAddr().String())
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(HELLO_TIMEOUT * time.Second))
+	hello, err := p.readHello(conn)
+	if err == nil && p.secret != nil && hello.Nonce == "" {
+		err = errPeerAuthRequired
+	}
+	if err != nil {
+		fmt.Printf("[peer] Handshake with %s failed: %s\n", conn.RemoteAddr().String(), err)
+		writeFrame(conn, frameError, []byte(err.Error()))
+		return
+	}
+	h := p.hello()
+	if p.secret != nil {
+		h.Nonce = p.newNonce()
+		h.Auth = p.secretProof(proofResponder, hello.Nonce, h.Nonce, hello.ID, p.ID)
+	}
+	if err := writeFrame(conn, frameHello, h.encode()); err != nil {
+		fmt.Printf("[peer] Unable to send HELLO to %s: %s\n", conn.RemoteAddr().String(), err)
+		return
+	}
+	if err := p.checkSecretProof(conn, h.Nonce, hello); err != nil {
+		fmt.Printf("[peer] Handshake with %s failed: %s\n", conn.RemoteAddr().String(), err)
+		writeFrame(conn, frameError, []byte(err.Error()))
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	addr, err := hello.listenAddr(conn.RemoteAddr())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	remotePeerAddr, remotePeerPort, err := utils.SplitHostPort(addr)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -575,52 +975,50 @@ func (p *Peer) HandlePeerRequest(s *tcp.TCPServer, conn net.Conn) {
 		fmt.Println(err)
 		return
 	}
-	remotePeer.RemoteConn = conn
 
-	for i := 0; i < TCP_WORKERS_PER_PEER; i++ {
-		go p.ResponseReader(i, remotePeer, c)
-		go p.ResponseWriter(remotePeer, c)
-		go p.QueryReader(remotePeer, c)
-		go p.QueryWriter(remotePeer, c)
+	p.Mesh.Register(remotePeer)
+	defer p.Mesh.Deregister(remotePeer)
+	p.serveRemotePeer(remotePeer, conn, hello)
+	fmt.Printf("[peer] Connection closed %s\n", conn.RemoteAddr().String())
+}
+
+// EnableTLS secures the links with the other peers with mutual TLS: both
+// sides present a certificate signed by the CA of the cluster. It has to be
+// called before Run.
+func (p *Peer) EnableTLS(t *tcp.TLS) error {
+	if t.CAFile == "" {
+		return fmt.Errorf("peer TLS requires a CA certificate to verify the other peers")
 	}
+	p.tls = t
+	return nil
+}
 
-	defer func() {
-		p.Mesh.deregister <- remotePeer
-		conn.Close()
-		close(remotePeer.queryResponseReceived)
-		close(remotePeer.responseQueueToSend)
-		close(remotePeer.broadcastVQLQuery)
-		close(remotePeer.gotRawQueryFromPeer)
-	}()
-	p.Mesh.register <- remotePeer
-	for {
-		buf := make([]byte, 1024)
-		reqLen, err := conn.Read(buf)
-		if err != nil {
-			fmt.Println("[peer] Error reading:", err.Error())
-			break
-		}
-		data := buf[:reqLen]
-		switch {
-		case bytes.HasPrefix(data, PEER_QUERY_TYPE):
-			fmt.Println("queing incoming query")
-			select {
-			case remotePeer.gotRawQueryFromPeer <- data:
-			default:
-			}
-			fmt.Println("incoming query queued")
-		case bytes.HasPrefix(data, PEER_RESPONSE_TYPE):
-			fmt.Println("queing incoming response")
-			select {
-			case remotePeer.queryResponseReceived <- data:
-			default:
-			}
-			fmt.Println("incoming response queued")
-		default:
-			fmt.Println("Unknown data received:", string(data))
-		}
+// SetHintsDir keeps the hints of the peer in dir instead of a temporary
+// directory, and reloads the hints kept there by a previous run. It has to be
+// called before Run.
+func (p *Peer) SetHintsDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
 	}
-	fmt.Printf("[peer] Connection closed %s\n", conn.RemoteAddr().String())
+	hints := newHintedHandoff(dir, p.Stats)
+	if err := hints.load(); err != nil {
+		return err
+	}
+	// the temporary directory is still empty
+	os.Remove(p.hints.dir)
+	p.hints = hints
+	return nil
+}
+
+// EnableSecret requires the peers linking with the peer to prove they know
+// the shared secret of the cluster, and proves it to the peers it links
+// with. It has to be called before Run.
+func (p *Peer) EnableSecret(secret string) error {
+	if secret == "" {
+		return fmt.Errorf("empty peer secret")
+	}
+	p.secret = []byte(secret)
+	return nil
 }
 
 func (p *Peer) Shutdown() {
@@ -630,68 +1028,131 @@ func (p *Peer) Shutdown() {
 }
 
 func (p *Peer) Ready() bool {
-	if p.ConnectionStatus() != PEER_STATUS_CONNECTED ||
-		p.ID == "" {
-		return false
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.RemoteConn != nil && p.ID != ""
+}
+
+// connectedPeers returns the peers of the mesh with an open connection,
+// whether or not their ID is known yet.
+func (p *Peer) connectedPeers() (peers []*Peer) {
+	for _, remotePeer := range p.Mesh.List() {
+		if remotePeer.ConnectionStatus() == PEER_STATUS_CONNECTED {
+			peers = append(peers, remotePeer)
+		}
 	}
-	return true
+	return peers
 }
 
-func (p *Peer) Updater(remotePeer *Peer) {
-	fmt.Println("Peer updater started")
-	defer func() {
-		fmt.Println("Peer updater exited")
-	}()
-	if remotePeer.ID == "" {
+func (p *Peer) PublishVQL(query *Query) {
+	p.publish(query, false)
+}
+
+// publish replicates a write to the linked peers storing it and hints it
+// for the unreachable ones. When acknowledged, acks receives the ID of
+// every peer the write was sent to once it acknowledged the write, an empty
+// ID when it did not in time; sent is the number of peers it was sent to.
+func (p *Peer) publish(query *Query, acknowledged bool) (acks chan string, sent int) {
+	if query.forwarded || query.asking {
+		// the write is replicated, not forwarded again
+		replicated := *query
+		replicated.forwarded, replicated.asking = false, false
+		query = &replicated
+	}
+	query.offset = p.backlog.append(query)
+	p.originate(query)
+	var owners []string
+	if p.cluster != nil {
+		owners = p.cluster.queryOwners(query)
+	}
+	links := p.fanOut(query, owners)
+	p.hintUnreachable(query, owners)
+	if acknowledged {
+		acks = make(chan string, len(links))
+	}
+	for _, link := range links {
+		if acknowledged {
+			waiting := make(chan *Response, 1)
+			lock.Lock()
+			link.queryWaiting[query.id] = waiting
+			lock.Unlock()
+			go link.awaitAck(query.id, waiting, acks)
+		}
+		// writes are sent after the snapshot of a full sync
+		if link.fullSync.hold(query) {
+			continue
+		}
+		_, done := link.session()
 		select {
-		case remotePeer.updateTrigger <- true:
-		default:
+		case link.broadcastVQLQuery <- query:
+		case <-done:
+			continue
 		}
+		atomic.AddInt64(&link.Stats.BytesOut, int64(len(query.raw)))
 	}
-	for {
-		select {
-		case _, more := <-remotePeer.updateTrigger:
-			if !more {
-				return
-			}
-			fmt.Println("Querying peer info of", remotePeer.connString())
-			q := NewSimpleQuery("peer id\r\n")
-
-			resp, err := p.RemoteExecute(remotePeer, q)
-			if err != nil {
-				remotePeer.RemoteConn.Close()
-				return
-			}
-			fmt.Println("-----------", string(resp.FormattedPayload()))
+	return acks, len(links)
+}
 
-			remotePeer.ID = string(resp.FormattedPayload())
+// awaitAck waits for the answer of the peer to the write id and sends its
+// ID on acks once it acknowledged the write, an empty ID when it answered
+// with an error, closed the connection or did not answer in time.
+func (p *Peer) awaitAck(id string, waiting chan *Response, acks chan<- string) {
+	defer func() {
+		lock.Lock()
+		delete(p.queryWaiting, id)
+		lock.Unlock()
+	}()
+	_, done := p.session()
+	select {
+	case resp := <-waiting:
+		if resp.Type != typeError {
+			acks <- p.remoteID()
+			return
 		}
+	case <-done:
+	case <-time.After(QUERY_TIMEOUT * time.Second):
 	}
-	// q := NewSimpleQuery("PEER ID")
-	// select {
-	// case p.broadcastVQLQuery <- q:
-	// 	fmt.Println("vql published to peer", p.ID)
-	// default:
-	// }
-	// // resp := <-remotePeer.queryWaiting[r.q.id]
-	// return nil
+	acks <- ""
 }
 
-func (p *Peer) PublishVQL(query *Query) {
-	// TODO: publish vql to the Peer Leader only who will dispatch query to
-	// followers.
-	// We can implement a region ID per cluster in order to we send queries to the
-	// leader of the other regions.
-	// It reduces network usage in high latency networks
-
-	for p := range p.Mesh.Peers {
-		if !p.Ready() {
+// originate gives a query received from a client the peer as origin, and
+// its failover epoch.
+func (p *Peer) originate(query *Query) {
+	if query.origin == "" {
+		query.origin, query.seq = p.ID, atomic.AddInt64(&p.originSeq, 1)
+		query.reached = []string{p.ID}
+		query.epoch = p.role.Epoch()
+	}
+}
+
+// fanOut returns the links a query is sent to, and adds their peers to the
+// peers the query reached. With sharding, owners are the peers storing the
+// keys of the query.
+func (p *Peer) fanOut(query *Query, owners []string) []*Peer {
+	links := []*Peer{}
+	for _, link := range p.Mesh.List() {
+		if !link.Ready() {
 			continue
 		}
-		select {
-		case p.broadcastVQLQuery <- query:
-			fmt.Println("vql published to peer", p.ID)
+		// with sharding, writes are only sent to the owners of their keys
+		if owners != nil && !stringInSlice(link.remoteID(), owners) {
+			continue
+		}
+		// the peers the write was already sent to relay it
+		if stringInSlice(link.remoteID(), query.reached) {
+			continue
 		}
-		p.Stats.BytesOut += int64(len(query.raw))
+		links = append(links, link)
+	}
+	// the other regions receive the write through their relay, except the
+	// writes of a consistency level acknowledged by every peer
+	if !query.coordinated {
+		links = p.regionalFanOut(links, query.reached, p.peerRegions())
+	}
+	reached := append([]string{}, query.reached...)
+	for _, link := range links {
+		reached = append(reached, link.remoteID())
 	}
+	query.reached = reached
+	return links
 }
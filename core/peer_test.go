@@ -1,6 +1,9 @@
 package core
 
 import (
+	"fmt"
+	"net"
+	"strings"
 	"testing"
 	"time"
 )
@@ -12,7 +15,7 @@ func TestPeering(t *testing.T) {
 	)
 	client1 := setup()
 
-	input := []byte("0\r\n*2\r\n$6\r\nid=foo\r\n$5\r\nbar\r\n\r\n")
+	input := []byte("*2\r\n$6\r\nid=foo\r\n$5\r\nbar\r\n\r\n")
 	q, err = client1.vqlTCPServer.Peer.ParsePeerQuery(client1, input)
 	if err != nil {
 		t.Fatal(err)
@@ -28,7 +31,7 @@ func TestPeering(t *testing.T) {
 		t.Fatalf("want %+v, got %+v", expected, output)
 	}
 
-	outputInt := len(client1.vqlTCPServer.Peer.Mesh.Peers)
+	outputInt := client1.vqlTCPServer.Peer.Mesh.Len()
 	expectedInt := 0
 	if expectedInt != outputInt {
 		t.Errorf("want %+v, got %+v", expectedInt, outputInt)
@@ -62,12 +65,12 @@ func TestPeering(t *testing.T) {
 		t.Fatalf("want %+v, got %+v", expectedInt, outputInt)
 	}
 
-	outputInt = len(client1.vqlTCPServer.Peer.Mesh.Peers)
+	outputInt = client1.vqlTCPServer.Peer.Mesh.Len()
 	expectedInt = 1
 	if expectedInt != outputInt {
 		t.Fatalf("want %+v, got %+v", expectedInt, outputInt)
 	}
-	outputInt = len(client2.vqlTCPServer.Peer.Mesh.Peers)
+	outputInt = client2.vqlTCPServer.Peer.Mesh.Len()
 	expectedInt = 1
 	if expectedInt != outputInt {
 		t.Fatalf("want %+v, got %+v", expectedInt, outputInt)
@@ -99,3 +102,106 @@ func TestPeering(t *testing.T) {
 	}
 
 }
+
+func TestReconnectDelay(t *testing.T) {
+	suites := []struct {
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{0, 50 * time.Millisecond, 100 * time.Millisecond},
+		{3, 400 * time.Millisecond, 800 * time.Millisecond},
+		{20, 15 * time.Second, 30 * time.Second},
+		{100, 15 * time.Second, 30 * time.Second},
+	}
+	for _, s := range suites {
+		for i := 0; i < 10; i++ {
+			output := reconnectDelay(s.attempt)
+			if output < s.min || output > s.max {
+				t.Errorf("attempt %d: want delay in [%s, %s], got %s", s.attempt, s.min, s.max, output)
+			}
+		}
+	}
+}
+
+func waitPeerStatus(remotePeer *Peer, status int) int {
+	for i := 0; i < 50 && remotePeer.ConnectionStatus() != status; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return remotePeer.ConnectionStatus()
+}
+
+func peerReconnects(remotePeer *Peer) int64 {
+	remotePeer.mu.RLock()
+	defer remotePeer.mu.RUnlock()
+	return remotePeer.Stats.Reconnects
+}
+
+func TestPeerReconnection(t *testing.T) {
+	client1 := setup()
+	p1 := client1.vqlTCPServer.Peer
+
+	// reserve a port nobody listens to yet
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	remotePeer, err := p1.ConnectToPeerAddr(fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output := waitPeerStatus(remotePeer, PEER_STATUS_RECONNECTING); output != PEER_STATUS_RECONNECTING {
+		t.Fatalf("want %+v, got %+v", PEER_STATUS_RECONNECTING, output)
+	}
+	output := <-executeAsync(client1, "peer list")
+	for _, expected := range []string{"connection=Reconnecting", "last_error=\"dial tcp4"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("want %q in %q", expected, output)
+		}
+	}
+
+	p2, err := NewPeer("127.0.0.1", int64(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p2.Run()
+	if output := waitPeerStatus(remotePeer, PEER_STATUS_CONNECTED); output != PEER_STATUS_CONNECTED {
+		t.Fatalf("want %+v, got %+v", PEER_STATUS_CONNECTED, output)
+	}
+	if remotePeer.ID != p2.ID || remotePeer.LastError() != "" {
+		t.Errorf("want peer %s without error, got %s %q", p2.ID, remotePeer.ID, remotePeer.LastError())
+	}
+
+	// dropped connections are redialed
+	reconnects := peerReconnects(remotePeer)
+	conn, _ := remotePeer.session()
+	conn.Close()
+	for i := 0; i < 50 && peerReconnects(remotePeer) == reconnects; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if output := peerReconnects(remotePeer); output != reconnects+1 {
+		t.Errorf("want %+v, got %+v", reconnects+1, output)
+	}
+	if output := waitPeerStatus(remotePeer, PEER_STATUS_CONNECTED); output != PEER_STATUS_CONNECTED {
+		t.Fatalf("want %+v, got %+v", PEER_STATUS_CONNECTED, output)
+	}
+
+	// removed peers are not redialed
+	expected := "+OK\r\n"
+	if output := <-executeAsync(client1, fmt.Sprintf("peer remove %s", remotePeer.Key())); expected != output {
+		t.Fatalf("want %q, got %q", expected, output)
+	}
+	for i := 0; i < 50 && p1.Mesh.Len() > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if output := p1.Mesh.Len(); output != 0 {
+		t.Errorf("want %+v, got %+v", 0, output)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if output := p2.Mesh.Len(); output != 0 {
+		t.Errorf("want %+v, got %+v", 0, output)
+	}
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/bjorand/velocidb/utils"
+)
+
+// FileDiscovery discovers the peers listed in a file, one host:port per
+// line. Empty lines and lines starting with # are ignored. The file is read
+// again every DISCOVERY_INTERVAL, so that editing it links the peer with
+// the peers added and removes the links with the peers removed. A file
+// which can't be read or holds an invalid address is ignored until fixed.
+type FileDiscovery struct {
+	Path string
+}
+
+func NewFileDiscovery(path string) *FileDiscovery {
+	return &FileDiscovery{Path: path}
+}
+
+func (f *FileDiscovery) Name() string {
+	return "file"
+}
+
+func (f *FileDiscovery) Register(p *Peer) error {
+	return nil
+}
+
+func (f *FileDiscovery) Deregister(p *Peer) error {
+	return nil
+}
+
+func (f *FileDiscovery) Peers() ([]string, error) {
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []string{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, _, err := utils.SplitHostPort(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid peer address %q", f.Path, i+1, line)
+		}
+		addrs = append(addrs, line)
+	}
+	return addrs, nil
+}
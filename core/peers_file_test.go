@@ -0,0 +1,90 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileDiscovery(t *testing.T) {
+	f, err := ioutil.TempFile("/tmp", "peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	client1, client2 := setupGossip(), setupGossip()
+	p1, p2 := client1.vqlTCPServer.Peer, client2.vqlTCPServer.Peer
+	d := NewFileDiscovery(f.Name())
+
+	suites := []struct {
+		content  string
+		expected string
+	}{
+		{"", "[] <nil>"},
+		{"# peers\n\n 10.0.0.1:4000 \n10.0.0.2:4000\n", "[10.0.0.1:4000 10.0.0.2:4000] <nil>"},
+		{"10.0.0.1\n", fmt.Sprintf("[] %s:1: invalid peer address %q", f.Name(), "10.0.0.1")},
+	}
+	for _, s := range suites {
+		ioutil.WriteFile(f.Name(), []byte(s.content), 0600)
+		addrs, err := d.Peers()
+		if output := fmt.Sprint(addrs, err); output != s.expected {
+			t.Errorf("%q: want %+v, got %+v", s.content, s.expected, output)
+		}
+	}
+
+	// the peer links with the peers added to the file
+	ioutil.WriteFile(f.Name(), []byte(p1.connString()+"\n"+p2.connString()+"\n"), 0600)
+	l := newDiscoveryLoop(d)
+	l.interval, l.retry = 100*time.Millisecond, 100*time.Millisecond
+	if err := p1.startDiscovery(l); err != nil {
+		t.Fatal(err)
+	}
+	defer p1.StopDiscovery()
+	var link *Peer
+	for i := 0; i < 100 && (link == nil || !link.Ready()); i++ {
+		time.Sleep(20 * time.Millisecond)
+		link = p1.Mesh.GetPeerByKey(p2.connString())
+	}
+	if link == nil || !link.Ready() {
+		t.Fatalf("want a link with %s", p2.connString())
+	}
+
+	// a link removed is made again
+	removed := link
+	p1.RemovePeer(removed)
+	for i := 0; i < 150 && (link == removed || link == nil || !link.Ready()); i++ {
+		time.Sleep(20 * time.Millisecond)
+		l.mu.Lock()
+		link = l.links[p2.connString()]
+		l.mu.Unlock()
+	}
+	if link == removed || link == nil || !link.Ready() {
+		t.Fatalf("want a new link with %s", p2.connString())
+	}
+
+	// an invalid file is ignored
+	ioutil.WriteFile(f.Name(), []byte("invalid\n"), 0600)
+	expected := "discovery_status:" + f.Name() + ":1: invalid peer address"
+	for i := 0; i < 150; i++ {
+		if output := <-executeAsync(client1, "info peer"); strings.Contains(output, expected) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if output := <-executeAsync(client1, "info peer"); !strings.Contains(output, expected) || link.Removed() {
+		t.Errorf("want %q in %q and the link kept", expected, output)
+	}
+
+	// the links with the peers removed from the file are removed
+	ioutil.WriteFile(f.Name(), []byte(p1.connString()+"\n"), 0600)
+	for i := 0; i < 150 && !link.Removed(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !link.Removed() {
+		t.Errorf("want the link with %s removed", p2.connString())
+	}
+}
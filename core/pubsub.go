@@ -0,0 +1,430 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/glob"
+)
+
+// PUBLISH delivers a message to the subscribers of the peer and sends it to
+// the peers of the mesh like a write, with its origin and the peers it
+// reached, so that the peers relay it to the peers not linked with the
+// publisher. Messages are neither kept in the backlog nor hinted: a peer
+// which is not linked misses them. A message waits up to
+// PUBSUB_SEND_TIMEOUT for a link with a full queue, then it is dropped for
+// that peer.
+const (
+	// milliseconds
+	PUBSUB_SEND_TIMEOUT = 1000
+)
+
+var (
+	// subscriberModeVerbs lists the commands a client can still run once it
+	// has at least one active subscription.
+	subscriberModeVerbs = map[string]bool{
+		"subscribe":    true,
+		"psubscribe":   true,
+		"unsubscribe":  true,
+		"punsubscribe": true,
+		"ping":         true,
+		"quit":         true,
+	}
+)
+
+type patternSubscribers struct {
+	g       glob.Glob
+	clients map[*VQLClient]bool
+}
+
+// PubSub keeps track of the channels and patterns VQL clients of a peer are
+// subscribed to and delivers published messages to them.
+type PubSub struct {
+	mu       sync.RWMutex
+	channels map[string]map[*VQLClient]bool
+	patterns map[string]*patternSubscribers
+	// subscriptions of every client, used to count and clean them up
+	clientChannels map[*VQLClient]map[string]bool
+	clientPatterns map[*VQLClient]map[string]bool
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		channels:       make(map[string]map[*VQLClient]bool),
+		patterns:       make(map[string]*patternSubscribers),
+		clientChannels: make(map[*VQLClient]map[string]bool),
+		clientPatterns: make(map[*VQLClient]map[string]bool),
+	}
+}
+
+func (ps *PubSub) subscriptionCount(c *VQLClient) int {
+	return len(ps.clientChannels[c]) + len(ps.clientPatterns[c])
+}
+
+// SubscriptionCount returns the number of channels and patterns the client
+// is subscribed to.
+func (ps *PubSub) SubscriptionCount(c *VQLClient) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.subscriptionCount(c)
+}
+
+func (ps *PubSub) Subscribe(c *VQLClient, channel string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.channels[channel] == nil {
+		ps.channels[channel] = make(map[*VQLClient]bool)
+	}
+	ps.channels[channel][c] = true
+	if ps.clientChannels[c] == nil {
+		ps.clientChannels[c] = make(map[string]bool)
+	}
+	ps.clientChannels[c][channel] = true
+	return ps.subscriptionCount(c)
+}
+
+func (ps *PubSub) Unsubscribe(c *VQLClient, channel string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.unsubscribe(c, channel)
+	return ps.subscriptionCount(c)
+}
+
+func (ps *PubSub) unsubscribe(c *VQLClient, channel string) {
+	delete(ps.channels[channel], c)
+	if len(ps.channels[channel]) == 0 {
+		delete(ps.channels, channel)
+	}
+	delete(ps.clientChannels[c], channel)
+	if len(ps.clientChannels[c]) == 0 {
+		delete(ps.clientChannels, c)
+	}
+}
+
+func (ps *PubSub) PSubscribe(c *VQLClient, pattern string) (int, error) {
+	g, err := glob.Compile(pattern)
+	if err != nil {
+		return 0, err
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.patterns[pattern] == nil {
+		ps.patterns[pattern] = &patternSubscribers{
+			g:       g,
+			clients: make(map[*VQLClient]bool),
+		}
+	}
+	ps.patterns[pattern].clients[c] = true
+	if ps.clientPatterns[c] == nil {
+		ps.clientPatterns[c] = make(map[string]bool)
+	}
+	ps.clientPatterns[c][pattern] = true
+	return ps.subscriptionCount(c), nil
+}
+
+func (ps *PubSub) PUnsubscribe(c *VQLClient, pattern string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.punsubscribe(c, pattern)
+	return ps.subscriptionCount(c)
+}
+
+func (ps *PubSub) punsubscribe(c *VQLClient, pattern string) {
+	if s := ps.patterns[pattern]; s != nil {
+		delete(s.clients, c)
+		if len(s.clients) == 0 {
+			delete(ps.patterns, pattern)
+		}
+	}
+	delete(ps.clientPatterns[c], pattern)
+	if len(ps.clientPatterns[c]) == 0 {
+		delete(ps.clientPatterns, c)
+	}
+}
+
+// ClientChannels returns the sorted channels the client is subscribed to.
+func (ps *PubSub) ClientChannels(c *VQLClient) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return sortedKeys(ps.clientChannels[c])
+}
+
+// ClientPatterns returns the sorted patterns the client is subscribed to.
+func (ps *PubSub) ClientPatterns(c *VQLClient) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return sortedKeys(ps.clientPatterns[c])
+}
+
+// RemoveClient drops every subscription of a disconnected client.
+func (ps *PubSub) RemoveClient(c *VQLClient) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for channel := range ps.clientChannels[c] {
+		ps.unsubscribe(c, channel)
+	}
+	for pattern := range ps.clientPatterns[c] {
+		ps.punsubscribe(c, pattern)
+	}
+}
+
+// Publish queues message for the local subscribers of channel and returns
+// the number of clients it was sent to. It does not wait for the subscribers
+// to read it: the message is dropped for the ones with a full queue.
+func (ps *PubSub) Publish(channel string, message []byte) int {
+	type delivery struct {
+		c       *VQLClient
+		payload []byte
+	}
+	var deliveries []delivery
+	ps.mu.RLock()
+	for c := range ps.channels[channel] {
+		deliveries = append(deliveries, delivery{
+			c:       c,
+			payload: formattedReply([]interface{}{"message", channel, message}),
+		})
+	}
+	for pattern, s := range ps.patterns {
+		if !s.g.Match(channel) {
+			continue
+		}
+		for c := range s.clients {
+			deliveries = append(deliveries, delivery{
+				c:       c,
+				payload: formattedReply([]interface{}{"pmessage", pattern, channel, message}),
+			})
+		}
+	}
+	ps.mu.RUnlock()
+	for _, d := range deliveries {
+		d.c.Push(d.payload)
+	}
+	return len(deliveries)
+}
+
+// Channels returns the active channels matching pattern. An empty pattern
+// matches every channel.
+func (ps *PubSub) Channels(pattern string) ([]string, error) {
+	var g glob.Glob
+	if pattern != "" {
+		var err error
+		g, err = glob.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	var channels []string
+	for channel := range ps.channels {
+		if g == nil || g.Match(channel) {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels, nil
+}
+
+func (ps *PubSub) NumSub(channel string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return len(ps.channels[channel])
+}
+
+func (ps *PubSub) NumPat() int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	var count int
+	for _, s := range ps.patterns {
+		count += len(s.clients)
+	}
+	return count
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// clusterPubSub runs a PUBSUB introspection query on every connected peer.
+// Remote peers answer with their local state only since the forwarded query
+// is flagged as coming from a peer.
+func (p *Peer) clusterPubSub(q *Query) []*Response {
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		responses []*Response
+	)
+	for _, remotePeer := range p.connectedPeers() {
+		wg.Add(1)
+		go func(remotePeer *Peer) {
+			defer wg.Done()
+			resp, err := p.RemoteExecute(remotePeer, NewSimpleQuery(string(formattedArray(q.parsed))))
+			if err != nil {
+				fmt.Printf("[pubsub] %s\n", err)
+				return
+			}
+			if resp.Type == typeError {
+				fmt.Printf("[pubsub] peer %s: %s\n", remotePeer.ID, resp.Payload[0])
+				return
+			}
+			mu.Lock()
+			responses = append(responses, resp)
+			mu.Unlock()
+		}(remotePeer)
+	}
+	wg.Wait()
+	return responses
+}
+
+func (q *Query) subscribe(r *Response, channels []string) error {
+	for _, channel := range channels {
+		count := q.p.pubsub.Subscribe(q.c, channel)
+		r.Replies = append(r.Replies, formattedReply([]interface{}{"subscribe", channel, count}))
+	}
+	return nil
+}
+
+func (q *Query) psubscribe(r *Response, patterns []string) error {
+	for _, pattern := range patterns {
+		count, err := q.p.pubsub.PSubscribe(q.c, pattern)
+		if err != nil {
+			return err
+		}
+		r.Replies = append(r.Replies, formattedReply([]interface{}{"psubscribe", pattern, count}))
+	}
+	return nil
+}
+
+func (q *Query) unsubscribe(r *Response, channels []string) error {
+	if len(channels) == 0 {
+		channels = q.p.pubsub.ClientChannels(q.c)
+	}
+	if len(channels) == 0 {
+		r.Replies = append(r.Replies, formattedReply([]interface{}{"unsubscribe", nil, q.p.pubsub.SubscriptionCount(q.c)}))
+	}
+	for _, channel := range channels {
+		count := q.p.pubsub.Unsubscribe(q.c, channel)
+		r.Replies = append(r.Replies, formattedReply([]interface{}{"unsubscribe", channel, count}))
+	}
+	return nil
+}
+
+func (q *Query) punsubscribe(r *Response, patterns []string) error {
+	if len(patterns) == 0 {
+		patterns = q.p.pubsub.ClientPatterns(q.c)
+	}
+	if len(patterns) == 0 {
+		r.Replies = append(r.Replies, formattedReply([]interface{}{"punsubscribe", nil, q.p.pubsub.SubscriptionCount(q.c)}))
+	}
+	for _, pattern := range patterns {
+		count := q.p.pubsub.PUnsubscribe(q.c, pattern)
+		r.Replies = append(r.Replies, formattedReply([]interface{}{"punsubscribe", pattern, count}))
+	}
+	return nil
+}
+
+func (q *Query) pubsubChannels(r *Response, args []string) error {
+	if len(args) > 2 {
+		return fmt.Errorf("Too many arguments")
+	}
+	var pattern string
+	if len(args) == 2 {
+		pattern = args[1]
+	}
+	channels, err := q.p.pubsub.Channels(pattern)
+	if err != nil {
+		return err
+	}
+	if !q.FromPeer {
+		seen := make(map[string]bool)
+		for _, channel := range channels {
+			seen[channel] = true
+		}
+		for _, resp := range q.p.clusterPubSub(q) {
+			for _, channel := range resp.Payload {
+				seen[string(channel)] = true
+			}
+		}
+		channels = sortedKeys(seen)
+	}
+	r.Payload = nil
+	for _, channel := range channels {
+		r.Payload = append(r.Payload, []byte(channel))
+	}
+	r.Type = typeArray
+	return nil
+}
+
+func (q *Query) pubsubNumSub(r *Response, args []string) error {
+	channels := args[1:]
+	counts := make([]int, len(channels))
+	for i, channel := range channels {
+		counts[i] = q.p.pubsub.NumSub(channel)
+	}
+	if !q.FromPeer {
+		for _, resp := range q.p.clusterPubSub(q) {
+			for i := range channels {
+				if 2*i+1 >= len(resp.Payload) {
+					break
+				}
+				n, err := strconv.Atoi(string(resp.Payload[2*i+1]))
+				if err != nil {
+					continue
+				}
+				counts[i] += n
+			}
+		}
+	}
+	var items []interface{}
+	for i, channel := range channels {
+		items = append(items, channel, counts[i])
+	}
+	r.Replies = [][]byte{formattedReply(items)}
+	return nil
+}
+
+func (q *Query) pubsubNumPat(r *Response, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Too many arguments")
+	}
+	count := q.p.pubsub.NumPat()
+	if !q.FromPeer {
+		for _, resp := range q.p.clusterPubSub(q) {
+			n, err := strconv.Atoi(string(resp.Payload[0]))
+			if err != nil {
+				continue
+			}
+			count += n
+		}
+	}
+	r.PayloadString([]byte(strconv.Itoa(count)))
+	r.Type = typeInteger
+	return nil
+}
+
+// publishMessage sends a published message to the peers it did not reach.
+func (p *Peer) publishMessage(query *Query) {
+	p.originate(query)
+	for _, link := range p.fanOut(query, nil) {
+		_, done := link.session()
+		timer := time.NewTimer(PUBSUB_SEND_TIMEOUT * time.Millisecond)
+		select {
+		case link.broadcastVQLQuery <- query:
+			atomic.AddInt64(&link.Stats.BytesOut, int64(len(query.raw)))
+		case <-done:
+			atomic.AddInt64(&p.Stats.PubSubDropped, 1)
+		case <-timer.C:
+			atomic.AddInt64(&p.Stats.PubSubDropped, 1)
+		}
+		timer.Stop()
+	}
+}
@@ -0,0 +1,252 @@
+package core
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func pipeVQLConn(v *VQLTCPServer) (net.Conn, *bufio.Reader) {
+	server, conn := net.Pipe()
+	go v.HandleVQLRequest(nil, server)
+	return conn, bufio.NewReader(conn)
+}
+
+func expectReply(t *testing.T, conn net.Conn, reader *bufio.Reader, expected string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	output := make([]byte, len(expected))
+	if _, err := io.ReadFull(reader, output); err != nil {
+		t.Fatalf("want %q, got error %s", expected, err)
+	}
+	if expected != string(output) {
+		t.Fatalf("want %q, got %q", expected, output)
+	}
+}
+
+func executeAsync(client *VQLClient, input string) chan string {
+	done := make(chan string, 1)
+	go func() {
+		q, err := client.ParseRawQuery([]byte(input))
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		r, err := q.Execute()
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		done <- string(r.FormattedPayload())
+	}()
+	return done
+}
+
+func TestPubSubLocal(t *testing.T) {
+	client := setup()
+	conn, reader := pipeVQLConn(client.vqlTCPServer)
+	defer conn.Close()
+
+	conn.Write([]byte("subscribe news sport\r\n"))
+	expectReply(t, conn, reader, "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$5\r\nsport\r\n:2\r\n")
+	conn.Write([]byte("psubscribe n*\r\n"))
+	expectReply(t, conn, reader, "*3\r\n$10\r\npsubscribe\r\n$2\r\nn*\r\n:3\r\n")
+	conn.Write([]byte("get foo\r\n"))
+	expectReply(t, conn, reader, "-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n")
+	conn.Write([]byte("ping\r\n"))
+	expectReply(t, conn, reader, "*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+
+	done := executeAsync(client, "publish news hello\r\n")
+	expectReply(t, conn, reader, "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n")
+	expectReply(t, conn, reader, "*4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$4\r\nnews\r\n$5\r\nhello\r\n")
+	expected := ":2\r\n"
+	if output := <-done; expected != output {
+		t.Fatalf("want %q, got %q", expected, output)
+	}
+
+	suites := []string{
+		"pubsub channels", "*2\r\n$4\r\nnews\r\n$5\r\nsport\r\n",
+		"pubsub channels s*", "*1\r\n$5\r\nsport\r\n",
+		"pubsub numsub news other", "*4\r\n$4\r\nnews\r\n:1\r\n$5\r\nother\r\n:0\r\n",
+		"pubsub numpat", ":1\r\n",
+		"publish other hello", ":0\r\n",
+	}
+	for i := 0; i < len(suites); i += 2 {
+		expected := suites[i+1]
+		if output := <-executeAsync(client, suites[i]); expected != output {
+			t.Errorf("%s: want %q, got %q", suites[i], expected, output)
+		}
+	}
+
+	conn.Write([]byte("unsubscribe\r\n"))
+	expectReply(t, conn, reader, "*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:2\r\n*3\r\n$11\r\nunsubscribe\r\n$5\r\nsport\r\n:1\r\n")
+	conn.Write([]byte("punsubscribe\r\n"))
+	expectReply(t, conn, reader, "*3\r\n$12\r\npunsubscribe\r\n$2\r\nn*\r\n:0\r\n")
+	conn.Write([]byte("punsubscribe\r\n"))
+	expectReply(t, conn, reader, "*3\r\n$12\r\npunsubscribe\r\n$-1\r\n:0\r\n")
+	conn.Write([]byte("ping\r\n"))
+	expectReply(t, conn, reader, "+PONG\r\n")
+
+	expected = ":0\r\n"
+	if output := <-executeAsync(client, "pubsub numpat"); expected != output {
+		t.Errorf("want %q, got %q", expected, output)
+	}
+}
+
+func TestPubSubDisconnect(t *testing.T) {
+	client := setup()
+	conn, reader := pipeVQLConn(client.vqlTCPServer)
+	conn.Write([]byte("subscribe news\r\n"))
+	expectReply(t, conn, reader, "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n")
+	conn.Close()
+	for i := 0; i < 50; i++ {
+		if client.vqlTCPServer.Peer.pubsub.NumSub("news") == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expected := 0
+	output := client.vqlTCPServer.Peer.pubsub.NumSub("news")
+	if expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestPubSubSlowSubscriber(t *testing.T) {
+	client := setup()
+	p := client.vqlTCPServer.Peer
+	conn, reader := pipeVQLConn(client.vqlTCPServer)
+	defer conn.Close()
+	conn.Write([]byte("subscribe news\r\n"))
+	expectReply(t, conn, reader, "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n")
+
+	// the publisher does not wait for a subscriber which does not read, the
+	// messages its queue cannot hold are dropped
+	start := time.Now()
+	for i := 0; i < PUSH_QUEUE_SIZE+10; i++ {
+		expected := ":1\r\n"
+		if output := <-executeAsync(client, "publish news hello\r\n"); expected != output {
+			t.Fatalf("want %q, got %q", expected, output)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > PUSH_TIMEOUT*time.Second {
+		t.Errorf("want publish without waiting, got %s", elapsed)
+	}
+	if output := atomic.LoadInt64(&p.Stats.PushDropped); output < 9 || output > 10 {
+		t.Errorf("want %+v dropped messages, got %+v", 10, output)
+	}
+	// the queued messages are still delivered
+	expectReply(t, conn, reader, "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n")
+}
+
+func TestPubSubMesh(t *testing.T) {
+	client1 := setup()
+	client2 := setup()
+	p2 := client2.vqlTCPServer.Peer
+	for i := 0; i < 50 && p2.tcpServer == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	remotePeer, err := client1.vqlTCPServer.Peer.ConnectToPeerAddr(p2.connString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if remotePeer.ConnectionStatus() == PEER_STATUS_CONNECTED && len(p2.connectedPeers()) == 1 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	conn1, reader1 := pipeVQLConn(client1.vqlTCPServer)
+	defer conn1.Close()
+	conn1.Write([]byte("subscribe news\r\n"))
+	expectReply(t, conn1, reader1, "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n")
+	conn2, reader2 := pipeVQLConn(client2.vqlTCPServer)
+	defer conn2.Close()
+	conn2.Write([]byte("psubscribe n*\r\n"))
+	expectReply(t, conn2, reader2, "*3\r\n$10\r\npsubscribe\r\n$2\r\nn*\r\n:1\r\n")
+
+	// published on the peer which dialed the connection
+	done := executeAsync(client1, "publish news hello\r\n")
+	expectReply(t, conn1, reader1, "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n")
+	expectReply(t, conn2, reader2, "*4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$4\r\nnews\r\n$5\r\nhello\r\n")
+	expected := ":1\r\n"
+	if output := <-done; expected != output {
+		t.Fatalf("want %q, got %q", expected, output)
+	}
+
+	// published on the peer which accepted the connection
+	done = executeAsync(client2, "publish news world\r\n")
+	expectReply(t, conn2, reader2, "*4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$4\r\nnews\r\n$5\r\nworld\r\n")
+	expectReply(t, conn1, reader1, "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nworld\r\n")
+	<-done
+
+	suites := []string{
+		"pubsub channels", "*1\r\n$4\r\nnews\r\n",
+		"pubsub numsub news", "*2\r\n$4\r\nnews\r\n:1\r\n",
+		"pubsub numpat", ":1\r\n",
+	}
+	for _, client := range []*VQLClient{client1, client2} {
+		for i := 0; i < len(suites); i += 2 {
+			expected := suites[i+1]
+			if output := <-executeAsync(client, suites[i]); expected != output {
+				t.Errorf("%s: want %q, got %q", suites[i], expected, output)
+			}
+		}
+	}
+}
+
+func TestPubSubRelay(t *testing.T) {
+	// a chain of peers a - b - c, c is not linked with a
+	clients := []*VQLClient{setupGossip(), setupGossip(), setupGossip()}
+	peers := []*Peer{}
+	for _, client := range clients {
+		p := client.vqlTCPServer.Peer
+		p.gossip.mu.Lock()
+		p.gossip.deaf = true
+		p.gossip.mu.Unlock()
+		peers = append(peers, p)
+	}
+	for _, i := range []int{0, 2} {
+		link, err := peers[i].ConnectToPeerAddr(peers[1].connString())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output := waitPeerStatus(link, PEER_STATUS_CONNECTED); output != PEER_STATUS_CONNECTED {
+			t.Fatalf("want %+v, got %+v", PEER_STATUS_CONNECTED, output)
+		}
+	}
+	for i := 0; i < 50 && len(peers[1].Mesh.List()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	conns := []net.Conn{}
+	readers := []*bufio.Reader{}
+	for _, client := range clients[1:] {
+		conn, reader := pipeVQLConn(client.vqlTCPServer)
+		defer conn.Close()
+		conn.Write([]byte("subscribe news\r\n"))
+		expectReply(t, conn, reader, "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n")
+		conns, readers = append(conns, conn), append(readers, reader)
+	}
+
+	// the subscribers of b and c receive every message once
+	for _, message := range []string{"hello", "world"} {
+		<-executeAsync(clients[0], "publish news "+message+"\r\n")
+		for i := range conns {
+			expectReply(t, conns[i], readers[i], "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\n"+message+"\r\n")
+		}
+	}
+	// messages are not kept in the backlog
+	if output := peers[0].backlog.Offset(); output != 0 {
+		t.Errorf("want %+v, got %+v", 0, output)
+	}
+	expected := "pubsub_dropped_messages:0"
+	if output := <-executeAsync(clients[0], "info vql"); !strings.Contains(output, expected) {
+		t.Errorf("want %q in %q", expected, output)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"strings"
 	"time"
 
+	storagePkg "github.com/bjorand/velocidb/storage"
 	"github.com/google/uuid"
 )
 
@@ -17,6 +18,40 @@ type Query struct {
 	c           *VQLClient
 	hasMoreData int
 	FromPeer    bool
+	// script is the running script which called the query
+	script *scriptRun
+	// version of the keys written, replicated with the query
+	version storagePkg.Version
+	// coordinated is set once the consistency level of the query is
+	// handled, written once the query wrote to the storage
+	coordinated bool
+	written     bool
+	// forwarded is set on the queries a peer forwarded on behalf of its
+	// client, executed like client queries
+	forwarded bool
+	// asking is set on the queries following ASKING, executed on keys of
+	// an importing slot
+	asking bool
+	// offset is the replication offset of a replicated write
+	offset int64
+	// origin is the ID of the peer which received the write from its
+	// client and seq its offset on that peer, reached the IDs of the peers
+	// the write was sent to
+	origin  string
+	seq     int64
+	reached []string
+	// epoch is the failover epoch of the origin peer when it received the
+	// write
+	epoch int64
+}
+
+// expireOptions are the expiration options of SET and the unit of their
+// time
+var expireOptions = map[string]time.Duration{
+	"ex":   time.Second,
+	"px":   time.Millisecond,
+	"exat": time.Second,
+	"pxat": time.Millisecond,
 }
 
 func NewSimpleQuery(q string) *Query {
@@ -58,6 +93,37 @@ func formattedArray(items [][]byte) []byte {
 	return payload
 }
 
+// formattedReply encodes a reply which can mix bulk strings, integers, null
+// values and nested arrays.
+func formattedReply(item interface{}) []byte {
+	switch v := item.(type) {
+	case nil:
+		return []byte("$-1\r\n")
+	case int:
+		return []byte(fmt.Sprintf(":%d\r\n", v))
+	case int64:
+		return []byte(fmt.Sprintf(":%d\r\n", v))
+	case statusReply:
+		return []byte(fmt.Sprintf("+%s\r\n", v))
+	case errorReply:
+		return []byte(fmt.Sprintf("-%s\r\n", v))
+	case string:
+		return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(v), v))
+	case []byte:
+		payload := []byte(fmt.Sprintf("$%d\r\n", len(v)))
+		payload = append(payload, v...)
+		return append(payload, "\r\n"...)
+	case []interface{}:
+		payload := []byte(fmt.Sprintf("*%d\r\n", len(v)))
+		for _, i := range v {
+			payload = append(payload, formattedReply(i)...)
+		}
+		return payload
+	default:
+		return formattedReply(fmt.Sprintf("%v", v))
+	}
+}
+
 func (q *Query) words() []string {
 	words := []string{}
 	for _, w := range q.parsed {
@@ -80,25 +146,65 @@ func (q *Query) args() []string {
 	return []string{}
 }
 
-func (q *Query) Set(key string, value []byte) {
-	q.p.storage.Set(key, value)
+// Set sets the value of a key. It returns false when a newer write of the
+// key was already applied.
+func (q *Query) Set(key string, value []byte) bool {
+	if !q.p.storage.SetVersion(key, value, q.writeVersion(key)) {
+		// a newer write of the key was already applied
+		return false
+	}
+	q.p.notifyKeyspaceEvent(notifyString, "set", key)
 	q.WalWrite()
+	return true
 }
 
 func (q *Query) Incr(key string) ([]byte, error) {
+	if q.isCounter(key) {
+		v, err := q.counterAdd(key, 1)
+		if err != nil {
+			return nil, err
+		}
+		q.p.notifyKeyspaceEvent(notifyString, "incrby", key)
+		q.WalWrite()
+		return v, nil
+	}
+	version := q.writeVersion(key)
+	if _, current, ok := q.p.storage.GetVersion(key); ok && q.FromPeer && current == version {
+		// the write was already applied with a full sync
+		return q.p.storage.Get(key), nil
+	}
 	v, err := q.p.storage.Incr(key)
 	if err != nil {
 		return nil, err
 	}
+	q.p.storage.Touch(key, version)
+	q.p.notifyKeyspaceEvent(notifyString, "incrby", key)
 	q.WalWrite()
 	return v, nil
 }
 
 func (q *Query) Decr(key string) ([]byte, error) {
+	if q.isCounter(key) {
+		v, err := q.counterAdd(key, -1)
+		if err != nil {
+			return nil, err
+		}
+		q.p.notifyKeyspaceEvent(notifyString, "decrby", key)
+		q.WalWrite()
+		return v, nil
+	}
+	version := q.writeVersion(key)
+	if _, current, ok := q.p.storage.GetVersion(key); ok && q.FromPeer && current == version {
+		// the write was already applied with a full sync
+		return q.p.storage.Get(key), nil
+	}
 	v, err := q.p.storage.Decr(key)
 	if err != nil {
 		return nil, err
 	}
+	q.p.storage.Touch(key, version)
+	q.p.notifyKeyspaceEvent(notifyString, "decrby", key)
+	q.WalWrite()
 	return v, nil
 }
 
@@ -109,17 +215,60 @@ func (q *Query) Get(key string) []byte {
 func (q *Query) Del(keys ...string) []byte {
 	var deletedCount int
 	for _, key := range keys {
-		deleted := q.p.storage.Del(key)
+		deleted := q.p.storage.DelVersion(key, q.writeVersion(key))
 		if deleted {
 			deletedCount = deletedCount + 1
+			q.p.notifyKeyspaceEvent(notifyGeneric, "del", key)
 		}
 	}
 	return []byte(fmt.Sprintf("%d", deletedCount))
 }
 
+// Expire sets the expiration time of a key, a time in the past deletes the
+// key. It returns false when the key does not exist.
+func (q *Query) Expire(key string, at time.Time) bool {
+	if !at.After(time.Now()) {
+		if !q.p.storage.DelVersion(key, q.writeVersion(key)) {
+			return false
+		}
+		q.p.notifyKeyspaceEvent(notifyGeneric, "del", key)
+		q.WalWrite()
+		return true
+	}
+	if !q.p.storage.Expire(key, at) {
+		return false
+	}
+	q.p.notifyKeyspaceEvent(notifyGeneric, "expire", key)
+	q.WalWrite()
+	return true
+}
+
+func (q *Query) Persist(key string) bool {
+	if !q.p.storage.Persist(key) {
+		return false
+	}
+	q.p.notifyKeyspaceEvent(notifyGeneric, "persist", key)
+	q.WalWrite()
+	return true
+}
+
+func (q *Query) FlushDB() {
+	for _, key := range q.p.storage.FlushData() {
+		q.p.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+	q.WalWrite()
+}
+
 func (q *Query) WalWrite() {
+	if q.script != nil {
+		q.p.scripts.markDirty(q.script)
+	}
+	q.written = true
 	q.p.walWriter.SyncWrite(q.raw)
-	if !q.FromPeer {
+	// in consistent mode, every peer executes the writes of the log, and
+	// coordinated writes are published by executeConsistent, which waits
+	// for their acknowledgements
+	if !q.FromPeer && q.p.consensus == nil && !q.coordinated {
 		q.p.PublishVQL(q)
 	}
 }
@@ -138,17 +287,7 @@ func (q *Query) Execute() (*Response, error) {
 				return nil
 			},
 			"list": func() error {
-				var peers []string
-				for peer := range q.p.Mesh.Peers {
-					peers = append(peers, fmt.Sprintf("id=%s addr=%s:%d connection=%s bytes_in=%d",
-						peer.ID,
-						peer.ListenAddr,
-						peer.ListenPort,
-						PEER_STATUS_TEXT[peer.ConnectionStatus()],
-						peer.Stats.BytesIn,
-					))
-				}
-				r.PayloadString([]byte(fmt.Sprintf("%s\r\n", strings.Join(peers, "\r\n"))))
+				r.PayloadString([]byte(fmt.Sprintf("%s\r\n", strings.Join(q.p.peerList(), "\r\n"))))
 				r.Type = typeBulkString
 				return nil
 			},
@@ -182,6 +321,52 @@ func (q *Query) Execute() (*Response, error) {
 				r.Type = typeBulkString
 				return nil
 			},
+			"read": func() error {
+				if len(args) != 2 {
+					return fmt.Errorf(Help("peer"))
+				}
+				q.peerRead(r, args[1])
+				return nil
+			},
+			"restore": func() error {
+				return q.peerRestore(r, args)
+			},
+			"importing": func() error {
+				return q.peerSlots(r, args)
+			},
+			"stable": func() error {
+				return q.peerSlots(r, args)
+			},
+			"merkle": func() error {
+				return q.peerMerkle(r, args)
+			},
+			"range": func() error {
+				return q.peerRange(r, args)
+			},
+			"repair": func() error {
+				return q.peerRepair(r, args)
+			},
+			"hint": func() error {
+				return q.peerHint(r, args)
+			},
+			"role": func() error {
+				q.peerRole(r)
+				return nil
+			},
+			"vote": func() error {
+				return q.peerVote(r, args)
+			},
+			"promoted": func() error {
+				return q.peerPromoted(r, args)
+			},
+			"leave": func() error {
+				if len(args) > 1 {
+					return fmt.Errorf("Too many arguments")
+				}
+				go q.p.Leave()
+				r.OK()
+				return nil
+			},
 		},
 		"client": {
 			"list": func() error {
@@ -193,6 +378,9 @@ func (q *Query) Execute() (*Response, error) {
 				r.PayloadString([]byte(fmt.Sprintf("%s\r\n", strings.Join(clients, "\r\n"))))
 				return nil
 			},
+			"consistency": func() error {
+				return q.clientConsistency(r, args)
+			},
 			"setname": func() error {
 				if len(args) > 2 {
 					return fmt.Errorf("Too many arguments")
@@ -248,11 +436,26 @@ func (q *Query) Execute() (*Response, error) {
 				r.PayloadString([]byte(fmt.Sprintf("%s\r\n", strings.Join(infoVQL(q.c.vqlTCPServer), "\r\n"))))
 				return nil
 			},
+			"cluster": func() error {
+				r.Type = typeBulkString
+				r.PayloadString([]byte(fmt.Sprintf("%s\r\n", strings.Join(infoCluster(q.p), "\r\n"))))
+				return nil
+			},
 			"wal": func() error {
 				r.Type = typeBulkString
 				r.PayloadString([]byte(fmt.Sprintf("%s\r\n", strings.Join(infoWal(q.c.vqlTCPServer), "\r\n"))))
 				return nil
 			},
+			"replication": func() error {
+				r.Type = typeBulkString
+				r.PayloadString([]byte(fmt.Sprintf("%s\r\n", strings.Join(infoReplication(q.p), "\r\n"))))
+				return nil
+			},
+			"raft": func() error {
+				r.Type = typeBulkString
+				r.PayloadString([]byte(fmt.Sprintf("%s\r\n", strings.Join(infoRaft(q.p), "\r\n"))))
+				return nil
+			},
 			"": func() error {
 				var info []string
 				info = append(info, infoPeer(q.p)...)
@@ -260,13 +463,59 @@ func (q *Query) Execute() (*Response, error) {
 				info = append(info, infoStorage(q.c.vqlTCPServer)...)
 				info = append(info, infoVQL(q.c.vqlTCPServer)...)
 				info = append(info, infoWal(q.c.vqlTCPServer)...)
+				info = append(info, infoReplication(q.p)...)
+				info = append(info, infoRaft(q.p)...)
+				info = append(info, infoCluster(q.p)...)
 				r.PayloadString([]byte(fmt.Sprintf("%s\r\n", strings.Join(info, "\r\n"))))
 				r.Type = typeBulkString
 				return nil
 			},
 		},
+		"asking": {
+			"": func() error {
+				if q.c != nil {
+					q.c.asking = true
+				}
+				r.OK()
+				return nil
+			},
+		},
+		"replicaof": {
+			"*": func() error {
+				return q.replicaOf(r, args)
+			},
+		},
+		"role": {
+			"": func() error {
+				q.role(r)
+				return nil
+			},
+		},
+		"readonly": {
+			"": func() error {
+				if q.c != nil {
+					q.c.readonly = true
+				}
+				r.OK()
+				return nil
+			},
+		},
+		"readwrite": {
+			"": func() error {
+				if q.c != nil {
+					q.c.readonly = false
+				}
+				r.OK()
+				return nil
+			},
+		},
 		"ping": {
 			"": func() error {
+				if q.c != nil && q.p.pubsub.SubscriptionCount(q.c) > 0 {
+					r.Payload = [][]byte{[]byte("pong"), []byte("")}
+					r.Type = typeArray
+					return nil
+				}
 				r.PayloadString([]byte("PONG"))
 				return nil
 			},
@@ -281,8 +530,7 @@ func (q *Query) Execute() (*Response, error) {
 		},
 		"flushdb": {
 			"": func() error {
-				q.c.vqlTCPServer.Peer.storage.FlushData()
-				q.WalWrite()
+				q.FlushDB()
 				r.OK()
 				return nil
 			},
@@ -290,6 +538,7 @@ func (q *Query) Execute() (*Response, error) {
 		"time": {
 			"": func() error {
 				t := time.Now()
+				r.Payload = [][]byte{}
 				r.Payload = append(
 					r.Payload,
 					[]byte(fmt.Sprintf("%d", t.Unix())),
@@ -303,7 +552,28 @@ func (q *Query) Execute() (*Response, error) {
 				if len(args) < 2 {
 					return fmt.Errorf("Too few arguments")
 				}
-				q.Set(args[0], q.parsed[2])
+				var at time.Time
+				for i := 2; i < len(args); i++ {
+					option := strings.ToLower(args[i])
+					unit, ok := expireOptions[option]
+					if !ok || i+1 >= len(args) || !at.IsZero() {
+						return fmt.Errorf("syntax error")
+					}
+					v, err := strconv.ParseInt(args[i+1], 10, 64)
+					if err != nil || v <= 0 {
+						return fmt.Errorf("invalid expire time in 'set' command")
+					}
+					if option == "ex" || option == "px" {
+						at = time.Now().Add(time.Duration(v) * unit)
+					} else {
+						at = time.Unix(0, v*int64(unit))
+					}
+					i++
+				}
+				if q.Set(args[0], q.parsed[2]) && !at.IsZero() {
+					q.p.storage.Expire(args[0], at)
+					q.p.notifyKeyspaceEvent(notifyGeneric, "expire", args[0])
+				}
 
 				r.OK()
 				return nil
@@ -314,6 +584,9 @@ func (q *Query) Execute() (*Response, error) {
 				if len(args) < 1 {
 					return fmt.Errorf("Too many arguments")
 				}
+				if q.p.storage.Type(args[0]) == storagePkg.CRDT_SET {
+					return storagePkg.ErrWrongType
+				}
 				r.PayloadString([]byte(q.Get(args[0])))
 				r.Type = typeBulkString
 				return nil
@@ -354,7 +627,6 @@ func (q *Query) Execute() (*Response, error) {
 					return err
 				}
 				r.PayloadString([]byte(v))
-				q.WalWrite()
 				r.Type = typeInteger
 				return nil
 			},
@@ -364,6 +636,7 @@ func (q *Query) Execute() (*Response, error) {
 				if len(args) != 1 {
 					return fmt.Errorf("Too many arguments")
 				}
+				r.Payload = [][]byte{}
 				for _, k := range q.c.vqlTCPServer.Peer.storage.Keys(args[0]) {
 					r.Payload = append(r.Payload, []byte(k))
 				}
@@ -405,7 +678,7 @@ func (q *Query) Execute() (*Response, error) {
 					return err
 				}
 
-				r.Payload = append(r.Payload, []byte(fmt.Sprintf("%d", cursor)))
+				r.Payload = [][]byte{[]byte(fmt.Sprintf("%d", cursor))}
 				var keysB [][]byte
 				for _, key := range keys {
 					keysB = append(keysB, []byte(key))
@@ -422,8 +695,11 @@ func (q *Query) Execute() (*Response, error) {
 				if len(args) != 1 {
 					return fmt.Errorf("Too many arguments")
 				}
-				// TODO we need to support more types
-				r.PayloadString([]byte("string"))
+				t := q.p.storage.Type(args[0])
+				if t == storagePkg.CRDT_COUNTER {
+					t = "string"
+				}
+				r.PayloadString([]byte(t))
 				r.Type = typeSimpleString
 				return nil
 			},
@@ -433,8 +709,55 @@ func (q *Query) Execute() (*Response, error) {
 				if len(args) != 1 {
 					return fmt.Errorf("Too many arguments")
 				}
-				// TODO we need to support TTL
-				r.PayloadString([]byte("-1"))
+				ttl := q.p.storage.TTL(args[0])
+				if ttl > 0 {
+					ttl = (ttl + time.Second/2) / time.Second
+				}
+				r.PayloadString([]byte(strconv.FormatInt(int64(ttl), 10)))
+				r.Type = typeInteger
+				return nil
+			},
+		},
+		"pttl": {
+			"*": func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Too many arguments")
+				}
+				ttl := q.p.storage.TTL(args[0])
+				if ttl > 0 {
+					ttl = ttl / time.Millisecond
+				}
+				r.PayloadString([]byte(strconv.FormatInt(int64(ttl), 10)))
+				r.Type = typeInteger
+				return nil
+			},
+		},
+		"expire": {
+			"*": func() error {
+				return q.expireCommand(r, args, time.Second)
+			},
+		},
+		"pexpire": {
+			"*": func() error {
+				return q.expireCommand(r, args, time.Millisecond)
+			},
+		},
+		"expireat": {
+			"*": func() error {
+				return q.expireAtCommand(r, args, time.Second)
+			},
+		},
+		"pexpireat": {
+			"*": func() error {
+				return q.expireAtCommand(r, args, time.Millisecond)
+			},
+		},
+		"persist": {
+			"*": func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("wrong number of arguments for 'persist' command")
+				}
+				r.PayloadString([]byte(boolToInteger(q.Persist(args[0]))))
 				r.Type = typeInteger
 				return nil
 			},
@@ -452,6 +775,201 @@ func (q *Query) Execute() (*Response, error) {
 				return nil
 			},
 		},
+		"subscribe": {
+			"*": func() error {
+				return q.subscribe(r, args)
+			},
+		},
+		"psubscribe": {
+			"*": func() error {
+				return q.psubscribe(r, args)
+			},
+		},
+		"unsubscribe": {
+			"": func() error {
+				return q.unsubscribe(r, nil)
+			},
+			"*": func() error {
+				return q.unsubscribe(r, args)
+			},
+		},
+		"punsubscribe": {
+			"": func() error {
+				return q.punsubscribe(r, nil)
+			},
+			"*": func() error {
+				return q.punsubscribe(r, args)
+			},
+		},
+		"publish": {
+			"*": func() error {
+				if len(args) != 2 {
+					return fmt.Errorf("wrong number of arguments for 'publish' command")
+				}
+				receivers := q.p.pubsub.Publish(args[0], q.parsed[2])
+				// messages received from a peer are relayed by the peer
+				if !q.FromPeer {
+					q.p.publishMessage(q)
+				}
+				r.PayloadString([]byte(strconv.Itoa(receivers)))
+				r.Type = typeInteger
+				return nil
+			},
+		},
+		"pubsub": {
+			"channels": func() error {
+				return q.pubsubChannels(r, args)
+			},
+			"numsub": func() error {
+				return q.pubsubNumSub(r, args)
+			},
+			"numpat": func() error {
+				return q.pubsubNumPat(r, args)
+			},
+		},
+		"eval": {
+			"*": func() error {
+				return q.eval(r, args, false)
+			},
+		},
+		"evalsha": {
+			"*": func() error {
+				return q.eval(r, args, true)
+			},
+		},
+		"fcall": {
+			"*": func() error {
+				return q.fcall(r, args)
+			},
+		},
+		"script": {
+			"load": func() error {
+				return q.scriptLoad(r, args)
+			},
+			"exists": func() error {
+				return q.scriptExists(r, args)
+			},
+			"flush": func() error {
+				q.p.scripts.Flush()
+				r.OK()
+				return nil
+			},
+			"kill": func() error {
+				if err := q.p.scripts.Kill(); err != nil {
+					return err
+				}
+				r.OK()
+				return nil
+			},
+		},
+		"function": {
+			"load": func() error {
+				return q.functionLoad(r, args)
+			},
+			"delete": func() error {
+				return q.functionDelete(r, args)
+			},
+			"list": func() error {
+				return q.functionList(r, args)
+			},
+			"flush": func() error {
+				q.p.scripts.FlushLibraries()
+				q.WalWrite()
+				r.OK()
+				return nil
+			},
+			"kill": func() error {
+				if err := q.p.scripts.Kill(); err != nil {
+					return err
+				}
+				r.OK()
+				return nil
+			},
+		},
+		"auth": {
+			"*": func() error {
+				return q.auth(r, args)
+			},
+		},
+		"acl": {
+			"setuser": func() error {
+				return q.aclSetUser(r, args)
+			},
+			"getuser": func() error {
+				return q.aclGetUser(r, args)
+			},
+			"deluser": func() error {
+				return q.aclDelUser(r, args)
+			},
+			"list": func() error {
+				return q.aclList(r)
+			},
+			"users": func() error {
+				return q.aclUsers(r)
+			},
+			"whoami": func() error {
+				if q.c == nil || q.c.user == nil {
+					return errNoAuth
+				}
+				r.PayloadString([]byte(q.c.user.name))
+				r.Type = typeBulkString
+				return nil
+			},
+			"cat": func() error {
+				return q.aclCat(r, args)
+			},
+			"log": func() error {
+				return q.aclLog(r, args)
+			},
+		},
+		"config": {
+			"get": func() error {
+				return q.configGet(r, args)
+			},
+			"set": func() error {
+				return q.configSet(r, args)
+			},
+		},
+		"cluster": {
+			"*": func() error {
+				return q.clusterCommand(r, args)
+			},
+		},
+		"consistency": {
+			"*": func() error {
+				return q.consistencyCommand(r, args)
+			},
+		},
+		"crdt": {
+			"*": func() error {
+				return q.crdtCommand(r, args)
+			},
+		},
+		"sadd": {
+			"*": func() error {
+				return q.setAdd(r, args)
+			},
+		},
+		"srem": {
+			"*": func() error {
+				return q.setRemove(r, args)
+			},
+		},
+		"smembers": {
+			"*": func() error {
+				return q.setRead(r, "smembers", args)
+			},
+		},
+		"sismember": {
+			"*": func() error {
+				return q.setRead(r, "sismember", args)
+			},
+		},
+		"scard": {
+			"*": func() error {
+				return q.setRead(r, "scard", args)
+			},
+		},
 		"quit": {
 			"": func() error {
 				r.DisconnectSignal = true
@@ -465,6 +983,54 @@ func (q *Query) Execute() (*Response, error) {
 			},
 		},
 	}
+	if err := q.checkACL(); err != nil {
+		return nil, err
+	}
+	if q.c != nil && !subscriberModeVerbs[q.verb()] && q.p.pubsub.SubscriptionCount(q.c) > 0 {
+		return nil, fmt.Errorf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", q.verb())
+	}
+	if !q.FromPeer && q.isWrite() {
+		q.absoluteExpire()
+		args = q.args()
+		if r, err, handled := q.replicaWrite(); handled {
+			return r, err
+		}
+	}
+	if q.p.cluster != nil && !q.FromPeer && q.script == nil {
+		if r, err, routed := q.route(); routed {
+			return r, err
+		}
+	}
+	if q.p.consensus != nil && !q.FromPeer && q.script == nil && q.consensusRequired() {
+		return q.p.consensus.propose(q)
+	}
+	if q.p.consensus != nil && !q.FromPeer && q.script == nil {
+		if r, err, handled := q.consensusRead(); handled {
+			return r, err
+		}
+	}
+	if !q.FromPeer && !q.coordinated && q.script == nil {
+		if level := q.consistencyLevel(); level > CONSISTENCY_ONE {
+			switch {
+			case q.isWrite():
+				return q.executeConsistent(level)
+			case q.verb() == "get":
+				return q.readConsistent(level)
+			}
+		}
+	}
+	// scripts run atomically: they exclude every other query except the
+	// ones they call and the ones killing them
+	switch {
+	case q.script != nil:
+	case (q.verb() == "script" || q.verb() == "function") && len(args) > 0 && strings.ToLower(args[0]) == "kill":
+	case scriptVerbs[q.verb()]:
+		q.p.execLock.Lock()
+		defer q.p.execLock.Unlock()
+	default:
+		q.p.execLock.RLock()
+		defer q.p.execLock.RUnlock()
+	}
 	verb := syntax[q.verb()]
 
 	if len(args) > 0 {
@@ -475,7 +1041,7 @@ func (q *Query) Execute() (*Response, error) {
 			}
 			return r, nil
 		}
-		f := verb[args[0]]
+		f := verb[strings.ToLower(args[0])]
 		if f != nil {
 			err := f()
 			return r, err
@@ -492,11 +1058,103 @@ func (q *Query) Execute() (*Response, error) {
 	return nil, nil
 }
 
+func (q *Query) expireCommand(r *Response, args []string, unit time.Duration) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for '%s' command", q.verb())
+	}
+	v, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("value is not an integer or out of range")
+	}
+	r.PayloadString([]byte(boolToInteger(q.Expire(args[0], time.Now().Add(time.Duration(v)*unit)))))
+	r.Type = typeInteger
+	return nil
+}
+
+func (q *Query) expireAtCommand(r *Response, args []string, unit time.Duration) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for '%s' command", q.verb())
+	}
+	v, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("value is not an integer or out of range")
+	}
+	r.PayloadString([]byte(boolToInteger(q.Expire(args[0], time.Unix(0, v*int64(unit))))))
+	r.Type = typeInteger
+	return nil
+}
+
+// absoluteExpire rewrites the relative expiration time of a write received
+// from a client into an absolute one, so that the peers replaying the write
+// later expire the key at the same time: SET EX/PX becomes SET PXAT and
+// EXPIRE/PEXPIRE becomes PEXPIREAT. Invalid times are left to the command.
+func (q *Query) absoluteExpire() {
+	args := q.args()
+	now := time.Now()
+	switch q.verb() {
+	case "set":
+		for i := 2; i+1 < len(args); i++ {
+			option := strings.ToLower(args[i])
+			if option != "ex" && option != "px" {
+				continue
+			}
+			v, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || v <= 0 {
+				return
+			}
+			at := now.Add(time.Duration(v) * expireOptions[option])
+			q.parsed[i+1] = []byte("pxat")
+			q.parsed[i+2] = []byte(strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10))
+		}
+	case "expire", "pexpire":
+		if len(args) != 2 {
+			return
+		}
+		v, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return
+		}
+		unit := time.Second
+		if q.verb() == "pexpire" {
+			unit = time.Millisecond
+		}
+		at := now.Add(time.Duration(v) * unit)
+		q.parsed = [][]byte{[]byte("pexpireat"), q.parsed[1], []byte(strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10))}
+	default:
+		return
+	}
+	q.raw = formattedArray(q.parsed)
+}
+
+func boolToInteger(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
 func (q *Query) PeerQueryEncode() []byte {
 	var data [][]byte
 	data = append(data, []byte(fmt.Sprintf("id=%s", q.id)))
 	data = append(data, q.raw)
-	payload := append(PEER_QUERY_TYPE, controlByte...)
-	payload = append(payload, formattedArray(data)...)
-	return payload
+	if !q.version.IsZero() {
+		data = append(data, []byte(fmt.Sprintf("version=%s", q.version)))
+	}
+	if q.forwarded {
+		data = append(data, []byte("forwarded=1"))
+	}
+	if q.asking {
+		data = append(data, []byte("asking=1"))
+	}
+	if q.offset > 0 {
+		data = append(data, []byte(fmt.Sprintf("offset=%d", q.offset)))
+	}
+	if q.origin != "" {
+		data = append(data, []byte(fmt.Sprintf("origin=%s:%d", q.origin, q.seq)))
+		data = append(data, []byte(fmt.Sprintf("reached=%s", strings.Join(q.reached, ","))))
+	}
+	if q.epoch > 0 {
+		data = append(data, []byte(fmt.Sprintf("epoch=%d", q.epoch)))
+	}
+	return encodeFrame(frameQuery, formattedArray(data))
 }
@@ -23,7 +23,7 @@ func TestPeerQueryEncodeSimple(t *testing.T) {
 	q.raw = []byte("PING\r\n")
 	q.id = "foo"
 	output := q.PeerQueryEncode()
-	expected := []byte("0\r\n*2\r\n$6\r\nid=foo\r\n$6\r\nPING\r\n\r\n")
+	expected := []byte("VD\x01Q\x00\x00\x00\x1c*2\r\n$6\r\nid=foo\r\n$6\r\nPING\r\n\r\n")
 	if string(output) != string(expected) {
 		fmt.Println(string(output))
 		t.Fatalf("want %+v, got %+v", expected, output)
@@ -35,7 +35,7 @@ func TestPeerQueryEncodeFormatted(t *testing.T) {
 	q.raw = []byte("*1\r\n$3\r\nbar\r\n")
 	q.id = "foo"
 	output := q.PeerQueryEncode()
-	expected := []byte("0\r\n*2\r\n$6\r\nid=foo\r\n$13\r\n*1\r\n$3\r\nbar\r\n\r\n")
+	expected := []byte("VD\x01Q\x00\x00\x00\x24*2\r\n$6\r\nid=foo\r\n$13\r\n*1\r\n$3\r\nbar\r\n\r\n")
 	if string(output) != string(expected) {
 		fmt.Println(string(output))
 		t.Fatalf("want %s, got %s", expected, output)
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Peers are labelled with the region and the zone they run in, tags
+// announced in their HELLO. A write sent to the peers of another region
+// crosses the WAN once: it is only sent to the relay of the region, the peer
+// of the region with the lowest ID among the peers it has to reach, which
+// relays it to the other peers of its region. A region is reached once one
+// of its peers is in the reached list of the write: the peers receiving the
+// write do not send it to the other peers of that region. Peers without a
+// region receive every write directly.
+const (
+	REGION_TAG = "region"
+	ZONE_TAG   = "zone"
+)
+
+// SetLocation labels the peer with the region and the zone it runs in. It
+// has to be called before the peer links with other peers.
+func (p *Peer) SetLocation(region string, zone string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Tags = nil
+	if region != "" {
+		p.Tags = append(p.Tags, fmt.Sprintf("%s=%s", REGION_TAG, region))
+	}
+	if zone != "" {
+		p.Tags = append(p.Tags, fmt.Sprintf("%s=%s", ZONE_TAG, zone))
+	}
+}
+
+// tag returns the value of a tag of the peer, empty when it is not set.
+func (p *Peer) tag(name string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, tag := range p.Tags {
+		if strings.HasPrefix(tag, name+"=") {
+			return tag[len(name)+1:]
+		}
+	}
+	return ""
+}
+
+func (p *Peer) region() string {
+	return p.tag(REGION_TAG)
+}
+
+// peerRegions returns the region of the remote peers of the mesh by ID.
+func (p *Peer) peerRegions() map[string]string {
+	regions := make(map[string]string)
+	for _, link := range p.Mesh.List() {
+		if id, region := link.remoteID(), link.region(); id != "" && region != "" {
+			regions[id] = region
+		}
+	}
+	return regions
+}
+
+// regionalFanOut returns the links a write is sent to out of the links
+// which did not receive it yet: the links with the peers of the region of
+// the peer or without region, and the relay of every other region which was
+// not reached.
+func (p *Peer) regionalFanOut(links []*Peer, reached []string, regions map[string]string) []*Peer {
+	local := p.region()
+	if local == "" {
+		return links
+	}
+	covered := make(map[string]bool)
+	for _, id := range reached {
+		covered[regions[id]] = true
+	}
+	relays := make(map[string]*Peer)
+	fanOut := []*Peer{}
+	for _, link := range links {
+		region := link.region()
+		switch {
+		case region == "" || region == local:
+			fanOut = append(fanOut, link)
+		case covered[region]:
+		case relays[region] == nil || link.remoteID() < relays[region].remoteID():
+			relays[region] = link
+		}
+	}
+	for _, relay := range relays {
+		fanOut = append(fanOut, relay)
+	}
+	return fanOut
+}
+
+// regionRelays returns the relay of every other region, the ready peer of
+// the region with the lowest ID.
+func (p *Peer) regionRelays() map[string]string {
+	relays := make(map[string]string)
+	local := p.region()
+	if local == "" {
+		return relays
+	}
+	for _, link := range p.Mesh.List() {
+		region, id := link.region(), link.remoteID()
+		if !link.Ready() || region == "" || region == local {
+			continue
+		}
+		if relay, ok := relays[region]; !ok || id < relay {
+			relays[region] = id
+		}
+	}
+	return relays
+}
+
+func infoRegion(p *Peer) (info []string) {
+	info = append(info, fmt.Sprintf("region:%s", p.region()))
+	info = append(info, fmt.Sprintf("zone:%s", p.tag(ZONE_TAG)))
+	relays := []string{}
+	for region, id := range p.regionRelays() {
+		relays = append(relays, fmt.Sprintf("%s=%s", region, id))
+	}
+	sort.Strings(relays)
+	info = append(info, fmt.Sprintf("region_relays:%s", strings.Join(relays, ",")))
+	return info
+}
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegionalFanOut(t *testing.T) {
+	p := &Peer{ID: "a"}
+	p.SetLocation("eu", "eu-1")
+	links := []*Peer{}
+	regions := make(map[string]string)
+	for _, l := range []struct{ id, region string }{{"b", "eu"}, {"d", "us"}, {"c", "us"}, {"e", "ap"}, {"f", ""}} {
+		link := &Peer{ID: l.id}
+		link.SetLocation(l.region, "")
+		links = append(links, link)
+		regions[l.id] = l.region
+	}
+	suites := []struct {
+		reached  []string
+		expected string
+	}{
+		{[]string{"a"}, "[b c e f]"},
+		// us was reached through d
+		{[]string{"a", "d"}, "[b e f]"},
+	}
+	for _, s := range suites {
+		ids := []string{}
+		for _, link := range p.regionalFanOut(links, s.reached, regions) {
+			ids = append(ids, link.ID)
+		}
+		sort.Strings(ids)
+		if output := fmt.Sprint(ids); output != s.expected {
+			t.Errorf("reached %v: want %+v, got %+v", s.reached, s.expected, output)
+		}
+	}
+	// peers without region receive every write directly
+	p.SetLocation("", "")
+	if output := len(p.regionalFanOut(links, []string{"a"}, regions)); output != len(links) {
+		t.Errorf("want %+v, got %+v", len(links), output)
+	}
+}
+
+func TestRegionRelay(t *testing.T) {
+	// a in eu, b and c in us
+	clients := []*VQLClient{setupGossip(), setupGossip(), setupGossip()}
+	peers := []*Peer{}
+	for i, client := range clients {
+		p := client.vqlTCPServer.Peer
+		p.SetLocation([]string{"eu", "us", "us"}[i], "")
+		peers = append(peers, p)
+	}
+	for _, c := range clients[1:] {
+		<-executeAsync(c, "peer connect "+peers[0].connString())
+	}
+	for i, c := range clients {
+		for j, p := range peers {
+			if i != j {
+				waitMemberState(c, p.ID, memberAlive)
+			}
+		}
+	}
+	relay, other := 1, 2
+	if peers[2].ID < peers[1].ID {
+		relay, other = 2, 1
+	}
+	expected := "region_relays:us=" + peers[relay].ID
+	if output := waitInfoReplication(clients[0], expected); !strings.Contains(output, expected) {
+		t.Fatalf("want %q in %q", expected, output)
+	}
+
+	// the write is sent to the relay of us only, which relays it
+	<-executeAsync(clients[0], "set k v")
+	for i := 0; i < 100 && peers[other].storage.Get("k") == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if output := string(peers[other].storage.Get("k")); output != "v" {
+		t.Errorf("want %+v, got %+v", "v", output)
+	}
+	for i, expected := range map[int]string{relay: "relayed_writes:1", other: "relayed_writes:0\r\nduplicate_writes:0"} {
+		if output := <-executeAsync(clients[i], "info replication"); !strings.Contains(output, expected) {
+			t.Errorf("peer %d: want %q in %q", i, expected, output)
+		}
+	}
+	// writes within a region are sent directly
+	<-executeAsync(clients[other], "set l v")
+	for i := 0; i < 100 && peers[0].storage.Get("l") == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	expected = "relayed_writes:1"
+	if output := <-executeAsync(clients[relay], "info replication"); !strings.Contains(output, expected) {
+		t.Errorf("want %q in %q", expected, output)
+	}
+	if output := string(peers[relay].storage.Get("l")) + string(peers[0].storage.Get("l")); output != "vv" {
+		t.Errorf("want %+v, got %+v", "vv", output)
+	}
+}
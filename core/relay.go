@@ -0,0 +1,101 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A write received from a client gets the ID of the peer and the next
+// sequence number of its writes, its origin, sent with the query as an
+// origin=<peer-id>:<seq> element of the Q frame. The reached= element lists
+// the peers the write was sent to: a peer receiving a write relays it to
+// the peers it is linked with which are not in the list, adding them to the
+// list, so that a write reaches the peers which are not linked with its
+// origin. The peers keep the sequence numbers received from every origin in
+// a window of RELAY_DEDUP_WINDOW writes, and apply a write received twice
+// once.
+const (
+	RELAY_DEDUP_WINDOW = 4096
+)
+
+// dedupWindow holds the sequence numbers of the writes received from every
+// origin peer.
+type dedupWindow struct {
+	mu      sync.Mutex
+	size    int64
+	origins map[string]*originWindow
+}
+
+type originWindow struct {
+	// every write up to low was received
+	low  int64
+	seen map[int64]bool
+}
+
+func newDedupWindow(size int64) *dedupWindow {
+	return &dedupWindow{size: size, origins: make(map[string]*originWindow)}
+}
+
+// add records a write of an origin peer, it returns false when the write
+// was already received. The writes older than the window are considered
+// received.
+func (w *dedupWindow) add(origin string, seq int64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	o := w.origins[origin]
+	if o == nil {
+		o = &originWindow{seen: make(map[int64]bool)}
+		w.origins[origin] = o
+	}
+	if seq <= o.low || o.seen[seq] {
+		return false
+	}
+	o.seen[seq] = true
+	if seq-o.low > w.size {
+		// the writes missing for long are not waited for anymore, the
+		// window is moved by half its size at once
+		o.low = seq - w.size/2
+		for s := range o.seen {
+			if s <= o.low {
+				delete(o.seen, s)
+			}
+		}
+	}
+	for o.seen[o.low+1] {
+		delete(o.seen, o.low+1)
+		o.low++
+	}
+	return true
+}
+
+// parseOrigin parses the <peer-id>:<seq> origin of a write.
+func parseOrigin(s string) (origin string, seq int64, err error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		return "", 0, fmt.Errorf("invalid write origin %q", s)
+	}
+	seq, err = strconv.ParseInt(s[i+1:], 10, 64)
+	if err != nil || seq <= 0 {
+		return "", 0, fmt.Errorf("invalid write origin %q", s)
+	}
+	return s[:i], seq, nil
+}
+
+// relay sends a write received from a peer to the peers it did not reach.
+// The write is kept in the backlog even when every peer was reached, to be
+// sent again to the peers linking again.
+func (p *Peer) relay(query *Query) {
+	relayed := *query
+	relayed.FromPeer, relayed.forwarded, relayed.asking = false, false, false
+	if relayed.verb() == "publish" {
+		p.publishMessage(&relayed)
+		return
+	}
+	p.PublishVQL(&relayed)
+	if len(relayed.reached) > len(query.reached) {
+		atomic.AddInt64(&p.Stats.RelayedWrites, 1)
+	}
+}
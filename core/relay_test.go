@@ -0,0 +1,122 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupWindow(t *testing.T) {
+	w := newDedupWindow(4)
+	suites := []struct {
+		origin   string
+		seq      int64
+		expected bool
+	}{
+		{"a", 1, true},
+		{"a", 1, false},
+		{"a", 3, true},
+		{"b", 1, true},
+		{"a", 2, true},
+		{"a", 3, false},
+		{"a", 2, false},
+		// writes missing for long are considered received
+		{"a", 9, true},
+		{"a", 5, false},
+		{"a", 8, true},
+		{"a", 8, false},
+	}
+	for _, s := range suites {
+		if output := w.add(s.origin, s.seq); output != s.expected {
+			t.Errorf("add %s:%d: want %+v, got %+v", s.origin, s.seq, s.expected, output)
+		}
+	}
+}
+
+func TestPeerQueryOrigin(t *testing.T) {
+	client := setup()
+	p := client.vqlTCPServer.Peer
+	q := NewSimpleQuery("set a 1")
+	q.origin, q.seq, q.reached = "peer-1", 42, []string{"peer-1", "peer-2"}
+	frame, err := readFrame(strings.NewReader(string(q.PeerQueryEncode())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := p.ParsePeerQuery(client, frame.payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.origin != q.origin || output.seq != q.seq || strings.Join(output.reached, ",") != "peer-1,peer-2" {
+		t.Errorf("want %+v, got %+v", q, output)
+	}
+	for _, s := range []string{"peer-1", "peer-1:0", ":1", "peer-1:x"} {
+		if _, _, err := parseOrigin(s); err == nil {
+			t.Errorf("want an error for %q", s)
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+	// a chain of peers a - b - c, c is not linked with a
+	clients := []*VQLClient{setupGossip(), setupGossip(), setupGossip()}
+	peers := []*Peer{}
+	for _, client := range clients {
+		p := client.vqlTCPServer.Peer
+		// the peers do not learn each other, and do not link
+		p.gossip.mu.Lock()
+		p.gossip.deaf = true
+		p.gossip.mu.Unlock()
+		peers = append(peers, p)
+	}
+	for _, i := range []int{0, 2} {
+		link, err := peers[i].ConnectToPeerAddr(peers[1].connString())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output := waitPeerStatus(link, PEER_STATUS_CONNECTED); output != PEER_STATUS_CONNECTED {
+			t.Fatalf("want %+v, got %+v", PEER_STATUS_CONNECTED, output)
+		}
+	}
+	for i := 0; i < 50 && len(peers[1].Mesh.List()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	<-executeAsync(clients[0], "set from a")
+	<-executeAsync(clients[2], "set from c")
+	for _, p := range peers {
+		for i := 0; i < 100 && p.storage.Get("from") == nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if output := string(peers[0].storage.Get("from")); output != string(peers[2].storage.Get("from")) {
+		t.Errorf("want %+v, got %+v", string(peers[2].storage.Get("from")), output)
+	}
+	expected := "relayed_writes:2"
+	if output := waitInfoReplication(clients[1], expected); !strings.Contains(output, expected) {
+		t.Errorf("want %q in %q", expected, output)
+	}
+	// the writes are not sent back to their origin
+	for _, i := range []int{0, 2} {
+		expected = "relayed_writes:0\r\nduplicate_writes:0"
+		if output := <-executeAsync(clients[i], "info replication"); !strings.Contains(output, expected) {
+			t.Errorf("want %q in %q", expected, output)
+		}
+	}
+
+	// a write received twice is applied once
+	q, _ := clients[1].ParseRawQuery([]byte("incr counter"))
+	q.origin, q.seq, q.reached = peers[0].ID, 100, []string{peers[0].ID, peers[1].ID, peers[2].ID}
+	data := q.PeerQueryEncode()
+	frame, _ := readFrame(strings.NewReader(string(data)))
+	for i := 0; i < 2; i++ {
+		peers[1].Mesh.List()[0].gotRawQueryFromPeer <- frame.payload
+	}
+	expected = "duplicate_writes:1"
+	if output := waitInfoReplication(clients[1], expected); !strings.Contains(output, expected) {
+		t.Errorf("want %q in %q", expected, output)
+	}
+	if output := string(peers[1].storage.Get("counter")); output != "1" {
+		t.Errorf("want %+v, got %+v", "1", output)
+	}
+}
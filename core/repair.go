@@ -0,0 +1,335 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	storagePkg "github.com/bjorand/velocidb/storage"
+)
+
+// Writes dropped on the way leave peers with different keys. Once every
+// ANTI_ENTROPY_INTERVAL, a peer repairs its keys with a random peer it is
+// linked with: it builds the Merkle tree of its keys and compares it with
+// the tree of the other peer, from the root down to the leaves which
+// differ. The keys of these leaves are exchanged, and each peer keeps the
+// latest version of every key:
+//
+//	PEER MERKLE <peer-id> <node> [node ...]    answers the hashes of nodes
+//	PEER RANGE <peer-id> <leaf> [leaf ...]     answers the items of leaves
+//
+// The keys are sent to the other peer with PEER RESTORE. With sharding,
+// only the keys of the slots both peers own are compared. Each peer builds
+// its tree once per repair: the other peer keeps the tree built when asked
+// for the root for the next queries of the repair, for up to
+// REPAIR_SESSION_TIMEOUT seconds.
+//
+// A deleted key leaves a tombstone with the version of the delete, compared
+// like the keys: the peers which missed the delete drop the key instead of
+// bringing it back to the others. Tombstones are purged TOMBSTONE_TTL
+// seconds after the delete, a peer which missed a delete for longer may
+// bring the key back.
+const (
+	MERKLE_DEPTH = 8
+	// seconds between two repairs, 0 disables them
+	ANTI_ENTROPY_INTERVAL  = 60
+	TOMBSTONE_TTL          = 3600
+	REPAIR_SESSION_TIMEOUT = 30
+)
+
+// repairSession is the tree of the keys a peer repairs with another peer.
+type repairSession struct {
+	tree *storagePkg.MerkleTree
+	at   time.Time
+}
+
+// repairFilter returns the filter of the keys repaired with a peer: with
+// sharding, the keys of the slots it owns.
+func (p *Peer) repairFilter(id string) func(k string) bool {
+	if p.cluster == nil {
+		return nil
+	}
+	return func(k string) bool {
+		return stringInSlice(id, p.cluster.slotOwners(keySlot(k)))
+	}
+}
+
+// repairTree returns the tree of the keys repaired with the peer id: a new
+// tree when the peer starts a repair, else the tree of the repair in
+// progress. The sessions older than REPAIR_SESSION_TIMEOUT are dropped.
+func (p *Peer) repairTree(id string, start bool) *storagePkg.MerkleTree {
+	now := time.Now()
+	p.repairSessionsMu.Lock()
+	for k, s := range p.repairSessions {
+		if now.Sub(s.at) > REPAIR_SESSION_TIMEOUT*time.Second {
+			delete(p.repairSessions, k)
+		}
+	}
+	s := p.repairSessions[id]
+	p.repairSessionsMu.Unlock()
+	if s != nil && !start {
+		return s.tree
+	}
+	s = &repairSession{tree: p.storage.MerkleTree(MERKLE_DEPTH, p.repairFilter(id)), at: now}
+	p.repairSessionsMu.Lock()
+	p.repairSessions[id] = s
+	p.repairSessionsMu.Unlock()
+	return s.tree
+}
+
+// endRepair drops the tree of the repair with the peer id.
+func (p *Peer) endRepair(id string) {
+	p.repairSessionsMu.Lock()
+	defer p.repairSessionsMu.Unlock()
+	delete(p.repairSessions, id)
+}
+
+// peerMerkle answers PEER MERKLE with the hashes of the nodes of the tree
+// of the keys repaired with the peer, asking for the root starts a repair.
+func (q *Query) peerMerkle(r *Response, args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf(Help("peer"))
+	}
+	tree := q.p.repairTree(args[1], stringInSlice("0", args[2:]))
+	r.Type = typeArray
+	r.Payload = [][]byte{}
+	for _, arg := range args[2:] {
+		node, err := strconv.Atoi(arg)
+		if err != nil || node < 0 || node >= len(tree.Nodes) {
+			return fmt.Errorf("ERR invalid Merkle tree node '%s'", arg)
+		}
+		r.Payload = append(r.Payload, []byte(strconv.FormatUint(tree.Nodes[node], 10)))
+	}
+	return nil
+}
+
+// peerRange answers PEER RANGE with the items of the leaves of the tree of
+// the keys repaired with the peer, which ends the repair.
+func (q *Query) peerRange(r *Response, args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf(Help("peer"))
+	}
+	leaves := []int{}
+	for _, arg := range args[2:] {
+		leaf, err := strconv.Atoi(arg)
+		if err != nil || leaf < 0 || leaf >= 1<<MERKLE_DEPTH {
+			return fmt.Errorf("ERR invalid Merkle tree leaf '%s'", arg)
+		}
+		leaves = append(leaves, leaf)
+	}
+	r.Type = typeArray
+	r.Payload = [][]byte{}
+	for _, item := range q.p.repairTree(args[1], false).LeafItems(leaves) {
+		r.Payload = append(r.Payload, encodeStorageItem(item)...)
+	}
+	q.p.endRepair(args[1])
+	return nil
+}
+
+// remoteRepair executes a PEER MERKLE or PEER RANGE query on the remote
+// peer of a link.
+func (p *Peer) remoteRepair(link *Peer, subcommand string, args []int) ([][]byte, error) {
+	parsed := [][]byte{[]byte("peer"), []byte(subcommand), []byte(p.ID)}
+	for _, arg := range args {
+		parsed = append(parsed, []byte(strconv.Itoa(arg)))
+	}
+	resp, err := p.RemoteExecute(link, NewSimpleQuery(string(formattedArray(parsed))))
+	if err != nil {
+		return nil, err
+	}
+	if resp.isError() {
+		return nil, fmt.Errorf("%s", resp.Payload[0])
+	}
+	return resp.Payload, nil
+}
+
+// differingLeaves walks down the Merkle trees of the peer and of the remote
+// peer of a link and returns the leaves which differ.
+func (p *Peer) differingLeaves(link *Peer, tree *storagePkg.MerkleTree) ([]int, error) {
+	leaves := []int{}
+	nodes := []int{0}
+	for len(nodes) > 0 {
+		hashes, err := p.remoteRepair(link, "merkle", nodes)
+		if err != nil {
+			return nil, err
+		}
+		if len(hashes) != len(nodes) {
+			return nil, fmt.Errorf("invalid Merkle tree answer from peer %s", link.connString())
+		}
+		next := []int{}
+		for i, node := range nodes {
+			if strconv.FormatUint(tree.Nodes[node], 10) == string(hashes[i]) {
+				continue
+			}
+			if leaf, ok := tree.Leaf(node); ok {
+				leaves = append(leaves, leaf)
+				continue
+			}
+			next = append(next, 2*node+1, 2*node+2)
+		}
+		nodes = next
+	}
+	return leaves, nil
+}
+
+// repairWinner reports whether the local item of a key wins over the remote
+// one: the latest version wins, then the greatest value.
+func repairWinner(local storagePkg.Item, remote storagePkg.Item) bool {
+	if local.Version != remote.Version {
+		return local.Version.Newer(remote.Version)
+	}
+	return bytes.Compare(local.Value, remote.Value) > 0
+}
+
+func sameItem(a storagePkg.Item, b storagePkg.Item) bool {
+	return a.Version == b.Version && a.Deleted == b.Deleted && a.Type == b.Type && bytes.Equal(a.Value, b.Value)
+}
+
+// Repair repairs the keys of the peer with the remote peer of a link and
+// returns the number of keys which differed.
+func (p *Peer) Repair(link *Peer) (int, error) {
+	if !link.Ready() {
+		return 0, fmt.Errorf("Peer %s is not connected", link.connString())
+	}
+	p.repairMu.Lock()
+	defer p.repairMu.Unlock()
+	tree := p.storage.MerkleTree(MERKLE_DEPTH, p.repairFilter(link.remoteID()))
+	leaves, err := p.differingLeaves(link, tree)
+	if err != nil {
+		return 0, err
+	}
+	atomic.AddInt64(&p.Stats.Repairs, 1)
+	if len(leaves) == 0 {
+		return 0, nil
+	}
+	fields, err := p.remoteRepair(link, "range", leaves)
+	if err != nil {
+		return 0, err
+	}
+	if len(fields)%STORAGE_ITEM_FIELDS != 0 {
+		return 0, fmt.Errorf("invalid Merkle tree range from peer %s", link.connString())
+	}
+	remote := make(map[string]storagePkg.Item)
+	for i := 0; i < len(fields); i += STORAGE_ITEM_FIELDS {
+		decoded := []string{}
+		for _, field := range fields[i : i+STORAGE_ITEM_FIELDS] {
+			decoded = append(decoded, string(field))
+		}
+		item, err := decodeStorageItem(decoded)
+		if err != nil {
+			return 0, err
+		}
+		remote[item.Key] = item
+	}
+
+	fixed := 0
+	push := []storagePkg.Item{}
+	for _, item := range tree.LeafItems(leaves) {
+		r, ok := remote[item.Key]
+		delete(remote, item.Key)
+		switch {
+		case ok && sameItem(item, r):
+			continue
+		case ok && (item.Type != "" || r.Type != ""):
+			// CRDTs are merged on both peers
+			p.storage.Restore(r)
+			push = append(push, item)
+		case ok && !repairWinner(item, r):
+			p.storage.Restore(r)
+		default:
+			push = append(push, item)
+		}
+		fixed++
+	}
+	// the keys the peer does not hold
+	for _, r := range remote {
+		p.storage.Restore(r)
+		fixed++
+	}
+	for i := 0; i < len(push); i += MIGRATION_BATCH_SIZE {
+		end := i + MIGRATION_BATCH_SIZE
+		if end > len(push) {
+			end = len(push)
+		}
+		parsed := [][]byte{[]byte("peer"), []byte("restore")}
+		for _, item := range push[i:end] {
+			parsed = append(parsed, encodeStorageItem(item)...)
+		}
+		resp, err := p.RemoteExecute(link, NewSimpleQuery(string(formattedArray(parsed))))
+		if err != nil {
+			return fixed, err
+		}
+		if resp.isError() {
+			return fixed, fmt.Errorf("%s", resp.Payload[0])
+		}
+	}
+	atomic.AddInt64(&p.Stats.RepairedKeys, int64(fixed))
+	return fixed, nil
+}
+
+// peerRepair answers PEER REPAIR <id> with the number of keys repaired with
+// the peer.
+func (q *Query) peerRepair(r *Response, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf(Help("peer"))
+	}
+	var link *Peer
+	for _, l := range q.p.Mesh.List() {
+		if (l.remoteID() == args[1] || l.Key() == args[1]) && (link == nil || l.Ready()) {
+			link = l
+		}
+	}
+	if link == nil {
+		return fmt.Errorf("Peer %s not found in peer list", args[1])
+	}
+	fixed, err := q.p.Repair(link)
+	if err != nil {
+		return err
+	}
+	r.PayloadString([]byte(strconv.Itoa(fixed)))
+	r.Type = typeInteger
+	return nil
+}
+
+// antiEntropy repairs the keys with a random peer once every repair
+// interval, and purges the tombstones older than TOMBSTONE_TTL. In
+// consistent mode, the peers are repaired by Raft.
+func (p *Peer) antiEntropy() {
+	last := time.Now()
+	for {
+		time.Sleep(time.Second)
+		p.storage.PurgeTombstones(time.Now().Add(-TOMBSTONE_TTL * time.Second).UnixNano())
+		interval := time.Duration(atomic.LoadInt64(&p.repairInterval)) * time.Second
+		if interval == 0 || time.Since(last) < interval || p.consensus != nil {
+			continue
+		}
+		last = time.Now()
+		links := []*Peer{}
+		for _, link := range p.Mesh.List() {
+			if link.Ready() && hasCapability(link.remoteCapabilities(), "sync") {
+				links = append(links, link)
+			}
+		}
+		if len(links) == 0 {
+			continue
+		}
+		link := links[rand.Intn(len(links))]
+		if fixed, err := p.Repair(link); err != nil {
+			fmt.Printf("[peer %s] Repair failed: %s\n", link.connString(), err)
+		} else if fixed > 0 {
+			fmt.Printf("[peer %s] Repaired %d keys\n", link.connString(), fixed)
+		}
+	}
+}
+
+func infoRepair(p *Peer) []string {
+	return []string{
+		fmt.Sprintf("anti_entropy_interval:%d", atomic.LoadInt64(&p.repairInterval)),
+		fmt.Sprintf("repairs:%d", atomic.LoadInt64(&p.Stats.Repairs)),
+		fmt.Sprintf("repaired_keys:%d", atomic.LoadInt64(&p.Stats.RepairedKeys)),
+		fmt.Sprintf("read_repairs:%d", atomic.LoadInt64(&p.Stats.ReadRepairs)),
+	}
+}
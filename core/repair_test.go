@@ -0,0 +1,86 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	storagePkg "github.com/bjorand/velocidb/storage"
+)
+
+func TestRepair(t *testing.T) {
+	clients := []*VQLClient{setupGossip(), setupGossip()}
+	peers := []*Peer{clients[0].vqlTCPServer.Peer, clients[1].vqlTCPServer.Peer}
+	<-executeAsync(clients[1], "peer connect "+peers[0].connString())
+	for _, client := range clients {
+		expected := "sync_state=done"
+		if output := waitInfoReplication(client, expected); !strings.Contains(output, expected) {
+			t.Fatalf("want %q in %q", expected, output)
+		}
+	}
+
+	// the peers missed writes
+	older, newer := storagePkg.Version{Timestamp: 1, Peer: "p"}, storagePkg.Version{Timestamp: 2, Peer: "p"}
+	peers[0].storage.SetVersion("same", []byte("v"), older)
+	peers[1].storage.SetVersion("same", []byte("v"), older)
+	peers[0].storage.SetVersion("newer", []byte("v2"), newer)
+	peers[1].storage.SetVersion("newer", []byte("v1"), older)
+	peers[0].storage.SetVersion("first", []byte("v"), older)
+	peers[1].storage.SetVersion("second", []byte("v"), older)
+	// a peer missed a delete
+	peers[0].storage.DelVersion("deleted", newer)
+	peers[1].storage.SetVersion("deleted", []byte("v"), older)
+	peers[0].storage.SetAdd("tags", "1@a", "a")
+	peers[1].storage.SetAdd("tags", "1@b", "b")
+
+	suites := []struct {
+		input    string
+		expected string
+	}{
+		{"peer repair unknown", "Peer unknown not found in peer list"},
+		{"peer repair " + peers[0].ID, ":5\r\n"},
+		{"peer repair " + peers[0].ID, ":0\r\n"},
+		{"peer merkle " + peers[0].ID + " 1000000", "ERR invalid Merkle tree node '1000000'"},
+		{"peer range " + peers[0].ID + " x", "ERR invalid Merkle tree leaf 'x'"},
+	}
+	for _, s := range suites {
+		if output := <-executeAsync(clients[1], s.input); output != s.expected {
+			t.Errorf("%s: want %q, got %q", s.input, s.expected, output)
+		}
+	}
+	for _, p := range peers {
+		dump := []string{}
+		for _, item := range p.storage.Dump() {
+			if item.Type == "" {
+				dump = append(dump, fmt.Sprintf("%s=%s", item.Key, item.Value))
+			}
+		}
+		members, _ := p.storage.SetMembers("tags")
+		expected := "[first=v newer=v2 same=v second=v] [a b]"
+		if output := fmt.Sprint(dump, " ", members); output != expected {
+			t.Errorf("want %q, got %q", expected, output)
+		}
+	}
+	// the deleted key is not brought back by the older writes
+	for i, p := range peers {
+		if p.storage.SetVersion("deleted", []byte("v"), older) {
+			t.Errorf("peer %d: want the delete to win over an older write", i)
+		}
+	}
+	expected := "repairs:2\r\nrepaired_keys:5"
+	if output := <-executeAsync(clients[1], "info replication"); !strings.Contains(output, expected) {
+		t.Errorf("want %q in %q", expected, output)
+	}
+
+	// the tree built when the root is asked is kept for the rest of the
+	// repair
+	tree := <-executeAsync(clients[0], "peer merkle test 0 1")
+	peers[0].storage.SetVersion("during", []byte("v"), newer)
+	expected = strings.TrimPrefix(<-executeAsync(clients[0], "peer merkle test 1"), "*1\r\n")
+	if !strings.HasSuffix(tree, expected) {
+		t.Errorf("want %q in %q", expected, tree)
+	}
+	if output := <-executeAsync(clients[0], "peer merkle test 0 1"); output == tree {
+		t.Errorf("want a new tree, got %q", output)
+	}
+}
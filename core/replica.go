@@ -0,0 +1,302 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bjorand/velocidb/utils"
+)
+
+// A replica is a read-only peer of the mesh linked with a primary peer: it
+// receives the writes of the mesh and serves the reads of its clients, but
+// does not accept their writes. They fail with READONLY, or are forwarded to
+// the primary with RemoteExecute when replica-writes is forward, for the
+// clients which did not set their connection READONLY. Replicas scale the
+// reads without adding peers writes are received from.
+//
+//	REPLICAOF <host> <port>             replicates the primary at host:port
+//	REPLICAOF NO ONE                    turns the replica into a primary
+//	PEER ROLE                           answers the role of the peer
+const (
+	replicaWritesReject  = "reject"
+	replicaWritesForward = "forward"
+
+	ROLE_PRIMARY = "master"
+	ROLE_REPLICA = "slave"
+)
+
+var (
+	errReadOnly   = fmt.Errorf("READONLY You can't write against a read only replica.")
+	errNoReplicas = fmt.Errorf("NOREPLICAS Not enough good replicas to write.")
+)
+
+// replicaRole is the role of the peer: it is a replica when primary, the
+// address of its primary, is set.
+type replicaRole struct {
+	mu      sync.RWMutex
+	primary string
+	writes  string
+	// primaryID is the ID of the primary once linked
+	primaryID string
+	// epoch is the failover epoch of the peer, lastVote the last epoch it
+	// voted in
+	epoch    int64
+	lastVote int64
+	// failedPrimary is the address of the primary the peer replaced when
+	// it was promoted by a failover
+	failedPrimary string
+	// promoted is the address of the peer promoted in epoch, replacing the
+	// primary at replaced, announced to the peers linking with the peer
+	promoted string
+	replaced string
+	// replicaIDs are the IDs of the replicas of a primary, fenced is set
+	// while it has no link ready with a majority of them
+	replicaIDs map[string]bool
+	fenced     bool
+	// announced is the ID of the primary last announced with ROLE
+	announced string
+	// electAt is when the peer starts an election, zero while its primary
+	// is linked
+	electAt time.Time
+	// timeout is read and written atomically
+	timeout int64
+}
+
+func newReplicaRole() *replicaRole {
+	return &replicaRole{writes: replicaWritesReject, timeout: FAILOVER_TIMEOUT}
+}
+
+func (r *replicaRole) Primary() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.primary
+}
+
+// PrimaryID returns the ID of the primary of a replica once linked with it,
+// else an empty string.
+func (r *replicaRole) PrimaryID() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.primary == "" {
+		return ""
+	}
+	return r.primaryID
+}
+
+// Epoch returns the failover epoch of the peer.
+func (r *replicaRole) Epoch() int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.epoch
+}
+
+func (r *replicaRole) Fenced() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.fenced
+}
+
+func (r *replicaRole) Writes() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.writes
+}
+
+func (r *replicaRole) SetWrites(writes string) error {
+	if writes != replicaWritesReject && writes != replicaWritesForward {
+		return fmt.Errorf("argument must be '%s' or '%s'", replicaWritesReject, replicaWritesForward)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writes = writes
+	return nil
+}
+
+// ReplicaOf makes the peer a replica of the primary listening on addr and
+// links with it, or a primary when addr is empty.
+func (p *Peer) ReplicaOf(addr string) error {
+	if addr == "" {
+		p.role.mu.Lock()
+		p.role.primary = ""
+		p.role.electAt = time.Time{}
+		p.role.mu.Unlock()
+		p.announceRole()
+		return nil
+	}
+	if p.consensus != nil || p.cluster != nil {
+		return fmt.Errorf("ERR REPLICAOF not allowed in consistent mode or with sharding")
+	}
+	if _, _, err := utils.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("ERR Invalid primary address %s", addr)
+	}
+	if addr == p.connString() {
+		return fmt.Errorf("ERR A peer can't replicate itself")
+	}
+	p.role.mu.Lock()
+	p.role.primary = addr
+	p.role.primaryID = ""
+	p.role.failedPrimary = ""
+	p.role.electAt = time.Time{}
+	p.role.mu.Unlock()
+	link := p.primaryLink()
+	if link == nil {
+		_, err := p.ConnectToPeerAddr(addr)
+		return err
+	}
+	if !link.Ready() {
+		return nil
+	}
+	// the primary learns its new replica and its keys are synced at once
+	p.role.mu.Lock()
+	p.role.primaryID = link.remoteID()
+	p.role.mu.Unlock()
+	p.announceRole()
+	if hasCapability(link.remoteCapabilities(), "sync") {
+		return p.requestSync(link, [][]byte{[]byte("FULLSYNC")})
+	}
+	return nil
+}
+
+// primaryLink returns the link with the primary of the peer, nil when it
+// is not a replica or not linked with its primary.
+func (p *Peer) primaryLink() *Peer {
+	primary := p.role.Primary()
+	if primary == "" {
+		return nil
+	}
+	var link *Peer
+	for _, l := range p.Mesh.List() {
+		if l.Key() == primary && (link == nil || l.Ready()) {
+			link = l
+		}
+	}
+	return link
+}
+
+// replicaWrite rejects or forwards to the primary the writes of the clients
+// of a replica, and rejects those of a fenced primary. handled is false when
+// the peer is a primary accepting writes.
+func (q *Query) replicaWrite() (r *Response, err error, handled bool) {
+	if q.p.role.Primary() == "" {
+		if q.p.role.Fenced() {
+			return nil, errNoReplicas, true
+		}
+		return nil, nil, false
+	}
+	// forwarded queries and the writes of scripts are not forwarded
+	if q.forwarded || q.script != nil || (q.c != nil && q.c.readonly) || q.p.role.Writes() != replicaWritesForward {
+		return nil, errReadOnly, true
+	}
+	link := q.p.primaryLink()
+	if link == nil || !link.Ready() {
+		return nil, fmt.Errorf("TRYAGAIN Primary %s is not linked", q.p.role.Primary()), true
+	}
+	r, err = q.forward(link, false)
+	return r, err, true
+}
+
+// replicaOf answers REPLICAOF.
+func (q *Query) replicaOf(r *Response, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for 'replicaof' command")
+	}
+	addr := fmt.Sprintf("%s:%s", args[0], args[1])
+	if strings.EqualFold(args[0], "no") && strings.EqualFold(args[1], "one") {
+		addr = ""
+	}
+	if err := q.p.ReplicaOf(addr); err != nil {
+		return err
+	}
+	r.OK()
+	return nil
+}
+
+// peerRole answers PEER ROLE with the role of the peer and the ID of its
+// primary.
+func (q *Query) peerRole(r *Response) {
+	r.Type = typeArray
+	link := q.p.primaryLink()
+	if q.p.role.Primary() == "" || link == nil {
+		r.Payload = [][]byte{[]byte(ROLE_PRIMARY)}
+		return
+	}
+	r.Payload = [][]byte{[]byte(ROLE_REPLICA), []byte(link.remoteID())}
+}
+
+// replicasOf returns the links ready with the replicas of the peer.
+func (p *Peer) replicasOf() (replicas []*Peer) {
+	for _, link := range p.replicas() {
+		if link.Ready() && link.remotePrimaryID() == p.ID {
+			replicas = append(replicas, link)
+		}
+	}
+	return replicas
+}
+
+// announceRole sends ROLE with the ID of the primary of the peer to the
+// remote peers of the links ready, when it changed since the last
+// announcement. The peers linking later learn it from the HELLO.
+func (p *Peer) announceRole() {
+	id := p.role.PrimaryID()
+	p.role.mu.Lock()
+	changed := id != p.role.announced
+	p.role.announced = id
+	p.role.mu.Unlock()
+	if !changed {
+		return
+	}
+	message := [][]byte{[]byte("ROLE")}
+	if id != "" {
+		message = append(message, []byte(id))
+	}
+	for _, link := range p.Mesh.List() {
+		if conn, _ := link.session(); conn != nil && link.Ready() {
+			writeFrame(conn, frameSync, formattedArray(message))
+		}
+	}
+}
+
+// role answers ROLE: the primary role with the replication offset of the
+// peer and its replicas, or the replica role with the address of the
+// primary, the state of the link and the offset received from it.
+func (q *Query) role(r *Response) {
+	p := q.p
+	primary := p.role.Primary()
+	if primary == "" {
+		replicas := []interface{}{}
+		for _, link := range p.replicasOf() {
+			host, port, _ := utils.SplitHostPort(link.Key())
+			replicas = append(replicas, []interface{}{host, fmt.Sprint(port), fmt.Sprint(atomic.LoadInt64(&link.replAcked))})
+		}
+		r.Replies = [][]byte{formattedReply([]interface{}{ROLE_PRIMARY, p.backlog.Offset(), replicas})}
+		return
+	}
+	host, port, _ := utils.SplitHostPort(primary)
+	state, offset := "connect", int64(0)
+	if link := p.primaryLink(); link != nil && link.Ready() {
+		state, offset = "connected", p.replOffset(link.remoteID())
+	}
+	r.Replies = [][]byte{formattedReply([]interface{}{ROLE_REPLICA, host, port, state, offset})}
+}
+
+func infoRole(p *Peer) (info []string) {
+	primary := p.role.Primary()
+	if primary == "" {
+		return []string{fmt.Sprintf("role:%s", ROLE_PRIMARY)}
+	}
+	host, port, _ := utils.SplitHostPort(primary)
+	status := "down"
+	if link := p.primaryLink(); link != nil && link.Ready() {
+		status = "up"
+	}
+	return []string{
+		fmt.Sprintf("role:%s", ROLE_REPLICA),
+		fmt.Sprintf("master_host:%s", host),
+		fmt.Sprintf("master_port:%d", port),
+		fmt.Sprintf("master_link_status:%s", status),
+		fmt.Sprintf("replica_writes:%s", p.role.Writes()),
+	}
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplica(t *testing.T) {
+	client1, client2 := setupGossip(), setupGossip()
+	p1, p2 := client1.vqlTCPServer.Peer, client2.vqlTCPServer.Peer
+	host, port := p1.tcpServer.Host, p1.tcpServer.Port()
+	if output := <-executeAsync(client2, fmt.Sprintf("replicaof %s %d", host, port)); output != "+OK\r\n" {
+		t.Fatalf("want %q, got %q", "+OK\r\n", output)
+	}
+	expected := "master_link_status:up"
+	if output := waitInfoReplication(client2, expected); !strings.Contains(output, expected) {
+		t.Fatalf("want %q in %q", expected, output)
+	}
+	expected = fmt.Sprintf("role:slave\r\nmaster_host:%s\r\nmaster_port:%d", host, port)
+	if output := <-executeAsync(client2, "info replication"); !strings.Contains(output, expected) {
+		t.Errorf("want %q in %q", expected, output)
+	}
+
+	// the writes of the clients of a replica are rejected by default
+	if output := <-executeAsync(client2, "set a 1"); output != errReadOnly.Error() {
+		t.Errorf("want %q, got %q", errReadOnly.Error(), output)
+	}
+	// or forwarded to the primary, which replicates them
+	<-executeAsync(client2, "config set replica-writes forward")
+	if output := <-executeAsync(client2, "set a 1"); output != "+OK\r\n" {
+		t.Errorf("want %q, got %q", "+OK\r\n", output)
+	}
+	for i := 0; i < 100 && p2.storage.Get("a") == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if output := string(p1.storage.Get("a")) + string(p2.storage.Get("a")); output != "11" {
+		t.Errorf("want %+v, got %+v", "11", output)
+	}
+	// except for the clients which set their connection READONLY
+	suites := []struct {
+		input    string
+		expected string
+	}{
+		{"readonly", "+OK\r\n"},
+		{"set b 2", errReadOnly.Error()},
+		{"get a", "$1\r\n1\r\n"},
+		{"readwrite", "+OK\r\n"},
+		{"set b 2", "+OK\r\n"},
+	}
+	for _, s := range suites {
+		if output := <-executeAsync(client2, s.input); output != s.expected {
+			t.Errorf("%s: want %q, got %q", s.input, s.expected, output)
+		}
+	}
+
+	expected = fmt.Sprintf("*5\r\n$5\r\nslave\r\n$%d\r\n%s\r\n:%d\r\n$9\r\nconnected\r\n", len(host), host, port)
+	if output := <-executeAsync(client2, "role"); !strings.HasPrefix(output, expected) {
+		t.Errorf("want %q in %q", expected, output)
+	}
+	// the primary learns its replica from the role it announces
+	expected = fmt.Sprintf("*1\r\n*3\r\n$%d\r\n%s\r\n", len(p2.tcpServer.Host), p2.tcpServer.Host)
+	for i := 0; i < 50 && !strings.Contains(<-executeAsync(client1, "role"), expected); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if output := <-executeAsync(client1, "role"); !strings.HasPrefix(output, "*3\r\n$6\r\nmaster\r\n") || !strings.Contains(output, expected) {
+		t.Errorf("want the replica %q in %q", expected, output)
+	}
+
+	// a replica promoted with REPLICAOF NO ONE accepts writes
+	<-executeAsync(client2, "config set replica-writes reject")
+	<-executeAsync(client2, "replicaof no one")
+	if output := <-executeAsync(client2, "set c 3"); output != "+OK\r\n" {
+		t.Errorf("want %q, got %q", "+OK\r\n", output)
+	}
+	expected = "role:master"
+	if output := <-executeAsync(client2, "info replication"); !strings.Contains(output, expected) {
+		t.Errorf("want %q in %q", expected, output)
+	}
+	// and its former primary forgets it
+	expected = "*0\r\n"
+	for i := 0; i < 50 && !strings.HasSuffix(<-executeAsync(client1, "role"), expected); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if output := <-executeAsync(client1, "role"); !strings.HasSuffix(output, expected) {
+		t.Errorf("want %q in %q", expected, output)
+	}
+	if output := <-executeAsync(client2, "replicaof "+strings.Replace(p2.connString(), ":", " ", 1)); !strings.Contains(output, "replicate itself") {
+		t.Errorf("want %q in %q", "replicate itself", output)
+	}
+}
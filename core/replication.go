@@ -0,0 +1,231 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Every write a peer replicates gets the next offset of the peer, sent with
+// the query as an offset= element of the Q frame. The peer keeps the last
+// REPLICATION_BACKLOG_SIZE writes in its backlog. The peers remember the
+// last offset they received from every peer and acknowledge it once every
+// REPLICATION_ACK_INTERVAL with REPLACK. A peer linking again with a peer
+// requests the writes following its offset with PSYNC: the writes still in
+// the backlog are sent after CONTINUE, else the peer answers with a full
+// sync ending with the offset of its snapshot.
+//
+//	PSYNC <peer-id> <offset> <epoch>    requests the writes after offset
+//	CONTINUE <offset>                   the writes after offset follow
+//	REPLACK <offset>                    acknowledges the writes up to offset
+const (
+	REPLICATION_BACKLOG_SIZE = 10000
+	// seconds between acknowledgments
+	REPLICATION_ACK_INTERVAL = 1
+)
+
+// replicationBacklog holds the last writes replicated by the peer.
+type replicationBacklog struct {
+	mu      sync.Mutex
+	entries []*Query
+	// offset is the offset of the last write
+	offset int64
+}
+
+func newReplicationBacklog(size int) *replicationBacklog {
+	return &replicationBacklog{entries: make([]*Query, size)}
+}
+
+// append records a write and returns its offset.
+func (b *replicationBacklog) append(q *Query) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.offset++
+	b.entries[b.offset%int64(len(b.entries))] = q
+	return b.offset
+}
+
+func (b *replicationBacklog) Offset() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.offset
+}
+
+// firstOffset returns the offset of the oldest write of the backlog.
+func (b *replicationBacklog) firstOffset() int64 {
+	first := b.offset - int64(len(b.entries)) + 1
+	if first < 1 {
+		first = 1
+	}
+	return first
+}
+
+// since returns the writes following offset. ok is false when some of them
+// are not in the backlog anymore.
+func (b *replicationBacklog) since(offset int64) (queries []*Query, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if offset > b.offset || offset < b.firstOffset()-1 {
+		return nil, false
+	}
+	for o := offset + 1; o <= b.offset; o++ {
+		queries = append(queries, b.entries[o%int64(len(b.entries))])
+	}
+	return queries, true
+}
+
+// syncRequest returns the sync message a peer sends on a new link, nil
+// when it does not need to sync: FULLSYNC to the first peer it links with,
+// PSYNC to the peers it was linked with before which may have written
+// meanwhile. In consistent mode, the followers are synced with Raft
+// snapshots.
+func (p *Peer) syncRequest(id string) [][]byte {
+	if p.consensus != nil {
+		return nil
+	}
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+	offset, seen := p.replOffsets[id]
+	if !seen {
+		p.replOffsets[id] = 0
+	}
+	first := !p.syncRequested
+	p.syncRequested = true
+	switch {
+	case seen:
+		return [][]byte{[]byte("PSYNC"), []byte(id), []byte(strconv.FormatInt(offset, 10))}
+	case first:
+		return [][]byte{[]byte("FULLSYNC")}
+	}
+	return nil
+}
+
+// receivedOffset records the offset of a write received from a peer.
+func (p *Peer) receivedOffset(id string, offset int64) {
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+	if offset > p.replOffsets[id] {
+		p.replOffsets[id] = offset
+	}
+}
+
+func (p *Peer) replOffset(id string) int64 {
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+	return p.replOffsets[id]
+}
+
+// resetOffset sets the offset of a peer after a full sync.
+func (p *Peer) resetOffset(id string, offset int64) {
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+	p.replOffsets[id] = offset
+}
+
+// servePartialSync sends the writes following offset to the remote peer of
+// a link, or a full sync when they are not in the backlog anymore.
+func (p *Peer) servePartialSync(link *Peer, id string, offset int64) {
+	conn, done := link.session()
+	if conn == nil {
+		return
+	}
+	f := link.fullSync
+	p.execLock.Lock()
+	var queries []*Query
+	ok := id == p.ID
+	if ok {
+		queries, ok = p.backlog.since(offset)
+	}
+	if ok {
+		p.hints.drop(link.remoteID())
+	} else if id == p.ID {
+		// the writes missing from the backlog may have been hinted
+		queries, ok = p.hintedWrites(link.remoteID(), offset)
+	}
+	f.mu.Lock()
+	if !ok || f.sending {
+		f.mu.Unlock()
+		p.execLock.Unlock()
+		if !ok {
+			p.serveSync(link)
+		}
+		return
+	}
+	f.sending = true
+	f.mu.Unlock()
+	p.execLock.Unlock()
+	defer p.drainSyncTail(link, done)
+
+	if err := writeFrame(conn, frameSync, formattedArray([][]byte{[]byte("CONTINUE"), []byte(strconv.FormatInt(offset, 10))})); err != nil {
+		return
+	}
+	atomic.AddInt64(&p.Stats.PartialSyncsServed, 1)
+	for _, q := range queries {
+		// the writes relayed by the peer are not sent back to their origin
+		if q.origin == link.remoteID() {
+			continue
+		}
+		if p.cluster != nil {
+			if owners := p.cluster.queryOwners(q); owners != nil && !stringInSlice(link.remoteID(), owners) {
+				continue
+			}
+		}
+		select {
+		case link.broadcastVQLQuery <- q:
+		case <-done:
+			return
+		}
+	}
+}
+
+// acknowledge sends the offset received from the remote peer of a link
+// every REPLICATION_ACK_INTERVAL, until the connection ends.
+func (p *Peer) acknowledge(link *Peer, done chan struct{}) {
+	ticker := time.NewTicker(REPLICATION_ACK_INTERVAL * time.Second)
+	defer ticker.Stop()
+	var acked int64
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			offset := p.replOffset(link.remoteID())
+			if offset == acked {
+				continue
+			}
+			conn, _ := link.session()
+			if conn == nil {
+				continue
+			}
+			if err := writeFrame(conn, frameSync, formattedArray([][]byte{[]byte("REPLACK"), []byte(strconv.FormatInt(offset, 10))})); err != nil {
+				continue
+			}
+			acked = offset
+		}
+	}
+}
+
+// sentOffset records the offset of a write sent to the remote peer of a
+// link.
+func (p *Peer) sentOffset(offset int64) {
+	for {
+		sent := atomic.LoadInt64(&p.replSent)
+		if offset <= sent || atomic.CompareAndSwapInt64(&p.replSent, sent, offset) {
+			return
+		}
+	}
+}
+
+// infoLinkOffsets returns the offsets of the writes received from the
+// remote peer of a link, and of the writes it acknowledged with the lag
+// behind the last write sent to it.
+func infoLinkOffsets(p *Peer, link *Peer) string {
+	acked := atomic.LoadInt64(&link.replAcked)
+	lag := atomic.LoadInt64(&link.replSent) - acked
+	if lag < 0 {
+		lag = 0
+	}
+	return fmt.Sprintf("offset=%d,acked=%d,lag=%d", p.replOffset(link.remoteID()), acked, lag)
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplicationBacklog(t *testing.T) {
+	b := newReplicationBacklog(3)
+	queries := []*Query{}
+	for i := 1; i <= 5; i++ {
+		q := NewSimpleQuery(fmt.Sprintf("set k %d", i))
+		queries = append(queries, q)
+		if output := b.append(q); output != int64(i) {
+			t.Errorf("want %+v, got %+v", i, output)
+		}
+	}
+	suites := []struct {
+		offset   int64
+		expected []*Query
+		ok       bool
+	}{
+		{5, nil, true},
+		{2, queries[2:], true},
+		{4, queries[4:], true},
+		{1, nil, false},
+		{6, nil, false},
+	}
+	for _, s := range suites {
+		output, ok := b.since(s.offset)
+		if ok != s.ok || fmt.Sprint(output) != fmt.Sprint(s.expected) {
+			t.Errorf("since %d: want %+v %+v, got %+v %+v", s.offset, s.expected, s.ok, output, ok)
+		}
+	}
+}
+
+func waitInfoReplication(client *VQLClient, s ...string) string {
+	var output string
+	for i := 0; i < 150; i++ {
+		output = <-executeAsync(client, "info replication")
+		found := 0
+		for _, e := range s {
+			if strings.Contains(output, e) {
+				found++
+			}
+		}
+		if found == len(s) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return output
+}
+
+func TestPartialSync(t *testing.T) {
+	client1, client2 := setupGossip(), setupGossip()
+	p1, p2 := client1.vqlTCPServer.Peer, client2.vqlTCPServer.Peer
+	link, err := p2.ConnectToPeerAddr(p1.connString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output := waitPeerStatus(link, PEER_STATUS_CONNECTED); output != PEER_STATUS_CONNECTED {
+		t.Fatalf("want %+v, got %+v", PEER_STATUS_CONNECTED, output)
+	}
+	<-executeAsync(client1, "set a 1")
+	expected := "offset=1,"
+	if output := waitInfoReplication(client2, expected); !strings.Contains(output, expected) {
+		t.Fatalf("want %q in %q", expected, output)
+	}
+	// the offset is acknowledged
+	expected = "acked=1,lag=0"
+	if output := waitInfoReplication(client1, expected); !strings.Contains(output, expected) {
+		t.Errorf("want %q in %q", expected, output)
+	}
+
+	// writes made while the link is down are sent from the backlog
+	reconnects := peerReconnects(link)
+	conn, _ := link.session()
+	conn.Close()
+	for i := 0; i < 50 && peerReconnects(link) == reconnects; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	<-executeAsync(client1, "set b 2")
+	<-executeAsync(client1, "incr c")
+	for i := 0; i < 100 && p2.storage.Get("c") == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if output := string(p2.storage.Get("b")) + string(p2.storage.Get("c")); output != "21" {
+		t.Errorf("want %+v, got %+v", "21", output)
+	}
+	expected = "partial_syncs_received:1"
+	output := waitInfoReplication(client2, expected, "offset=3,")
+	for _, e := range []string{expected, "full_syncs_received:1", "offset=3,"} {
+		if !strings.Contains(output, e) {
+			t.Errorf("want %q in %q", e, output)
+		}
+	}
+	if output := <-executeAsync(client1, "info replication"); !strings.Contains(output, "partial_syncs_served:1") || !strings.Contains(output, "repl_offset:3") {
+		t.Errorf("want a partial sync served at offset 3, got %q", output)
+	}
+}
@@ -1,7 +1,9 @@
 package core
 
 import (
+	"bytes"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -9,7 +11,10 @@ type Response struct {
 	Payload          [][]byte
 	DisconnectSignal bool
 	Type             string
-	q                *Query
+	// Replies holds already formatted replies written as is, for commands
+	// like SUBSCRIBE answering with one reply per argument.
+	Replies [][]byte
+	q       *Query
 }
 
 func NewResponse(q *Query) *Response {
@@ -21,7 +26,8 @@ func NewResponse(q *Query) *Response {
 
 func NewPeerResponseError(q *Query, err error) *Response {
 	r := NewResponse(q)
-	r.Payload = append(r.Payload, []byte(fmt.Sprintf("-%s\r\n", err.Error())))
+	r.PayloadString([]byte(err.Error()))
+	r.Type = typeError
 	return r
 }
 
@@ -78,8 +84,18 @@ func (r *Response) isNullBulkString() bool {
 	return false
 }
 
+func (r *Response) isError() bool {
+	if r.Type == typeError {
+		return true
+	}
+	return false
+}
+
 func (r *Response) FormattedPayload() []byte {
 	var payload []byte
+	if len(r.Replies) > 0 {
+		return bytes.Join(r.Replies, nil)
+	}
 	if len(r.Payload) == 1 && !r.isArray() {
 
 		if r.isBulkString() {
@@ -91,6 +107,8 @@ func (r *Response) FormattedPayload() []byte {
 			}
 		} else if r.isInteger() {
 			payload = []byte(fmt.Sprintf(":%s", r.Payload[0]))
+		} else if r.isError() {
+			payload = []byte(fmt.Sprintf("-%s", r.Payload[0]))
 		} else {
 			payload = []byte(fmt.Sprintf("+%s", r.Payload[0]))
 		}
@@ -123,7 +141,133 @@ func (r *Response) PeerResponseEncode() []byte {
 	var data [][]byte
 	data = append(data, []byte(fmt.Sprintf("id=%s", qid)))
 	data = append(data, r.FormattedPayload())
-	payload := append(PEER_RESPONSE_TYPE, controlByte...)
-	payload = append(payload, formattedArray(data)...)
-	return payload
+	return encodeFrame(frameResponse, formattedArray(data))
+}
+
+// statusReply and errorReply are the simple string and error values of a
+// reply decoded by decodeReply, other values are int64, []byte, nil and
+// []interface{}.
+type statusReply string
+type errorReply string
+
+// decodeReply decodes a formatted reply and returns its value with the number
+// of bytes consumed.
+func decodeReply(data []byte) (interface{}, int, error) {
+	if len(data) == 0 {
+		return nil, 0, fmt.Errorf("truncated reply")
+	}
+	switch string(data[:1]) {
+	case typeSimpleString, typeError, typeInteger:
+		item, n, err := readReplyItem(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch string(data[:1]) {
+		case typeSimpleString:
+			return statusReply(item), n, nil
+		case typeError:
+			return errorReply(item), n, nil
+		}
+		i, err := strconv.ParseInt(string(item), 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		return i, n, nil
+	case typeBulkString:
+		item, n, err := readReplyItem(data)
+		if err != nil || item == nil {
+			return nil, n, err
+		}
+		return item, n, nil
+	case typeArray:
+		count, cur := readInt(data[1:], 1)
+		if count < 0 {
+			return nil, cur, nil
+		}
+		items := []interface{}{}
+		for i := 0; i < count; i++ {
+			item, n, err := decodeReply(data[cur:])
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+			cur += n
+		}
+		return items, cur, nil
+	}
+	return nil, 0, fmt.Errorf("invalid reply type %s", strconv.Quote(string(data[:1])))
+}
+
+// parseReply decodes a formatted reply into a Response. Elements of an array
+// reply are stored in Payload, nested arrays are kept formatted.
+func parseReply(data []byte) (*Response, error) {
+	r := NewResponse(nil)
+	r.Payload = nil
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty reply")
+	}
+	switch string(data[:1]) {
+	case typeArray:
+		count, cur := readInt(data[1:], 1)
+		if count < 0 {
+			r.Type = typeBulkString
+			r.Payload = [][]byte{nil}
+			return r, nil
+		}
+		r.Type = typeArray
+		r.Payload = [][]byte{}
+		for i := 0; i < count; i++ {
+			item, n, err := readReplyItem(data[cur:])
+			if err != nil {
+				return nil, err
+			}
+			r.Payload = append(r.Payload, item)
+			cur += n
+		}
+		return r, nil
+	default:
+		item, _, err := readReplyItem(data)
+		if err != nil {
+			return nil, err
+		}
+		r.Type = string(data[:1])
+		r.Payload = [][]byte{item}
+		return r, nil
+	}
+}
+
+// readReplyItem reads the value of one formatted reply and returns it with
+// the number of bytes consumed.
+func readReplyItem(data []byte) ([]byte, int, error) {
+	if len(data) == 0 {
+		return nil, 0, fmt.Errorf("truncated reply")
+	}
+	switch string(data[:1]) {
+	case typeSimpleString, typeError, typeInteger:
+		end := bytes.Index(data, endByte)
+		if end < 0 {
+			return nil, 0, fmt.Errorf("truncated reply")
+		}
+		return data[1:end], end + len(endByte), nil
+	case typeBulkString:
+		size, cur := readInt(data[1:], 1)
+		if size < 0 {
+			return nil, cur, nil
+		}
+		if len(data) < cur+size+len(endByte) {
+			return nil, 0, fmt.Errorf("truncated reply")
+		}
+		return data[cur : cur+size], cur + size + len(endByte), nil
+	case typeArray:
+		count, cur := readInt(data[1:], 1)
+		for i := 0; i < count; i++ {
+			_, n, err := readReplyItem(data[cur:])
+			if err != nil {
+				return nil, 0, err
+			}
+			cur += n
+		}
+		return data[:cur], cur, nil
+	}
+	return nil, 0, fmt.Errorf("invalid reply type %s", strconv.Quote(string(data[:1])))
 }
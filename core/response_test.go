@@ -16,7 +16,7 @@ func TestPeerResponseEncode(t *testing.T) {
 		t.Fatal(err)
 	}
 	output := r.PeerResponseEncode()
-	expected := []byte("1\r\n*2\r\n$6\r\nid=foo\r\n$7\r\n+PONG\r\n\r\n")
+	expected := []byte("VD\x01R\x00\x00\x00\x1d*2\r\n$6\r\nid=foo\r\n$7\r\n+PONG\r\n\r\n")
 	if string(output) != string(expected) {
 		t.Fatalf("want %+v, got %+v", expected, output)
 	}
@@ -0,0 +1,875 @@
+package core
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	// default execution time limit of a script in milliseconds
+	SCRIPT_TIME_LIMIT = 5000
+	// default execution time limit in milliseconds of a script which wrote
+	// to the dataset
+	SCRIPT_HARD_TIME_LIMIT = 60000
+)
+
+var (
+	// scriptDeniedVerbs lists the commands scripts cannot call
+	scriptDeniedVerbs = map[string]bool{
+		"subscribe":    true,
+		"psubscribe":   true,
+		"unsubscribe":  true,
+		"punsubscribe": true,
+		"eval":         true,
+		"evalsha":      true,
+		"fcall":        true,
+		"script":       true,
+		"function":     true,
+		"client":       true,
+		"quit":         true,
+	}
+	// scriptNondeterministicVerbs answer or write differently on every peer,
+	// as SET with the EX or PX option: in consistent mode, scripts are run by
+	// every peer from the Raft log and cannot call them
+	scriptNondeterministicVerbs = map[string]bool{
+		"time":    true,
+		"ttl":     true,
+		"pttl":    true,
+		"expire":  true,
+		"pexpire": true,
+	}
+	errScriptNondeterministic = fmt.Errorf("ERR This command is not deterministic and is not allowed from script in consistent mode")
+	// scriptVerbs run with an exclusive lock on the peer
+	scriptVerbs = map[string]bool{
+		"eval":    true,
+		"evalsha": true,
+		"fcall":   true,
+	}
+	libraryMetadata = regexp.MustCompile(`^#!lua name=([A-Za-z0-9_]+)\s*(\n|$)`)
+)
+
+// ScriptEngine keeps the scripts and function libraries of a peer and runs
+// them with an embedded Lua interpreter.
+type ScriptEngine struct {
+	mu      sync.Mutex
+	scripts map[string]*lua.FunctionProto
+	// sources of the scripts, by SHA1 digest
+	sources   map[string]string
+	libraries map[string]*scriptLibrary
+	// library of every registered function
+	functions map[string]*scriptLibrary
+	running   *scriptRun
+	timeLimit int64
+	// hardTimeLimit stops the scripts which wrote
+	hardTimeLimit int64
+}
+
+type scriptLibrary struct {
+	name      string
+	code      string
+	proto     *lua.FunctionProto
+	functions []string
+}
+
+// scriptRun is the state of a running script, commands called by the script
+// hold a reference to it. Its flags are guarded by the mutex of the engine.
+type scriptRun struct {
+	cancel func()
+	// dirty is set once the script ran a write command
+	dirty    bool
+	killed   bool
+	timedOut bool
+	// aborted is set once the script reached the hard time limit
+	aborted bool
+}
+
+func NewScriptEngine() *ScriptEngine {
+	return &ScriptEngine{
+		scripts:       make(map[string]*lua.FunctionProto),
+		sources:       make(map[string]string),
+		libraries:     make(map[string]*scriptLibrary),
+		functions:     make(map[string]*scriptLibrary),
+		timeLimit:     SCRIPT_TIME_LIMIT,
+		hardTimeLimit: SCRIPT_HARD_TIME_LIMIT,
+	}
+}
+
+func scriptSHA1(script []byte) string {
+	h := sha1.Sum(script)
+	return hex.EncodeToString(h[:])
+}
+
+func compileScript(name string, code string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(code), name)
+	if err != nil {
+		return nil, fmt.Errorf("ERR Error compiling script: %s", err)
+	}
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, fmt.Errorf("ERR Error compiling script: %s", err)
+	}
+	return proto, nil
+}
+
+// Load compiles and caches a script, it returns the SHA1 digest of the
+// script used to call it with EVALSHA.
+func (e *ScriptEngine) Load(script []byte) (string, error) {
+	sha := scriptSHA1(script)
+	e.mu.Lock()
+	_, ok := e.scripts[sha]
+	e.mu.Unlock()
+	if ok {
+		return sha, nil
+	}
+	proto, err := compileScript("user_script", string(script))
+	if err != nil {
+		return "", err
+	}
+	e.mu.Lock()
+	e.scripts[sha] = proto
+	e.sources[sha] = string(script)
+	e.mu.Unlock()
+	return sha, nil
+}
+
+func (e *ScriptEngine) Get(sha string) *lua.FunctionProto {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.scripts[strings.ToLower(sha)]
+}
+
+func (e *ScriptEngine) Exists(sha string) bool {
+	return e.Get(sha) != nil
+}
+
+func (e *ScriptEngine) Flush() {
+	e.mu.Lock()
+	e.scripts = make(map[string]*lua.FunctionProto)
+	e.sources = make(map[string]string)
+	e.mu.Unlock()
+}
+
+func (e *ScriptEngine) TimeLimit() time.Duration {
+	return time.Duration(atomic.LoadInt64(&e.timeLimit)) * time.Millisecond
+}
+
+func (e *ScriptEngine) SetTimeLimit(ms int64) {
+	atomic.StoreInt64(&e.timeLimit, ms)
+}
+
+func (e *ScriptEngine) HardTimeLimit() time.Duration {
+	return time.Duration(atomic.LoadInt64(&e.hardTimeLimit)) * time.Millisecond
+}
+
+func (e *ScriptEngine) SetHardTimeLimit(ms int64) {
+	atomic.StoreInt64(&e.hardTimeLimit, ms)
+}
+
+// Kill stops the running script unless it already wrote to the dataset.
+func (e *ScriptEngine) Kill() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.running == nil {
+		return fmt.Errorf("NOTBUSY No scripts in execution right now.")
+	}
+	if e.running.dirty {
+		return fmt.Errorf("UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or its abort at the hard time limit of %s.", e.HardTimeLimit())
+	}
+	e.running.killed = true
+	e.running.cancel()
+	return nil
+}
+
+// expire stops run once it reached the time limit, unless it already wrote
+// to the dataset: it then runs until it returns, its writes are never cut
+// off halfway.
+func (e *ScriptEngine) expire(run *scriptRun) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if run.dirty || run.killed {
+		return
+	}
+	run.timedOut = true
+	run.cancel()
+}
+
+// abort stops run once it reached the hard time limit, even when it wrote
+// to the dataset: the writes it made are kept.
+func (e *ScriptEngine) abort(run *scriptRun) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if run.killed || run.timedOut {
+		return
+	}
+	run.aborted = true
+	run.cancel()
+}
+
+// markDirty records that run wrote to the dataset.
+func (e *ScriptEngine) markDirty(run *scriptRun) {
+	e.mu.Lock()
+	run.dirty = true
+	e.mu.Unlock()
+}
+
+// LoadLibrary registers the functions of a library. The library code starts
+// with a "#!lua name=<library>" line and registers its functions with
+// redis.register_function.
+func (e *ScriptEngine) LoadLibrary(code string, replace bool) (string, error) {
+	m := libraryMetadata.FindStringSubmatch(code)
+	if m == nil {
+		return "", fmt.Errorf("ERR Missing library metadata")
+	}
+	lib := &scriptLibrary{
+		name: m[1],
+		code: code,
+	}
+	var err error
+	lib.proto, err = compileScript(lib.name, libraryMetadata.ReplaceAllString(code, "$2"))
+	if err != nil {
+		return "", err
+	}
+	L := newScriptState()
+	defer L.Close()
+	// the code of the library runs under the time limit of the scripts
+	ctx, cancel := context.WithTimeout(context.Background(), e.TimeLimit())
+	defer cancel()
+	L.SetContext(ctx)
+	functions, err := loadLibraryFunctions(L, lib)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("ERR Library code exceeded the execution time limit of %s", e.TimeLimit())
+		}
+		return "", err
+	}
+	if len(functions) == 0 {
+		return "", fmt.Errorf("ERR No functions registered")
+	}
+	for name := range functions {
+		lib.functions = append(lib.functions, name)
+	}
+	sort.Strings(lib.functions)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.libraries[lib.name] != nil && !replace {
+		return "", fmt.Errorf("ERR Library '%s' already exists", lib.name)
+	}
+	for _, name := range lib.functions {
+		if other := e.functions[name]; other != nil && other.name != lib.name {
+			return "", fmt.Errorf("ERR Function %s already exists", name)
+		}
+	}
+	e.deleteLibrary(lib.name)
+	e.libraries[lib.name] = lib
+	for _, name := range lib.functions {
+		e.functions[name] = lib
+	}
+	return lib.name, nil
+}
+
+func (e *ScriptEngine) deleteLibrary(name string) bool {
+	lib := e.libraries[name]
+	if lib == nil {
+		return false
+	}
+	for _, f := range lib.functions {
+		delete(e.functions, f)
+	}
+	delete(e.libraries, name)
+	return true
+}
+
+func (e *ScriptEngine) DeleteLibrary(name string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.deleteLibrary(name)
+}
+
+func (e *ScriptEngine) FlushLibraries() {
+	e.mu.Lock()
+	e.libraries = make(map[string]*scriptLibrary)
+	e.functions = make(map[string]*scriptLibrary)
+	e.mu.Unlock()
+}
+
+// Libraries returns the libraries whose name matches pattern sorted by name.
+func (e *ScriptEngine) Libraries(pattern string) []*scriptLibrary {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var libs []*scriptLibrary
+	for name, lib := range e.libraries {
+		if pattern == "" || strings.Contains(name, pattern) {
+			libs = append(libs, lib)
+		}
+	}
+	sort.Slice(libs, func(i, j int) bool { return libs[i].name < libs[j].name })
+	return libs
+}
+
+// dump returns the sources of the scripts and the code of the libraries,
+// sorted.
+func (e *ScriptEngine) dump() (scripts []string, libraries []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, source := range e.sources {
+		scripts = append(scripts, source)
+	}
+	for _, lib := range e.libraries {
+		libraries = append(libraries, lib.code)
+	}
+	sort.Strings(scripts)
+	sort.Strings(libraries)
+	return scripts, libraries
+}
+
+// restore replaces the scripts and the libraries with the ones dumped.
+func (e *ScriptEngine) restore(scripts []string, libraries []string) error {
+	e.Flush()
+	e.FlushLibraries()
+	for _, script := range scripts {
+		if _, err := e.Load([]byte(script)); err != nil {
+			return err
+		}
+	}
+	for _, code := range libraries {
+		if _, err := e.LoadLibrary(code, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *ScriptEngine) library(function string) *scriptLibrary {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.functions[function]
+}
+
+func (e *ScriptEngine) start(run *scriptRun) {
+	e.mu.Lock()
+	e.running = run
+	e.mu.Unlock()
+}
+
+func (e *ScriptEngine) stop() {
+	e.mu.Lock()
+	e.running = nil
+	e.mu.Unlock()
+}
+
+// newScriptState returns a Lua interpreter without access to the
+// filesystem or the operating system.
+func newScriptState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	openScriptRandom(L)
+	return L
+}
+
+// openScriptRandom replaces math.random and math.randomseed with a generator
+// of the interpreter seeded with 0: a script gets the same numbers on every
+// peer running it.
+func openScriptRandom(L *lua.LState) {
+	rng := rand.New(rand.NewSource(0))
+	math := L.GetGlobal(lua.MathLibName).(*lua.LTable)
+	L.SetField(math, "random", L.NewFunction(func(L *lua.LState) int {
+		switch L.GetTop() {
+		case 0:
+			L.Push(lua.LNumber(rng.Float64()))
+		case 1:
+			n := L.CheckInt(1)
+			if n < 1 {
+				L.ArgError(1, "interval is empty")
+			}
+			L.Push(lua.LNumber(rng.Intn(n) + 1))
+		default:
+			m, n := L.CheckInt(1), L.CheckInt(2)
+			if n < m {
+				L.ArgError(2, "interval is empty")
+			}
+			L.Push(lua.LNumber(m + rng.Intn(n-m+1)))
+		}
+		return 1
+	}))
+	L.SetField(math, "randomseed", L.NewFunction(func(L *lua.LState) int {
+		rng.Seed(L.CheckInt64(1))
+		return 0
+	}))
+}
+
+// loadLibraryFunctions runs the code of a library and returns the functions
+// it registers.
+func loadLibraryFunctions(L *lua.LState, lib *scriptLibrary) (map[string]*lua.LFunction, error) {
+	functions := make(map[string]*lua.LFunction)
+	api := L.NewTable()
+	L.SetField(api, "register_function", L.NewFunction(func(L *lua.LState) int {
+		var (
+			name     string
+			callback *lua.LFunction
+		)
+		switch v := L.CheckAny(1).(type) {
+		case lua.LString:
+			name = string(v)
+			callback = L.CheckFunction(2)
+		case *lua.LTable:
+			name = lua.LVAsString(L.GetField(v, "function_name"))
+			f, ok := L.GetField(v, "callback").(*lua.LFunction)
+			if !ok {
+				L.RaiseError("callback is missing or is not a function")
+			}
+			callback = f
+		default:
+			L.RaiseError("wrong arguments given to redis.register_function")
+		}
+		if name == "" {
+			L.RaiseError("function name is missing")
+		}
+		if functions[name] != nil {
+			L.RaiseError("Function already exists in the library")
+		}
+		functions[name] = callback
+		return 0
+	}))
+	L.SetGlobal("redis", api)
+	L.Push(L.NewFunctionFromProto(lib.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			err = fmt.Errorf("%s", apiErr.Object)
+		}
+		return nil, fmt.Errorf("ERR Error registering functions: %s", err)
+	}
+	return functions, nil
+}
+
+// registerRedisAPI exposes the redis table to the script run by q.
+func (q *Query) registerRedisAPI(L *lua.LState, run *scriptRun) {
+	api, ok := L.GetGlobal("redis").(*lua.LTable)
+	if !ok {
+		api = L.NewTable()
+		L.SetGlobal("redis", api)
+	}
+	L.SetField(api, "call", L.NewFunction(func(L *lua.LState) int {
+		return q.scriptCall(L, run, true)
+	}))
+	L.SetField(api, "pcall", L.NewFunction(func(L *lua.LState) int {
+		return q.scriptCall(L, run, false)
+	}))
+	L.SetField(api, "error_reply", L.NewFunction(func(L *lua.LState) int {
+		t := L.NewTable()
+		L.SetField(t, "err", lua.LString(L.CheckString(1)))
+		L.Push(t)
+		return 1
+	}))
+	L.SetField(api, "status_reply", L.NewFunction(func(L *lua.LState) int {
+		t := L.NewTable()
+		L.SetField(t, "ok", lua.LString(L.CheckString(1)))
+		L.Push(t)
+		return 1
+	}))
+	L.SetField(api, "sha1hex", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(scriptSHA1([]byte(L.CheckString(1)))))
+		return 1
+	}))
+}
+
+// scriptCall runs the command given as arguments of redis.call or
+// redis.pcall. Errors are raised by redis.call and returned as a table with
+// an err field by redis.pcall.
+func (q *Query) scriptCall(L *lua.LState, run *scriptRun, raise bool) int {
+	if L.GetTop() == 0 {
+		L.RaiseError("Please specify at least one argument for this redis lib call")
+	}
+	var words [][]byte
+	for i := 1; i <= L.GetTop(); i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LString, lua.LNumber:
+			words = append(words, []byte(v.String()))
+		default:
+			L.RaiseError("Lua redis lib command arguments must be strings or integers")
+		}
+	}
+	reply := q.scriptExecute(run, words)
+	if e, ok := reply.(errorReply); ok && raise {
+		L.RaiseError("%s", string(e))
+	}
+	L.Push(replyToLua(L, reply))
+	return 1
+}
+
+// scriptExecute runs a command for a script. Write commands replicate their
+// own effects to the WAL and the peers, the script itself never is.
+func (q *Query) scriptExecute(run *scriptRun, words [][]byte) interface{} {
+	verb := strings.ToLower(string(words[0]))
+	if scriptDeniedVerbs[verb] {
+		return errorReply("ERR This Redis command is not allowed from script")
+	}
+	if q.p.consensus != nil && nondeterministic(verb, words) {
+		return errorReply(errScriptNondeterministic.Error())
+	}
+	id, err := uuid.NewUUID()
+	if err != nil {
+		panic(err)
+	}
+	sub := &Query{
+		raw:    formattedArray(words),
+		id:     id.String(),
+		parsed: words,
+		p:      q.p,
+		c:      q.c,
+		script: run,
+		// the calls of the scripts applied from a peer or the log are
+		// applied as well
+		FromPeer: q.FromPeer,
+	}
+	r, err := sub.Execute()
+	if err != nil {
+		return errorReply(err.Error())
+	}
+	if r == nil {
+		return nil
+	}
+	reply, _, err := decodeReply(r.FormattedPayload())
+	if err != nil {
+		return errorReply(fmt.Sprintf("ERR %s", err))
+	}
+	return reply
+}
+
+// nondeterministic reports whether a command called by a script may answer
+// or write differently on every peer.
+func nondeterministic(verb string, words [][]byte) bool {
+	if scriptNondeterministicVerbs[verb] {
+		return true
+	}
+	if verb == "set" {
+		for _, word := range words[1:] {
+			if option := strings.ToLower(string(word)); option == "ex" || option == "px" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func replyToLua(L *lua.LState, reply interface{}) lua.LValue {
+	switch v := reply.(type) {
+	case int64:
+		return lua.LNumber(v)
+	case []byte:
+		return lua.LString(v)
+	case statusReply:
+		t := L.NewTable()
+		L.SetField(t, "ok", lua.LString(v))
+		return t
+	case errorReply:
+		t := L.NewTable()
+		L.SetField(t, "err", lua.LString(v))
+		return t
+	case []interface{}:
+		t := L.NewTable()
+		for _, item := range v {
+			t.Append(replyToLua(L, item))
+		}
+		return t
+	}
+	return lua.LFalse
+}
+
+func luaToReply(L *lua.LState, value lua.LValue) interface{} {
+	switch v := value.(type) {
+	case lua.LNumber:
+		return int64(v)
+	case lua.LString:
+		return []byte(v)
+	case lua.LBool:
+		if v {
+			return int64(1)
+		}
+		return nil
+	case *lua.LTable:
+		if e, ok := L.GetField(v, "err").(lua.LString); ok {
+			return errorReply(e)
+		}
+		if s, ok := L.GetField(v, "ok").(lua.LString); ok {
+			return statusReply(s)
+		}
+		items := []interface{}{}
+		for i := 1; ; i++ {
+			item := v.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			items = append(items, luaToReply(L, item))
+		}
+		return items
+	}
+	return nil
+}
+
+func luaStrings(L *lua.LState, values []string) *lua.LTable {
+	t := L.NewTable()
+	for _, v := range values {
+		t.Append(lua.LString(v))
+	}
+	return t
+}
+
+// runScript calls the function returned by resolve with the given arguments
+// and writes the value it returns to r. resolve runs under the same limits
+// as the function. The script is stopped once the time limit of the engine
+// is reached or when killed by SCRIPT KILL, unless it already wrote to the
+// dataset, and in any case once the hard time limit is reached.
+func (q *Query) runScript(r *Response, L *lua.LState, resolve func() (*lua.LFunction, error), args ...lua.LValue) error {
+	engine := q.p.scripts
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	run := &scriptRun{cancel: cancel}
+	engine.start(run)
+	defer engine.stop()
+	timer := time.AfterFunc(engine.TimeLimit(), func() {
+		engine.expire(run)
+	})
+	defer timer.Stop()
+	hardTimer := time.AfterFunc(engine.HardTimeLimit(), func() {
+		engine.abort(run)
+	})
+	defer hardTimer.Stop()
+	L.SetContext(ctx)
+
+	fn, err := resolve()
+	if err == nil {
+		q.registerRedisAPI(L, run)
+		L.Push(fn)
+		for _, arg := range args {
+			L.Push(arg)
+		}
+		err = L.PCall(len(args), 1, nil)
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			// without the stack trace
+			err = fmt.Errorf("ERR Error running script: %s", apiErr.Object)
+		} else if err != nil {
+			err = fmt.Errorf("ERR Error running script: %s", err)
+		}
+	}
+	if err != nil {
+		engine.mu.Lock()
+		killed, timedOut, aborted := run.killed, run.timedOut, run.aborted
+		engine.mu.Unlock()
+		switch {
+		case killed:
+			return fmt.Errorf("ERR Script killed by user with SCRIPT KILL")
+		case timedOut:
+			return fmt.Errorf("ERR Script exceeded the execution time limit of %s", engine.TimeLimit())
+		case aborted:
+			return fmt.Errorf("ERR Script exceeded the hard execution time limit of %s, the writes it made are kept", engine.HardTimeLimit())
+		}
+		return err
+	}
+	reply := luaToReply(L, L.Get(-1))
+	switch v := reply.(type) {
+	case errorReply:
+		return fmt.Errorf("%s", v)
+	case statusReply:
+		r.PayloadString([]byte(v))
+		r.Type = typeSimpleString
+	default:
+		r.Replies = [][]byte{formattedReply(v)}
+	}
+	return nil
+}
+
+// scriptArgs splits the arguments of EVAL, EVALSHA and FCALL in keys and
+// arguments.
+func scriptArgs(args []string) ([]string, []string, error) {
+	if len(args) < 2 {
+		return nil, nil, fmt.Errorf("wrong number of arguments")
+	}
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("ERR value is not an integer or out of range")
+	}
+	if numKeys < 0 {
+		return nil, nil, fmt.Errorf("ERR Number of keys can't be negative")
+	}
+	if numKeys > len(args)-2 {
+		return nil, nil, fmt.Errorf("ERR Number of keys can't be greater than number of args")
+	}
+	return args[2 : 2+numKeys], args[2+numKeys:], nil
+}
+
+func (q *Query) eval(r *Response, args []string, bySHA bool) error {
+	keys, argv, err := scriptArgs(args)
+	if err != nil {
+		return err
+	}
+	var proto *lua.FunctionProto
+	if bySHA {
+		proto = q.p.scripts.Get(args[0])
+		if proto == nil {
+			return fmt.Errorf("NOSCRIPT No matching script. Please use EVAL.")
+		}
+	} else {
+		sha, err := q.p.scripts.Load(q.parsed[1])
+		if err != nil {
+			return err
+		}
+		proto = q.p.scripts.Get(sha)
+	}
+	L := newScriptState()
+	defer L.Close()
+	L.SetGlobal("KEYS", luaStrings(L, keys))
+	L.SetGlobal("ARGV", luaStrings(L, argv))
+	return q.runScript(r, L, func() (*lua.LFunction, error) {
+		return L.NewFunctionFromProto(proto), nil
+	})
+}
+
+func (q *Query) fcall(r *Response, args []string) error {
+	keys, argv, err := scriptArgs(args)
+	if err != nil {
+		return err
+	}
+	lib := q.p.scripts.library(args[0])
+	if lib == nil {
+		return fmt.Errorf("ERR Function not found")
+	}
+	L := newScriptState()
+	defer L.Close()
+	// the code of the library registering the function runs under the
+	// limits of the function
+	return q.runScript(r, L, func() (*lua.LFunction, error) {
+		functions, err := loadLibraryFunctions(L, lib)
+		if err != nil {
+			return nil, err
+		}
+		fn := functions[args[0]]
+		if fn == nil {
+			return nil, fmt.Errorf("ERR Function not found")
+		}
+		return fn, nil
+	}, luaStrings(L, keys), luaStrings(L, argv))
+}
+
+func (q *Query) scriptLoad(r *Response, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for 'script load' command")
+	}
+	sha, err := q.p.scripts.Load(q.parsed[2])
+	if err != nil {
+		return err
+	}
+	r.PayloadString([]byte(sha))
+	r.Type = typeBulkString
+	return nil
+}
+
+func (q *Query) scriptExists(r *Response, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("wrong number of arguments for 'script exists' command")
+	}
+	var exists []interface{}
+	for _, sha := range args[1:] {
+		if q.p.scripts.Exists(sha) {
+			exists = append(exists, 1)
+		} else {
+			exists = append(exists, 0)
+		}
+	}
+	r.Replies = [][]byte{formattedReply(exists)}
+	return nil
+}
+
+func (q *Query) functionLoad(r *Response, args []string) error {
+	var replace bool
+	if len(args) == 3 && strings.ToLower(args[1]) == "replace" {
+		replace = true
+	} else if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for 'function load' command")
+	}
+	name, err := q.p.scripts.LoadLibrary(string(q.parsed[len(q.parsed)-1]), replace)
+	if err != nil {
+		return err
+	}
+	// libraries are replicated so functions can be called on every peer
+	q.WalWrite()
+	r.PayloadString([]byte(name))
+	r.Type = typeBulkString
+	return nil
+}
+
+func (q *Query) functionDelete(r *Response, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for 'function delete' command")
+	}
+	if !q.p.scripts.DeleteLibrary(args[1]) {
+		return fmt.Errorf("ERR Library not found")
+	}
+	q.WalWrite()
+	r.OK()
+	return nil
+}
+
+func (q *Query) functionList(r *Response, args []string) error {
+	var (
+		pattern  string
+		withCode bool
+	)
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "withcode":
+			withCode = true
+		case "libraryname":
+			if i+1 >= len(args) {
+				return fmt.Errorf("ERR library name argument was not given")
+			}
+			pattern = args[i+1]
+			i++
+		default:
+			return fmt.Errorf("ERR Unknown argument %s", args[i])
+		}
+	}
+	libs := []interface{}{}
+	for _, lib := range q.p.scripts.Libraries(pattern) {
+		functions := []interface{}{}
+		for _, name := range lib.functions {
+			functions = append(functions, []interface{}{"name", name})
+		}
+		item := []interface{}{"library_name", lib.name, "engine", "LUA", "functions", functions}
+		if withCode {
+			item = append(item, "library_code", lib.code)
+		}
+		libs = append(libs, item)
+	}
+	r.Replies = [][]byte{formattedReply(libs)}
+	return nil
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func vqlCommand(words ...string) string {
+	var parsed [][]byte
+	for _, w := range words {
+		parsed = append(parsed, []byte(w))
+	}
+	return string(formattedArray(parsed))
+}
+
+func TestScriptEval(t *testing.T) {
+	client := setup()
+	sha := scriptSHA1([]byte("return redis.call('get', KEYS[1])"))
+	suites := []string{
+		vqlCommand("eval", "return 1", "0"), ":1\r\n",
+		vqlCommand("eval", "return 'foo'", "0"), "$3\r\nfoo\r\n",
+		vqlCommand("eval", "return {1, 'two', {3}, nil, 5}", "0"), "*3\r\n:1\r\n$3\r\ntwo\r\n*1\r\n:3\r\n",
+		vqlCommand("eval", "return {KEYS[1], KEYS[2], ARGV[1]}", "2", "a", "b", "c"), "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n",
+		vqlCommand("eval", "return redis.call('set', KEYS[1], ARGV[1])", "1", "key", "1337"), "+OK\r\n",
+		vqlCommand("eval", "return redis.call('get', KEYS[1])", "1", "key"), "$4\r\n1337\r\n",
+		vqlCommand("eval", "return redis.call('get', 'nokey')", "0"), "$-1\r\n",
+		vqlCommand("eval", "return redis.call('incr', KEYS[1]) + 1", "1", "key"), ":1339\r\n",
+		vqlCommand("eval", "return redis.status_reply('FINE')", "0"), "+FINE\r\n",
+		vqlCommand("eval", "return redis.error_reply('ERR boom')", "0"), "ERR boom",
+		vqlCommand("eval", "return redis.pcall('subscribe', 'foo')['err']", "0"), "$49\r\nERR This Redis command is not allowed from script\r\n",
+		vqlCommand("eval", "return redis.call('unknown')", "0"), "ERR Error running script: user_script:1: ERR unknown command 'unknown'",
+		vqlCommand("eval", "return 1", "2", "a"), "ERR Number of keys can't be greater than number of args",
+		vqlCommand("eval", "return 1", "-1"), "ERR Number of keys can't be negative",
+		vqlCommand("eval", "return (", "0"), "ERR Error compiling script: ",
+		vqlCommand("evalsha", sha, "1", "key"), "$4\r\n1338\r\n",
+		vqlCommand("script", "exists", sha, "0000"), "*2\r\n:1\r\n:0\r\n",
+		vqlCommand("script", "flush"), "+OK\r\n",
+		vqlCommand("evalsha", sha, "1", "key"), "NOSCRIPT No matching script. Please use EVAL.",
+		vqlCommand("script", "load", "return redis.call('get', KEYS[1])"), "$40\r\n" + sha + "\r\n",
+		vqlCommand("evalsha", strings.ToUpper(sha), "1", "key"), "$4\r\n1338\r\n",
+		vqlCommand("script", "kill"), "NOTBUSY No scripts in execution right now.",
+	}
+	for i := 0; i < len(suites); i += 2 {
+		expected := suites[i+1]
+		output := <-executeAsync(client, suites[i])
+		if !strings.HasPrefix(output, expected) || (expected != output && !strings.HasSuffix(expected, ": ")) {
+			t.Errorf("%q: want %q, got %q", suites[i], expected, output)
+		}
+	}
+}
+
+func TestScriptEffectsReplication(t *testing.T) {
+	client := setup()
+	time.Sleep(100 * time.Millisecond)
+	<-executeAsync(client, vqlCommand("eval", "redis.call('set', KEYS[1], 'a'); redis.call('get', KEYS[1]); return redis.call('del', KEYS[1])", "1", "key"))
+	time.Sleep(200 * time.Millisecond)
+	output, err := ioutil.ReadFile(client.vqlTCPServer.Peer.walWriter.WalFile.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "-WAL 0\r\n" + vqlCommand("set", "key", "a") + "\r\n" + vqlCommand("del", "key") + "\r\n"
+	if expected != string(output) {
+		t.Errorf("want %q, got %q", expected, output)
+	}
+}
+
+func TestScriptTimeLimit(t *testing.T) {
+	client := setup()
+	suites := []string{
+		"config set lua-time-limit 100", "+OK\r\n",
+		"config get lua-time-limit", "*2\r\n$14\r\nlua-time-limit\r\n$3\r\n100\r\n",
+		vqlCommand("eval", "while true do end", "0"), "ERR Script exceeded the execution time limit of 100ms",
+		"config set lua-time-limit 0", "ERR Invalid argument '0' for CONFIG SET 'lua-time-limit' - argument must be a positive number of milliseconds",
+	}
+	for i := 0; i < len(suites); i += 2 {
+		expected := suites[i+1]
+		if output := <-executeAsync(client, suites[i]); expected != output {
+			t.Errorf("%q: want %q, got %q", suites[i], expected, output)
+		}
+	}
+}
+
+func TestScriptKill(t *testing.T) {
+	client := setup()
+	done := executeAsync(client, vqlCommand("eval", "while true do end", "0"))
+	time.Sleep(100 * time.Millisecond)
+	// scripts are atomic
+	get := executeAsync(client, "get foo")
+	select {
+	case output := <-get:
+		t.Fatalf("query executed while a script is running: %q", output)
+	case <-time.After(100 * time.Millisecond):
+	}
+	expected := "+OK\r\n"
+	if output := <-executeAsync(client, "script kill"); expected != output {
+		t.Fatalf("want %q, got %q", expected, output)
+	}
+	expected = "ERR Script killed by user with SCRIPT KILL"
+	if output := <-done; expected != output {
+		t.Fatalf("want %q, got %q", expected, output)
+	}
+	<-get
+
+	<-executeAsync(client, "config set lua-time-limit 300")
+	// a script which wrote runs past the time limit until it returns
+	busy := "redis.call('set', 'foo', 'bar')\n" +
+		"local start = redis.call('time')\n" +
+		"repeat\n" +
+		"  local now = redis.call('time')\n" +
+		"until (tonumber(now[1]) - tonumber(start[1])) * 1000000 + tonumber(now[2]) - tonumber(start[2]) > 600000\n" +
+		"return redis.call('get', 'foo')"
+	done = executeAsync(client, vqlCommand("eval", busy, "0"))
+	time.Sleep(100 * time.Millisecond)
+	expected = "UNKILLABLE"
+	if output := <-executeAsync(client, "function kill"); !strings.HasPrefix(output, expected) {
+		t.Fatalf("want %q, got %q", expected, output)
+	}
+	expected = "$3\r\nbar\r\n"
+	if output := <-done; expected != output {
+		t.Fatalf("want %q, got %q", expected, output)
+	}
+
+	// until the hard time limit
+	<-executeAsync(client, "config set lua-hard-time-limit 500")
+	expected = "ERR Script exceeded the hard execution time limit of 500ms, the writes it made are kept"
+	if output := <-executeAsync(client, vqlCommand("eval", "redis.call('set', 'foo', 'baz')\nwhile true do end", "0")); expected != output {
+		t.Fatalf("want %q, got %q", expected, output)
+	}
+	if output := <-executeAsync(client, "get foo"); output != "$3\r\nbaz\r\n" {
+		t.Errorf("want %q, got %q", "$3\r\nbaz\r\n", output)
+	}
+
+	// the code of libraries runs under the time limit
+	expected = "ERR Library code exceeded the execution time limit of 300ms"
+	if output := <-executeAsync(client, vqlCommand("function", "load", "#!lua name=busy\nwhile true do end")); expected != output {
+		t.Errorf("want %q, got %q", expected, output)
+	}
+}
+
+func TestScriptFunctions(t *testing.T) {
+	client := setup()
+	lib := "#!lua name=mylib\n" +
+		"redis.register_function('myset', function(keys, args) return redis.call('set', keys[1], args[1]) end)\n" +
+		"redis.register_function{function_name='myget', callback=function(keys, args) return redis.call('get', keys[1]) end}\n"
+	suites := []string{
+		vqlCommand("function", "load", lib), "$5\r\nmylib\r\n",
+		vqlCommand("function", "load", lib), "ERR Library 'mylib' already exists",
+		vqlCommand("function", "load", "replace", lib), "$5\r\nmylib\r\n",
+		vqlCommand("function", "load", "return 1"), "ERR Missing library metadata",
+		vqlCommand("function", "load", "#!lua name=other\nredis.register_function('myget', function() end)"), "ERR Function myget already exists",
+		vqlCommand("function", "load", "#!lua name=empty\nlocal a = 1"), "ERR No functions registered",
+		vqlCommand("fcall", "myset", "1", "foo", "bar"), "+OK\r\n",
+		vqlCommand("fcall", "myget", "1", "foo"), "$3\r\nbar\r\n",
+		vqlCommand("fcall", "nofunction", "0"), "ERR Function not found",
+		vqlCommand("function", "list"), "*1\r\n*6\r\n$12\r\nlibrary_name\r\n$5\r\nmylib\r\n$6\r\nengine\r\n$3\r\nLUA\r\n$9\r\nfunctions\r\n*2\r\n*2\r\n$4\r\nname\r\n$5\r\nmyget\r\n*2\r\n$4\r\nname\r\n$5\r\nmyset\r\n",
+		vqlCommand("function", "list", "libraryname", "other"), "*0\r\n",
+		vqlCommand("function", "delete", "mylib"), "+OK\r\n",
+		vqlCommand("function", "delete", "mylib"), "ERR Library not found",
+		vqlCommand("fcall", "myget", "1", "foo"), "ERR Function not found",
+	}
+	for i := 0; i < len(suites); i += 2 {
+		expected := suites[i+1]
+		if output := <-executeAsync(client, suites[i]); expected != output {
+			t.Errorf("%q: want %q, got %q", suites[i], expected, output)
+		}
+	}
+}
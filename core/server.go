@@ -1,9 +1,13 @@
 package core
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	tcp "github.com/bjorand/velocidb/tcp"
 )
@@ -17,6 +21,13 @@ type VQLTCPServer struct {
 	ListenAddr string
 	ListenPort int64
 	clients    map[*VQLClient]bool
+	tlsConfig  *tls.Config
+	tcpServer  *tcp.TCPServer
+	// mu guards tcpServer and draining, set once the server stops
+	// executing new queries; inflight counts the queries executing
+	mu       sync.Mutex
+	draining bool
+	inflight sync.WaitGroup
 }
 
 func NewVQLTCPServer(peer *Peer, listenAddr string, listenPort int64) (*VQLTCPServer, error) {
@@ -31,6 +42,13 @@ func NewVQLTCPServer(peer *Peer, listenAddr string, listenPort int64) (*VQLTCPSe
 	return v, nil
 }
 
+func (v *VQLTCPServer) connString() string {
+	if v.tcpServer != nil {
+		return fmt.Sprintf("%s:%d", v.tcpServer.Host, v.tcpServer.Port())
+	}
+	return fmt.Sprintf("%s:%d", v.ListenAddr, v.ListenPort)
+}
+
 func (v *VQLTCPServer) clientNextID() int64 {
 	lock.Lock()
 	defer lock.Unlock()
@@ -43,28 +61,44 @@ func (v *VQLTCPServer) Run() {
 	if err != nil {
 		panic(err)
 	}
+	s.TLSConfig = v.tlsConfig
+	v.mu.Lock()
+	v.tcpServer = s
+	draining := v.draining
+	v.mu.Unlock()
+	if draining {
+		return
+	}
 	s.Run("vql", v.HandleVQLRequest)
 }
 
+// EnableTLS makes clients connect with TLS. With authClients, clients have
+// to present a certificate signed by the CA. It has to be called before
+// Run.
+func (v *VQLTCPServer) EnableTLS(t *tcp.TLS, authClients bool) error {
+	if authClients && t.CAFile == "" {
+		return fmt.Errorf("authenticating clients requires a CA certificate")
+	}
+	v.tlsConfig = t.ServerConfig(authClients)
+	return nil
+}
+
 func (v *VQLTCPServer) HandleVQLRequest(s *tcp.TCPServer, conn net.Conn) {
 	// Make a buffer to hold incoming data.
 	var hasMoreData int
 	var query *Query
-	client := &VQLClient{
-		id:           v.clientNextID(),
-		conn:         conn,
-		vqlTCPServer: v,
-	}
+	client := NewVQLClient(v.clientNextID(), "", conn, v)
 	fmt.Printf("[vql] Serving addr=%s\n", conn.RemoteAddr().String())
 	lock.Lock()
 	v.clients[client] = true
 	lock.Unlock()
 	defer func() {
 		lock.Lock()
-		conn.Close()
+		client.Close()
 		fmt.Printf("[vql] Connection closed addr=%s\n", conn.RemoteAddr().String())
 		delete(v.clients, client)
 		lock.Unlock()
+		v.Peer.pubsub.RemoveClient(client)
 	}()
 	for {
 		buf := make([]byte, 1024)
@@ -87,7 +121,7 @@ func (v *VQLTCPServer) HandleVQLRequest(s *tcp.TCPServer, conn net.Conn) {
 		if hasMoreData == 0 {
 			query, err = v.Peer.ParseRawQuery(client, buf[:reqLen])
 			if err != nil {
-				conn.Write([]byte(fmt.Sprintf("-%s\r\n", err.Error())))
+				client.Write([]byte(fmt.Sprintf("-%s\r\n", err.Error())))
 				continue
 			}
 			hasMoreData = query.hasMoreData
@@ -95,20 +129,64 @@ func (v *VQLTCPServer) HandleVQLRequest(s *tcp.TCPServer, conn net.Conn) {
 				continue
 			}
 		}
+		if !v.startQuery() {
+			client.Write([]byte(fmt.Sprintf("-%s\r\n", errLeaving.Error())))
+			continue
+		}
 		resp, err := query.Execute()
 		if err != nil {
-			conn.Write([]byte(fmt.Sprintf("-%s\r\n", err.Error())))
+			client.Write([]byte(fmt.Sprintf("-%s\r\n", err.Error())))
+			v.inflight.Done()
 			continue
 		}
-		conn.Write(resp.FormattedPayload())
+		client.Write(resp.FormattedPayload())
+		v.inflight.Done()
 		if resp.DisconnectSignal {
 			break
 		}
 	}
 }
 
-func (v *VQLTCPServer) Shutdown() {
+// startQuery counts a query executing, false once the server is draining.
+func (v *VQLTCPServer) startQuery() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.draining {
+		return false
+	}
+	v.inflight.Add(1)
+	return true
+}
 
+// Drain stops accepting clients and executing new queries, waits up to
+// timeout for the queries executing, and closes the client connections.
+func (v *VQLTCPServer) Drain(timeout time.Duration) {
+	v.mu.Lock()
+	v.draining = true
+	s := v.tcpServer
+	v.mu.Unlock()
+	if s != nil {
+		s.Close()
+	}
+	done := make(chan struct{})
+	go func() {
+		v.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		fmt.Println("[vql] Closing the connections with queries in progress")
+	}
+	lock.Lock()
+	for c := range v.clients {
+		c.conn.Close()
+	}
+	lock.Unlock()
+}
+
+func (v *VQLTCPServer) Shutdown() {
+	v.Drain(0)
 	fmt.Println("[vql] shutdown")
 }
 
@@ -145,5 +223,10 @@ func infoServer(peer *Peer) (info []string) {
 func infoVQL(v *VQLTCPServer) (info []string) {
 	info = append(info, "# VQL")
 	info = append(info, fmt.Sprintf("connected_clients:%d", len(v.clients)))
+	channels, _ := v.Peer.pubsub.Channels("")
+	info = append(info, fmt.Sprintf("pubsub_channels:%d", len(channels)))
+	info = append(info, fmt.Sprintf("pubsub_patterns:%d", v.Peer.pubsub.NumPat()))
+	info = append(info, fmt.Sprintf("pubsub_dropped_messages:%d", atomic.LoadInt64(&v.Peer.Stats.PubSubDropped)))
+	info = append(info, fmt.Sprintf("pubsub_client_dropped_messages:%d", atomic.LoadInt64(&v.Peer.Stats.PushDropped)))
 	return info
 }
@@ -0,0 +1,370 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	storagePkg "github.com/bjorand/velocidb/storage"
+)
+
+// PublishVQL only sends the new writes to the peers, a peer joining the
+// mesh misses the writes made before. It requests a full sync from the
+// first peer it links with. The peer answering takes a snapshot of its keyspace
+// and holds the writes to send to the requesting peer from then on, the WAL
+// tail. The snapshot is sent in chunks of SYNC_CHUNK_SIZE keys, at most
+// SYNC_WINDOW chunks waiting to be acknowledged, then the tail is sent and
+// the writes are replicated again as they come.
+//
+// The sync requests carry the failover epoch of the requesting peer, a peer
+// in an older epoch refuses them with STALE.
+//
+// Sync messages are arrays sent in frameSync frames:
+//
+//	FULLSYNC <epoch>                    requests a full sync
+//	STALE <epoch>                       refuses a sync, the peer is in epoch
+//	CHUNK <seq> <key> <version> <expire-at-ms> <type> <value> [...]
+//	ACK <seq>                           acknowledges a chunk
+//	END <keys> <offset>                 ends the snapshot taken at offset
+const (
+	SYNC_CHUNK_SIZE = 100
+	SYNC_WINDOW     = 8
+	// seconds waiting for a chunk to be acknowledged
+	SYNC_ACK_TIMEOUT = 10
+)
+
+const (
+	SYNC_STATE_NONE = iota
+	SYNC_STATE_REQUESTED
+	SYNC_STATE_RECEIVING
+	SYNC_STATE_DONE
+	SYNC_STATE_FAILED
+)
+
+var (
+	SYNC_STATE_TEXT = map[int]string{
+		SYNC_STATE_NONE:      "none",
+		SYNC_STATE_REQUESTED: "requested",
+		SYNC_STATE_RECEIVING: "receiving",
+		SYNC_STATE_DONE:      "done",
+		SYNC_STATE_FAILED:    "failed",
+	}
+)
+
+// fullSync is the state of the full syncs of a link.
+type fullSync struct {
+	mu sync.Mutex
+	// sending is set while a snapshot is sent to the remote peer, the
+	// writes published meanwhile are held in tail
+	sending bool
+	tail    []*Query
+	acks    chan int
+	// state and keys describe the full sync requested from the remote peer
+	state int
+	keys  int
+}
+
+func newFullSync() *fullSync {
+	return &fullSync{acks: make(chan int, SYNC_WINDOW)}
+}
+
+// hold keeps a write published while a snapshot is sent, it returns false
+// when no snapshot is sent.
+func (f *fullSync) hold(q *Query) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.sending {
+		return false
+	}
+	f.tail = append(f.tail, q)
+	return true
+}
+
+func (f *fullSync) setState(state int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state = state
+}
+
+func (f *fullSync) status() (state int, keys int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state, f.keys
+}
+
+func (p *Peer) requestSync(link *Peer, request [][]byte) error {
+	conn, _ := link.session()
+	if conn == nil {
+		return fmt.Errorf("no connection to peer %s", link.connString())
+	}
+	link.fullSync.setState(SYNC_STATE_REQUESTED)
+	request = append(request, []byte(strconv.FormatInt(p.role.Epoch(), 10)))
+	return writeFrame(conn, frameSync, formattedArray(request))
+}
+
+// staleSync refuses with STALE a sync requested from a newer failover epoch:
+// the peer may be a primary replaced since. Requests without epoch are of
+// epoch 0.
+func (p *Peer) staleSync(link *Peer, args []string) bool {
+	var epoch int64
+	if len(args) > 0 {
+		epoch, _ = strconv.ParseInt(args[0], 10, 64)
+	}
+	own := p.role.Epoch()
+	if epoch <= own {
+		return false
+	}
+	fmt.Printf("[peer %s] Sync of failover epoch %d refused, the peer is in epoch %d\n", link.connString(), epoch, own)
+	if conn, _ := link.session(); conn != nil {
+		writeFrame(conn, frameSync, formattedArray([][]byte{[]byte("STALE"), []byte(strconv.FormatInt(own, 10))}))
+	}
+	return true
+}
+
+// handleSync handles the sync messages received from the remote peer of a
+// link.
+func (p *Peer) handleSync(link *Peer, payload []byte) {
+	q, err := p.ParseRawQuery(nil, payload)
+	if err != nil || len(q.parsed) == 0 {
+		fmt.Printf("[peer %s] Invalid sync message\n", link.connString())
+		return
+	}
+	args := []string{}
+	for _, arg := range q.parsed[1:] {
+		args = append(args, string(arg))
+	}
+	switch string(q.parsed[0]) {
+	case "FULLSYNC":
+		if p.staleSync(link, args) {
+			return
+		}
+		go p.serveSync(link)
+	case "PSYNC":
+		if len(args) != 2 && len(args) != 3 {
+			return
+		}
+		offset, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return
+		}
+		if p.staleSync(link, args[2:]) {
+			return
+		}
+		go p.servePartialSync(link, args[0], offset)
+	case "ROLE":
+		id := ""
+		if len(args) > 0 {
+			id = args[0]
+		}
+		link.setRemotePrimaryID(id)
+	case "STALE":
+		link.fullSync.setState(SYNC_STATE_FAILED)
+		fmt.Printf("[peer %s] Sync refused by a peer of an older failover epoch\n", link.connString())
+	case "CONTINUE":
+		if len(args) != 1 {
+			return
+		}
+		link.fullSync.setState(SYNC_STATE_DONE)
+		atomic.AddInt64(&p.Stats.PartialSyncsReceived, 1)
+		fmt.Printf("[peer %s] Partial sync from offset %s\n", link.connString(), args[0])
+	case "REPLACK":
+		if len(args) != 1 {
+			return
+		}
+		offset, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return
+		}
+		atomic.StoreInt64(&link.replAcked, offset)
+	case "CHUNK":
+		if err := p.restoreChunk(link, args); err != nil {
+			fmt.Printf("[peer %s] Invalid sync chunk: %s\n", link.connString(), err)
+			link.fullSync.setState(SYNC_STATE_FAILED)
+		}
+	case "ACK":
+		if len(args) != 1 {
+			return
+		}
+		seq, err := strconv.Atoi(args[0])
+		if err != nil {
+			return
+		}
+		select {
+		case link.fullSync.acks <- seq:
+		default:
+		}
+	case "END":
+		if len(args) == 2 {
+			if offset, err := strconv.ParseInt(args[1], 10, 64); err == nil {
+				p.resetOffset(link.remoteID(), offset)
+			}
+		}
+		f := link.fullSync
+		f.mu.Lock()
+		if f.state == SYNC_STATE_REQUESTED || f.state == SYNC_STATE_RECEIVING {
+			f.state = SYNC_STATE_DONE
+		}
+		keys := f.keys
+		f.mu.Unlock()
+		atomic.AddInt64(&p.Stats.FullSyncsReceived, 1)
+		fmt.Printf("[peer %s] Full sync done: %d keys\n", link.connString(), keys)
+	}
+}
+
+// restoreChunk restores the keys of a chunk and acknowledges it.
+func (p *Peer) restoreChunk(link *Peer, args []string) error {
+	if len(args) == 0 || (len(args)-1)%STORAGE_ITEM_FIELDS != 0 {
+		return fmt.Errorf("wrong number of fields")
+	}
+	items := []storagePkg.Item{}
+	for i := 1; i < len(args); i += STORAGE_ITEM_FIELDS {
+		item, err := decodeStorageItem(args[i : i+STORAGE_ITEM_FIELDS])
+		if err != nil {
+			return err
+		}
+		items = append(items, item)
+	}
+	for _, item := range items {
+		p.storage.Restore(item)
+	}
+	f := link.fullSync
+	f.mu.Lock()
+	f.state = SYNC_STATE_RECEIVING
+	f.keys += len(items)
+	f.mu.Unlock()
+	conn, _ := link.session()
+	if conn == nil {
+		return fmt.Errorf("no connection to peer %s", link.connString())
+	}
+	return writeFrame(conn, frameSync, formattedArray([][]byte{[]byte("ACK"), []byte(args[0])}))
+}
+
+// syncItems returns the snapshot sent to the remote peer of a link: with
+// sharding, the keys of the slots it owns.
+func (p *Peer) syncItems(link *Peer, items []storagePkg.Item) []storagePkg.Item {
+	if p.cluster == nil {
+		return items
+	}
+	id := link.remoteID()
+	owned := []storagePkg.Item{}
+	for _, item := range items {
+		if stringInSlice(id, p.cluster.slotOwners(keySlot(item.Key))) {
+			owned = append(owned, item)
+		}
+	}
+	return owned
+}
+
+// serveSync sends a snapshot of the keyspace to the remote peer of a link,
+// then the writes published meanwhile.
+func (p *Peer) serveSync(link *Peer) {
+	conn, done := link.session()
+	if conn == nil {
+		return
+	}
+	f := link.fullSync
+	// no write is executed while the snapshot is taken: the writes are
+	// either in the snapshot or in the tail
+	p.execLock.Lock()
+	f.mu.Lock()
+	if f.sending {
+		f.mu.Unlock()
+		p.execLock.Unlock()
+		return
+	}
+	f.sending = true
+	f.mu.Unlock()
+	items := p.storage.Dump()
+	offset := p.backlog.Offset()
+	// the snapshot holds the writes hinted for the peer
+	p.hints.drop(link.remoteID())
+	p.execLock.Unlock()
+	defer p.drainSyncTail(link, done)
+
+	items = p.syncItems(link, items)
+	// drop acknowledgments of a previous sync
+	for len(f.acks) > 0 {
+		<-f.acks
+	}
+	acked := -1
+	for seq := 0; seq*SYNC_CHUNK_SIZE < len(items); seq++ {
+		for seq-acked > SYNC_WINDOW {
+			select {
+			case ack := <-f.acks:
+				if ack > acked {
+					acked = ack
+				}
+			case <-done:
+				return
+			case <-time.After(SYNC_ACK_TIMEOUT * time.Second):
+				fmt.Printf("[peer %s] Full sync aborted: chunk %d not acknowledged\n", link.connString(), acked+1)
+				return
+			}
+		}
+		end := (seq + 1) * SYNC_CHUNK_SIZE
+		if end > len(items) {
+			end = len(items)
+		}
+		chunk := [][]byte{[]byte("CHUNK"), []byte(strconv.Itoa(seq))}
+		for _, item := range items[seq*SYNC_CHUNK_SIZE : end] {
+			chunk = append(chunk, encodeStorageItem(item)...)
+		}
+		if err := writeFrame(conn, frameSync, formattedArray(chunk)); err != nil {
+			return
+		}
+	}
+	if err := writeFrame(conn, frameSync, formattedArray([][]byte{[]byte("END"), []byte(strconv.Itoa(len(items))), []byte(strconv.FormatInt(offset, 10))})); err != nil {
+		return
+	}
+	atomic.AddInt64(&p.Stats.FullSyncsServed, 1)
+}
+
+// drainSyncTail sends the writes held while a snapshot was sent, until no
+// write is held anymore.
+func (p *Peer) drainSyncTail(link *Peer, done chan struct{}) {
+	f := link.fullSync
+	for {
+		f.mu.Lock()
+		tail := f.tail
+		f.tail = nil
+		if len(tail) == 0 {
+			f.sending = false
+			f.mu.Unlock()
+			return
+		}
+		f.mu.Unlock()
+		for _, q := range tail {
+			select {
+			case link.broadcastVQLQuery <- q:
+			case <-done:
+			}
+		}
+	}
+}
+
+func infoReplication(p *Peer) (info []string) {
+	info = append(info, "# Replication")
+	info = append(info, infoRole(p)...)
+	info = append(info, infoFailover(p)...)
+	info = append(info, fmt.Sprintf("full_syncs_served:%d", atomic.LoadInt64(&p.Stats.FullSyncsServed)))
+	info = append(info, fmt.Sprintf("full_syncs_received:%d", atomic.LoadInt64(&p.Stats.FullSyncsReceived)))
+	info = append(info, fmt.Sprintf("partial_syncs_served:%d", atomic.LoadInt64(&p.Stats.PartialSyncsServed)))
+	info = append(info, fmt.Sprintf("partial_syncs_received:%d", atomic.LoadInt64(&p.Stats.PartialSyncsReceived)))
+	info = append(info, fmt.Sprintf("relayed_writes:%d", atomic.LoadInt64(&p.Stats.RelayedWrites)))
+	info = append(info, fmt.Sprintf("duplicate_writes:%d", atomic.LoadInt64(&p.Stats.DuplicateWrites)))
+	info = append(info, infoRepair(p)...)
+	info = append(info, infoHints(p)...)
+	info = append(info, infoRegion(p)...)
+	p.backlog.mu.Lock()
+	info = append(info, fmt.Sprintf("repl_offset:%d", p.backlog.offset))
+	info = append(info, fmt.Sprintf("repl_backlog_first_offset:%d", p.backlog.firstOffset()))
+	p.backlog.mu.Unlock()
+	info = append(info, fmt.Sprintf("repl_backlog_size:%d", REPLICATION_BACKLOG_SIZE))
+	for i, link := range p.Mesh.List() {
+		state, keys := link.fullSync.status()
+		info = append(info, fmt.Sprintf("link%d:id=%s,addr=%s,sync_state=%s,sync_keys=%d,%s", i, link.remoteID(), link.connString(), SYNC_STATE_TEXT[state], keys, infoLinkOffsets(p, link)))
+	}
+	return info
+}
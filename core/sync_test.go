@@ -0,0 +1,93 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	storagePkg "github.com/bjorand/velocidb/storage"
+)
+
+func TestFullSyncTail(t *testing.T) {
+	link, _ := NewRemotePeer("127.0.0.1", 1)
+	q1, q2 := NewSimpleQuery("set a 1"), NewSimpleQuery("set a 2")
+	if link.fullSync.hold(q1) {
+		t.Errorf("want %+v, got %+v", false, true)
+	}
+	link.fullSync.sending = true
+	link.fullSync.hold(q1)
+	link.fullSync.hold(q2)
+
+	client := setup()
+	client.vqlTCPServer.Peer.drainSyncTail(link, make(chan struct{}))
+	if output := <-link.broadcastVQLQuery; output != q1 {
+		t.Errorf("want %+v, got %+v", q1, output)
+	}
+	if output := <-link.broadcastVQLQuery; output != q2 {
+		t.Errorf("want %+v, got %+v", q2, output)
+	}
+	if link.fullSync.sending || link.fullSync.hold(q1) {
+		t.Errorf("want the writes replicated again")
+	}
+}
+
+func TestReplicatedIncrApplied(t *testing.T) {
+	client := setup()
+	version := storagePkg.Version{Timestamp: time.Now().UnixNano(), Peer: "remote"}
+	for i := 0; i < 2; i++ {
+		q, _ := client.ParseRawQuery([]byte("incr counter"))
+		q.FromPeer = true
+		q.version = version
+		if _, err := q.Execute(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the same write applied twice, by a full sync and replication
+	if output := string(client.vqlTCPServer.Peer.storage.Get("counter")); output != "1" {
+		t.Errorf("want %+v, got %+v", "1", output)
+	}
+}
+
+func TestFullSync(t *testing.T) {
+	clients := []*VQLClient{setupGossip(), setupGossip()}
+	peers := []*Peer{clients[0].vqlTCPServer.Peer, clients[1].vqlTCPServer.Peer}
+	keys := 2*SYNC_CHUNK_SIZE + 10
+	for i := 0; i < keys; i++ {
+		<-executeAsync(clients[0], fmt.Sprintf("set key%d v%d", i, i))
+	}
+	<-executeAsync(clients[0], "expire key0 100")
+
+	// the peer joining receives the keys written before
+	<-executeAsync(clients[1], fmt.Sprintf("peer connect %s", peers[0].connString()))
+	var info string
+	for i := 0; i < 100; i++ {
+		info = <-executeAsync(clients[1], "info replication")
+		if strings.Contains(info, "sync_state=done") {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	expected := fmt.Sprintf("sync_state=done,sync_keys=%d", keys)
+	if !strings.Contains(info, expected) || !strings.Contains(info, "full_syncs_received:1") {
+		t.Errorf("want %q in %q", expected, info)
+	}
+	if output := len(peers[1].storage.Keys("*")); output != keys {
+		t.Errorf("want %+v, got %+v", keys, output)
+	}
+	if output := <-executeAsync(clients[1], "get key42"); output != "$3\r\nv42\r\n" {
+		t.Errorf("want %q, got %q", "$3\r\nv42\r\n", output)
+	}
+	if output := peers[1].storage.TTL("key0"); output <= 0 {
+		t.Errorf("want a time to live, got %+v", output)
+	}
+
+	// then writes are replicated as they come
+	<-executeAsync(clients[0], "set after sync")
+	for i := 0; i < 50 && peers[1].storage.Get("after") == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if output := string(peers[1].storage.Get("after")); output != "sync" {
+		t.Errorf("want %+v, got %+v", "sync", output)
+	}
+}
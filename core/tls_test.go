@@ -0,0 +1,260 @@
+package core
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tcp "github.com/bjorand/velocidb/tcp"
+	"github.com/google/uuid"
+)
+
+// writeTestCertificates writes a self-signed CA and a certificate it signed
+// to dir.
+func writeTestCertificates(t *testing.T, dir string) *tcp.TLS {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "velocidb test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "velocidb"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{
+		"ca.pem":   {Type: "CERTIFICATE", Bytes: caDer},
+		"cert.pem": {Type: "CERTIFICATE", Bytes: der},
+		"key.pem":  {Type: "EC PRIVATE KEY", Bytes: keyDer},
+	}
+	for name, block := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	certs, err := tcp.NewTLS(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certs
+}
+
+func setupTLS(certs *tcp.TLS) *VQLClient {
+	peer, err := NewPeer("127.0.0.1", 0)
+	if err != nil {
+		panic(err)
+	}
+	if err := peer.EnableTLS(certs); err != nil {
+		panic(err)
+	}
+	go peer.Run()
+	vqlTCPServer, err := NewVQLTCPServer(peer, "127.0.0.1", 0)
+	if err != nil {
+		panic(err)
+	}
+	if err := vqlTCPServer.EnableTLS(certs, true); err != nil {
+		panic(err)
+	}
+	go vqlTCPServer.Run()
+	for i := 0; i < 50 && (peer.tcpServer == nil || peer.tcpServer.Port() == 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return NewVQLClient(1, "test-client-1", nil, vqlTCPServer)
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "velocidb-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certs := writeTestCertificates(t, dir)
+	client1 := setupTLS(certs)
+	client2 := setupTLS(certs)
+
+	// peers over mutual TLS
+	remotePeer, err := client1.vqlTCPServer.Peer.ConnectToPeerAddr(client2.vqlTCPServer.Peer.connString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50 && !remotePeer.Ready(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !remotePeer.Ready() {
+		t.Fatalf("want peer connected over TLS")
+	}
+	<-executeAsync(client1, "set foo bar")
+	expected := "$3\r\nbar\r\n"
+	var output string
+	for i := 0; i < 50; i++ {
+		if output = <-executeAsync(client2, "get foo"); output == expected {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if expected != output {
+		t.Errorf("want %q, got %q", expected, output)
+	}
+
+	// peers cannot be verified without CA
+	if err := client1.vqlTCPServer.Peer.EnableTLS(&tcp.TLS{}); err == nil {
+		t.Errorf("want error for peer TLS without CA")
+	}
+
+	// VQL clients have to present a certificate
+	v := client1.vqlTCPServer
+	for i := 0; i < 50 && (v.tcpServer == nil || v.tcpServer.Port() == 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", v.tcpServer.Port())
+	conn, err := tls.Dial("tcp4", addr, certs.ClientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping\r\n"))
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || reply != "+PONG\r\n" {
+		t.Errorf("want %q, got %q %v", "+PONG\r\n", reply, err)
+	}
+
+	insecure, err := tls.Dial("tcp4", addr, &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		defer insecure.Close()
+		insecure.Write([]byte("ping\r\n"))
+		if _, err = bufio.NewReader(insecure).ReadString('\n'); err == nil {
+			t.Errorf("want error for a VQL client without certificate")
+		}
+	}
+}
+
+func setupSecret(secret string) *Peer {
+	peer, err := NewPeer("127.0.0.1", 0)
+	if err != nil {
+		panic(err)
+	}
+	if secret != "" {
+		if err := peer.EnableSecret(secret); err != nil {
+			panic(err)
+		}
+	}
+	go peer.Run()
+	for i := 0; i < 50 && (peer.tcpServer == nil || peer.tcpServer.Port() == 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return peer
+}
+
+func TestPeerSecret(t *testing.T) {
+	p1 := setupSecret("s3cret")
+
+	// peers sharing the secret link
+	remotePeer, err := setupSecret("s3cret").ConnectToPeerAddr(p1.connString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50 && !remotePeer.Ready(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !remotePeer.Ready() {
+		t.Fatalf("want peers sharing the secret linked")
+	}
+
+	// other peers are refused, whichever side dialed
+	for _, secret := range []string{"other", ""} {
+		other := setupSecret(secret)
+		for _, pair := range [][2]*Peer{{other, p1}, {p1, other}} {
+			dialer, target := pair[0], pair[1]
+			remotePeer, err := dialer.ConnectToPeerAddr(target.connString())
+			if err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(500 * time.Millisecond)
+			if remotePeer.Ready() {
+				t.Errorf("secret %q: want the link refused", secret)
+			}
+			dialer.RemovePeer(remotePeer)
+		}
+	}
+	if err := p1.EnableSecret(""); err == nil {
+		t.Errorf("want error for an empty secret")
+	}
+}
+
+func TestPeerSecretRelay(t *testing.T) {
+	p1, p2 := setupSecret("s3cret"), setupSecret("s3cret")
+	handshake := func(addr string, id string, nonce string) (net.Conn, *peerHello) {
+		conn, err := net.Dial("tcp4", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		h := &peerHello{ID: id, Addr: "127.0.0.1:1", Version: PEER_PROTOCOL_VERSION, Nonce: nonce}
+		if err := writeFrame(conn, frameHello, h.encode()); err != nil {
+			t.Fatal(err)
+		}
+		f, err := readFrame(conn)
+		if err != nil || f.kind != frameHello {
+			t.Fatalf("want HELLO, got %+v %+v", f, err)
+		}
+		hello, err := decodePeerHello(f.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, hello
+	}
+
+	// a peer without the secret dials p1 as p2, and relays to p1 the answer
+	// of p2 to the nonce of p1
+	conn, hello1 := handshake(p1.connString(), p2.ID, "00")
+	defer conn.Close()
+	conn2, hello2 := handshake(p2.connString(), uuid.New().String(), hello1.Nonce)
+	conn2.Close()
+	if err := writeFrame(conn, frameAuth, []byte(hello2.Auth)); err != nil {
+		t.Fatal(err)
+	}
+	f, err := readFrame(conn)
+	if err != nil || f.kind != frameError {
+		t.Errorf("want the relayed answer refused, got %+v %+v", f, err)
+	}
+}
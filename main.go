@@ -11,6 +11,7 @@ import (
 	"syscall"
 
 	"github.com/bjorand/velocidb/core"
+	tcp "github.com/bjorand/velocidb/tcp"
 	utils "github.com/bjorand/velocidb/utils"
 )
 
@@ -22,16 +23,52 @@ const (
 var (
 	cpuprofile       = flag.String("cpuprofile", "", "write cpu profile to file")
 	walDir           = flag.String("wal-dir", "/var/lib/velocidb/wals", "WAL storage directory")
+	hintsDirFlag     = flag.String("hints-dir", "", "Directory of the writes hinted for unreachable peers, kept across restarts (default: a temporary directory)")
 	listenPeerFlag   = flag.String("peer-listen", "", fmt.Sprintf("Peer server listen host:port (default: %s)", defaultListenPeer))
 	listenVQLFlag    = flag.String("vql-listen", "", fmt.Sprintf("VQL server listen host:port (default: %s)", defaultListenVQL))
 	peers            = flag.String("peers", "", "Lisf of peers addr:port,addr1:port")
 	disableVQLServer = flag.Bool("disable-vql-server", false, "Disable VQL server")
+	aclFileFlag      = flag.String("acl-file", "", "ACL file describing the VQL users")
+	tlsCertFile      = flag.String("tls-cert-file", "", "TLS certificate file")
+	tlsKeyFile       = flag.String("tls-key-file", "", "TLS private key file")
+	tlsCACertFile    = flag.String("tls-ca-cert-file", "", "CA certificate file used to verify peers and clients")
+	tlsVQL           = flag.Bool("tls-vql", false, "Enable TLS on the VQL server")
+	tlsPeer          = flag.Bool("tls-peer", false, "Enable mutual TLS between peers")
+	tlsAuthClients   = flag.Bool("tls-auth-clients", false, "Require VQL clients to present a certificate signed by the CA")
+	consistent       = flag.Bool("consistent", false, "Order writes with Raft consensus (consistent mode)")
+	raftBootstrap    = flag.Bool("raft-bootstrap", false, "Bootstrap a new consistent cluster with this peer as first member")
+	sharding         = flag.Bool("sharding", false, "Partition the keyspace among the peers")
+	replication      = flag.Int("replication-factor", core.CLUSTER_REPLICATION_FACTOR, "Number of peers storing each hash slot when sharding")
+	regionFlag       = flag.String("region", "", "Region the peer runs in, writes cross regions through a relay")
+	zoneFlag         = flag.String("zone", "", "Zone of the region the peer runs in")
+	replicaOfFlag    = flag.String("replicaof", "", "Run as a read-only replica of the primary peer at host:port")
+	consulFlag       = flag.Bool("consul", false, "Discover the peers in the Consul catalog")
+	consulAddrFlag   = flag.String("consul-addr", "", "Address of the Consul agent")
+	consulService    = flag.String("consul-service", core.CONSUL_SERVICE, "Consul service the peers register as")
+	discoveryDNS     = flag.String("discovery-dns", "", "Discover the peers in the SRV records of a DNS name, or its addresses with -discovery-dns-port")
+	discoveryDNSPort = flag.Int64("discovery-dns-port", 0, "Peer port of the addresses of -discovery-dns")
+	discoveryFile    = flag.String("discovery-file", "", "Discover the peers listed in a file, one host:port per line")
 )
 
 type Config struct {
 	listenPeer string
 	listenVQL  string
 	peersAddr  []string
+	aclFile    string
+	tlsCert    string
+	tlsKey     string
+	tlsCACert  string
+	region     string
+	zone       string
+	replicaOf  string
+	consulAddr string
+	dnsName    string
+	peersFile  string
+	hintsDir   string
+	// consulToken is only read from CONSUL_HTTP_TOKEN
+	consulToken string
+	// peerSecret is only read from PEER_SECRET
+	peerSecret string
 }
 
 func cleanPeersInput(input string) (peers []string) {
@@ -49,7 +86,7 @@ func (c *Config) SetDefault() {
 
 func (c *Config) FromEnvironment() {
 	for _, env := range os.Environ() {
-		envArray := strings.Split(env, "=")
+		envArray := strings.SplitN(env, "=", 2)
 		envKey := envArray[0]
 		envValue := envArray[1]
 		// breakSwitch:
@@ -60,6 +97,32 @@ func (c *Config) FromEnvironment() {
 			c.listenVQL = envValue
 		case "PEERS":
 			c.peersAddr = cleanPeersInput(envValue)
+		case "ACL_FILE":
+			c.aclFile = envValue
+		case "TLS_CERT_FILE":
+			c.tlsCert = envValue
+		case "TLS_KEY_FILE":
+			c.tlsKey = envValue
+		case "TLS_CA_CERT_FILE":
+			c.tlsCACert = envValue
+		case "REGION":
+			c.region = envValue
+		case "ZONE":
+			c.zone = envValue
+		case "REPLICAOF":
+			c.replicaOf = envValue
+		case "CONSUL_HTTP_ADDR":
+			c.consulAddr = envValue
+		case "CONSUL_HTTP_TOKEN":
+			c.consulToken = envValue
+		case "PEER_SECRET":
+			c.peerSecret = envValue
+		case "DISCOVERY_DNS":
+			c.dnsName = envValue
+		case "DISCOVERY_FILE":
+			c.peersFile = envValue
+		case "HINTS_DIR":
+			c.hintsDir = envValue
 		}
 	}
 }
@@ -74,6 +137,39 @@ func (c *Config) FlagsOverride() {
 	if *peers != "" {
 		c.peersAddr = cleanPeersInput(*peers)
 	}
+	if *aclFileFlag != "" {
+		c.aclFile = *aclFileFlag
+	}
+	if *tlsCertFile != "" {
+		c.tlsCert = *tlsCertFile
+	}
+	if *tlsKeyFile != "" {
+		c.tlsKey = *tlsKeyFile
+	}
+	if *tlsCACertFile != "" {
+		c.tlsCACert = *tlsCACertFile
+	}
+	if *regionFlag != "" {
+		c.region = *regionFlag
+	}
+	if *zoneFlag != "" {
+		c.zone = *zoneFlag
+	}
+	if *replicaOfFlag != "" {
+		c.replicaOf = *replicaOfFlag
+	}
+	if *consulAddrFlag != "" {
+		c.consulAddr = *consulAddrFlag
+	}
+	if *discoveryDNS != "" {
+		c.dnsName = *discoveryDNS
+	}
+	if *discoveryFile != "" {
+		c.peersFile = *discoveryFile
+	}
+	if *hintsDirFlag != "" {
+		c.hintsDir = *hintsDirFlag
+	}
 }
 
 func main() {
@@ -88,7 +184,10 @@ func main() {
 		q := <-signalChan
 		log.Printf("Signal %+v received", q)
 		close(quit)
-		return
+		// a second signal exits without waiting for the peer to leave
+		q = <-signalChan
+		log.Printf("Signal %+v received, exiting", q)
+		os.Exit(1)
 	}()
 
 	if *cpuprofile != "" {
@@ -118,23 +217,89 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	peer.SetLocation(config.region, config.zone)
+	if config.hintsDir != "" {
+		if err := peer.SetHintsDir(config.hintsDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to use the hints directory %s: %s\n", config.hintsDir, err)
+			os.Exit(1)
+		}
+	}
+	if config.aclFile != "" {
+		if err := peer.LoadACLFile(config.aclFile); err != nil {
+			panic(err)
+		}
+	}
+	var certs *tcp.TLS
+	if *tlsVQL || *tlsPeer {
+		certs, err = tcp.NewTLS(config.tlsCert, config.tlsKey, config.tlsCACert)
+		if err != nil {
+			panic(err)
+		}
+		go certs.Watch("tls")
+	}
+	if *tlsPeer {
+		if err := peer.EnableTLS(certs); err != nil {
+			panic(err)
+		}
+	}
+	if config.peerSecret != "" {
+		if err := peer.EnableSecret(config.peerSecret); err != nil {
+			panic(err)
+		}
+	}
+	if config.aclFile != "" && !*tlsPeer && config.peerSecret == "" {
+		fmt.Println("[peer] Warning: the peers are not authenticated, anyone reaching the peer port bypasses the ACL (use -tls-peer or PEER_SECRET)")
+	}
+	if *consistent {
+		peer.EnableConsensus(*raftBootstrap)
+	}
+	if *sharding {
+		peer.EnableSharding(*replication)
+	}
 	go func() {
 		for _, peerAddr := range config.peersAddr {
 			peer.ConnectToPeerAddr(peerAddr)
 		}
+		if config.replicaOf != "" {
+			if err := peer.ReplicaOf(config.replicaOf); err != nil {
+				log.Printf("Unable to replicate %s: %s", config.replicaOf, err)
+			}
+		}
 	}()
 
 	go peer.Run()
-	defer peer.Shutdown()
+	var discovery core.Discovery
+	switch {
+	case *consulFlag:
+		discovery = core.NewConsulDiscovery(config.consulAddr, *consulService, config.consulToken)
+	case config.dnsName != "":
+		discovery = core.NewDNSDiscovery(config.dnsName, *discoveryDNSPort)
+	case config.peersFile != "":
+		discovery = core.NewFileDiscovery(config.peersFile)
+	}
+	if discovery != nil {
+		if err := peer.StartDiscovery(discovery); err != nil {
+			panic(err)
+		}
+	}
 
 	if !*disableVQLServer {
 		v, err := core.NewVQLTCPServer(peer, hostVQL, portVQL)
 		if err != nil {
 			panic(err)
 		}
+		if *tlsVQL {
+			if err := v.EnableTLS(certs, *tlsAuthClients); err != nil {
+				panic(err)
+			}
+		}
 		go v.Run()
-		defer v.Shutdown()
 	}
-	<-quit
+	// a signal makes the peer leave the cluster, PEER LEAVE too
+	select {
+	case <-quit:
+		peer.Leave()
+	case <-peer.Left():
+	}
 	log.Println("Clean shutdown done")
 }
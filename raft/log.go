@@ -0,0 +1,108 @@
+package raft
+
+// raftLog holds the entries following the last snapshot.
+type raftLog struct {
+	snapshotIndex uint64
+	snapshotTerm  uint64
+	entries       []Entry
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return l.snapshotIndex + uint64(len(l.entries))
+}
+
+func (l *raftLog) lastTerm() uint64 {
+	if len(l.entries) == 0 {
+		return l.snapshotTerm
+	}
+	return l.entries[len(l.entries)-1].Term
+}
+
+// term returns the term of the entry at index. It is not known for the
+// entries compacted in the snapshot or following the last one.
+func (l *raftLog) term(index uint64) (uint64, bool) {
+	if index == l.snapshotIndex {
+		return l.snapshotTerm, true
+	}
+	if index < l.snapshotIndex || index > l.lastIndex() {
+		return 0, false
+	}
+	return l.entries[index-l.snapshotIndex-1].Term, true
+}
+
+func (l *raftLog) entry(index uint64) *Entry {
+	if index <= l.snapshotIndex || index > l.lastIndex() {
+		return nil
+	}
+	return &l.entries[index-l.snapshotIndex-1]
+}
+
+// slice returns up to max entries from index.
+func (l *raftLog) slice(index uint64, max int) []Entry {
+	if index <= l.snapshotIndex || index > l.lastIndex() {
+		return nil
+	}
+	entries := l.entries[index-l.snapshotIndex-1:]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	return append([]Entry{}, entries...)
+}
+
+func (l *raftLog) append(entries ...Entry) {
+	l.entries = append(l.entries, entries...)
+}
+
+// merge appends the entries received from the leader. Entries conflicting
+// with them are removed with all the entries following them. It returns
+// whether the log changed.
+func (l *raftLog) merge(entries []Entry) bool {
+	for i, e := range entries {
+		if e.Index <= l.snapshotIndex {
+			continue
+		}
+		t, ok := l.term(e.Index)
+		if ok && t == e.Term {
+			continue
+		}
+		if ok {
+			l.entries = l.entries[:e.Index-l.snapshotIndex-1]
+		}
+		l.append(entries[i:]...)
+		return true
+	}
+	return false
+}
+
+// compact removes the entries up to index, included in a snapshot.
+func (l *raftLog) compact(index uint64, term uint64) {
+	if index <= l.snapshotIndex {
+		return
+	}
+	if index >= l.lastIndex() {
+		l.entries = nil
+	} else {
+		l.entries = append([]Entry{}, l.entries[index-l.snapshotIndex:]...)
+	}
+	l.snapshotIndex = index
+	l.snapshotTerm = term
+}
+
+// restore resets the log to a snapshot received from the leader. The
+// entries following the snapshot are kept when the log contains its last
+// entry.
+func (l *raftLog) restore(index uint64, term uint64) {
+	if t, ok := l.term(index); ok && t == term {
+		l.compact(index, term)
+		return
+	}
+	l.entries = nil
+	l.snapshotIndex = index
+	l.snapshotTerm = term
+}
+
+// isUpToDate reports whether a log ending with the given entry is at least
+// as up-to-date as this one.
+func (l *raftLog) isUpToDate(lastIndex uint64, lastTerm uint64) bool {
+	return lastTerm > l.lastTerm() || lastTerm == l.lastTerm() && lastIndex >= l.lastIndex()
+}
@@ -0,0 +1,79 @@
+package raft
+
+import (
+	"fmt"
+	"testing"
+)
+
+func logTerms(l *raftLog) string {
+	terms := []uint64{}
+	for i := l.snapshotIndex + 1; i <= l.lastIndex(); i++ {
+		t, _ := l.term(i)
+		terms = append(terms, t)
+	}
+	return fmt.Sprintf("%d:%v", l.snapshotIndex, terms)
+}
+
+func TestLog(t *testing.T) {
+	l := &raftLog{}
+	l.append(Entry{Term: 1, Index: 1}, Entry{Term: 1, Index: 2}, Entry{Term: 2, Index: 3})
+	if output := l.lastIndex(); output != 3 {
+		t.Errorf("want %+v, got %+v", 3, output)
+	}
+
+	// matching entries are kept
+	if output := l.merge([]Entry{{Term: 1, Index: 2}, {Term: 2, Index: 3}}); output {
+		t.Errorf("want %+v, got %+v", false, output)
+	}
+	// a conflict removes the entries following it
+	if output := l.merge([]Entry{{Term: 3, Index: 3}, {Term: 3, Index: 4}}); !output {
+		t.Errorf("want %+v, got %+v", true, output)
+	}
+	expected := "0:[1 1 3 3]"
+	if output := logTerms(l); expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+
+	if output := len(l.slice(2, 2)); output != 2 {
+		t.Errorf("want %+v, got %+v", 2, output)
+	}
+
+	l.compact(2, 1)
+	expected = "2:[3 3]"
+	if output := logTerms(l); expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+	if _, ok := l.term(1); ok {
+		t.Errorf("want compacted term unknown")
+	}
+	if output := l.entry(2); output != nil {
+		t.Errorf("want %+v, got %+v", nil, output)
+	}
+
+	// a snapshot matching the log keeps the following entries
+	l.restore(3, 3)
+	expected = "3:[3]"
+	if output := logTerms(l); expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+	l.restore(10, 4)
+	expected = "10:[]"
+	if output := logTerms(l); expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+
+	suites := []struct {
+		index, term uint64
+		expected    bool
+	}{
+		{10, 4, true},
+		{9, 4, false},
+		{1, 5, true},
+		{20, 3, false},
+	}
+	for _, s := range suites {
+		if output := l.isUpToDate(s.index, s.term); s.expected != output {
+			t.Errorf("%d/%d: want %+v, got %+v", s.index, s.term, s.expected, output)
+		}
+	}
+}
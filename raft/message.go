@@ -0,0 +1,87 @@
+package raft
+
+import (
+	"encoding/json"
+)
+
+type EntryType int
+
+const (
+	// EntryCommand holds data applied to the state machine
+	EntryCommand EntryType = iota
+	// EntryConfig holds the members of the cluster
+	EntryConfig
+	// EntryNoop is appended by a new leader to commit the entries of the
+	// previous terms
+	EntryNoop
+)
+
+type Entry struct {
+	Term  uint64
+	Index uint64
+	Type  EntryType
+	Data  []byte
+}
+
+type MessageType int
+
+const (
+	MsgVote MessageType = iota
+	MsgVoteResp
+	MsgAppend
+	MsgAppendResp
+	MsgSnapshot
+	// MsgProp forwards proposals of a follower to the leader
+	MsgProp
+)
+
+// Snapshot is the state of the state machine once the entries up to Index
+// are applied.
+type Snapshot struct {
+	Index   uint64
+	Term    uint64
+	Members []string
+	Data    []byte
+}
+
+// Message is exchanged between the nodes. Fields are used depending on the
+// message type.
+type Message struct {
+	Type MessageType
+	From string
+	To   string
+	Term uint64
+
+	// MsgVote: last entry of the candidate
+	LastLogIndex uint64
+	LastLogTerm  uint64
+	// MsgVoteResp
+	Granted bool
+
+	// MsgAppend: entries following PrevLogIndex, MsgProp: proposed entries
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	Commit       uint64
+	// MsgAppendResp: MatchIndex is the last entry matching the leader log
+	// on success, a hint of where the logs may match on failure
+	Success    bool
+	MatchIndex uint64
+
+	// MsgSnapshot
+	Snapshot *Snapshot
+
+	// MsgAppend, MsgSnapshot: round of the last read started by the leader,
+	// echoed by MsgAppendResp
+	ReadRound uint64
+}
+
+func EncodeMessage(msg Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func DecodeMessage(data []byte) (Message, error) {
+	var msg Message
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
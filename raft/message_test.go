@@ -0,0 +1,45 @@
+package raft
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMessage(t *testing.T) {
+	msg := Message{
+		Type:         MsgAppend,
+		From:         "a",
+		To:           "b",
+		Term:         3,
+		PrevLogIndex: 4,
+		PrevLogTerm:  2,
+		Entries:      []Entry{{Term: 3, Index: 5, Type: EntryCommand, Data: []byte("set foo bar")}},
+		Commit:       4,
+		Snapshot:     &Snapshot{Index: 2, Term: 1, Members: []string{"a", "b"}, Data: []byte("{}")},
+	}
+	data, err := EncodeMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Snapshot == nil {
+		t.Fatalf("want snapshot")
+	}
+	snapshot := *decoded.Snapshot
+	msg.Snapshot, decoded.Snapshot = nil, nil
+	expected := fmt.Sprintf("%+v", msg)
+	if output := fmt.Sprintf("%+v", decoded); expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+	expected = "{Index:2 Term:1 Members:[a b] Data:[123 125]}"
+	if output := fmt.Sprintf("%+v", snapshot); expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+
+	if _, err := DecodeMessage([]byte("garbage")); err == nil {
+		t.Errorf("want error")
+	}
+}
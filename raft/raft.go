@@ -0,0 +1,695 @@
+// Package raft implements the Raft consensus algorithm: leader election,
+// log replication, membership changes one member at a time, snapshots and
+// linearizable reads with a read index.
+//
+// A Node is driven by its caller: Tick is called at a regular interval to
+// time elections and heartbeats, Step with every message received from the
+// other nodes. Messages are sent with a Transport. The state of a node is
+// kept in memory only.
+package raft
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+const (
+	// ticks without heartbeat before a follower starts an election, the
+	// timeout of each election is randomized between ELECTION_TICKS and
+	// twice ELECTION_TICKS
+	ELECTION_TICKS = 10
+	// ticks between two heartbeats of the leader
+	HEARTBEAT_TICKS = 1
+	// applied entries kept in the log before it is compacted in a snapshot
+	SNAPSHOT_THRESHOLD = 1024
+	// maximum number of entries sent in a MsgAppend
+	MAX_APPEND_ENTRIES = 64
+)
+
+var (
+	STATE_TEXT = map[State]string{
+		Follower:  "follower",
+		Candidate: "candidate",
+		Leader:    "leader",
+	}
+
+	ErrNoLeader            = fmt.Errorf("no leader elected")
+	ErrNotLeader           = fmt.Errorf("not the leader")
+	ErrConfigChangePending = fmt.Errorf("a membership change is in progress")
+	ErrLeaderNotReady      = fmt.Errorf("the leader did not commit an entry of its term yet")
+)
+
+func (s State) String() string {
+	return STATE_TEXT[s]
+}
+
+// FSM is the state machine the committed entries are applied to. It is
+// called with the node locked and must not call the node.
+type FSM interface {
+	Apply(entry Entry)
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
+
+// Transport sends messages to the other nodes. Messages may be lost.
+type Transport interface {
+	Send(msg Message)
+}
+
+type Config struct {
+	ID string
+	// Members of a new cluster. A node joining an existing cluster starts
+	// without members and waits to be added by the leader.
+	Members           []string
+	ElectionTicks     int
+	HeartbeatTicks    int
+	SnapshotThreshold uint64
+	// Seed of the randomized election timeouts
+	Seed int64
+}
+
+type Status struct {
+	ID            string
+	State         State
+	Term          uint64
+	Leader        string
+	CommitIndex   uint64
+	AppliedIndex  uint64
+	LastIndex     uint64
+	SnapshotIndex uint64
+	Members       []string
+}
+
+// ReadState is a read started by ReadIndex on the leader: it is served once
+// the state machine applied the entries up to Index and ReadConfirmed
+// reported the leadership of the node confirmed.
+type ReadState struct {
+	Index uint64
+	Term  uint64
+	Round uint64
+}
+
+type Node struct {
+	mu        sync.Mutex
+	config    Config
+	fsm       FSM
+	transport Transport
+	rand      *rand.Rand
+
+	state       State
+	term        uint64
+	votedFor    string
+	leader      string
+	log         raftLog
+	commitIndex uint64
+	applied     uint64
+	// members is the latest configuration of the log, committed or not
+	members []string
+	// snapshot is the last snapshot taken or received
+	snapshot *Snapshot
+
+	votes      map[string]bool
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	// readRound is the round of the last read started, readAcks the last
+	// round each member acknowledged
+	readRound uint64
+	readAcks  map[string]uint64
+
+	electionElapsed  int
+	heartbeatElapsed int
+	electionTimeout  int
+}
+
+func NewNode(config Config, fsm FSM, transport Transport) *Node {
+	if config.ElectionTicks == 0 {
+		config.ElectionTicks = ELECTION_TICKS
+	}
+	if config.HeartbeatTicks == 0 {
+		config.HeartbeatTicks = HEARTBEAT_TICKS
+	}
+	if config.SnapshotThreshold == 0 {
+		config.SnapshotThreshold = SNAPSHOT_THRESHOLD
+	}
+	n := &Node{
+		config:    config,
+		fsm:       fsm,
+		transport: transport,
+		rand:      rand.New(rand.NewSource(config.Seed)),
+		snapshot:  &Snapshot{Members: config.Members},
+	}
+	n.members = sortedMembers(config.Members)
+	n.becomeFollower(0, "")
+	return n
+}
+
+func sortedMembers(members []string) []string {
+	sorted := append([]string{}, members...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+func encodeMembers(members []string) []byte {
+	return []byte(strings.Join(members, ","))
+}
+
+func decodeMembers(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(string(data), ",")
+}
+
+func (n *Node) ID() string {
+	return n.config.ID
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:            n.config.ID,
+		State:         n.state,
+		Term:          n.term,
+		Leader:        n.leader,
+		CommitIndex:   n.commitIndex,
+		AppliedIndex:  n.applied,
+		LastIndex:     n.log.lastIndex(),
+		SnapshotIndex: n.log.snapshotIndex,
+		Members:       append([]string{}, n.members...),
+	}
+}
+
+func (n *Node) isMember(id string) bool {
+	for _, m := range n.members {
+		if m == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) quorum() int {
+	return len(n.members)/2 + 1
+}
+
+func (n *Node) send(msg Message) {
+	msg.From = n.config.ID
+	if msg.Term == 0 {
+		msg.Term = n.term
+	}
+	n.transport.Send(msg)
+}
+
+func (n *Node) resetElectionTimeout() {
+	n.electionElapsed = 0
+	n.electionTimeout = n.config.ElectionTicks + n.rand.Intn(n.config.ElectionTicks)
+}
+
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+	}
+	n.state = Follower
+	n.leader = leader
+	n.resetElectionTimeout()
+}
+
+func (n *Node) becomeLeader() {
+	n.state = Leader
+	n.leader = n.config.ID
+	n.heartbeatElapsed = 0
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.readAcks = make(map[string]uint64)
+	for _, m := range n.members {
+		n.nextIndex[m] = n.log.lastIndex() + 1
+		n.matchIndex[m] = 0
+	}
+	// entries of previous terms are committed with an entry of the new term
+	n.appendEntries(Entry{Type: EntryNoop})
+}
+
+func (n *Node) campaign() {
+	n.state = Candidate
+	n.term++
+	n.votedFor = n.config.ID
+	n.leader = ""
+	n.votes = map[string]bool{n.config.ID: true}
+	n.resetElectionTimeout()
+	if n.quorum() <= 1 {
+		n.becomeLeader()
+		return
+	}
+	for _, m := range n.members {
+		if m == n.config.ID {
+			continue
+		}
+		n.send(Message{
+			Type:         MsgVote,
+			To:           m,
+			LastLogIndex: n.log.lastIndex(),
+			LastLogTerm:  n.log.lastTerm(),
+		})
+	}
+}
+
+// Tick advances the election and heartbeat timers.
+func (n *Node) Tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state == Leader {
+		n.heartbeatElapsed++
+		if n.heartbeatElapsed >= n.config.HeartbeatTicks {
+			n.heartbeatElapsed = 0
+			n.broadcastAppend()
+		}
+		return
+	}
+	n.electionElapsed++
+	// nodes which are not members never start an election
+	if n.electionElapsed >= n.electionTimeout && n.isMember(n.config.ID) {
+		n.campaign()
+	}
+}
+
+// Propose appends data to the log of the leader. Followers forward the
+// proposal to the leader. Proposals may be lost, callers find out when the
+// data is applied.
+func (n *Node) Propose(data []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	entry := Entry{Type: EntryCommand, Data: data}
+	switch {
+	case n.state == Leader:
+		n.appendEntries(entry)
+	case n.leader != "":
+		n.send(Message{Type: MsgProp, To: n.leader, Entries: []Entry{entry}})
+	default:
+		return ErrNoLeader
+	}
+	return nil
+}
+
+// ReadIndex starts a read on the leader. The read sees every entry committed
+// before it once the state machine applied the entries up to the index of
+// the read, and once the members confirmed that the node still leads them:
+// a heartbeat carrying the round of the read is sent at once.
+func (n *Node) ReadIndex() (ReadState, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state != Leader {
+		return ReadState{}, ErrNotLeader
+	}
+	// the commit index of the previous leader is known once an entry of the
+	// term is committed
+	if t, _ := n.log.term(n.commitIndex); t != n.term {
+		return ReadState{}, ErrLeaderNotReady
+	}
+	n.readRound++
+	n.broadcastAppend()
+	return ReadState{Index: n.commitIndex, Term: n.term, Round: n.readRound}, nil
+}
+
+// ReadConfirmed reports whether a majority of the members acknowledged the
+// leadership of the node since the read started, and whether the state
+// machine applied the entries the read has to see. It returns ErrNotLeader
+// once the node lost the leadership.
+func (n *Node) ReadConfirmed(read ReadState) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state != Leader || n.term != read.Term {
+		return false, ErrNotLeader
+	}
+	count := 0
+	for _, m := range n.members {
+		if m == n.config.ID || n.readAcks[m] >= read.Round {
+			count++
+		}
+	}
+	return count >= n.quorum() && n.applied >= read.Index, nil
+}
+
+// AddMember adds a node to the cluster. Only the leader changes the
+// members, one at a time.
+func (n *Node) AddMember(id string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isMember(id) {
+		return nil
+	}
+	return n.changeMembers(append(append([]string{}, n.members...), id))
+}
+
+// RemoveMember removes a node from the cluster. A leader removing itself
+// steps down once the change is committed.
+func (n *Node) RemoveMember(id string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.isMember(id) {
+		return nil
+	}
+	members := []string{}
+	for _, m := range n.members {
+		if m != id {
+			members = append(members, m)
+		}
+	}
+	return n.changeMembers(members)
+}
+
+func (n *Node) changeMembers(members []string) error {
+	if n.state != Leader {
+		return ErrNotLeader
+	}
+	for i := n.commitIndex + 1; i <= n.log.lastIndex(); i++ {
+		if e := n.log.entry(i); e != nil && e.Type == EntryConfig {
+			return ErrConfigChangePending
+		}
+	}
+	n.appendEntries(Entry{Type: EntryConfig, Data: encodeMembers(sortedMembers(members))})
+	return nil
+}
+
+// appendEntries appends entries to the log of the leader and replicates
+// them.
+func (n *Node) appendEntries(entries ...Entry) {
+	for i := range entries {
+		entries[i].Term = n.term
+		entries[i].Index = n.log.lastIndex() + 1
+		n.log.append(entries[i])
+		if entries[i].Type == EntryConfig {
+			n.refreshMembers()
+		}
+	}
+	n.maybeCommit()
+	n.broadcastAppend()
+}
+
+// refreshMembers sets the members from the latest configuration of the
+// log: a configuration is used as soon as it is in the log.
+func (n *Node) refreshMembers() {
+	n.members = n.membersAt(n.log.lastIndex())
+	if n.state != Leader {
+		return
+	}
+	for _, m := range n.members {
+		if _, ok := n.nextIndex[m]; !ok {
+			n.nextIndex[m] = n.log.lastIndex() + 1
+			n.matchIndex[m] = 0
+		}
+	}
+}
+
+// membersAt returns the configuration in use at index.
+func (n *Node) membersAt(index uint64) []string {
+	for i := index; i > n.log.snapshotIndex; i-- {
+		if e := n.log.entry(i); e != nil && e.Type == EntryConfig {
+			return decodeMembers(e.Data)
+		}
+	}
+	return sortedMembers(n.snapshot.Members)
+}
+
+func (n *Node) broadcastAppend() {
+	for _, m := range n.members {
+		if m != n.config.ID {
+			n.sendAppend(m)
+		}
+	}
+}
+
+func (n *Node) sendAppend(to string) {
+	next := n.nextIndex[to]
+	if next == 0 {
+		next = 1
+	}
+	if next <= n.log.snapshotIndex {
+		n.send(Message{Type: MsgSnapshot, To: to, Snapshot: n.snapshot, ReadRound: n.readRound})
+		return
+	}
+	prevTerm, _ := n.log.term(next - 1)
+	n.send(Message{
+		Type:         MsgAppend,
+		To:           to,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  prevTerm,
+		Entries:      n.log.slice(next, MAX_APPEND_ENTRIES),
+		Commit:       n.commitIndex,
+		ReadRound:    n.readRound,
+	})
+}
+
+// maybeCommit commits the last entry of the current term replicated on a
+// majority of the members.
+func (n *Node) maybeCommit() {
+	for index := n.log.lastIndex(); index > n.commitIndex; index-- {
+		if t, _ := n.log.term(index); t != n.term {
+			return
+		}
+		count := 0
+		for _, m := range n.members {
+			if m == n.config.ID || n.matchIndex[m] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.apply()
+			if n.state == Leader {
+				n.broadcastAppend()
+			}
+			return
+		}
+	}
+}
+
+// apply applies the committed entries to the state machine.
+func (n *Node) apply() {
+	for n.applied < n.commitIndex {
+		n.applied++
+		e := n.log.entry(n.applied)
+		if e == nil {
+			continue
+		}
+		switch e.Type {
+		case EntryCommand:
+			n.fsm.Apply(*e)
+		case EntryConfig:
+			if n.state == Leader && !n.isMember(n.config.ID) {
+				// the leader removed itself
+				n.becomeFollower(n.term, "")
+			}
+		}
+	}
+	n.maybeSnapshot()
+}
+
+func (n *Node) maybeSnapshot() {
+	if n.applied-n.log.snapshotIndex < n.config.SnapshotThreshold {
+		return
+	}
+	data, err := n.fsm.Snapshot()
+	if err != nil {
+		return
+	}
+	term, _ := n.log.term(n.applied)
+	n.snapshot = &Snapshot{
+		Index:   n.applied,
+		Term:    term,
+		Members: n.membersAt(n.applied),
+		Data:    data,
+	}
+	n.log.compact(n.applied, term)
+}
+
+// Step processes a message received from another node.
+func (n *Node) Step(msg Message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if msg.Type == MsgProp {
+		if n.state == Leader {
+			n.appendEntries(msg.Entries...)
+		} else if n.leader != "" && n.leader != msg.From {
+			n.send(Message{Type: MsgProp, To: n.leader, Entries: msg.Entries})
+		}
+		return
+	}
+	if msg.Term > n.term {
+		if msg.Type == MsgVote && n.leader != "" && n.electionElapsed < n.config.ElectionTicks {
+			// a leader is alive: ignore nodes removed from the cluster
+			// or isolated which could disrupt it
+			return
+		}
+		leader := ""
+		if msg.Type == MsgAppend || msg.Type == MsgSnapshot {
+			leader = msg.From
+		}
+		n.becomeFollower(msg.Term, leader)
+	}
+	if msg.Term < n.term {
+		switch msg.Type {
+		case MsgVote:
+			n.send(Message{Type: MsgVoteResp, To: msg.From})
+		case MsgAppend, MsgSnapshot:
+			// let the stale leader step down
+			n.send(Message{Type: MsgAppendResp, To: msg.From})
+		}
+		return
+	}
+	switch msg.Type {
+	case MsgVote:
+		n.handleVote(msg)
+	case MsgVoteResp:
+		n.handleVoteResp(msg)
+	case MsgAppend:
+		n.handleAppend(msg)
+	case MsgSnapshot:
+		n.handleSnapshot(msg)
+	case MsgAppendResp:
+		n.handleAppendResp(msg)
+	}
+}
+
+func (n *Node) handleVote(msg Message) {
+	granted := (n.votedFor == "" || n.votedFor == msg.From) &&
+		n.leader == "" &&
+		n.log.isUpToDate(msg.LastLogIndex, msg.LastLogTerm)
+	if granted {
+		n.votedFor = msg.From
+		n.resetElectionTimeout()
+	}
+	n.send(Message{Type: MsgVoteResp, To: msg.From, Granted: granted})
+}
+
+func (n *Node) handleVoteResp(msg Message) {
+	if n.state != Candidate {
+		return
+	}
+	n.votes[msg.From] = msg.Granted
+	granted, rejected := 0, 0
+	for _, m := range n.members {
+		if v, ok := n.votes[m]; ok && v {
+			granted++
+		} else if ok {
+			rejected++
+		}
+	}
+	switch {
+	case granted >= n.quorum():
+		n.becomeLeader()
+	case rejected >= n.quorum():
+		n.becomeFollower(n.term, "")
+	}
+}
+
+func (n *Node) handleAppend(msg Message) {
+	if n.state != Follower || n.leader != msg.From {
+		n.becomeFollower(n.term, msg.From)
+	}
+	n.electionElapsed = 0
+	prev := msg.PrevLogIndex
+	entries := msg.Entries
+	if prev < n.log.snapshotIndex {
+		// entries up to the snapshot are committed and match
+		for len(entries) > 0 && entries[0].Index <= n.log.snapshotIndex {
+			entries = entries[1:]
+		}
+		prev = n.log.snapshotIndex
+		msg.PrevLogTerm = n.log.snapshotTerm
+	}
+	if t, ok := n.log.term(prev); !ok || t != msg.PrevLogTerm {
+		hint := n.log.lastIndex()
+		if prev <= hint {
+			hint = prev - 1
+		}
+		n.send(Message{Type: MsgAppendResp, To: msg.From, MatchIndex: hint, ReadRound: msg.ReadRound})
+		return
+	}
+	if n.log.merge(entries) {
+		n.members = n.membersAt(n.log.lastIndex())
+	}
+	lastNew := prev + uint64(len(entries))
+	if msg.Commit > n.commitIndex {
+		commit := msg.Commit
+		if commit > lastNew {
+			commit = lastNew
+		}
+		if commit > n.commitIndex {
+			n.commitIndex = commit
+			n.apply()
+		}
+	}
+	n.send(Message{Type: MsgAppendResp, To: msg.From, Success: true, MatchIndex: lastNew, ReadRound: msg.ReadRound})
+}
+
+func (n *Node) handleSnapshot(msg Message) {
+	if n.state != Follower || n.leader != msg.From {
+		n.becomeFollower(n.term, msg.From)
+	}
+	n.electionElapsed = 0
+	snap := msg.Snapshot
+	if snap == nil {
+		return
+	}
+	if snap.Index <= n.commitIndex {
+		n.send(Message{Type: MsgAppendResp, To: msg.From, Success: true, MatchIndex: n.commitIndex, ReadRound: msg.ReadRound})
+		return
+	}
+	if err := n.fsm.Restore(snap.Data); err != nil {
+		return
+	}
+	n.log.restore(snap.Index, snap.Term)
+	n.snapshot = snap
+	n.commitIndex = snap.Index
+	n.applied = snap.Index
+	n.members = n.membersAt(n.log.lastIndex())
+	n.send(Message{Type: MsgAppendResp, To: msg.From, Success: true, MatchIndex: snap.Index, ReadRound: msg.ReadRound})
+}
+
+func (n *Node) handleAppendResp(msg Message) {
+	if n.state != Leader {
+		return
+	}
+	if _, ok := n.nextIndex[msg.From]; !ok {
+		return
+	}
+	// the member follows the node in its term
+	if msg.ReadRound > n.readAcks[msg.From] {
+		n.readAcks[msg.From] = msg.ReadRound
+	}
+	if !msg.Success {
+		next := n.nextIndex[msg.From] - 1
+		if msg.MatchIndex+1 < next {
+			next = msg.MatchIndex + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.nextIndex[msg.From] = next
+		n.sendAppend(msg.From)
+		return
+	}
+	if msg.MatchIndex > n.matchIndex[msg.From] {
+		n.matchIndex[msg.From] = msg.MatchIndex
+	}
+	if msg.MatchIndex+1 > n.nextIndex[msg.From] {
+		n.nextIndex[msg.From] = msg.MatchIndex + 1
+	}
+	n.maybeCommit()
+	if n.nextIndex[msg.From] <= n.log.lastIndex() {
+		n.sendAppend(msg.From)
+	}
+}
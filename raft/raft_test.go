@@ -0,0 +1,301 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// listFSM records the applied commands.
+type listFSM struct {
+	applied []string
+}
+
+func (f *listFSM) Apply(entry Entry) {
+	f.applied = append(f.applied, string(entry.Data))
+}
+
+func (f *listFSM) Snapshot() ([]byte, error) {
+	return json.Marshal(f.applied)
+}
+
+func (f *listFSM) Restore(data []byte) error {
+	f.applied = nil
+	return json.Unmarshal(data, &f.applied)
+}
+
+type testCluster struct {
+	network *InmemNetwork
+	fsms    map[string]*listFSM
+}
+
+func newTestCluster(ids ...string) *testCluster {
+	c := &testCluster{network: NewInmemNetwork(), fsms: make(map[string]*listFSM)}
+	for i, id := range ids {
+		c.add(Config{ID: id, Members: ids, SnapshotThreshold: 8, Seed: int64(i)})
+	}
+	return c
+}
+
+func (c *testCluster) add(config Config) *Node {
+	c.fsms[config.ID] = &listFSM{}
+	node := NewNode(config, c.fsms[config.ID], c.network.Transport())
+	c.network.Add(node)
+	return node
+}
+
+// waitLeader ticks until one of the nodes is the leader.
+func (c *testCluster) waitLeader(t *testing.T, ids ...string) *Node {
+	for i := 0; i < 100; i++ {
+		c.network.Tick()
+		for _, id := range ids {
+			if node := c.network.Node(id); node.Status().State == Leader {
+				return node
+			}
+		}
+	}
+	t.Fatalf("no leader elected among %v", ids)
+	return nil
+}
+
+func (c *testCluster) ticks(n int) {
+	for i := 0; i < n; i++ {
+		c.network.Tick()
+	}
+}
+
+func (c *testCluster) applied(id string) string {
+	return strings.Join(c.fsms[id].applied, ",")
+}
+
+func TestElection(t *testing.T) {
+	c := newTestCluster("a", "b", "c")
+	leader := c.waitLeader(t, "a", "b", "c")
+	c.ticks(2)
+	status := leader.Status()
+	for _, id := range []string{"a", "b", "c"} {
+		s := c.network.Node(id).Status()
+		if s.Leader != leader.ID() || s.Term != status.Term {
+			t.Errorf("%s: want leader %s term %d, got %+v", id, leader.ID(), status.Term, s)
+		}
+	}
+	// the noop entry of the new leader is committed
+	if status.CommitIndex != 1 {
+		t.Errorf("want %+v, got %+v", 1, status.CommitIndex)
+	}
+
+	// a single node cluster elects itself
+	c = newTestCluster("a")
+	c.waitLeader(t, "a")
+}
+
+func TestReplication(t *testing.T) {
+	c := newTestCluster("a", "b", "c")
+	leader := c.waitLeader(t, "a", "b", "c")
+	var follower *Node
+	for _, id := range []string{"a", "b", "c"} {
+		if id != leader.ID() {
+			follower = c.network.Node(id)
+		}
+	}
+	if err := leader.Propose([]byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	// followers forward their proposals to the leader
+	if err := follower.Propose([]byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	c.ticks(2)
+	expected := "1,2"
+	for _, id := range []string{"a", "b", "c"} {
+		if output := c.applied(id); expected != output {
+			t.Errorf("%s: want %+v, got %+v", id, expected, output)
+		}
+	}
+
+	// without leader, proposals fail
+	node := NewNode(Config{ID: "x", Members: []string{"x", "y"}}, &listFSM{}, c.network.Transport())
+	if err := node.Propose([]byte("3")); err != ErrNoLeader {
+		t.Errorf("want %+v, got %+v", ErrNoLeader, err)
+	}
+}
+
+func TestLeaderFailure(t *testing.T) {
+	c := newTestCluster("a", "b", "c")
+	leader := c.waitLeader(t, "a", "b", "c")
+	leader.Propose([]byte("1"))
+	c.ticks(2)
+
+	// the leader is isolated, the others elect a new one
+	c.network.Partition(leader.ID())
+	others := []string{}
+	for _, id := range []string{"a", "b", "c"} {
+		if id != leader.ID() {
+			others = append(others, id)
+		}
+	}
+	newLeader := c.waitLeader(t, others...)
+	if newLeader.Status().Term <= leader.Status().Term {
+		t.Errorf("want term higher than %d, got %d", leader.Status().Term, newLeader.Status().Term)
+	}
+	// proposals of the old leader can't be committed
+	leader.Propose([]byte("lost"))
+	newLeader.Propose([]byte("2"))
+	c.ticks(2)
+
+	// once healed, the old leader follows and its conflicting entry is
+	// replaced
+	c.network.Heal()
+	c.ticks(5)
+	if output := leader.Status(); output.State != Follower || output.Leader != newLeader.ID() {
+		t.Errorf("want follower of %s, got %+v", newLeader.ID(), output)
+	}
+	expected := "1,2"
+	for _, id := range []string{"a", "b", "c"} {
+		if output := c.applied(id); expected != output {
+			t.Errorf("%s: want %+v, got %+v", id, expected, output)
+		}
+	}
+}
+
+func TestMembership(t *testing.T) {
+	c := newTestCluster("a")
+	leader := c.waitLeader(t, "a")
+	leader.Propose([]byte("1"))
+
+	// a new node waits to be added
+	d := c.add(Config{ID: "d", Seed: 4})
+	c.ticks(30)
+	if output := d.Status(); output.State != Follower || output.Term != 0 {
+		t.Errorf("want idle follower, got %+v", output)
+	}
+	if err := leader.AddMember("d"); err != nil {
+		t.Fatal(err)
+	}
+	// one change at a time
+	if err := leader.AddMember("e"); err != ErrConfigChangePending {
+		t.Errorf("want %+v, got %+v", ErrConfigChangePending, err)
+	}
+	if err := d.AddMember("e"); err != ErrNotLeader {
+		t.Errorf("want %+v, got %+v", ErrNotLeader, err)
+	}
+	c.ticks(2)
+	expected := "[a d]"
+	for _, node := range []*Node{leader, d} {
+		if output := fmt.Sprintf("%v", node.Status().Members); expected != output {
+			t.Errorf("%s: want %+v, got %+v", node.ID(), expected, output)
+		}
+	}
+	if output := c.applied("d"); output != "1" {
+		t.Errorf("want %+v, got %+v", "1", output)
+	}
+
+	// the leader removing itself steps down, the remaining member takes
+	// over
+	if err := leader.RemoveMember("a"); err != nil {
+		t.Fatal(err)
+	}
+	c.ticks(2)
+	if output := leader.Status().State; output != Follower {
+		t.Errorf("want %+v, got %+v", Follower, output)
+	}
+	c.network.Remove("a")
+	c.waitLeader(t, "d")
+	expected = "[d]"
+	if output := fmt.Sprintf("%v", d.Status().Members); expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestReadIndex(t *testing.T) {
+	c := newTestCluster("a", "b", "c")
+	leader := c.waitLeader(t, "a", "b", "c")
+	leader.Propose([]byte("1"))
+	c.network.Deliver()
+
+	read, err := leader.ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Index != leader.Status().CommitIndex {
+		t.Errorf("want index %d, got %+v", leader.Status().CommitIndex, read)
+	}
+	// the leadership is confirmed once the members answered the heartbeat
+	if ok, err := leader.ReadConfirmed(read); ok || err != nil {
+		t.Errorf("want read waiting for the members, got %v %+v", ok, err)
+	}
+	c.network.Deliver()
+	if ok, err := leader.ReadConfirmed(read); !ok || err != nil {
+		t.Errorf("want read confirmed, got %v %+v", ok, err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if node := c.network.Node(id); node != leader {
+			if _, err := node.ReadIndex(); err != ErrNotLeader {
+				t.Errorf("%s: want %+v, got %+v", id, ErrNotLeader, err)
+			}
+		}
+	}
+
+	// an isolated leader never confirms a read
+	c.network.Partition(leader.ID())
+	read, err = leader.ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ticks(3)
+	if ok, err := leader.ReadConfirmed(read); ok || err != nil {
+		t.Errorf("want read waiting for the members, got %v %+v", ok, err)
+	}
+	others := []string{}
+	for _, id := range []string{"a", "b", "c"} {
+		if id != leader.ID() {
+			others = append(others, id)
+		}
+	}
+	c.waitLeader(t, others...)
+	c.network.Heal()
+	c.ticks(3)
+	if _, err := leader.ReadConfirmed(read); err != ErrNotLeader {
+		t.Errorf("want %+v, got %+v", ErrNotLeader, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	c := newTestCluster("a", "b", "c")
+	leader := c.waitLeader(t, "a", "b", "c")
+	var lagging string
+	for _, id := range []string{"a", "b", "c"} {
+		if id != leader.ID() {
+			lagging = id
+		}
+	}
+	c.network.Partition(lagging)
+	expected := []string{}
+	for i := 0; i < 20; i++ {
+		leader.Propose([]byte(fmt.Sprint(i)))
+		expected = append(expected, fmt.Sprint(i))
+		c.network.Deliver()
+	}
+	c.ticks(1)
+	if output := leader.Status().SnapshotIndex; output == 0 {
+		t.Errorf("want log compacted, got snapshot index %d", output)
+	}
+
+	// the lagging follower is sent the snapshot then the following entries
+	c.network.Heal()
+	c.ticks(3)
+	if output := c.applied(lagging); strings.Join(expected, ",") != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+	if output := c.network.Node(lagging).Status(); output.CommitIndex != leader.Status().CommitIndex {
+		t.Errorf("want commit index %d, got %+v", leader.Status().CommitIndex, output)
+	}
+}
+
+func TestStateText(t *testing.T) {
+	expected := "follower candidate leader"
+	if output := fmt.Sprintf("%s %s %s", Follower, Candidate, Leader); expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+}
@@ -0,0 +1,129 @@
+package raft
+
+import (
+	"sort"
+	"sync"
+)
+
+const (
+	// maximum number of messages delivered by InmemNetwork.Deliver, a
+	// cluster exchanging messages forever is a bug
+	MAX_DELIVERED_MESSAGES = 100000
+)
+
+// InmemNetwork connects nodes in memory. Messages are queued and delivered
+// in order when Deliver is called, so that tests are deterministic.
+type InmemNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+	queue []Message
+	// cut holds the nodes isolated from the others
+	cut map[string]bool
+}
+
+type inmemTransport struct {
+	network *InmemNetwork
+}
+
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{
+		nodes: make(map[string]*Node),
+		cut:   make(map[string]bool),
+	}
+}
+
+// Transport returns a transport sending messages on the network.
+func (n *InmemNetwork) Transport() Transport {
+	return &inmemTransport{network: n}
+}
+
+func (t *inmemTransport) Send(msg Message) {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	t.network.queue = append(t.network.queue, msg)
+}
+
+func (n *InmemNetwork) Add(node *Node) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nodes[node.ID()] = node
+}
+
+// Remove stops the node: the messages to and from it are dropped.
+func (n *InmemNetwork) Remove(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.nodes, id)
+}
+
+func (n *InmemNetwork) Node(id string) *Node {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.nodes[id]
+}
+
+// Partition isolates the nodes from the others. Isolated nodes still
+// communicate with each other.
+func (n *InmemNetwork) Partition(ids ...string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, id := range ids {
+		n.cut[id] = true
+	}
+}
+
+func (n *InmemNetwork) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cut = make(map[string]bool)
+}
+
+func (n *InmemNetwork) sortedNodes() []*Node {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ids := []string{}
+	for id := range n.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	nodes := []*Node{}
+	for _, id := range ids {
+		nodes = append(nodes, n.nodes[id])
+	}
+	return nodes
+}
+
+// next pops the next message which can be delivered.
+func (n *InmemNetwork) next() (*Node, Message, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for len(n.queue) > 0 {
+		msg := n.queue[0]
+		n.queue = n.queue[1:]
+		from, to := n.nodes[msg.From], n.nodes[msg.To]
+		if from == nil || to == nil || n.cut[msg.From] != n.cut[msg.To] {
+			continue
+		}
+		return to, msg, true
+	}
+	return nil, Message{}, false
+}
+
+// Deliver delivers the queued messages and the messages they trigger.
+func (n *InmemNetwork) Deliver() {
+	for i := 0; i < MAX_DELIVERED_MESSAGES; i++ {
+		node, msg, ok := n.next()
+		if !ok {
+			return
+		}
+		node.Step(msg)
+	}
+}
+
+// Tick ticks every node then delivers the messages.
+func (n *InmemNetwork) Tick() {
+	for _, node := range n.sortedNodes() {
+		node.Tick()
+	}
+	n.Deliver()
+}
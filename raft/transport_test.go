@@ -0,0 +1,48 @@
+package raft
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestInmemNetwork(t *testing.T) {
+	network := NewInmemNetwork()
+	for _, id := range []string{"a", "b", "c"} {
+		network.Add(NewNode(Config{ID: id, Members: []string{"a", "b", "c"}}, &listFSM{}, network.Transport()))
+	}
+	transport := network.Transport()
+	terms := func() []uint64 {
+		terms := []uint64{}
+		for _, id := range []string{"a", "b", "c"} {
+			terms = append(terms, network.Node(id).Status().Term)
+		}
+		return terms
+	}
+
+	// partitioned nodes don't reach the others
+	network.Partition("c")
+	transport.Send(Message{Type: MsgVoteResp, From: "a", To: "b", Term: 1})
+	transport.Send(Message{Type: MsgVoteResp, From: "a", To: "c", Term: 1})
+	network.Deliver()
+	expected := "[0 1 0]"
+	if output := fmt.Sprintf("%v", terms()); expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+
+	// removed nodes neither send nor receive
+	network.Heal()
+	network.Remove("b")
+	transport.Send(Message{Type: MsgVoteResp, From: "a", To: "c", Term: 2})
+	transport.Send(Message{Type: MsgVoteResp, From: "b", To: "a", Term: 3})
+	transport.Send(Message{Type: MsgVoteResp, From: "a", To: "b", Term: 3})
+	network.Deliver()
+	if output := network.Node("b"); output != nil {
+		t.Errorf("want %+v, got %+v", nil, output)
+	}
+	if output := network.Node("c").Status().Term; output != 2 {
+		t.Errorf("want %+v, got %+v", 2, output)
+	}
+	if output := network.Node("a").Status().Term; output != 0 {
+		t.Errorf("want %+v, got %+v", 0, output)
+	}
+}
@@ -0,0 +1,373 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// The keys holding a CRDT are merged with the writes of the other peers
+// instead of being replaced by the latest one, so that the peers converge
+// whatever the order they receive the writes in. A PN-counter holds the
+// increments and the decrements made on every peer, its value is their sum.
+// An OR-set holds a unique tag for every addition of a member, removing a
+// member removes the tags observed: a member added concurrently with its
+// removal stays in the set.
+const (
+	CRDT_COUNTER = "counter"
+	CRDT_SET     = "set"
+	// CRDT_COUNTER_BASE counts the integer a key held when it became a
+	// counter, once whatever the number of peers which converted it
+	CRDT_COUNTER_BASE = "*"
+)
+
+var (
+	ErrWrongType = fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errNotInt    = fmt.Errorf("ERR value is not an integer or out of range")
+)
+
+// CRDT is a value merged with the values of the other peers.
+type CRDT interface {
+	Type() string
+	// Merge merges the state of a CRDT of the same type
+	Merge(o CRDT)
+	// Value returns the value read as a string, nil when the CRDT is not
+	// read as a string
+	Value() []byte
+	Encode() []byte
+	Copy() CRDT
+}
+
+// DecodeCRDT decodes the state of a CRDT of a type.
+func DecodeCRDT(crdtType string, data []byte) (CRDT, error) {
+	var c CRDT
+	switch crdtType {
+	case CRDT_COUNTER:
+		c = NewPNCounter()
+	case CRDT_SET:
+		c = NewORSet()
+	default:
+		return nil, fmt.Errorf("unknown CRDT type %q", crdtType)
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("invalid %s state: %s", crdtType, err)
+	}
+	return c, nil
+}
+
+// PNCounter holds the increments and the decrements of every peer.
+type PNCounter struct {
+	P map[string]int64 `json:"p"`
+	N map[string]int64 `json:"n"`
+}
+
+func NewPNCounter() *PNCounter {
+	return &PNCounter{P: make(map[string]int64), N: make(map[string]int64)}
+}
+
+func (c *PNCounter) Type() string {
+	return CRDT_COUNTER
+}
+
+func (c *PNCounter) Sum() int64 {
+	var sum int64
+	for _, v := range c.P {
+		sum += v
+	}
+	for _, v := range c.N {
+		sum -= v
+	}
+	return sum
+}
+
+// Add adds by to the counter of a peer and returns the delta to merge on
+// the other peers.
+func (c *PNCounter) Add(peer string, by int64) *PNCounter {
+	delta := NewPNCounter()
+	if by >= 0 {
+		c.P[peer] += by
+		delta.P[peer] = c.P[peer]
+	} else {
+		c.N[peer] -= by
+		delta.N[peer] = c.N[peer]
+	}
+	return delta
+}
+
+// Merge keeps the highest count of every peer.
+func (c *PNCounter) Merge(o CRDT) {
+	oc := o.(*PNCounter)
+	for peer, v := range oc.P {
+		if v > c.P[peer] {
+			c.P[peer] = v
+		}
+	}
+	for peer, v := range oc.N {
+		if v > c.N[peer] {
+			c.N[peer] = v
+		}
+	}
+}
+
+func (c *PNCounter) Value() []byte {
+	return []byte(strconv.FormatInt(c.Sum(), 10))
+}
+
+func (c *PNCounter) Encode() []byte {
+	data, _ := json.Marshal(c)
+	return data
+}
+
+func (c *PNCounter) Copy() CRDT {
+	copied := NewPNCounter()
+	copied.Merge(c)
+	return copied
+}
+
+// ORSet holds the tags of the additions of every member and the tags
+// removed. The tag of a write is shared by the members it adds.
+type ORSet struct {
+	Adds    map[string]map[string]bool `json:"adds"`
+	Removed map[string]map[string]bool `json:"removed"`
+}
+
+func NewORSet() *ORSet {
+	return &ORSet{Adds: make(map[string]map[string]bool), Removed: make(map[string]map[string]bool)}
+}
+
+func addTag(tags map[string]map[string]bool, member string, tag string) {
+	if tags[member] == nil {
+		tags[member] = make(map[string]bool)
+	}
+	tags[member][tag] = true
+}
+
+func (s *ORSet) Type() string {
+	return CRDT_SET
+}
+
+// Contains reports whether a member has a tag which was not removed.
+func (s *ORSet) Contains(member string) bool {
+	for tag := range s.Adds[member] {
+		if !s.Removed[member][tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// Members returns the sorted members of the set.
+func (s *ORSet) Members() (members []string) {
+	for member := range s.Adds {
+		if s.Contains(member) {
+			members = append(members, member)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Add adds a member with a unique tag and returns the delta to merge on the
+// other peers.
+func (s *ORSet) Add(member string, tag string) *ORSet {
+	addTag(s.Adds, member, tag)
+	delta := NewORSet()
+	addTag(delta.Adds, member, tag)
+	return delta
+}
+
+// Remove removes the tags of a member and returns the delta to merge on the
+// other peers.
+func (s *ORSet) Remove(member string) *ORSet {
+	delta := NewORSet()
+	for tag := range s.Adds[member] {
+		if !s.Removed[member][tag] {
+			addTag(s.Removed, member, tag)
+			addTag(delta.Removed, member, tag)
+		}
+	}
+	return delta
+}
+
+func (s *ORSet) Merge(o CRDT) {
+	os := o.(*ORSet)
+	for member, tags := range os.Adds {
+		for tag := range tags {
+			addTag(s.Adds, member, tag)
+		}
+	}
+	for member, tags := range os.Removed {
+		for tag := range tags {
+			addTag(s.Removed, member, tag)
+		}
+	}
+}
+
+func (s *ORSet) Value() []byte {
+	return nil
+}
+
+func (s *ORSet) Encode() []byte {
+	data, _ := json.Marshal(s)
+	return data
+}
+
+func (s *ORSet) Copy() CRDT {
+	copied := NewORSet()
+	copied.Merge(s)
+	return copied
+}
+
+// Type returns the type of a key: none when it does not exist, string or
+// the type of its CRDT.
+func (m *MemoryStorage) Type(k string) string {
+	m.expireIfNeeded(k)
+	lock.RLock()
+	defer lock.RUnlock()
+	if _, ok := m.data[k]; !ok {
+		return "none"
+	}
+	if c, ok := m.crdts[k]; ok {
+		return c.Type()
+	}
+	return "string"
+}
+
+// CounterAdd adds by to the count of a peer in the PN-counter of a key. A
+// key holding an integer becomes a counter starting at that integer. It
+// returns the value of the counter and the delta to merge on the other
+// peers.
+func (m *MemoryStorage) CounterAdd(k string, peer string, by int64) ([]byte, CRDT, error) {
+	m.expireIfNeeded(k)
+	lock.Lock()
+	defer lock.Unlock()
+	var counter *PNCounter
+	c, ok := m.crdts[k]
+	switch {
+	case ok && c.Type() != CRDT_COUNTER:
+		return nil, nil, ErrWrongType
+	case ok:
+		counter = c.(*PNCounter)
+	default:
+		counter = NewPNCounter()
+		if s, exists := m.data[k]; exists {
+			i, err := strconv.ParseInt(string(s), 10, 64)
+			if err != nil {
+				return nil, nil, errNotInt
+			}
+			counter.Add(CRDT_COUNTER_BASE, i)
+		}
+	}
+	var delta CRDT = counter.Add(peer, by)
+	if !ok {
+		// the integer the counter starts at is replicated with the delta
+		delta = counter.Copy()
+	}
+	m.crdts[k] = counter
+	m.data[k] = counter.Value()
+	delete(m.versions, k)
+	return m.data[k], delta, nil
+}
+
+func (m *MemoryStorage) orSet(k string, create bool) (*ORSet, error) {
+	c, ok := m.crdts[k]
+	switch {
+	case ok && c.Type() != CRDT_SET:
+		return nil, ErrWrongType
+	case ok:
+		return c.(*ORSet), nil
+	}
+	if _, exists := m.data[k]; exists {
+		return nil, ErrWrongType
+	}
+	if !create {
+		return nil, nil
+	}
+	s := NewORSet()
+	m.crdts[k] = s
+	m.data[k] = s.Value()
+	return s, nil
+}
+
+// SetAdd adds members to the OR-set of a key with a tag unique to the
+// write. It returns the number of members which were not in the set and the
+// delta to merge on the other peers.
+func (m *MemoryStorage) SetAdd(k string, tag string, members ...string) (int, CRDT, error) {
+	m.expireIfNeeded(k)
+	lock.Lock()
+	defer lock.Unlock()
+	s, err := m.orSet(k, true)
+	if err != nil {
+		return 0, nil, err
+	}
+	added := 0
+	delta := NewORSet()
+	for _, member := range members {
+		if !s.Contains(member) {
+			added++
+		}
+		delta.Merge(s.Add(member, tag))
+	}
+	return added, delta, nil
+}
+
+// SetRemove removes members from the OR-set of a key. It returns the number
+// of members which were in the set and the delta to merge on the other
+// peers. The tags removed are kept, an empty set is kept until the key is
+// deleted.
+func (m *MemoryStorage) SetRemove(k string, members ...string) (int, CRDT, error) {
+	m.expireIfNeeded(k)
+	lock.Lock()
+	defer lock.Unlock()
+	s, err := m.orSet(k, false)
+	if err != nil || s == nil {
+		return 0, nil, err
+	}
+	removed := 0
+	delta := NewORSet()
+	for _, member := range members {
+		if s.Contains(member) {
+			removed++
+		}
+		delta.Merge(s.Remove(member))
+	}
+	return removed, delta, nil
+}
+
+// SetMembers returns the sorted members of the OR-set of a key.
+func (m *MemoryStorage) SetMembers(k string) ([]string, error) {
+	m.expireIfNeeded(k)
+	lock.RLock()
+	defer lock.RUnlock()
+	s, err := m.orSet(k, false)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	return s.Members(), nil
+}
+
+// MergeCRDT merges a CRDT in a key. A key holding a string is replaced by
+// the CRDT.
+func (m *MemoryStorage) MergeCRDT(k string, c CRDT) error {
+	m.expireIfNeeded(k)
+	lock.Lock()
+	defer lock.Unlock()
+	return m.mergeCRDT(k, c)
+}
+
+func (m *MemoryStorage) mergeCRDT(k string, c CRDT) error {
+	current, ok := m.crdts[k]
+	switch {
+	case ok && current.Type() != c.Type():
+		return ErrWrongType
+	case ok:
+		current.Merge(c)
+	default:
+		current = c.Copy()
+		m.crdts[k] = current
+		delete(m.versions, k)
+	}
+	m.data[k] = current.Value()
+	return nil
+}
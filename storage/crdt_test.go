@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPNCounter(t *testing.T) {
+	a, b := NewPNCounter(), NewPNCounter()
+	a.Add("a", 2)
+	a.Add("a", -1)
+	deltaB := b.Add("b", 5)
+	b.Add("b", -3)
+
+	// merges are commutative and idempotent
+	a.Merge(deltaB)
+	a.Merge(deltaB)
+	a.Merge(b)
+	b.Merge(a)
+	for _, c := range []*PNCounter{a, b} {
+		if output := string(c.Value()); output != "3" {
+			t.Errorf("want %+v, got %+v", "3", output)
+		}
+	}
+	decoded, err := DecodeCRDT(CRDT_COUNTER, a.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output := string(decoded.Value()); output != "3" {
+		t.Errorf("want %+v, got %+v", "3", output)
+	}
+	for _, s := range []struct{ crdtType, data string }{{"list", "{}"}, {CRDT_COUNTER, "x"}} {
+		if _, err := DecodeCRDT(s.crdtType, []byte(s.data)); err == nil {
+			t.Errorf("want error for %+v", s)
+		}
+	}
+}
+
+func TestORSet(t *testing.T) {
+	a, b := NewORSet(), NewORSet()
+	a.Add("x", "1@a")
+	a.Add("y", "2@a")
+	b.Merge(a)
+
+	// b removes x while a adds it again: the addition wins
+	removed := b.Remove("x")
+	added := a.Add("x", "3@a")
+	b.Remove("y")
+	a.Merge(removed)
+	a.Merge(b)
+	b.Merge(added)
+	for _, s := range []*ORSet{a, b} {
+		if output := fmt.Sprint(s.Members()); output != "[x]" {
+			t.Errorf("want %+v, got %+v", "[x]", output)
+		}
+	}
+}
+
+func TestMemoryStorageCRDT(t *testing.T) {
+	m := NewMemoryStorage()
+	m.Set("c", []byte("10"))
+	v, delta, err := m.CounterAdd("c", "a", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "11" || string(m.Get("c")) != "11" || m.Type("c") != CRDT_COUNTER {
+		t.Errorf("want %+v, got %+v %+v", "a counter at 11", string(v), m.Type("c"))
+	}
+	// the integer the counter started at is counted once
+	o := NewMemoryStorage()
+	o.Set("c", []byte("10"))
+	o.CounterAdd("c", "b", 1)
+	if err := o.MergeCRDT("c", delta); err != nil {
+		t.Fatal(err)
+	}
+	if output := string(o.Get("c")); output != "12" {
+		t.Errorf("want %+v, got %+v", "12", output)
+	}
+
+	added, _, err := m.SetAdd("s", "1@a", "x", "y", "x")
+	if err != nil || added != 2 {
+		t.Errorf("want %+v, got %+v %+v", 2, added, err)
+	}
+	if removed, _, _ := m.SetRemove("s", "y", "z"); removed != 1 {
+		t.Errorf("want %+v, got %+v", 1, removed)
+	}
+	if members, _ := m.SetMembers("s"); fmt.Sprint(members) != "[x]" {
+		t.Errorf("want %+v, got %+v", "[x]", members)
+	}
+	suites := []error{}
+	_, _, err = m.SetAdd("c", "2@a", "x")
+	suites = append(suites, err)
+	_, _, err = m.CounterAdd("s", "a", 1)
+	suites = append(suites, err)
+	_, err = m.Incr("s")
+	suites = append(suites, err)
+	suites = append(suites, m.MergeCRDT("s", NewPNCounter()))
+	for _, err := range suites {
+		if err != ErrWrongType {
+			t.Errorf("want %+v, got %+v", ErrWrongType, err)
+		}
+	}
+	if output := m.Type("missing") + "," + m.Type("s"); output != "none,set" {
+		t.Errorf("want %+v, got %+v", "none,set", output)
+	}
+
+	// the CRDTs of the items are merged
+	item, _ := m.DumpKey("s")
+	if item.Type != CRDT_SET {
+		t.Errorf("want %+v, got %+v", CRDT_SET, item.Type)
+	}
+	o.SetAdd("s", "1@b", "z")
+	if !o.Restore(item) {
+		t.Errorf("want %+v, got %+v", true, false)
+	}
+	if members, _ := o.SetMembers("s"); fmt.Sprint(members) != "[x z]" {
+		t.Errorf("want %+v, got %+v", "[x z]", members)
+	}
+	o.Load(m.Dump())
+	if members, _ := o.SetMembers("s"); fmt.Sprint(members) != "[x]" || string(o.Get("c")) != "11" {
+		t.Errorf("want %+v, got %+v %s", "[x] and 11", members, o.Get("c"))
+	}
+	m.Set("s", []byte("v"))
+	if output := m.Type("s"); output != "string" {
+		t.Errorf("want %+v, got %+v", "string", output)
+	}
+}
@@ -2,8 +2,10 @@ package storage
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/gobwas/glob"
 )
@@ -13,83 +15,301 @@ var (
 )
 
 type MemoryStorage struct {
-	data map[string][]byte
+	data    map[string][]byte
+	expires map[string]time.Time
+	// versions holds the version of the keys written with SetVersion or
+	// Touch
+	versions map[string]Version
+	// crdts holds the CRDT of the keys merged with the other peers, their
+	// value is kept in data
+	crdts map[string]CRDT
+	// tombstones holds the version of the keys deleted with DelVersion,
+	// until PurgeTombstones removes them
+	tombstones map[string]Version
+	onExpire   func(k string)
 }
 
 func NewMemoryStorage() *MemoryStorage {
 	m := &MemoryStorage{}
 	m.data = make(map[string][]byte)
+	m.expires = make(map[string]time.Time)
+	m.versions = make(map[string]Version)
+	m.crdts = make(map[string]CRDT)
+	m.tombstones = make(map[string]Version)
 	return m
 }
 
-func (m *MemoryStorage) FlushData() {
+// OnExpire registers a function called with every key removed because it
+// reached its expiration time.
+func (m *MemoryStorage) OnExpire(f func(k string)) {
+	m.onExpire = f
+}
+
+// FlushData removes every key and returns the removed keys.
+func (m *MemoryStorage) FlushData() (keys []string) {
+	lock.Lock()
+	for k := range m.data {
+		keys = append(keys, k)
+	}
 	m.data = make(map[string][]byte)
+	m.expires = make(map[string]time.Time)
+	m.versions = make(map[string]Version)
+	m.crdts = make(map[string]CRDT)
+	m.tombstones = make(map[string]Version)
+	lock.Unlock()
+	return keys
 }
 
 func (m *MemoryStorage) Set(k string, v []byte) {
 	lock.Lock()
 	// TODO we could implement metrics to get locked time
 	m.data[k] = v
+	delete(m.expires, k)
+	delete(m.versions, k)
+	delete(m.crdts, k)
+	delete(m.tombstones, k)
 	lock.Unlock()
 }
 
+// SetVersion sets a key unless it holds a newer version or was deleted by
+// a newer write. It returns whether the key was set.
+func (m *MemoryStorage) SetVersion(k string, v []byte, version Version) bool {
+	m.expireIfNeeded(k)
+	lock.Lock()
+	defer lock.Unlock()
+	if current, ok := m.versions[k]; ok && !version.Newer(current) {
+		return false
+	}
+	if deleted, ok := m.tombstones[k]; ok && !version.Newer(deleted) {
+		return false
+	}
+	m.data[k] = v
+	delete(m.expires, k)
+	m.versions[k] = version
+	delete(m.crdts, k)
+	delete(m.tombstones, k)
+	return true
+}
+
+// GetVersion returns the value of a key with its version, zero when the
+// key was not written with a version.
+func (m *MemoryStorage) GetVersion(k string) ([]byte, Version, bool) {
+	m.expireIfNeeded(k)
+	lock.RLock()
+	defer lock.RUnlock()
+	v, ok := m.data[k]
+	return v, m.versions[k], ok
+}
+
+// Touch sets the version of an existing key.
+func (m *MemoryStorage) Touch(k string, version Version) {
+	lock.Lock()
+	defer lock.Unlock()
+	if _, ok := m.data[k]; ok {
+		m.versions[k] = version
+	}
+}
+
 func (m *MemoryStorage) Get(k string) []byte {
+	m.expireIfNeeded(k)
 	lock.RLock()
 	d := m.data[k]
 	lock.RUnlock()
 	return d
 }
 
-func (m *MemoryStorage) Incr(k string) ([]byte, error) {
+func (m *MemoryStorage) Exists(k string) bool {
+	m.expireIfNeeded(k)
 	lock.RLock()
-	s, ok := m.data[k]
+	_, ok := m.data[k]
 	lock.RUnlock()
-	if ok {
-		i, err := strconv.Atoi(string(s))
-		if err != nil {
-			return nil, err
-		}
-		i = i + 1
-		m.Set(k, []byte(fmt.Sprintf("%d", i)))
-		return []byte(fmt.Sprintf("%d", i)), nil
-	}
-	m.Set(k, []byte("1"))
-	return []byte("1"), nil
+	return ok
 }
 
-func (m *MemoryStorage) Decr(k string) ([]byte, error) {
-	lock.RLock()
+func (m *MemoryStorage) incrBy(k string, by int) ([]byte, error) {
+	m.expireIfNeeded(k)
+	lock.Lock()
+	defer lock.Unlock()
+	if _, ok := m.crdts[k]; ok {
+		return nil, ErrWrongType
+	}
 	s, ok := m.data[k]
-	lock.RUnlock()
+	var i int
 	if ok {
-		i, err := strconv.Atoi(string(s))
+		var err error
+		i, err = strconv.Atoi(string(s))
 		if err != nil {
 			return nil, err
 		}
-		i = i - 1
-		m.Set(k, []byte(fmt.Sprintf("%d", i)))
-		return []byte(fmt.Sprintf("%d", i)), nil
 	}
-	m.Set(k, []byte("-1"))
-	return []byte("-1"), nil
+	i = i + by
+	// the expiration time of the key is kept
+	m.data[k] = []byte(fmt.Sprintf("%d", i))
+	return m.data[k], nil
+}
+
+func (m *MemoryStorage) Incr(k string) ([]byte, error) {
+	return m.incrBy(k, 1)
+}
+
+func (m *MemoryStorage) Decr(k string) ([]byte, error) {
+	return m.incrBy(k, -1)
 }
 
 func (m *MemoryStorage) Del(k string) bool {
+	m.expireIfNeeded(k)
 	lock.Lock()
 	defer lock.Unlock()
 	_, ok := m.data[k]
 	if ok {
 		delete(m.data, k)
+		delete(m.expires, k)
+		delete(m.versions, k)
+		delete(m.crdts, k)
 		return true
 	}
 	return false
 }
 
+// DelVersion deletes a key unless it holds a newer version, and keeps a
+// tombstone with the version of the delete: the older writes of the key
+// applied later do not bring it back. It returns whether the key was
+// deleted.
+func (m *MemoryStorage) DelVersion(k string, version Version) bool {
+	m.expireIfNeeded(k)
+	lock.Lock()
+	defer lock.Unlock()
+	return m.delVersion(k, version)
+}
+
+// delVersion deletes a key with a version, lock must be held.
+func (m *MemoryStorage) delVersion(k string, version Version) bool {
+	if current, ok := m.versions[k]; ok && current.Newer(version) {
+		return false
+	}
+	if deleted, ok := m.tombstones[k]; !ok || version.Newer(deleted) {
+		m.tombstones[k] = version
+	}
+	_, ok := m.data[k]
+	delete(m.data, k)
+	delete(m.expires, k)
+	delete(m.versions, k)
+	delete(m.crdts, k)
+	return ok
+}
+
+// PurgeTombstones removes the tombstones of the deletes versioned before
+// a timestamp and returns their number.
+func (m *MemoryStorage) PurgeTombstones(before int64) (purged int) {
+	lock.Lock()
+	defer lock.Unlock()
+	for k, version := range m.tombstones {
+		if version.Timestamp < before {
+			delete(m.tombstones, k)
+			purged++
+		}
+	}
+	return purged
+}
+
+// Expire sets the time at which a key is removed. It returns false when
+// the key does not exist.
+func (m *MemoryStorage) Expire(k string, at time.Time) bool {
+	m.expireIfNeeded(k)
+	lock.Lock()
+	defer lock.Unlock()
+	if _, ok := m.data[k]; !ok {
+		return false
+	}
+	m.expires[k] = at
+	return true
+}
+
+// Persist removes the expiration time of a key. It returns false when the
+// key does not exist or has no expiration time.
+func (m *MemoryStorage) Persist(k string) bool {
+	m.expireIfNeeded(k)
+	lock.Lock()
+	defer lock.Unlock()
+	if _, ok := m.expires[k]; !ok {
+		return false
+	}
+	delete(m.expires, k)
+	return true
+}
+
+// TTL returns the time to live of a key, -1 if the key has no expiration
+// time and -2 if the key does not exist, like Redis does.
+func (m *MemoryStorage) TTL(k string) time.Duration {
+	m.expireIfNeeded(k)
+	lock.RLock()
+	defer lock.RUnlock()
+	if _, ok := m.data[k]; !ok {
+		return -2
+	}
+	at, ok := m.expires[k]
+	if !ok {
+		return -1
+	}
+	return time.Until(at)
+}
+
+func (m *MemoryStorage) isExpired(k string, now time.Time) bool {
+	at, ok := m.expires[k]
+	return ok && !now.Before(at)
+}
+
+func (m *MemoryStorage) expireIfNeeded(k string) {
+	now := time.Now()
+	lock.RLock()
+	expired := m.isExpired(k, now)
+	lock.RUnlock()
+	if expired {
+		m.removeExpired(k, now)
+	}
+}
+
+func (m *MemoryStorage) removeExpired(k string, now time.Time) {
+	lock.Lock()
+	// the key may have been updated since it was found expired
+	if !m.isExpired(k, now) {
+		lock.Unlock()
+		return
+	}
+	delete(m.data, k)
+	delete(m.expires, k)
+	delete(m.versions, k)
+	delete(m.crdts, k)
+	lock.Unlock()
+	if m.onExpire != nil {
+		m.onExpire(k)
+	}
+}
+
+// DeleteExpired removes the keys whose expiration time is reached and
+// returns them.
+func (m *MemoryStorage) DeleteExpired(now time.Time) (keys []string) {
+	lock.RLock()
+	for k := range m.expires {
+		if m.isExpired(k, now) {
+			keys = append(keys, k)
+		}
+	}
+	lock.RUnlock()
+	for _, k := range keys {
+		m.removeExpired(k, now)
+	}
+	return keys
+}
+
 func (m *MemoryStorage) Keys(filter string) (keys []string) {
 	var g glob.Glob
 	g = glob.MustCompile(filter)
+	now := time.Now()
+	lock.RLock()
+	defer lock.RUnlock()
 	for k := range m.data {
-		if g.Match(k) {
+		if g.Match(k) && !m.isExpired(k, now) {
 			keys = append(keys, k)
 		}
 	}
@@ -103,10 +323,168 @@ func (m *MemoryStorage) Scan(cursor int, count int, filter string, typeFilter st
 		return fmt.Errorf("Invalid filter type"), 0, nil
 	}
 	g = glob.MustCompile(filter)
+	now := time.Now()
+	lock.RLock()
+	defer lock.RUnlock()
 	for k := range m.data {
-		if g.Match(k) {
+		if g.Match(k) && !m.isExpired(k, now) {
 			keys = append(keys, k)
 		}
 	}
 	return nil, 0, keys
 }
+
+// Item is a key with its value, expiration time and version. ExpireAt is
+// zero when the key does not expire. The value of the keys holding a CRDT
+// is its encoded state, Type is the type of the CRDT. Deleted is set on the
+// tombstones of the deleted keys, which have a version only.
+type Item struct {
+	Key      string
+	Value    []byte
+	ExpireAt time.Time
+	Version  Version
+	Type     string
+	Deleted  bool
+}
+
+// item returns the item of a key, lock must be held.
+func (m *MemoryStorage) item(k string, v []byte) Item {
+	item := Item{Key: k, Value: v, ExpireAt: m.expires[k], Version: m.versions[k]}
+	if c, ok := m.crdts[k]; ok {
+		item.Type, item.Value = c.Type(), c.Encode()
+	}
+	return item
+}
+
+// Dump returns every key which is not expired, sorted by key.
+func (m *MemoryStorage) Dump() (items []Item) {
+	now := time.Now()
+	lock.RLock()
+	for k, v := range m.data {
+		if m.isExpired(k, now) {
+			continue
+		}
+		items = append(items, m.item(k, v))
+	}
+	lock.RUnlock()
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Key < items[j].Key
+	})
+	return items
+}
+
+// DumpTombstones returns every key which is not expired and the tombstones
+// of the deleted keys, sorted by key.
+func (m *MemoryStorage) DumpTombstones() []Item {
+	items := m.Dump()
+	lock.RLock()
+	for k, version := range m.tombstones {
+		items = append(items, Item{Key: k, Version: version, Deleted: true})
+	}
+	lock.RUnlock()
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Key < items[j].Key
+	})
+	return items
+}
+
+// DumpKey returns a key with its value, expiration time and version.
+func (m *MemoryStorage) DumpKey(k string) (Item, bool) {
+	m.expireIfNeeded(k)
+	lock.RLock()
+	defer lock.RUnlock()
+	v, ok := m.data[k]
+	if !ok {
+		return Item{}, false
+	}
+	return m.item(k, v), true
+}
+
+// Restore sets a key from an item unless the key holds a newer version or
+// was deleted by a newer write: an item of the same version replaces the
+// key. The CRDT of an item is merged in the key instead, a tombstone
+// deletes the key. It returns whether the key was set or deleted.
+func (m *MemoryStorage) Restore(item Item) bool {
+	if item.Deleted {
+		m.expireIfNeeded(item.Key)
+		lock.Lock()
+		defer lock.Unlock()
+		if current, ok := m.versions[item.Key]; ok && current.Newer(item.Version) {
+			return false
+		}
+		m.delVersion(item.Key, item.Version)
+		return true
+	}
+	if !item.ExpireAt.IsZero() && !time.Now().Before(item.ExpireAt) {
+		return false
+	}
+	var c CRDT
+	if item.Type != "" {
+		var err error
+		if c, err = DecodeCRDT(item.Type, item.Value); err != nil {
+			return false
+		}
+	}
+	m.expireIfNeeded(item.Key)
+	lock.Lock()
+	defer lock.Unlock()
+	if c != nil {
+		if err := m.mergeCRDT(item.Key, c); err != nil {
+			return false
+		}
+		if !item.ExpireAt.IsZero() {
+			m.expires[item.Key] = item.ExpireAt
+		}
+		return true
+	}
+	if current, ok := m.versions[item.Key]; ok && current.Newer(item.Version) {
+		return false
+	}
+	if deleted, ok := m.tombstones[item.Key]; ok && !item.Version.Newer(deleted) {
+		return false
+	}
+	delete(m.tombstones, item.Key)
+	m.data[item.Key] = item.Value
+	delete(m.expires, item.Key)
+	delete(m.crdts, item.Key)
+	if !item.ExpireAt.IsZero() {
+		m.expires[item.Key] = item.ExpireAt
+	}
+	delete(m.versions, item.Key)
+	if !item.Version.IsZero() {
+		m.versions[item.Key] = item.Version
+	}
+	return true
+}
+
+// Load replaces the content of the storage with items.
+func (m *MemoryStorage) Load(items []Item) {
+	data := make(map[string][]byte)
+	expires := make(map[string]time.Time)
+	versions := make(map[string]Version)
+	crdts := make(map[string]CRDT)
+	for _, item := range items {
+		data[item.Key] = item.Value
+		if item.Type != "" {
+			c, err := DecodeCRDT(item.Type, item.Value)
+			if err != nil {
+				continue
+			}
+			crdts[item.Key] = c
+			data[item.Key] = c.Value()
+		}
+		if !item.ExpireAt.IsZero() {
+			expires[item.Key] = item.ExpireAt
+		}
+		if !item.Version.IsZero() {
+			versions[item.Key] = item.Version
+		}
+	}
+	lock.Lock()
+	m.data = data
+	m.expires = expires
+	m.versions = versions
+	m.crdts = crdts
+	m.tombstones = make(map[string]Version)
+	lock.Unlock()
+}
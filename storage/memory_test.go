@@ -1,6 +1,10 @@
 package storage
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+	"time"
+)
 
 func TestMemoryStorage(t *testing.T) {
 	var err error
@@ -57,3 +61,212 @@ func TestMemoryStorage(t *testing.T) {
 		t.Error("want an error here")
 	}
 }
+
+func TestMemoryStorageExpire(t *testing.T) {
+	var expired []string
+	m := NewMemoryStorage()
+	m.OnExpire(func(k string) {
+		expired = append(expired, k)
+	})
+	outputB := m.Expire("key", time.Now().Add(time.Second))
+	if outputB {
+		t.Errorf("want %+v, got %+v", false, outputB)
+	}
+	m.Set("key", []byte("foobar"))
+	output := m.TTL("key")
+	var expected time.Duration = -1
+	if expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+	outputB = m.Expire("key", time.Now().Add(time.Hour))
+	if !outputB {
+		t.Errorf("want %+v, got %+v", true, outputB)
+	}
+	output = m.TTL("key")
+	if output <= 59*time.Minute || output > time.Hour {
+		t.Errorf("want a ttl close to 1h, got %+v", output)
+	}
+	outputB = m.Persist("key")
+	if !outputB {
+		t.Errorf("want %+v, got %+v", true, outputB)
+	}
+	output = m.TTL("key")
+	if expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+
+	m.Expire("key", time.Now().Add(-time.Second))
+	outputV := m.Get("key")
+	if outputV != nil {
+		t.Errorf("want nil, got %s", outputV)
+	}
+	output = m.TTL("key")
+	expected = -2
+	if expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+	if len(expired) != 1 || expired[0] != "key" {
+		t.Errorf("want [key], got %+v", expired)
+	}
+
+	m.Set("a", []byte("1"))
+	m.Set("b", []byte("2"))
+	m.Expire("a", time.Now().Add(time.Minute))
+	m.Incr("a")
+	outputK := m.DeleteExpired(time.Now())
+	if len(outputK) != 0 {
+		t.Errorf("want no expired key, got %+v", outputK)
+	}
+	outputK = m.DeleteExpired(time.Now().Add(2 * time.Minute))
+	if len(outputK) != 1 || outputK[0] != "a" {
+		t.Errorf("want [a], got %+v", outputK)
+	}
+	outputK = m.Keys("*")
+	if len(outputK) != 1 || outputK[0] != "b" {
+		t.Errorf("want [b], got %+v", outputK)
+	}
+	outputK = m.FlushData()
+	if len(outputK) != 1 || outputK[0] != "b" {
+		t.Errorf("want [b], got %+v", outputK)
+	}
+}
+
+func TestMemoryStorageDump(t *testing.T) {
+	m := NewMemoryStorage()
+	at := time.Now().Add(time.Hour)
+	m.Set("b", []byte("2"))
+	m.Set("a", []byte("1"))
+	m.Expire("a", at)
+	m.Set("expired", []byte("3"))
+	m.Expire("expired", time.Now().Add(-time.Second))
+
+	items := m.Dump()
+	expected := fmt.Sprintf("%+v", []Item{{Key: "a", Value: []byte("1"), ExpireAt: at}, {Key: "b", Value: []byte("2")}})
+	if output := fmt.Sprintf("%+v", items); expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+
+	other := NewMemoryStorage()
+	other.Set("c", []byte("3"))
+	other.Load(items)
+	if output := other.Exists("c"); output {
+		t.Errorf("want %+v, got %+v", false, output)
+	}
+	if output := string(other.Get("b")); output != "2" {
+		t.Errorf("want %+v, got %+v", "2", output)
+	}
+	if output := other.TTL("a"); output <= 59*time.Minute {
+		t.Errorf("want a ttl close to 1h, got %+v", output)
+	}
+}
+
+func TestMemoryStorageVersion(t *testing.T) {
+	m := NewMemoryStorage()
+	v1 := Version{Timestamp: 1, Peer: "a"}
+	v2 := Version{Timestamp: 2, Peer: "a"}
+	if output := m.SetVersion("k", []byte("new"), v2); !output {
+		t.Errorf("want %+v, got %+v", true, output)
+	}
+	// older writes lose
+	if output := m.SetVersion("k", []byte("old"), v1); output {
+		t.Errorf("want %+v, got %+v", false, output)
+	}
+	value, version, ok := m.GetVersion("k")
+	if string(value) != "new" || version != v2 || !ok {
+		t.Errorf("want %+v, got %s %+v %+v", "new", value, version, ok)
+	}
+	m.Touch("k", Version{Timestamp: 3, Peer: "b"})
+	if items := m.Dump(); items[0].Version.Timestamp != 3 {
+		t.Errorf("want %+v, got %+v", 3, items[0].Version)
+	}
+
+	// writes without version reset it
+	m.Set("k", []byte("plain"))
+	if _, version, _ = m.GetVersion("k"); !version.IsZero() {
+		t.Errorf("want zero version, got %+v", version)
+	}
+	m.Del("k")
+	if _, _, ok = m.GetVersion("k"); ok {
+		t.Errorf("want %+v, got %+v", false, ok)
+	}
+}
+
+func TestMemoryStorageRestore(t *testing.T) {
+	m := NewMemoryStorage()
+	m.SetVersion("k", []byte("v2"), Version{Timestamp: 2, Peer: "a"})
+	m.Expire("k", time.Now().Add(time.Hour))
+	item, ok := m.DumpKey("k")
+	if !ok || string(item.Value) != "v2" || item.Version.Timestamp != 2 || item.ExpireAt.IsZero() {
+		t.Fatalf("want %+v, got %+v", "v2 with version and expiration", item)
+	}
+	if _, ok := m.DumpKey("missing"); ok {
+		t.Errorf("want %+v, got %+v", false, ok)
+	}
+
+	o := NewMemoryStorage()
+	if !o.Restore(item) {
+		t.Errorf("want %+v, got %+v", true, false)
+	}
+	if restored, _ := o.DumpKey("k"); restored.ExpireAt != item.ExpireAt || restored.Version != item.Version {
+		t.Errorf("want %+v, got %+v", item, restored)
+	}
+	// older versions and expired items are not restored
+	if o.Restore(Item{Key: "k", Value: []byte("v1"), Version: Version{Timestamp: 1, Peer: "a"}}) {
+		t.Errorf("want %+v, got %+v", false, true)
+	}
+	if o.Restore(Item{Key: "e", Value: []byte("v"), ExpireAt: time.Now().Add(-time.Second)}) {
+		t.Errorf("want %+v, got %+v", false, true)
+	}
+	if output := string(o.Get("k")); output != "v2" {
+		t.Errorf("want %+v, got %+v", "v2", output)
+	}
+	// an item of the same version replaces the key
+	item.Value = []byte("v2bis")
+	if !o.Restore(item) {
+		t.Errorf("want %+v, got %+v", true, false)
+	}
+}
+
+func TestMemoryStorageTombstones(t *testing.T) {
+	m := NewMemoryStorage()
+	m.SetVersion("k", []byte("v2"), Version{Timestamp: 2, Peer: "a"})
+	// an older delete does not remove a newer write
+	if m.DelVersion("k", Version{Timestamp: 1, Peer: "a"}) {
+		t.Errorf("want %+v, got %+v", false, true)
+	}
+	if !m.DelVersion("k", Version{Timestamp: 3, Peer: "a"}) {
+		t.Errorf("want %+v, got %+v", true, false)
+	}
+	// the older writes do not bring the key back
+	if m.SetVersion("k", []byte("v2"), Version{Timestamp: 2, Peer: "a"}) {
+		t.Errorf("want %+v, got %+v", false, true)
+	}
+	if m.Restore(Item{Key: "k", Value: []byte("v2"), Version: Version{Timestamp: 2, Peer: "a"}}) {
+		t.Errorf("want %+v, got %+v", false, true)
+	}
+	expected := fmt.Sprintf("%+v", []Item{{Key: "k", Version: Version{Timestamp: 3, Peer: "a"}, Deleted: true}})
+	if output := fmt.Sprintf("%+v", m.DumpTombstones()); expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+
+	// a tombstone restored deletes the key
+	o := NewMemoryStorage()
+	o.SetVersion("k", []byte("v2"), Version{Timestamp: 2, Peer: "a"})
+	if !o.Restore(m.DumpTombstones()[0]) || o.Exists("k") {
+		t.Errorf("want %+v, got %+v", "k deleted", o.Get("k"))
+	}
+	if o.MerkleTree(4, nil).Nodes[0] != m.MerkleTree(4, nil).Nodes[0] {
+		t.Errorf("want the same root")
+	}
+
+	// a newer write replaces the tombstone, which are purged after a while
+	if !m.SetVersion("k", []byte("v4"), Version{Timestamp: 4, Peer: "a"}) {
+		t.Errorf("want %+v, got %+v", true, false)
+	}
+	if output := m.PurgeTombstones(10); output != 0 {
+		t.Errorf("want %+v, got %+v", 0, output)
+	}
+	if output := o.PurgeTombstones(10); output != 1 {
+		t.Errorf("want %+v, got %+v", 1, output)
+	}
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// MerkleTree is a hash tree over the keys of a storage. The keys are spread
+// over 1<<Depth leaves, ranges of the hash of their name. The hash of a
+// leaf is the sum of the hashes of its keys with their version, type and
+// value, the hash of a node the hash of its two children: two storages
+// holding the same keys have the same root, and the leaves which differ
+// hold the keys which differ. Expiration times are not hashed, peers
+// expiring a key at slightly different times hold the same key. The
+// tombstones of the deleted keys are hashed like keys, so that the peers
+// which missed a delete are repaired too.
+type MerkleTree struct {
+	Depth int
+	// Nodes holds the nodes level by level from the root, the children of
+	// the node i are the nodes 2i+1 and 2i+2
+	Nodes []uint64
+	// items holds the items of every leaf
+	items map[int][]Item
+}
+
+func hash64(parts ...[]byte) uint64 {
+	h := fnv.New64a()
+	for _, part := range parts {
+		h.Write(part)
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// MerkleLeaf returns the leaf of a key in a tree of depth.
+func MerkleLeaf(k string, depth int) int {
+	if depth == 0 {
+		return 0
+	}
+	return int(hash64([]byte(k)) >> uint(64-depth))
+}
+
+func itemHash(item Item) uint64 {
+	var version string
+	if !item.Version.IsZero() {
+		version = item.Version.String()
+	}
+	if item.Deleted {
+		return hash64([]byte(item.Key), []byte(version), []byte("deleted"))
+	}
+	return hash64([]byte(item.Key), []byte(version), []byte(item.Type), item.Value)
+}
+
+// MerkleTree returns the tree of the keys for which filter returns true,
+// of every key when filter is nil. The tree keeps the items of its leaves:
+// it is built once for a repair.
+func (m *MemoryStorage) MerkleTree(depth int, filter func(k string) bool) *MerkleTree {
+	t := &MerkleTree{Depth: depth, Nodes: make([]uint64, 1<<uint(depth+1)-1), items: make(map[int][]Item)}
+	first := t.firstLeaf()
+	for _, item := range m.DumpTombstones() {
+		if filter == nil || filter(item.Key) {
+			leaf := MerkleLeaf(item.Key, depth)
+			t.Nodes[first+leaf] += itemHash(item)
+			t.items[leaf] = append(t.items[leaf], item)
+		}
+	}
+	buf := make([]byte, 16)
+	for i := first - 1; i >= 0; i-- {
+		left, right := t.Nodes[2*i+1], t.Nodes[2*i+2]
+		for b := 0; b < 8; b++ {
+			buf[b] = byte(left >> uint(8*b))
+			buf[8+b] = byte(right >> uint(8*b))
+		}
+		t.Nodes[i] = hash64(buf)
+	}
+	return t
+}
+
+func (t *MerkleTree) firstLeaf() int {
+	return 1<<uint(t.Depth) - 1
+}
+
+// Leaf returns the leaf of a node, false when the node is not a leaf.
+func (t *MerkleTree) Leaf(node int) (int, bool) {
+	first := t.firstLeaf()
+	if node < first || node >= len(t.Nodes) {
+		return 0, false
+	}
+	return node - first, true
+}
+
+// LeafItems returns the items and tombstones of the keys of leaves the tree
+// was built with, sorted by key.
+func (t *MerkleTree) LeafItems(leaves []int) (items []Item) {
+	for _, leaf := range leaves {
+		items = append(items, t.items[leaf]...)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Key < items[j].Key
+	})
+	return items
+}
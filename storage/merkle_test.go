@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMerkleTree(t *testing.T) {
+	m, o := NewMemoryStorage(), NewMemoryStorage()
+	for _, s := range []*MemoryStorage{m, o} {
+		s.SetVersion("a", []byte("1"), Version{Timestamp: 1, Peer: "p"})
+		s.SetVersion("b", []byte("2"), Version{Timestamp: 2, Peer: "p"})
+	}
+	// expiration times are not compared
+	m.Expire("a", time.Now().Add(time.Hour))
+	if m.MerkleTree(4, nil).Nodes[0] != o.MerkleTree(4, nil).Nodes[0] {
+		t.Errorf("want the same root")
+	}
+
+	o.SetVersion("b", []byte("3"), Version{Timestamp: 3, Peer: "p"})
+	tm, to := m.MerkleTree(4, nil), o.MerkleTree(4, nil)
+	differing := []int{}
+	for i := range tm.Nodes {
+		if leaf, ok := tm.Leaf(i); ok && tm.Nodes[i] != to.Nodes[i] {
+			differing = append(differing, leaf)
+		}
+	}
+	if len(differing) != 1 || differing[0] != MerkleLeaf("b", 4) || tm.Nodes[0] == to.Nodes[0] {
+		t.Errorf("want %+v, got %+v", []int{MerkleLeaf("b", 4)}, differing)
+	}
+	// the other keys of the leaf are returned too
+	items := o.MerkleTree(4, func(k string) bool { return k != "a" }).LeafItems(differing)
+	if len(items) != 1 || items[0].Key != "b" || string(items[0].Value) != "3" {
+		t.Errorf("want %+v, got %+v", "b=3", items)
+	}
+	if items := o.MerkleTree(4, func(k string) bool { return k != "b" }).LeafItems(differing); len(items) != 0 && items[0].Key != "a" {
+		t.Errorf("want %+v, got %+v", "a or nothing", items)
+	}
+	if _, ok := tm.Leaf(0); ok {
+		t.Errorf("want the root not to be a leaf")
+	}
+	if tree := m.MerkleTree(0, nil); len(tree.Nodes) != 1 || MerkleLeaf("b", 0) != 0 {
+		t.Errorf("want a single node, got %+v", tree.Nodes)
+	}
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version orders the writes of a key made on different peers: the write with
+// the latest timestamp wins, the peer ID breaks ties.
+type Version struct {
+	// Timestamp in nanoseconds since the epoch
+	Timestamp int64
+	Peer      string
+}
+
+func (v Version) IsZero() bool {
+	return v.Timestamp == 0 && v.Peer == ""
+}
+
+// Newer reports whether v wins over o.
+func (v Version) Newer(o Version) bool {
+	if v.Timestamp != o.Timestamp {
+		return v.Timestamp > o.Timestamp
+	}
+	return v.Peer > o.Peer
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d@%s", v.Timestamp, v.Peer)
+}
+
+func ParseVersion(s string) (Version, error) {
+	parts := strings.SplitN(s, "@", 2)
+	if len(parts) != 2 {
+		return Version{}, fmt.Errorf("invalid version %q", s)
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Version{}, fmt.Errorf("invalid version %q", s)
+	}
+	return Version{Timestamp: ts, Peer: parts[1]}, nil
+}
+
+// Clock is a hybrid logical clock: it follows the physical time of the peer
+// but never goes backwards nor behind the timestamps received from the
+// other peers, so that a write is always versioned after the writes the
+// peer saw, whatever the clock skew between the peers.
+type Clock struct {
+	mu   sync.Mutex
+	last int64
+}
+
+// Now returns the next timestamp in nanoseconds since the epoch.
+func (c *Clock) Now() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := time.Now().UnixNano(); now > c.last {
+		c.last = now
+	} else {
+		c.last++
+	}
+	return c.last
+}
+
+// Observe moves the clock after a timestamp received from a peer.
+func (c *Clock) Observe(ts int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ts > c.last {
+		c.last = ts
+	}
+}
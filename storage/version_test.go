@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVersion(t *testing.T) {
+	v := Version{Timestamp: 42, Peer: "a-b"}
+	parsed, err := ParseVersion(v.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != v {
+		t.Errorf("want %+v, got %+v", v, parsed)
+	}
+	for _, s := range []string{"", "42", "x@a"} {
+		if _, err := ParseVersion(s); err == nil {
+			t.Errorf("want error for %q", s)
+		}
+	}
+
+	suites := []struct {
+		v, o     Version
+		expected bool
+	}{
+		{Version{2, "a"}, Version{1, "b"}, true},
+		{Version{1, "b"}, Version{1, "a"}, true},
+		{Version{1, "a"}, Version{1, "a"}, false},
+		{Version{1, "a"}, Version{}, true},
+	}
+	for _, s := range suites {
+		if output := s.v.Newer(s.o); s.expected != output {
+			t.Errorf("%s > %s: want %+v, got %+v", s.v, s.o, s.expected, output)
+		}
+	}
+}
+
+func TestClock(t *testing.T) {
+	c := &Clock{}
+	last := c.Now()
+	for i := 0; i < 1000; i++ {
+		if now := c.Now(); now <= last {
+			t.Fatalf("want a timestamp after %+v, got %+v", last, now)
+		}
+		last = c.Now()
+	}
+	// a timestamp received ahead of the physical time moves the clock
+	ahead := last + int64(time.Hour)
+	c.Observe(ahead)
+	if output := c.Now(); output != ahead+1 {
+		t.Errorf("want %+v, got %+v", ahead+1, output)
+	}
+	c.Observe(1)
+	if output := c.Now(); output != ahead+2 {
+		t.Errorf("want %+v, got %+v", ahead+2, output)
+	}
+}
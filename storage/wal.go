@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
 )
 
 type walFile struct {
@@ -19,6 +20,9 @@ type WalFileWriter struct {
 	WaitTerminate chan bool
 	BytesWritten  int
 	WriteOps      int
+	// closed stops the writer, the writes received after it are dropped
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 func (w *WalFileWriter) WriteQueueSize() int {
@@ -41,13 +45,17 @@ func NewWalFileWriter(walDir string) *WalFileWriter {
 	w := &WalFileWriter{
 		walDir: walDir,
 		data:   make(chan ([]byte)),
+		closed: make(chan struct{}),
 	}
 	return w
 }
 
 func (writer *WalFileWriter) SyncWrite(data []byte) {
 	// TODO get stats here
-	writer.data <- data
+	select {
+	case writer.data <- data:
+	case <-writer.closed:
+	}
 }
 
 func (writer *WalFileWriter) Run() {
@@ -70,10 +78,9 @@ func (writer *WalFileWriter) Run() {
 	f.Write([]byte("-WAL 0\r\n"))
 	for {
 		select {
-		case data, more := <-writer.data:
-			if !more {
-				return
-			}
+		case <-writer.closed:
+			return
+		case data := <-writer.data:
 			data = append(data, "\r\n"...)
 			f.Write(data)
 			lock.Lock()
@@ -85,6 +92,10 @@ func (writer *WalFileWriter) Run() {
 	}
 }
 
+// Close stops the writer once the writes in progress are written. It may be
+// called more than once.
 func (writer *WalFileWriter) Close() {
-	close(writer.data)
+	writer.closeOnce.Do(func() {
+		close(writer.closed)
+	})
 }
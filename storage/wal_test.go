@@ -50,4 +50,8 @@ func TestWalFileWriter(t *testing.T) {
 	if string(expected) != string(output) {
 		t.Fatalf("want %s, got %s", expected, output)
 	}
+	// writes after Close are dropped
+	wfw.Close()
+	wfw.SyncWrite([]byte("late"))
+	<-wfw.WaitTerminate
 }
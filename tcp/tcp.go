@@ -1,41 +1,92 @@
 package tcp
 
 import (
+	"crypto/tls"
 	"fmt"
 	"math/rand"
 	"net"
 	"os"
+	"sync"
 	"time"
 )
 
 type TCPServer struct {
-	Port int64
 	Host string
+	// TLSConfig enables TLS on the listener when set
+	TLSConfig *tls.Config
+	mu        sync.Mutex
+	port      int64
+	listener  net.Listener
+	closed    bool
 }
 
 func NewTCPServer(host string, port int64) (*TCPServer, error) {
 	return &TCPServer{
 		Host: host,
-		Port: port,
+		port: port,
 	}, nil
 }
 
 func (s *TCPServer) Run(id string, handleRequesFunc func(*TCPServer, net.Conn)) {
-	l, err := net.Listen("tcp4", fmt.Sprintf("%s:%d", s.Host, s.Port))
+	l, err := net.Listen("tcp4", fmt.Sprintf("%s:%d", s.Host, s.Port()))
 	if err != nil {
 		fmt.Printf("[%s] Error listening: %s\n", id, err.Error())
 		os.Exit(1)
 	}
-	s.Port = int64(l.Addr().(*net.TCPAddr).Port)
+	if s.TLSConfig != nil {
+		l = tls.NewListener(l, s.TLSConfig)
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return
+	}
+	s.port = int64(l.Addr().(*net.TCPAddr).Port)
+	s.listener = l
+	s.mu.Unlock()
 	defer l.Close()
 	rand.Seed(time.Now().Unix())
-	fmt.Printf("[%s] Listening on %s:%d\n", id, s.Host, s.Port)
+	fmt.Printf("[%s] Listening on %s:%d\n", id, s.Host, s.Port())
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.Closed() {
+				fmt.Printf("[%s] Stopped listening on %s:%d\n", id, s.Host, s.Port())
+				return
+			}
 			fmt.Printf("[%s] Error accepting: %s\n", id, err.Error())
 			os.Exit(1)
 		}
 		go handleRequesFunc(s, conn)
 	}
 }
+
+// Close stops accepting connections, Run returns. The connections already
+// accepted are left open.
+func (s *TCPServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// Port returns the listening port, the one picked by the system once Run is
+// listening when the server was created with port 0.
+func (s *TCPServer) Port() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.port
+}
+
+func (s *TCPServer) Closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
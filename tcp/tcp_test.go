@@ -0,0 +1,54 @@
+package tcp
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTCPServerClose(t *testing.T) {
+	s, err := NewTCPServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan bool)
+	go func() {
+		s.Run("test", func(s *TCPServer, conn net.Conn) {
+			conn.Write([]byte("hello"))
+		})
+		close(stopped)
+	}()
+	for i := 0; i < 50 && s.Port() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	addr := net.JoinHostPort(s.Host, strconv.FormatInt(s.Port(), 10))
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 5)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("want Run to return once closed")
+	}
+	if _, err := net.Dial("tcp4", addr); err == nil {
+		t.Errorf("want new connections refused once closed")
+	}
+	// the connections accepted are kept
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Errorf("want the accepted connection open, got %+v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("want closing twice to succeed, got %+v", err)
+	}
+}
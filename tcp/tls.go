@@ -0,0 +1,203 @@
+package tcp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// seconds between two checks of the certificate files
+	TLS_RELOAD_INTERVAL = 10
+)
+
+// TLS holds a certificate and the CA used to verify the certificates of the
+// other side. Certificate files are reloaded when they change so that
+// certificates can be renewed without a restart.
+type TLS struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	ca      *x509.CertPool
+	modTime time.Time
+}
+
+func NewTLS(certFile string, keyFile string, caFile string) (*TLS, error) {
+	t := &TLS{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		CAFile:   caFile,
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *TLS) files() []string {
+	files := []string{t.CertFile, t.KeyFile}
+	if t.CAFile != "" {
+		files = append(files, t.CAFile)
+	}
+	return files
+}
+
+// lastModTime returns the modification time of the most recently modified
+// file.
+func (t *TLS) lastModTime() (time.Time, error) {
+	var last time.Time
+	for _, f := range t.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return last, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+func (t *TLS) load() error {
+	modTime, err := t.lastModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return err
+	}
+	var ca *x509.CertPool
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return err
+		}
+		ca = x509.NewCertPool()
+		if !ca.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", t.CAFile)
+		}
+	}
+	t.mu.Lock()
+	t.cert = &cert
+	t.ca = ca
+	t.modTime = modTime
+	t.mu.Unlock()
+	return nil
+}
+
+// Reload loads the files again when one of them changed. It returns true
+// when the certificates were reloaded. The current certificates are kept if
+// the new ones are invalid.
+func (t *TLS) Reload() (bool, error) {
+	modTime, err := t.lastModTime()
+	if err != nil {
+		return false, err
+	}
+	t.mu.RLock()
+	changed := modTime.After(t.modTime)
+	t.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	if err := t.load(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Watch reloads the certificates when their files change.
+func (t *TLS) Watch(id string) {
+	ticker := time.NewTicker(TLS_RELOAD_INTERVAL * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		reloaded, err := t.Reload()
+		if err != nil {
+			fmt.Printf("[%s] Unable to reload TLS certificates: %s\n", id, err)
+			continue
+		}
+		if reloaded {
+			fmt.Printf("[%s] TLS certificates reloaded\n", id)
+		}
+	}
+}
+
+func (t *TLS) certificate() *tls.Certificate {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.cert
+}
+
+func (t *TLS) certPool() *x509.CertPool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.ca
+}
+
+// ServerConfig returns the configuration of a TLS listener. With
+// clientAuth, clients have to present a certificate signed by the CA.
+func (t *TLS) ServerConfig(clientAuth bool) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// evaluated for every connection to use the reloaded certificates
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*t.certificate()},
+			}
+			if clientAuth {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = t.certPool()
+			}
+			return config, nil
+		},
+	}
+}
+
+// ClientConfig returns the configuration to dial a TLS listener, presenting
+// the certificate. The server certificate is verified against the CA
+// without checking its host name: peers are addressed by IP and trusted for
+// holding a certificate of the cluster CA.
+func (t *TLS) ClientConfig() *tls.Config {
+	ca := t.certPool()
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*t.certificate()},
+		// the chain is verified by VerifyPeerCertificate
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, ca)
+		},
+	}
+}
+
+func verifyChain(rawCerts [][]byte, ca *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no certificate presented")
+	}
+	var certs []*x509.Certificate
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         ca,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
@@ -0,0 +1,217 @@
+package tcp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "velocidb test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// writeCertificate writes a certificate signed by the CA, its key and the CA
+// certificate to dir.
+func (ca *testCA) writeCertificate(t *testing.T, dir string, name string) (string, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	ioutil.WriteFile(caFile, ca.pem, 0600)
+	return certFile, keyFile, caFile
+}
+
+func startTLSServer(t *testing.T, config *tls.Config) *TCPServer {
+	s, err := NewTCPServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.TLSConfig = config
+	go s.Run("test", func(s *TCPServer, conn net.Conn) {
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+	})
+	for i := 0; i < 50 && s.Port() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s
+}
+
+func readGreeting(addr string, config *tls.Config) (string, *tls.ConnectionState, error) {
+	conn, err := tls.Dial("tcp4", addr, config)
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, 5)
+	if _, err := conn.Read(buf); err != nil {
+		return "", nil, err
+	}
+	state := conn.ConnectionState()
+	return string(buf), &state, nil
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "velocidb-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	server, err := NewTLS(ca.writeCertificate(t, dir, "server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewTLS(ca.writeCertificate(t, dir, "client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := startTLSServer(t, server.ServerConfig(true))
+	addr := fmt.Sprintf("%s:%d", s.Host, s.Port())
+
+	output, _, err := readGreeting(addr, client.ClientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "hello"
+	if expected != output {
+		t.Errorf("want %+v, got %+v", expected, output)
+	}
+
+	// without client certificate
+	if _, _, err := readGreeting(addr, &tls.Config{InsecureSkipVerify: true}); err == nil {
+		t.Errorf("want error for a client without certificate")
+	}
+
+	// certificate of another CA
+	otherDir, err := ioutil.TempDir("", "velocidb-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(otherDir)
+	other, err := NewTLS(newTestCA(t).writeCertificate(t, otherDir, "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readGreeting(addr, other.ClientConfig()); err == nil {
+		t.Errorf("want error for a certificate of another CA")
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "velocidb-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	server, err := NewTLS(ca.writeCertificate(t, dir, "server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := startTLSServer(t, server.ServerConfig(false))
+	addr := fmt.Sprintf("%s:%d", s.Host, s.Port())
+	config := &tls.Config{InsecureSkipVerify: true}
+
+	_, state, err := readGreeting(addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := state.PeerCertificates[0].SerialNumber
+
+	reloaded, err := server.Reload()
+	if err != nil || reloaded {
+		t.Errorf("want no reload of unchanged files, got %+v %+v", reloaded, err)
+	}
+
+	ca.writeCertificate(t, dir, "server")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(server.CertFile, future, future)
+	reloaded, err = server.Reload()
+	if err != nil || !reloaded {
+		t.Fatalf("want reload, got %+v %+v", reloaded, err)
+	}
+	_, state, err = readGreeting(addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial.Cmp(state.PeerCertificates[0].SerialNumber) == 0 {
+		t.Errorf("want the reloaded certificate, got serial %s", serial)
+	}
+
+	// invalid files keep the current certificate
+	ioutil.WriteFile(server.KeyFile, []byte("invalid"), 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(server.KeyFile, future, future)
+	if _, err := server.Reload(); err == nil {
+		t.Errorf("want error for an invalid key")
+	}
+	if _, _, err := readGreeting(addr, config); err != nil {
+		t.Errorf("want the previous certificate served, got %s", err)
+	}
+}